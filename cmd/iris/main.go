@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/NHAS/StatsCollector/internal/iris"
 	"github.com/NHAS/StatsCollector/utils"
@@ -16,10 +17,13 @@ func main() {
 
 	var configPath = flag.String("config", "config.json", "Configuration file")
 	var logFilePath = flag.String("log", "log.txt", "Path to log file")
+	var enrollToken = flag.String("enroll", "", "Register with theia using a one-time enrollment token from its web interface, then write the config and quit")
+	var serverAddress = flag.String("server", "", "Address of theia to enroll with, overrides server_address in the config")
+	var watch = flag.Duration("watch", 0, "Reload the configuration file when it changes, checking at this interval e.g 10s (SIGHUP always reloads)")
 
 	flag.Parse()
 
-	logFile, err := os.OpenFile(*logFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	logFile, err := utils.OpenLogFile(*logFilePath)
 	utils.Check("Opening logging file failed", err)
 
 	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
@@ -27,14 +31,95 @@ func main() {
 	flagset := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
 
-	configurationBytes, err := ioutil.ReadFile(*configPath)
+	if len(*enrollToken) > 0 {
+		enroll(*configPath, *enrollToken, *serverAddress)
+		return
+	}
+
+	config, err := loadConfig(*configPath)
 	utils.Check("Load [settings] failed", err)
 
-	var config iris.ClientConfig
+	if len(config.LogPath) > 0 {
+		utils.Check("Opening logging file failed", logFile.Reopen(config.LogPath))
+	}
+
+	client, err := iris.NewClient(config)
+	utils.Check("Invalid [settings]", err)
+
+	utils.WatchConfig(*configPath, *watch, func() {
+		log.Println("Reloading configuration")
+
+		newConfig, err := loadConfig(*configPath)
+		if err == nil {
+			err = client.Reload(newConfig)
+		}
+
+		if err != nil {
+			log.Println("Configuration not reloaded, keeping the current one: ", err)
+			return
+		}
+
+		logPath := *logFilePath
+		if len(newConfig.LogPath) > 0 {
+			logPath = newConfig.LogPath
+		}
+
+		// Always reopened so that rotated logs are picked up
+		if err := logFile.Reopen(logPath); err != nil {
+			log.Println("Unable to open new log file, still logging to ", logFile.Path(), ": ", err)
+		}
+
+		log.Println("Configuration reloaded")
+	})
+
+	client.Run(utils.ShutdownContext())
+
+	log.Println("Stopped")
+}
 
+func loadConfig(path string) (config iris.ClientConfig, err error) {
 	config.UpdateIntervalSec = 240
+	config.MaxConcurrentChecks = 4
+	config.BufferPath = filepath.Join(filepath.Dir(path), "buffer.json")
+	config.BufferMaxSamples = 1000
+
+	configurationBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
 	err = json.Unmarshal(configurationBytes, &config)
-	utils.Check("Unmarshalling [settings[ failed", err)
+	return config, err
+}
+
+//enroll registers this agent with theia and writes out a config that can be started straight away. An existing config is used as the base if there is one
+func enroll(configPath, token, serverAddress string) {
+	config, err := loadConfig(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		utils.Check("Load [settings] failed", err)
+	}
+
+	if len(serverAddress) > 0 {
+		config.ServerAddress = serverAddress
+	}
+
+	if len(config.PrivateKeyPath) == 0 {
+		config.PrivateKeyPath = filepath.Join(filepath.Dir(configPath), "id_ecdsa")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println("Unable to get hostname, theia will use the name in the token: ", err)
+	}
+
+	config, name, err := iris.Enroll(config, token, hostname)
+	utils.Check("Enrollment failed", err)
+
+	configurationBytes, err := json.MarshalIndent(config, "", "    ")
+	utils.Check("Encoding [settings] failed", err)
+
+	err = ioutil.WriteFile(configPath, configurationBytes, 0600)
+	utils.Check("Writing [settings] failed", err)
 
-	iris.RunClient(config)
+	log.Printf("Enrolled as %q, configuration written to %s. Start iris without -enroll to begin sending stats", name, configPath)
 }
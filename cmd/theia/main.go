@@ -3,14 +3,17 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/NHAS/StatsCollector/internal/theia"
 	"github.com/NHAS/StatsCollector/models"
@@ -23,10 +26,23 @@ func main() {
 	flag.Bool("adduser", false, "Add user to database and quit")
 	var configPath = flag.String("config", "config.json", "Configuration file")
 	var logFilePath = flag.String("log", "log.txt", "Path to log file")
+	flag.Bool("migrate", false, "Apply every pending migration to the database and quit")
+	var migrateTo = flag.String("migrate-to", "", "Migrate the database and quit: 'up' applies every pending migration, 'down' reverts the last one, 'status' lists them, or give a version to migrate up or down to")
+	var watch = flag.Duration("watch", 0, "Reload the configuration file when it changes, checking at this interval e.g 10s (SIGHUP always reloads)")
+	var exportPath = flag.String("export", "", "Write a backup of agents, groups, users and their settings to this file and quit")
+	var exportHistory = flag.Bool("history", false, "Include monitor and metric history in the backup written by -export")
+	var importPath = flag.String("import", "", "Merge a backup written by -export into the database and quit")
 
 	flag.Parse()
 
-	logFile, err := os.OpenFile(*logFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	// -migrate used to take the action, so catch "-migrate down" rather than applying every migration instead
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments %q, migrations other than up are run with -migrate-to\n", flag.Args())
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logFile, err := utils.OpenLogFile(*logFilePath)
 	utils.Check("Opening logging file failed", err)
 
 	log.SetOutput(io.MultiWriter(os.Stdout, logFile))
@@ -34,37 +50,201 @@ func main() {
 	flagset := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
 
-	pwd := os.Getenv("PASSWORD")
+	// Public key authentication is done by comparing
+	// the public key of a received connection
+	// with the entries in the authorized_keys file.
+	config, err := loadConfig(*configPath)
+	utils.Check("Failed to load settings", err)
 
-	db, err := gorm.Open("postgres", "sslmode=disable host=localhost port=5432 user=gorm dbname=stats password="+pwd)
+	db, err := theia.OpenDatabase(config.Database)
 	utils.Check("Could not connect to database", err)
 
+	log.Printf("Using %s database %s", config.Database.Driver, config.Database)
+
+	if flagset["migrate"] || flagset["migrate-to"] {
+		action := "up"
+		if flagset["migrate-to"] {
+			action = *migrateTo
+		}
+
+		err := migrate(db, action)
+		utils.Check("Migration failed", err)
+		return
+	}
+
 	if flagset["adduser"] {
 
-		models.InitaliseModels(db)
+		err := models.InitaliseModels(db)
+		utils.Check("Unable to migrate database", err)
+
 		username, password, err := credentials()
 		utils.Check("Unable to get password", err)
 
-		err = models.AddUser(username, password)
+		err = models.NewDatabaseStore(db).AddUser(username, password)
 		utils.Check("Unable to add user to database", err)
 
 		log.Println("User added")
 		return
 	}
 
-	// Public key authentication is done by comparing
-	// the public key of a received connection
-	// with the entries in the authorized_keys file.
-	configurationBytes, err := ioutil.ReadFile(*configPath)
-	utils.Check("Failed to load settings", err)
+	if flagset["export"] {
+		err := models.InitaliseModels(db)
+		utils.Check("Unable to migrate database", err)
+
+		err = exportBackup(models.NewDatabaseStore(db), *exportPath, *exportHistory)
+		utils.Check("Export failed", err)
+
+		log.Printf("Backup written to %s", *exportPath)
+		return
+	}
+
+	if flagset["import"] {
+		err := models.InitaliseModels(db)
+		utils.Check("Unable to migrate database", err)
+
+		result, err := importBackup(models.NewDatabaseStore(db), *importPath)
+		utils.Check("Import failed", err)
+
+		log.Println("Backup imported: ", result)
+		return
+	}
+
+	if len(config.LogPath) > 0 {
+		utils.Check("Opening logging file failed", logFile.Reopen(config.LogPath))
+	}
+
+	server, err := theia.NewServer(db, config)
+	utils.Check("Invalid settings", err)
+
+	utils.WatchConfig(*configPath, *watch, func() {
+		log.Println("Reloading configuration")
+
+		newConfig, err := loadConfig(*configPath)
+		if err == nil {
+			err = server.Reload(newConfig)
+		}
+
+		if err != nil {
+			log.Println("Configuration not reloaded, keeping the current one: ", err)
+			return
+		}
+
+		logPath := *logFilePath
+		if len(newConfig.LogPath) > 0 {
+			logPath = newConfig.LogPath
+		}
+
+		// Always reopened so that rotated logs are picked up
+		if err := logFile.Reopen(logPath); err != nil {
+			log.Println("Unable to open new log file, still logging to ", logFile.Path(), ": ", err)
+		}
+
+		log.Println("Configuration reloaded")
+	})
+
+	err = server.Run(utils.ShutdownContext())
+	utils.Check("Server failed", err)
+
+	if err := db.Close(); err != nil {
+		log.Println("Closing database failed: ", err)
+	}
+}
+
+// reportRetentionDays is enough history for an availability report on the whole of last month
+const reportRetentionDays = 62
+
+func loadConfig(path string) (config theia.ServerConfig, err error) {
+	configurationBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
 
-	var config theia.ServerConfig
 	config.WebResourcesPath = "."
-	err = json.Unmarshal(configurationBytes, &config)
-	utils.Check("Failed to unmarshal config", err)
+	config.CertWarningDays = []int{30, 14, 3}
+	config.HistoryRetentionDays = reportRetentionDays
+	config.ArchiveRetentionDays = 30
+	config.Database = theia.DefaultDatabaseConfig()
+
+	if err := json.Unmarshal(configurationBytes, &config); err != nil {
+		return config, err
+	}
+
+	config.Database.ApplyEnvironment(os.LookupEnv)
+
+	if config.HistoryRetentionDays > 0 && config.HistoryRetentionDays < reportRetentionDays {
+		log.Printf("history_retention_days is %d, monthly availability reports will be missing the start of last month", config.HistoryRetentionDays)
+	}
+
+	return config, nil
+}
+
+// migrate runs the -migrate and -migrate-to actions
+func migrate(db *gorm.DB, action string) error {
+	current, err := models.SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "status":
+		status, err := models.GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Schema version %d, latest %d\n", current, models.LatestSchemaVersion())
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-50s %s\n", m.Version, m.Name, applied)
+		}
+		return nil
 
-	theia.RunServer(db, config)
+	case "up":
+		return models.Migrate(db)
+
+	case "down":
+		if current == 0 {
+			return errors.New("No migrations have been applied")
+		}
+		return models.MigrateTo(db, current-1)
+	}
+
+	version, err := strconv.ParseInt(action, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Unknown migrate action %q, expected up, down, status or a version", action)
+	}
+
+	return models.MigrateTo(db, version)
+}
+
+// exportBackup runs the -export action, the backup holds password hashes and email account passwords so only the owner can read it
+func exportBackup(store models.DatabaseStore, path string, includeHistory bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := store.ExportBackup(f, includeHistory); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+// importBackup runs the -import action
+func importBackup(store models.DatabaseStore, path string) (models.ImportResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return models.ImportResult{}, err
+	}
+	defer f.Close()
 
+	return store.ImportBackup(f)
 }
 
 func credentials() (string, string, error) {
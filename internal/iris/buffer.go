@@ -0,0 +1,226 @@
+package iris
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+// statsBuffer is a bounded queue of stats that couldnt be sent to theia.
+// It is kept on disk, one JSON report per line, so that buffered stats survive the agent restarting. Once full the oldest stats are dropped.
+type statsBuffer struct {
+	sync.Mutex
+
+	path string
+	max  int
+
+	stats []models.Stats
+}
+
+// openStatsBuffer loads any stats left in the buffer file by a previous run, an empty path keeps the buffer in memory only
+func openStatsBuffer(path string, max int) (*statsBuffer, error) {
+	if max < 1 {
+		max = 1
+	}
+
+	b := &statsBuffer{path: path, max: max}
+	if path == "" {
+		return b, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return b, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var stat models.Stats
+		if err := decoder.Decode(&stat); err != nil {
+			if err != io.EOF {
+				// Most likely the agent died part way through a write, keep what we could read
+				log.Println("Buffer file is damaged, ignoring the rest of it: ", err)
+			}
+			break
+		}
+
+		b.stats = append(b.stats, stat)
+	}
+
+	if len(b.stats) > b.max {
+		b.stats = b.stats[len(b.stats)-b.max:]
+	}
+
+	return b, b.persist()
+}
+
+// Len returns the number of buffered stats
+func (b *statsBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+
+	return len(b.stats)
+}
+
+// Push adds stats to the end of the buffer, dropping the oldest if it is full.
+// The stats are kept in memory even if writing them to disk fails
+func (b *statsBuffer) Push(stat models.Stats) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.stats = append(b.stats, stat)
+	if len(b.stats) > b.max {
+		b.stats = b.stats[len(b.stats)-b.max:]
+		return b.persist()
+	}
+
+	if b.path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(b.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(stat)
+}
+
+// Drain calls send with each buffered stat, oldest first, removing them as they are sent.
+// It stops at the first error, leaving the unsent stats in the buffer, and returns how many were sent
+func (b *statsBuffer) Drain(send func(models.Stats) error) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	sent := 0
+	var err error
+	for _, stat := range b.stats {
+		if err = send(stat); err != nil {
+			break
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return 0, err
+	}
+
+	b.stats = b.stats[sent:]
+	if perr := b.persist(); perr != nil {
+		log.Println("Unable to update buffer file: ", perr)
+	}
+
+	return sent, err
+}
+
+// persist rewrites the buffer file with the current contents of the buffer
+func (b *statsBuffer) persist() error {
+	if b.path == "" {
+		return nil
+	}
+
+	if len(b.stats) == 0 {
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// Write to the side and rename, so a crash part way through doesnt lose the whole buffer
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, stat := range b.stats {
+		if err := encoder.Encode(stat); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, b.path)
+}
+
+// publisher sends stats to theia while connected, and buffers them while not
+type publisher struct {
+	sync.Mutex
+
+	buffer  *statsBuffer
+	session *session
+}
+
+// Publish sends stats over the current session, or buffers them if there isnt one or sending fails
+func (p *publisher) Publish(stat models.Stats) {
+	p.Lock()
+	defer p.Unlock()
+
+	// Stats must arrive in order, so while anything is buffered new stats queue up behind it
+	if p.session != nil && p.buffer.Len() == 0 {
+		err := p.session.Send(models.MessageStats, stat)
+		if err == nil {
+			return
+		}
+
+		log.Println("Writing to channel failed, buffering stats until reconnected: ", err)
+		p.session.Close()
+		p.session = nil
+	}
+
+	if err := p.buffer.Push(stat); err != nil {
+		log.Println("Unable to write stats to buffer file: ", err)
+	}
+}
+
+// Attach replays any buffered stats over a newly opened session, then uses it to send stats as they are taken
+func (p *publisher) Attach(s *session) error {
+	p.Lock()
+	defer p.Unlock()
+
+	sent, err := p.buffer.Drain(func(stat models.Stats) error {
+		return s.Send(models.MessageStats, stat)
+	})
+
+	if sent > 0 {
+		log.Printf("Replayed %d buffered stats, %d remaining", sent, p.buffer.Len())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.session = s
+	return nil
+}
+
+// Detach stops sending stats over a session that has ended
+func (p *publisher) Detach(s *session) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.session == s {
+		p.session = nil
+	}
+}
@@ -0,0 +1,77 @@
+package iris
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+func TestStatsBufferDropsOldest(t *testing.T) {
+	b, err := openStatsBuffer("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := b.Push(models.Stats{MemoryUsage: float32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var replayed []float32
+	if _, err := b.Drain(func(stat models.Stats) error {
+		replayed = append(replayed, stat.MemoryUsage)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replayed) != 3 || replayed[0] != 2 || replayed[2] != 4 {
+		t.Fatal("Buffer should keep the newest stats in order: ", replayed)
+	}
+}
+
+func TestStatsBufferSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+
+	b, err := openStatsBuffer(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := b.Push(models.Stats{MemoryUsage: float32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Theia goes away again part way through replaying
+	sent, err := b.Drain(func(stat models.Stats) error {
+		if stat.MemoryUsage == 2 {
+			return errors.New("connection lost")
+		}
+		return nil
+	})
+	if err == nil || sent != 2 {
+		t.Fatal("Drain should stop at the first failure: ", sent, err)
+	}
+
+	reopened, err := openStatsBuffer(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened.Len() != 2 {
+		t.Fatal("Unsent stats were not kept on disk: ", reopened.Len())
+	}
+
+	if _, err := reopened.Drain(func(stat models.Stats) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if emptied, _ := openStatsBuffer(path, 10); emptied.Len() != 0 {
+		t.Fatal("Replayed stats were not removed from disk")
+	}
+}
@@ -2,18 +2,18 @@ package iris
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NHAS/StatsCollector/models"
-	"github.com/NHAS/StatsCollector/utils"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/host"
@@ -26,6 +26,29 @@ type monitor struct {
 	OkayCode       int    `json:"okay_code"`
 	OkayString     string `json:"okay_string"`
 	TimeoutSeconds int    `json:"timeout_seconds"`
+
+	// Name allows the monitor to be run on demand from theia
+	Name string `json:"name"`
+
+	// IntervalSeconds overrides how often this monitor is checked, defaults to update_seconds
+	IntervalSeconds int `json:"interval_seconds"`
+
+	// HTTP(s) specific options
+	Method          string            `json:"method"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	BasicAuth       *basicAuth        `json:"basic_auth"`
+	BearerToken     string            `json:"bearer_token"`
+	FollowRedirects *bool             `json:"follow_redirects"`
+	MaxRedirects    int               `json:"max_redirects"`
+	OkayCodes       string            `json:"okay_codes"`
+	OkayRegex       string            `json:"okay_regex"`
+	JSONAssertions  map[string]string `json:"json_assertions"`
+	MaxResponseMs   int               `json:"max_response_ms"`
+
+	// TLS options, used by https:// and tls:// monitors
+	CAPath             string `json:"ca_path"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
 }
 
 type ClientConfig struct {
@@ -34,18 +57,64 @@ type ClientConfig struct {
 	MonitorURLS       []monitor `json:"monitor_urls"`
 	PrivateKeyPath    string    `json:"private_key_path"`
 	UpdateIntervalSec int       `json:"update_seconds"`
+
+	MaxConcurrentChecks int `json:"max_concurrent_checks"`
+
+	// Stats taken while theia is unreachable are buffered in BufferPath, up to BufferMaxSamples, and replayed on reconnect
+	BufferPath       string `json:"buffer_path"`
+	BufferMaxSamples int    `json:"buffer_max_samples"`
+
+	// LogPath overrides the -log flag, changing it and reloading moves the log
+	LogPath string `json:"log_path"`
+
+	// CertificatePath is an ssh certificate for the private key, signed by a CA theia trusts. Principal is who to authenticate as, by default the first principal in the certificate
+	CertificatePath string `json:"certificate_path"`
+	Principal       string `json:"principal"`
 }
 
-func RunClient(config ClientConfig) {
+// Validate checks the config is usable, including that the keys it refers to can be loaded
+func (config ClientConfig) Validate() error {
+	_, err := config.sshConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(config.ServerAddress) == 0 {
+		return errors.New("server_address must be set")
+	}
+
+	if config.UpdateIntervalSec < 1 {
+		return errors.New("update_seconds must be at least 1")
+	}
+
+	for i, m := range config.MonitorURLS {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("monitor_urls %d: %w", i, err)
+		}
+	}
+
+	if err := checkUniqueURLs(config.MonitorURLS); err != nil {
+		return fmt.Errorf("monitor_urls: %w", err)
+	}
+
+	return nil
+}
 
+func (config ClientConfig) sshConfig() (*ssh.ClientConfig, error) {
 	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.AuthorisedKey))
-	utils.Check("Parse [authorised key] failed", err)
+	if err != nil {
+		return nil, fmt.Errorf("Parse [authorised key] failed: %w", err)
+	}
 
 	privateBytes, err := ioutil.ReadFile(config.PrivateKeyPath)
-	utils.Check("Load [private key] failed", err)
+	if err != nil {
+		return nil, fmt.Errorf("Load [private key] failed: %w", err)
+	}
 
 	private, err := ssh.ParsePrivateKey(privateBytes)
-	utils.Check("Parse [private key] failed", err)
+	if err != nil {
+		return nil, fmt.Errorf("Parse [private key] failed: %w", err)
+	}
 
 	// An SSH client is represented with a ClientConn.
 	//
@@ -59,193 +128,299 @@ func RunClient(config ClientConfig) {
 		HostKeyCallback: ssh.FixedHostKey(hostKey),
 	}
 
-	for {
+	if len(config.CertificatePath) == 0 {
+		return sshConfig, nil
+	}
 
-		con, err := net.Dial("tcp", config.ServerAddress)
-		if err != nil {
-			log.Println("Connecting to stats server failed", err)
-			log.Println("Attempting to reconnect after 20 seconds")
-			<-time.After(20 * time.Second)
-			continue
-		}
+	cert, err := loadCertificate(config.CertificatePath, private)
+	if err != nil {
+		return nil, err
+	}
 
-		sshConn, chans, reqs, err := ssh.NewClientConn(con, config.ServerAddress, sshConfig)
-		if err != nil {
-			log.Println("Starting ssh client connection failed", err)
-			log.Println("Attempting to reconnect after 20 seconds")
-			<-time.After(20 * time.Second)
-			continue
-		}
-		defer sshConn.Close()
+	sshConfig.User = config.Principal
+	if len(sshConfig.User) == 0 && len(cert.ValidPrincipals) > 0 {
+		sshConfig.User = cert.ValidPrincipals[0]
+	}
 
-		// The incoming Request channel must be serviced.
-		go ssh.DiscardRequests(reqs)
+	// Reread on every connection, so a renewed certificate is used without needing a reload
+	sshConfig.Auth = []ssh.AuthMethod{
+		ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			cert, err := loadCertificate(config.CertificatePath, private)
+			if err != nil {
+				return nil, err
+			}
 
-		channel, reqs, err := sshConn.OpenChannel("metrics", nil)
-		utils.Check("Opening metrics channel failed", err)
+			certSigner, err := ssh.NewCertSigner(cert, private)
+			if err != nil {
+				return nil, err
+			}
 
-		go ssh.DiscardRequests(reqs)
+			return []ssh.Signer{certSigner}, nil
+		}),
+	}
 
-		//Updates the system metrics that shouldnt change very often, such as memory size/cpu
-		//Uses ssh channels
-		go func() {
-			log.Println("Started sending system info")
+	return sshConfig, nil
+}
 
-			for {
-				systemInfoBytes, err := getSystemInfo()
-				if err != nil {
-					log.Println("Unable to send system info: ", err)
-					return
-				}
+// loadCertificate reads an ssh certificate and checks it is for private
+func loadCertificate(path string, private ssh.Signer) (*ssh.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Load [certificate] failed: %w", err)
+	}
 
-				channel.SendRequest("system", false, systemInfoBytes)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Parse [certificate] failed: %w", err)
+	}
 
-				<-time.After(1 * time.Hour)
-			}
-		}()
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("certificate_path does not contain an ssh certificate")
+	}
 
-		//The main workhorse, sends all the changing stats and does liveness checks on endpoints
-		go func() {
-			defer channel.Close()
+	if !bytes.Equal(cert.Key.Marshal(), private.PublicKey().Marshal()) {
+		return nil, errors.New("Certificate is not for the private key in private_key_path")
+	}
 
-			log.Println("Started sending updates")
-			for {
+	return cert, nil
+}
 
-				contents, err := getStats(config.MonitorURLS)
-				utils.Check("Failed to get stats", err)
+// publicKey returns the public half of the agents private key, in authorized_keys format
+func (config ClientConfig) publicKey() (string, error) {
+	privateBytes, err := ioutil.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("Load [private key] failed: %w", err)
+	}
 
-				_, err = channel.Write(contents)
-				if err != nil {
-					log.Println("Writing to channel failed", err)
-					return
-				}
-				<-time.After(time.Duration(config.UpdateIntervalSec) * time.Second)
-			}
-		}()
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return "", fmt.Errorf("Parse [private key] failed: %w", err)
+	}
 
-		for newChannel := range chans {
-			newChannel.Reject(ssh.Prohibited, "Clients disallow channel requests")
-		}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(private.PublicKey()))), nil
+}
+
+func (config ClientConfig) updateInterval() time.Duration {
+	return time.Duration(config.UpdateIntervalSec) * time.Second
+}
+
+// Client is a running iris agent
+type Client struct {
+	sync.Mutex
+
+	config    ClientConfig
+	publicKey string
+
+	checks   *scheduler
+	settings *configurator
+	stats    *publisher
+	sessions *supervisor
+}
+
+// NewClient checks the config and sets up the agent, nothing is started until Run is called
+func NewClient(config ClientConfig) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	sshConfig, err := config.sshConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := config.publicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	checks := newScheduler(config.MonitorURLS, config.updateInterval(), config.MaxConcurrentChecks)
+
+	buffer, err := openStatsBuffer(config.BufferPath, config.BufferMaxSamples)
+	if err != nil {
+		log.Println("Unable to load buffered stats, continuing without them: ", err)
+	}
 
+	if buffer.Len() > 0 {
+		log.Printf("Loaded %d buffered stats from a previous run", buffer.Len())
 	}
 
+	c := &Client{
+		config:    config,
+		publicKey: publicKey,
+		checks:    checks,
+		settings:  newConfigurator(config.MonitorURLS, config.updateInterval(), checks),
+		stats:     &publisher{buffer: buffer},
+	}
+
+	c.sessions = newSupervisor(config.ServerAddress, sshConfig, c.stats, &commander{checks: checks}, c.settings)
+
+	return c, nil
 }
 
-func getStats(monitorUrls []monitor) ([]byte, error) {
-	monitorsStatus := make(chan []models.MonitorStatus)
-	quit := make(chan bool)
+// Run takes stats and keeps a session with theia open until ctx is cancelled.
+// A final report is sent before returning, or buffered if theia is unreachable
+func (c *Client) Run(ctx context.Context) {
+	// Checks run continuously in the background, regardless of whether we're connected
+	c.checks.Start()
+	defer c.checks.Stop()
 
-	go checkMonitors(monitorUrls, monitorsStatus, quit)
+	// The session outlives ctx just long enough to send the final report
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	disksUsedPercent, err := getDisks()
+	finished := make(chan struct{})
+	go func() {
+		c.sessions.Run(sessionCtx)
+		close(finished)
+	}()
+
+	c.takeStats(ctx)
+
+	log.Println("Sending final report")
+	c.report()
+
+	cancel()
+	<-finished
+}
+
+// Reload applies a new config without dropping the session with theia, unless the server or the agents key or certificate changed.
+// An invalid config is refused and the current one kept
+func (c *Client) Reload(config ClientConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	sshConfig, err := config.sshConfig()
 	if err != nil {
-		quit <- true
-		return []byte(""), err
+		return err
 	}
 
-	memUsedPercent, err := getMemory()
+	publicKey, err := config.publicKey()
 	if err != nil {
-		quit <- true
-		return []byte(""), err
+		return err
 	}
 
-	mons := <-monitorsStatus
+	c.Lock()
+	previous, previousKey := c.config, c.publicKey
+	c.config, c.publicKey = config, publicKey
+	c.Unlock()
 
-	stat := &models.Stats{
-		DiskUsage:     disksUsedPercent,
-		MemoryUsage:   memUsedPercent,
-		MonitorValues: mons,
+	c.settings.SetLocal(config.MonitorURLS, config.updateInterval())
+
+	c.sessions.SetTarget(config.ServerAddress, sshConfig)
+
+	// The key file may have been replaced in place when rotating the agents key, so compare the key itself not just its path
+	if previous.ServerAddress != config.ServerAddress || previous.AuthorisedKey != config.AuthorisedKey || previousKey != publicKey ||
+		previous.CertificatePath != config.CertificatePath || previous.Principal != config.Principal {
+		log.Println("Server address, keys or certificate changed, reconnecting")
+		c.sessions.Reconnect()
 	}
 
-	return json.Marshal(stat)
+	if previous.BufferPath != config.BufferPath || previous.BufferMaxSamples != config.BufferMaxSamples || previous.MaxConcurrentChecks != config.MaxConcurrentChecks {
+		log.Println("Changes to buffer_path, buffer_max_samples and max_concurrent_checks only take effect after a restart")
+	}
+
+	return nil
 }
 
-func checkMonitors(monitorUrls []monitor, final chan<- []models.MonitorStatus, end <-chan bool) {
+func (c *Client) updateInterval() time.Duration {
+	c.Lock()
+	defer c.Unlock()
 
-	output := make([]models.MonitorStatus, len(monitorUrls))
+	return c.config.updateInterval()
+}
 
-check:
-	for index, m := range monitorUrls {
+//takeStats is the main workhorse, it takes the changing stats whether or not we're connected to theia until ctx is cancelled
+func (c *Client) takeStats(ctx context.Context) {
+	log.Println("Started taking stats")
+	for {
+		c.report()
 
 		select {
-		case <-end:
-			break check
-		default:
-
+		case <-ctx.Done():
+			return
+		case <-time.After(c.updateInterval()):
 		}
+	}
+}
 
-		ms := models.MonitorStatus{Path: m.URL, Reason: "-", OK: true}
+// report takes stats and sends them to theia, buffering them if it isnt connected
+func (c *Client) report() {
+	stat, err := getStats(c.checks)
+	if err != nil {
+		log.Println("Failed to get stats: ", err)
+		return
+	}
 
-		u, err := url.Parse(m.URL)
-		if err != nil {
-			log.Println("Warning, was unable to parse URL:", m.URL, " Err:", err, "Skipping")
-			ms.OK = false
-			ms.Reason = "Unable to parse URL: " + err.Error()
-			output[index] = ms
-			continue
-		}
+	c.stats.Publish(*stat)
+}
 
-		switch strings.TrimSpace(u.Scheme) {
+func getStats(checks *scheduler) (*models.Stats, error) {
 
-		case "http", "https":
+	disksUsedPercent, err := getDisks()
+	if err != nil {
+		return nil, err
+	}
 
-			httpClient := http.Client{
-				Timeout: time.Duration(m.TimeoutSeconds) * time.Second,
-			}
+	memUsedPercent, err := getMemory()
+	if err != nil {
+		return nil, err
+	}
 
-			resp, err := httpClient.Get(m.URL)
-			if err != nil {
-				ms.OK = false
-				ms.Reason = "HTTP get failed: " + err.Error()
-				output[index] = ms
-				continue
-			}
+	return &models.Stats{
+		DiskUsage:     disksUsedPercent,
+		MemoryUsage:   memUsedPercent,
+		MonitorValues: checks.Results(),
+		Timestamp:     time.Now(),
+	}, nil
+}
 
-			ms.StatusCode = resp.StatusCode
+func checkMonitor(m monitor) models.MonitorStatus {
 
-			if resp.StatusCode != m.OkayCode {
-				ms.OK = false
-				ms.Reason = "Status code not expected (Got " + fmt.Sprintf("%d", resp.StatusCode) + " expected " + fmt.Sprintf("%d", m.OkayCode) + ")"
-				output[index] = ms
-				continue
-			}
+	ms := models.MonitorStatus{Path: m.URL, Reason: "-", OK: true}
 
-			defer resp.Body.Close()
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		log.Println("Warning, was unable to parse URL:", m.URL, " Err:", err, "Skipping")
+		ms.OK = false
+		ms.Reason = "Unable to parse URL: " + err.Error()
+		return ms
+	}
 
-			if len(m.OkayString) > 0 {
+	switch strings.TrimSpace(u.Scheme) {
 
-				contents, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					ms.OK = false
-					ms.Reason = "Unable to read body"
-					output[index] = ms
-					continue
-				}
+	case "http", "https":
+		return checkHTTP(m)
 
-				if !bytes.Contains(contents, []byte(m.OkayString)) {
-					ms.OK = false
-					ms.Reason = "String not found"
-					output[index] = ms
-					continue
-				}
-			}
+	case "tls":
+		return checkTLS(m)
 
-		default:
-			log.Println("Testing using net dialer")
-			d := net.Dialer{Timeout: time.Duration(m.TimeoutSeconds) * time.Second}
-			_, err := d.Dial(u.Scheme, u.Host)
-			if err != nil {
-				ms.OK = false
-				ms.Reason = "Could not connect: " + err.Error()
-				output[index] = ms
-				continue
-			}
-		}
+	case "dns":
+		return checkDNS(m)
+
+	case "icmp":
+		return checkICMP(m)
 
-		output[index] = ms
+	default:
+		log.Println("Testing using net dialer")
+		d := net.Dialer{Timeout: monitorTimeout(m, checkTimeout)}
+
+		start := time.Now()
+		conn, err := d.Dial(u.Scheme, u.Host)
+
+		ms.ConnectMs = durationMs(time.Since(start))
+		ms.TotalMs = ms.ConnectMs
+
+		if err != nil {
+			ms.OK = false
+			ms.Reason = "Could not connect: " + err.Error()
+			return ms
+		}
+		conn.Close()
 	}
 
-	final <- output
+	return ms
 }
 
 func getMemory() (float32, error) {
@@ -285,29 +460,27 @@ func getDisks() (d map[string]float32, err error) {
 	return d, err
 }
 
-func getSystemInfo() ([]byte, error) {
+func getSystemInfo() (*models.SystemInfo, error) {
 	cores, err := cpu.Counts(false)
 	if err != nil {
-		return []byte(""), err
+		return nil, err
 	}
 
 	m, err := mem.VirtualMemory()
 	if err != nil {
-		return []byte(""), err
+		return nil, err
 	}
 
 	platform, family, version, err := host.PlatformInformation()
 	if err != nil {
-		return []byte(""), err
+		return nil, err
 	}
 
-	output := &models.SystemInfo{
+	return &models.SystemInfo{
 		CpuCores:    cores,
 		TotalMemory: m.Total,
 		Platform:    platform,
 		Family:      family,
 		Version:     version,
-	}
-
-	return json.Marshal(output)
+	}, nil
 }
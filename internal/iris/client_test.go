@@ -0,0 +1,165 @@
+package iris
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func writeTestKey(t *testing.T) string {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func testClientConfig(t *testing.T) ClientConfig {
+	return ClientConfig{
+		ServerAddress:       "127.0.0.1:1",
+		AuthorisedKey:       strings.TrimSpace(string(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey()))),
+		PrivateKeyPath:      writeTestKey(t),
+		UpdateIntervalSec:   60,
+		MaxConcurrentChecks: 1,
+		MonitorURLS:         []monitor{{URL: "tcp://127.0.0.1:1", Name: "first"}},
+	}
+}
+
+func TestClientReload(t *testing.T) {
+	config := testClientConfig(t)
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.UpdateIntervalSec = 5
+	config.MonitorURLS = append(config.MonitorURLS, monitor{URL: "tcp://127.0.0.1:2", Name: "second"})
+	if err := client.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.updateInterval() != 5*time.Second {
+		t.Fatal("Update interval was not reloaded: ", client.updateInterval())
+	}
+
+	if len(client.checks.Monitors()) != 2 {
+		t.Fatal("Monitors were not reloaded, have: ", client.checks.Monitors())
+	}
+
+	invalid := config
+	invalid.PrivateKeyPath = filepath.Join(t.TempDir(), "missing")
+	invalid.UpdateIntervalSec = 1
+	if err := client.Reload(invalid); err == nil {
+		t.Fatal("Config with a missing private key was accepted")
+	}
+
+	if client.updateInterval() != 5*time.Second {
+		t.Fatal("Refused config was partially applied")
+	}
+}
+
+func TestClientBuffersFinalReport(t *testing.T) {
+	config := testClientConfig(t)
+	config.BufferPath = filepath.Join(t.TempDir(), "buffer.json")
+	config.BufferMaxSamples = 10
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	finished := make(chan bool)
+	go func() {
+		client.Run(ctx)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Client did not stop when cancelled")
+	}
+
+	// theia is unreachable, so both the first and final reports should be waiting on disk
+	buffer, err := openStatsBuffer(config.BufferPath, config.BufferMaxSamples)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buffer.Len() != 2 {
+		t.Fatal("Expected the first and final reports to be buffered, have: ", buffer.Len())
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	config := testClientConfig(t)
+
+	privateBytes, err := ioutil.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCert := func(key ssh.PublicKey) string {
+		cert := &ssh.Certificate{Key: key, CertType: ssh.UserCert, ValidPrincipals: []string{"web-1", "web"}, ValidBefore: ssh.CertTimeInfinity}
+		if err := cert.SignCert(rand.Reader, newTestSigner(t)); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "id_ecdsa-cert.pub")
+		if err := ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	config.CertificatePath = writeCert(private.PublicKey())
+
+	sshConfig, err := config.sshConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sshConfig.User != "web-1" {
+		t.Fatal("Expected to authenticate as the first principal, got: ", sshConfig.User)
+	}
+
+	config.Principal = "web"
+	if sshConfig, err = config.sshConfig(); err != nil || sshConfig.User != "web" {
+		t.Fatal("Principal was not used: ", sshConfig, err)
+	}
+
+	config.CertificatePath = writeCert(newTestSigner(t).PublicKey())
+	if err := config.Validate(); err == nil {
+		t.Fatal("Certificate for a different key was accepted")
+	}
+}
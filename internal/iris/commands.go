@@ -0,0 +1,71 @@
+package iris
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// commander runs the fixed set of commands theia is allowed to send, there is deliberately no way to run anything else
+type commander struct {
+	checks *scheduler
+}
+
+// Run performs a command and reports the outcome
+func (c *commander) Run(command models.Command) models.CommandResult {
+	result := models.CommandResult{Id: command.Id}
+
+	switch command.Action {
+	case models.CommandRecheck:
+		result.Monitors = c.checks.CheckNow(c.checks.Monitors())
+
+	case models.CommandSystemInfo:
+		info, err := getSystemInfo()
+		if err != nil {
+			result.Error = "Unable to get system info: " + err.Error()
+			return result
+		}
+		result.SystemInfo = info
+
+	case models.CommandRunCheck:
+		m, ok := c.checks.Named(command.Check)
+		if !ok {
+			result.Error = "No check named " + command.Check
+			return result
+		}
+		result.Monitors = c.checks.CheckNow([]monitor{m})
+
+	default:
+		result.Error = "Unknown action " + command.Action
+		return result
+	}
+
+	result.OK = true
+	return result
+}
+
+// serve handles a command channel opened by theia, replying with the result and closing it
+func (c *commander) serve(newChannel ssh.NewChannel) {
+	var command models.Command
+	if err := json.Unmarshal(newChannel.ExtraData(), &command); err != nil {
+		newChannel.Reject(ssh.Prohibited, "Malformed command")
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Println("Could not accept command channel: ", err)
+		return
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	log.Printf("Running command %q [%s] for server", command.Action, command.Id)
+
+	if err := json.NewEncoder(channel).Encode(c.Run(command)); err != nil {
+		log.Println("Unable to send command result: ", err)
+	}
+}
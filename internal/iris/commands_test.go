@@ -0,0 +1,56 @@
+package iris
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+func TestCommanderRunCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	checks := newScheduler([]monitor{
+		{URL: "tcp://" + listener.Addr().String(), Name: "local", TimeoutSeconds: 2},
+		{URL: "tcp://127.0.0.1:1", TimeoutSeconds: 2},
+	}, time.Hour, 2)
+
+	c := &commander{checks: checks}
+
+	result := c.Run(models.Command{Id: "1", Action: models.CommandRunCheck, Check: "local"})
+	if !result.OK || result.Id != "1" || len(result.Monitors) != 1 || !result.Monitors[0].OK || result.Monitors[0].Name != "local" {
+		t.Fatalf("Named check did not run: %+v", result)
+	}
+
+	if cached := checks.Results(); len(cached) != 1 || cached[0].Name != "local" {
+		t.Fatal("On demand result was not cached for the next stats report: ", cached)
+	}
+
+	result = c.Run(models.Command{Id: "2", Action: models.CommandRecheck})
+	if !result.OK || len(result.Monitors) != 2 || result.Monitors[1].OK {
+		t.Fatalf("Recheck should run every monitor: %+v", result)
+	}
+
+	if result := c.Run(models.Command{Id: "3", Action: models.CommandRunCheck, Check: "missing"}); result.OK {
+		t.Fatal("Running a check that isnt configured should fail")
+	}
+
+	if result := c.Run(models.Command{Id: "4", Action: "shell", Check: "rm -rf /"}); result.OK || result.Error == "" {
+		t.Fatal("Unknown actions must be refused")
+	}
+}
@@ -0,0 +1,131 @@
+package iris
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+// configurator merges the monitors pushed by theia with those in the local config file.
+// Local monitors always run, a pushed monitor with the same URL as a local one is ignored
+type configurator struct {
+	sync.Mutex
+
+	local    []monitor
+	remote   []monitor
+	interval time.Duration
+
+	revision int64
+	checks   *scheduler
+}
+
+func newConfigurator(local []monitor, interval time.Duration, checks *scheduler) *configurator {
+	return &configurator{local: local, interval: interval, checks: checks}
+}
+
+// validate checks a monitor can be run
+func (m monitor) validate() error {
+	u, err := url.Parse(m.URL)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("invalid url %q", m.URL)
+	}
+
+	return nil
+}
+
+// checkUniqueURLs refuses monitors that share a URL, theia keeps the state and history of an agents monitors by URL so they would overwrite each other
+func checkUniqueURLs(monitors []monitor) error {
+	seen := make(map[string]int)
+	for i, m := range monitors {
+		if first, ok := seen[m.URL]; ok {
+			return fmt.Errorf("monitor %d has the same url as monitor %d, %q", i, first, m.URL)
+		}
+		seen[m.URL] = i
+	}
+
+	return nil
+}
+
+// SetLocal replaces the monitors and default interval from the local config file, keeping those pushed by theia
+func (c *configurator) SetLocal(local []monitor, interval time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.local = local
+	c.interval = interval
+	c.checks.SetMonitors(c.merged(), c.interval)
+}
+
+// Apply replaces the pushed monitors with those in update. Nothing is changed if any of them are invalid
+func (c *configurator) Apply(update models.ConfigUpdate) error {
+	remote := make([]monitor, 0, len(update.Monitors))
+	for i, raw := range update.Monitors {
+		var m monitor
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return fmt.Errorf("monitor %d: %w", i, err)
+		}
+
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("monitor %d: %w", i, err)
+		}
+
+		remote = append(remote, m)
+	}
+
+	if err := checkUniqueURLs(remote); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.revision == update.Revision && c.revision != 0 {
+		// Resent on reconnect, nothing has changed
+		return nil
+	}
+
+	c.remote = remote
+	c.revision = update.Revision
+	c.checks.SetMonitors(c.merged(), c.interval)
+
+	log.Printf("Applied config revision %d, %d monitors from server", update.Revision, len(remote))
+
+	return nil
+}
+
+// Paths returns the URL of every monitor being run, local and pushed
+func (c *configurator) Paths() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	paths := []string{}
+	for _, m := range c.merged() {
+		paths = append(paths, m.URL)
+	}
+
+	return paths
+}
+
+func (c *configurator) merged() []monitor {
+	merged := append([]monitor{}, c.local...)
+
+	local := make(map[string]bool)
+	for _, m := range c.local {
+		local[m.URL] = true
+	}
+
+	for _, m := range c.remote {
+		if local[m.URL] {
+			log.Printf("Monitor %s from server is already in the local config, using the local one", m.URL)
+			continue
+		}
+		merged = append(merged, m)
+	}
+
+	return merged
+}
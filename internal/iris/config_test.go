@@ -0,0 +1,74 @@
+package iris
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+func TestConfiguratorMergesPushedMonitors(t *testing.T) {
+	local := []monitor{{URL: "tcp://127.0.0.1:1", Name: "local"}}
+
+	checks := newScheduler(local, time.Hour, 1)
+	c := newConfigurator(local, time.Hour, checks)
+
+	update := models.ConfigUpdate{
+		Revision: 1,
+		Monitors: []json.RawMessage{
+			json.RawMessage(`{"url": "tcp://127.0.0.1:1", "name": "duplicate"}`),
+			json.RawMessage(`{"url": "https://example.com", "name": "pushed", "okay_code": 204}`),
+		},
+	}
+
+	if err := c.Apply(update); err != nil {
+		t.Fatal(err)
+	}
+
+	monitors := checks.Monitors()
+	if len(monitors) != 2 || monitors[0].Name != "local" || monitors[1].Name != "pushed" || monitors[1].OkayCode != 204 {
+		t.Fatalf("Pushed monitors not merged with local config: %+v", monitors)
+	}
+
+	if paths := c.Paths(); len(paths) != 2 || paths[0] != "tcp://127.0.0.1:1" || paths[1] != "https://example.com" {
+		t.Fatal("Acknowledged monitors should be every monitor being run: ", paths)
+	}
+
+	bad := models.ConfigUpdate{
+		Revision: 2,
+		Monitors: []json.RawMessage{json.RawMessage(`{"url": "no scheme"}`)},
+	}
+
+	if err := c.Apply(bad); err == nil {
+		t.Fatal("Invalid monitor should be refused")
+	}
+
+	if len(checks.Monitors()) != 2 {
+		t.Fatal("Refused config should leave the monitors alone")
+	}
+
+	duplicated := models.ConfigUpdate{
+		Revision: 2,
+		Monitors: []json.RawMessage{
+			json.RawMessage(`{"url": "https://example.com", "name": "get"}`),
+			json.RawMessage(`{"url": "https://example.com", "name": "post", "method": "POST"}`),
+		},
+	}
+
+	if err := c.Apply(duplicated); err == nil {
+		t.Fatal("Monitors sharing a URL should be refused")
+	}
+
+	if err := c.Apply(models.ConfigUpdate{Revision: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if monitors := checks.Monitors(); len(monitors) != 1 || monitors[0].Name != "local" {
+		t.Fatalf("Removing every pushed monitor should leave the local ones: %+v", monitors)
+	}
+
+	if paths := c.Paths(); len(paths) != 1 {
+		t.Fatal("Removed monitors should not be acknowledged: ", paths)
+	}
+}
@@ -0,0 +1,183 @@
+package iris
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+// checkDNS resolves the name in a dns://[resolver[:port]]/name?type=A&expect=1.2.3.4 monitor and checks that every expected value
+// is present in the answer. If no resolver is given the system resolver is used.
+func checkDNS(m monitor) models.MonitorStatus {
+	ms := models.MonitorStatus{Path: m.URL, Reason: "-", OK: true}
+
+	fail := func(reason string) models.MonitorStatus {
+		ms.OK = false
+		ms.Reason = reason
+		return ms
+	}
+
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		return fail("Unable to parse URL: " + err.Error())
+	}
+
+	name := strings.TrimPrefix(u.Path, "/")
+	if len(name) == 0 {
+		return fail("No name to resolve")
+	}
+
+	// Always query the exact name, rather than applying search domains
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	recordType := strings.ToUpper(u.Query().Get("type"))
+	if recordType == "" {
+		recordType = "A"
+	}
+
+	var expected []string
+	for _, e := range strings.Split(u.Query().Get("expect"), ",") {
+		if e = normaliseDNSAnswer(e); len(e) > 0 {
+			expected = append(expected, e)
+		}
+	}
+
+	resolver := net.DefaultResolver
+	if len(u.Host) > 0 {
+		server := u.Host
+		if len(u.Port()) == 0 {
+			server = net.JoinHostPort(strings.Trim(u.Host, "[]"), "53")
+		}
+
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), monitorTimeout(m, 5*time.Second))
+	defer cancel()
+
+	start := time.Now()
+
+	answers, err := lookupRecord(ctx, resolver, recordType, name)
+
+	ms.DNSMs = durationMs(time.Since(start))
+	ms.TotalMs = ms.DNSMs
+
+	if err != nil {
+		return fail("DNS lookup failed: " + err.Error())
+	}
+
+	if len(answers) == 0 {
+		return fail("No " + recordType + " records returned")
+	}
+
+	for _, e := range expected {
+		found := false
+		for _, a := range answers {
+			if a == e {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fail(fmt.Sprintf("Expected %q in %s answer, got [%s]", e, recordType, strings.Join(answers, ", ")))
+		}
+	}
+
+	return ms
+}
+
+func lookupRecord(ctx context.Context, resolver *net.Resolver, recordType, name string) (answers []string, err error) {
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, normaliseDNSAnswer(cname))
+
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mx := range mxs {
+			answers = append(answers, normaliseDNSAnswer(mx.Host))
+		}
+
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ns := range nss {
+			answers = append(answers, normaliseDNSAnswer(ns.Host))
+		}
+
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, txt := range txts {
+			answers = append(answers, normaliseDNSAnswer(txt))
+		}
+
+	default:
+		return nil, errors.New("unsupported record type " + recordType)
+	}
+
+	return answers, nil
+}
+
+func normaliseDNSAnswer(answer string) string {
+	answer = strings.TrimSpace(answer)
+	if ip := net.ParseIP(answer); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(strings.TrimSuffix(answer, "."))
+}
+
+// checkTimeout is how long a TCP, TLS or HTTP check may take when the monitor doesnt set timeout_seconds.
+// A check without one could hang forever, holding one of the schedulers slots
+const checkTimeout = 10 * time.Second
+
+// monitorTimeout returns the configured timeout of a monitor, or the default if it has not been set.
+func monitorTimeout(m monitor, def time.Duration) time.Duration {
+	if m.TimeoutSeconds > 0 {
+		return time.Duration(m.TimeoutSeconds) * time.Second
+	}
+	return def
+}
@@ -0,0 +1,103 @@
+package iris
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startDNSStandIn answers A queries from a fixed table on a loopback udp socket, and NXDOMAIN for anything else
+func startDNSStandIn(t *testing.T, records map[string][]net.IP) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, peer, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			if n < 12 {
+				continue
+			}
+
+			// Walk the labels of the (single) question
+			offset := 12
+			var labels []string
+			for offset < n && buffer[offset] != 0 {
+				length := int(buffer[offset])
+				labels = append(labels, string(buffer[offset+1:offset+1+length]))
+				offset += length + 1
+			}
+			offset++
+			questionEnd := offset + 4
+			if questionEnd > n {
+				continue
+			}
+
+			qtype := binary.BigEndian.Uint16(buffer[offset : offset+2])
+			name := strings.ToLower(strings.Join(labels, "."))
+
+			ips, ok := records[name]
+
+			response := make([]byte, 12, 512)
+			copy(response, buffer[:2])
+			binary.BigEndian.PutUint16(response[2:], 0x8180)
+			if !ok {
+				binary.BigEndian.PutUint16(response[2:], 0x8183)
+			}
+			binary.BigEndian.PutUint16(response[4:], 1)
+
+			var answers [][]byte
+			if qtype == 1 {
+				for _, ip := range ips {
+					answer := []byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}
+					answers = append(answers, append(answer, ip.To4()...))
+				}
+			}
+			binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+
+			response = append(response, buffer[12:questionEnd]...)
+			for _, a := range answers {
+				response = append(response, a...)
+			}
+
+			conn.WriteTo(response, peer)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestCheckDNS(t *testing.T) {
+	resolver := startDNSStandIn(t, map[string][]net.IP{
+		"service.iris.test": {net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+	})
+
+	status := checkDNS(monitor{URL: "dns://" + resolver + "/service.iris.test?type=A&expect=10.0.0.2", TimeoutSeconds: 2})
+	if !status.OK {
+		t.Fatal("Expected lookup to succeed: ", status.Reason)
+	}
+
+	status = checkDNS(monitor{URL: "dns://" + resolver + "/service.iris.test?expect=10.0.0.1,10.0.0.3", TimeoutSeconds: 2})
+	if status.OK {
+		t.Fatal("Expected check to fail when an expected address is missing from the answer")
+	}
+
+	status = checkDNS(monitor{URL: "dns://" + resolver + "/missing.iris.test", TimeoutSeconds: 2})
+	if status.OK {
+		t.Fatal("Expected check to fail for a name that does not resolve")
+	}
+
+	status = checkDNS(monitor{URL: "dns://" + resolver + "/service.iris.test?type=SRV", TimeoutSeconds: 2})
+	if status.OK {
+		t.Fatal("Unsupported record type should fail the check")
+	}
+}
@@ -0,0 +1,110 @@
+package iris
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/NHAS/StatsCollector/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// Enroll registers a new key with theia using a one-time token from its web interface.
+// The host key theia presents must match the fingerprint in the token, the returned config has it pinned along with the new key.
+// The agent is registered as name unless the token sets one, the name it was registered as is returned.
+// Nothing is written unless enrollment succeeds, and an existing private key is never overwritten
+func Enroll(config ClientConfig, token, name string) (ClientConfig, string, error) {
+	secret, fingerprint, err := models.ParseEnrollmentToken(token)
+	if err != nil {
+		return config, "", err
+	}
+
+	if len(config.ServerAddress) == 0 {
+		return config, "", errors.New("server_address must be set to enroll")
+	}
+
+	if len(config.PrivateKeyPath) == 0 {
+		return config, "", errors.New("private_key_path must be set to enroll")
+	}
+
+	if _, err := os.Stat(config.PrivateKeyPath); err == nil {
+		return config, "", fmt.Errorf("A private key already exists at %s, remove it or choose another private_key_path", config.PrivateKeyPath)
+	}
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return config, "", err
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return config, "", err
+	}
+
+	var hostKey ssh.PublicKey
+	sshConfig := &ssh.ClientConfig{
+		User: models.EnrollmentUser,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		// Trust on first use, but confirmed by the token so we know its the server that issued it
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if utils.HexFingerprintSHA256(key) != fingerprint {
+				return errors.New("Server host key does not match the enrollment token, is server_address right?")
+			}
+
+			hostKey = key
+			return nil
+		},
+		Timeout: dialTimeout,
+	}
+
+	conn, err := ssh.Dial("tcp", config.ServerAddress, sshConfig)
+	if err != nil {
+		return config, "", err
+	}
+	defer conn.Close()
+
+	request, err := json.Marshal(models.EnrollmentRequest{Token: secret, Name: name, ClientVersion: Version})
+	if err != nil {
+		return config, "", err
+	}
+
+	channel, requests, err := conn.OpenChannel(models.EnrollmentChannel, request)
+	if err != nil {
+		if rejected, ok := err.(*ssh.OpenChannelError); ok {
+			return config, "", fmt.Errorf("Server refused enrollment: %s", rejected.Message)
+		}
+		return config, "", err
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	var result models.EnrollmentResult
+	if err := json.NewDecoder(channel).Decode(&result); err != nil {
+		return config, "", fmt.Errorf("Reading enrollment result failed: %w", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		return config, "", err
+	}
+
+	if err := ioutil.WriteFile(config.PrivateKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return config, result.AgentName, fmt.Errorf("Enrolled as %q, but writing the private key failed: %w", result.AgentName, err)
+	}
+
+	config.AuthorisedKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))
+
+	return config, result.AgentName, nil
+}
@@ -0,0 +1,358 @@
+package iris
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+type basicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// checkHTTP performs a single http(s) request as described by the monitor and checks the response against the
+// status codes, body assertions and response time threshold configured for it.
+func checkHTTP(m monitor) models.MonitorStatus {
+	ms := models.MonitorStatus{Path: m.URL, Reason: "-", OK: true}
+
+	fail := func(reason string) models.MonitorStatus {
+		ms.OK = false
+		ms.Reason = reason
+		return ms
+	}
+
+	okayCodes, err := parseStatusCodes(m.OkayCodes, m.OkayCode)
+	if err != nil {
+		return fail("Invalid okay_codes: " + err.Error())
+	}
+
+	httpClient, err := newHTTPClient(m)
+	if err != nil {
+		return fail(err.Error())
+	}
+
+	method := strings.ToUpper(strings.TrimSpace(m.Method))
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, m.URL, strings.NewReader(m.Body))
+	if err != nil {
+		return fail("Unable to build request: " + err.Error())
+	}
+
+	for header, value := range m.Headers {
+		req.Header.Set(header, value)
+	}
+
+	if req.Header.Get("Host") != "" {
+		req.Host = req.Header.Get("Host")
+	}
+
+	if m.BasicAuth != nil {
+		req.SetBasicAuth(m.BasicAuth.Username, m.BasicAuth.Password)
+	}
+
+	if len(m.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+m.BearerToken)
+	}
+
+	var timing requestTiming
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timing.trace()))
+
+	start := time.Now()
+
+	resp, err := httpClient.Do(req)
+	timing.record(&ms, start)
+	if err != nil {
+		if req.URL.Scheme == "https" {
+			probeCertificate(&ms, req.URL.Host, req.URL.Hostname(), monitorTimeout(m, checkTimeout))
+		}
+		return fail("HTTP " + strings.ToLower(method) + " failed: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	ms.StatusCode = resp.StatusCode
+
+	if resp.TLS != nil {
+		recordCertificate(&ms, *resp.TLS, resp.Request.URL.Hostname())
+	}
+
+	if !okayCodes.contains(resp.StatusCode) {
+		return fail(fmt.Sprintf("Status code not expected (Got %d expected %s)", resp.StatusCode, okayCodes))
+	}
+
+	var contents []byte
+	if len(m.OkayString) > 0 || len(m.OkayRegex) > 0 || len(m.JSONAssertions) > 0 {
+		contents, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fail("Unable to read body")
+		}
+	}
+
+	elapsed := time.Since(start)
+	ms.TotalMs = durationMs(elapsed)
+
+	if len(m.OkayString) > 0 && !bytes.Contains(contents, []byte(m.OkayString)) {
+		return fail("String not found")
+	}
+
+	if len(m.OkayRegex) > 0 {
+		re, err := regexp.Compile(m.OkayRegex)
+		if err != nil {
+			return fail("Invalid okay_regex: " + err.Error())
+		}
+
+		if !re.Match(contents) {
+			return fail("Body did not match regex")
+		}
+	}
+
+	if len(m.JSONAssertions) > 0 {
+		if err := checkJSONAssertions(contents, m.JSONAssertions); err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	if m.MaxResponseMs > 0 && elapsed > time.Duration(m.MaxResponseMs)*time.Millisecond {
+		return fail(fmt.Sprintf("Response too slow (took %dms, threshold %dms)", elapsed.Milliseconds(), m.MaxResponseMs))
+	}
+
+	return ms
+}
+
+// requestTiming collects the timestamps of each phase of a request, if a request is redirected the last hop is recorded
+type requestTiming struct {
+	sync.Mutex
+
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+func (rt *requestTiming) trace() *httptrace.ClientTrace {
+	now := func(t *time.Time) {
+		rt.Lock()
+		*t = time.Now()
+		rt.Unlock()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { now(&rt.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { now(&rt.dnsDone) },
+		ConnectStart:         func(string, string) { now(&rt.connectStart) },
+		ConnectDone:          func(string, string, error) { now(&rt.connectDone) },
+		TLSHandshakeStart:    func() { now(&rt.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { now(&rt.tlsDone) },
+		GotFirstResponseByte: func() { now(&rt.firstByte) },
+	}
+}
+
+func (rt *requestTiming) record(ms *models.MonitorStatus, start time.Time) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	between := func(from, to time.Time) float32 {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return durationMs(to.Sub(from))
+	}
+
+	ms.DNSMs = between(rt.dnsStart, rt.dnsDone)
+	ms.ConnectMs = between(rt.connectStart, rt.connectDone)
+	ms.TLSMs = between(rt.tlsStart, rt.tlsDone)
+	ms.TTFBMs = between(start, rt.firstByte)
+	ms.TotalMs = durationMs(time.Since(start))
+}
+
+func durationMs(d time.Duration) float32 {
+	return float32(d.Microseconds()) / 1000
+}
+
+func newHTTPClient(m monitor) (*http.Client, error) {
+
+	tlsConfig, err := newTLSConfig(m, "")
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DisableKeepAlives = true
+
+	httpClient := &http.Client{
+		Timeout:   monitorTimeout(m, checkTimeout),
+		Transport: transport,
+	}
+
+	if m.FollowRedirects != nil && !*m.FollowRedirects {
+		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	} else if m.MaxRedirects > 0 {
+		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) > m.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", m.MaxRedirects)
+			}
+			return nil
+		}
+	}
+
+	return httpClient, nil
+}
+
+type statusRange struct {
+	low, high int
+}
+
+type statusCodes []statusRange
+
+func (s statusCodes) contains(code int) bool {
+	for _, r := range s {
+		if code >= r.low && code <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+func (s statusCodes) String() string {
+	var parts []string
+	for _, r := range s {
+		if r.low == r.high {
+			parts = append(parts, strconv.Itoa(r.low))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d-%d", r.low, r.high))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseStatusCodes parses a list of accepted status codes such as "200,204,300-399".
+// If no list is given the single okay code is used, and if that is unset 200 is assumed.
+func parseStatusCodes(list string, single int) (statusCodes, error) {
+	if strings.TrimSpace(list) == "" {
+		if single == 0 {
+			single = http.StatusOK
+		}
+		return statusCodes{{single, single}}, nil
+	}
+
+	var codes statusCodes
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a status code", part)
+		}
+
+		high := low
+		if len(bounds) == 2 {
+			high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a status code range", part)
+			}
+		}
+
+		if low > high || low < 100 || high > 599 {
+			return nil, fmt.Errorf("%q is not a valid status code range", part)
+		}
+
+		codes = append(codes, statusRange{low, high})
+	}
+
+	if len(codes) == 0 {
+		return nil, errors.New("no status codes specified")
+	}
+
+	return codes, nil
+}
+
+// checkJSONAssertions decodes the body as JSON and compares the value at each dotted path (e.g "data.items.0.state")
+// against the expected value
+func checkJSONAssertions(body []byte, assertions map[string]string) error {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return errors.New("Body was not valid JSON: " + err.Error())
+	}
+
+	for path, expected := range assertions {
+		value, err := lookupJSONPath(document, path)
+		if err != nil {
+			return err
+		}
+
+		if actual := jsonValueString(value); actual != expected {
+			return fmt.Errorf("JSON path %q was %q expected %q", path, actual, expected)
+		}
+	}
+
+	return nil
+}
+
+func lookupJSONPath(document interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+
+	current := document
+	if path == "" {
+		return current, nil
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("JSON path %q not found (missing %q)", path, key)
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, fmt.Errorf("JSON path %q not found (bad index %q)", path, key)
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("JSON path %q not found (%q is not an object or array)", path, key)
+		}
+	}
+
+	return current, nil
+}
+
+func jsonValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,161 @@
+package iris
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckHTTPMethodHeadersAndBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		user, pass, _ := r.BasicAuth()
+
+		if r.Method != http.MethodPost || r.Header.Get("X-Test") != "yes" || string(body) != "ping" || user != "admin" || pass != "hunter22" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	status := checkHTTP(monitor{
+		URL:       ts.URL,
+		Method:    "post",
+		Headers:   map[string]string{"X-Test": "yes"},
+		Body:      "ping",
+		BasicAuth: &basicAuth{Username: "admin", Password: "hunter22"},
+		OkayCodes: "200-201",
+	})
+
+	if !status.OK {
+		t.Fatal("Expected check to pass: ", status.Reason)
+	}
+}
+
+func TestCheckHTTPStatusCodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	if status := checkHTTP(monitor{URL: ts.URL}); status.OK || status.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expected default okay code of 200 to fail a 503")
+	}
+
+	if status := checkHTTP(monitor{URL: ts.URL, OkayCodes: "200,500-599"}); !status.OK {
+		t.Fatal("Expected 503 to be within accepted range: ", status.Reason)
+	}
+
+	if status := checkHTTP(monitor{URL: ts.URL, OkayCodes: "abc"}); status.OK {
+		t.Fatal("Invalid status code list should fail the check")
+	}
+}
+
+func TestCheckHTTPRedirectPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/final" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "/final", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	if status := checkHTTP(monitor{URL: ts.URL + "/start"}); !status.OK {
+		t.Fatal("Redirects should be followed by default: ", status.Reason)
+	}
+
+	follow := false
+	status := checkHTTP(monitor{URL: ts.URL + "/start", FollowRedirects: &follow, OkayCode: http.StatusFound})
+	if !status.OK {
+		t.Fatal("Redirect should not have been followed: ", status.Reason)
+	}
+}
+
+func TestCheckHTTPBodyAssertions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"healthy","checks":[{"name":"db","up":true}],"version":"1.4.2"}`))
+	}))
+	defer ts.Close()
+
+	status := checkHTTP(monitor{
+		URL:            ts.URL,
+		OkayRegex:      `"version":"1\.\d+\.\d+"`,
+		JSONAssertions: map[string]string{"status": "healthy", "$.checks.0.up": "true"},
+	})
+	if !status.OK {
+		t.Fatal("Expected assertions to pass: ", status.Reason)
+	}
+
+	status = checkHTTP(monitor{URL: ts.URL, JSONAssertions: map[string]string{"checks.0.name": "cache"}})
+	if status.OK {
+		t.Fatal("Expected json assertion to fail")
+	}
+
+	status = checkHTTP(monitor{URL: ts.URL, JSONAssertions: map[string]string{"checks.3.name": "db"}})
+	if status.OK {
+		t.Fatal("Expected missing json path to fail")
+	}
+}
+
+func TestCheckHTTPResponseTime(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	if status := checkHTTP(monitor{URL: ts.URL, MaxResponseMs: 10}); status.OK {
+		t.Fatal("Expected slow response to fail")
+	}
+
+	status := checkHTTP(monitor{URL: ts.URL, MaxResponseMs: 5000})
+	if !status.OK {
+		t.Fatal("Expected response to be within threshold: ", status.Reason)
+	}
+
+	if status.TTFBMs < 50 || status.TotalMs < status.TTFBMs || status.ConnectMs <= 0 {
+		t.Fatalf("Timings not recorded correctly, ttfb: %f total: %f connect: %f", status.TTFBMs, status.TotalMs, status.ConnectMs)
+	}
+}
+
+func TestCheckHTTPTLSOptions(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	if status := checkHTTP(monitor{URL: ts.URL, TimeoutSeconds: 5}); status.OK {
+		t.Fatal("Self signed certificate should not be trusted by default")
+	}
+
+	if status := checkHTTP(monitor{URL: ts.URL, TimeoutSeconds: 5, InsecureSkipVerify: true}); !status.OK {
+		t.Fatal("Expected verification to be skipped: ", status.Reason)
+	}
+}
+
+func TestCheckHTTPDefaultTimeout(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	done := make(chan bool)
+	go func() {
+		done <- checkMonitor(monitor{URL: ts.URL}).OK
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("Endpoint that never answered should fail")
+		}
+	case <-time.After(checkTimeout + 5*time.Second):
+		t.Fatal("Check without timeout_seconds hung waiting for a response")
+	}
+}
@@ -0,0 +1,184 @@
+package iris
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// checkICMP sends echo requests to the host of an icmp://host?count=3&max_loss=0&max_rtt_ms=200 monitor.
+// An unprivileged (udp) ping socket is used where the system allows it, falling back to a raw socket.
+// The check fails if no replies are received, or the packet loss/average round trip time exceed the given limits.
+func checkICMP(m monitor) models.MonitorStatus {
+	ms := models.MonitorStatus{Path: m.URL, Reason: "-", OK: true}
+
+	fail := func(reason string) models.MonitorStatus {
+		ms.OK = false
+		ms.Reason = reason
+		return ms
+	}
+
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		return fail("Unable to parse URL: " + err.Error())
+	}
+
+	query := u.Query()
+
+	count, err := queryInt(query, "count", 3)
+	if err != nil || count < 1 {
+		return fail("Invalid count")
+	}
+
+	maxLoss, err := queryInt(query, "max_loss", 100)
+	if err != nil {
+		return fail("Invalid max_loss")
+	}
+
+	maxRTT, err := queryInt(query, "max_rtt_ms", 0)
+	if err != nil {
+		return fail("Invalid max_rtt_ms")
+	}
+
+	addr, err := net.ResolveIPAddr("ip", u.Hostname())
+	if err != nil {
+		return fail("Unable to resolve host: " + err.Error())
+	}
+
+	isIPv6 := addr.IP.To4() == nil
+
+	conn, privileged, err := listenICMP(isIPv6)
+	if err != nil {
+		return fail("Unable to open ICMP socket: " + err.Error())
+	}
+	defer conn.Close()
+
+	var destination net.Addr = addr
+	if !privileged {
+		destination = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+
+	var (
+		echoType  icmp.Type = ipv4.ICMPTypeEcho
+		replyType icmp.Type = ipv4.ICMPTypeEchoReply
+		protocol            = protocolICMP
+	)
+
+	if isIPv6 {
+		echoType = ipv6.ICMPTypeEchoRequest
+		replyType = ipv6.ICMPTypeEchoReply
+		protocol = protocolIPv6ICMP
+	}
+
+	// Unprivileged sockets have the identifier rewritten by the kernel so only raw sockets can check it
+	id := os.Getpid() & 0xffff
+	perPacket := monitorTimeout(m, 5*time.Second) / time.Duration(count)
+
+	var (
+		received int
+		totalRTT time.Duration
+		buffer   = make([]byte, 1500)
+	)
+
+	for seq := 1; seq <= count; seq++ {
+		request := icmp.Message{
+			Type: echoType,
+			Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("iris")},
+		}
+
+		packet, err := request.Marshal(nil)
+		if err != nil {
+			return fail("Unable to build echo request: " + err.Error())
+		}
+
+		start := time.Now()
+		if _, err := conn.WriteTo(packet, destination); err != nil {
+			return fail("Unable to send echo request: " + err.Error())
+		}
+
+		conn.SetReadDeadline(start.Add(perPacket))
+
+		for {
+			n, _, err := conn.ReadFrom(buffer)
+			if err != nil {
+				// Timed out, count this packet as lost
+				break
+			}
+
+			reply, err := icmp.ParseMessage(protocol, buffer[:n])
+			if err != nil || reply.Type != replyType {
+				continue
+			}
+
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || (privileged && echo.ID != id) {
+				continue
+			}
+
+			received++
+			totalRTT += time.Since(start)
+			break
+		}
+	}
+
+	ms.PacketLoss = float32(count-received) / float32(count) * 100
+	if received > 0 {
+		ms.RoundTripMs = durationMs(totalRTT) / float32(received)
+		ms.TotalMs = ms.RoundTripMs
+	}
+
+	if received == 0 {
+		return fail(fmt.Sprintf("No echo replies received (%d sent)", count))
+	}
+
+	if ms.PacketLoss > float32(maxLoss) {
+		return fail(fmt.Sprintf("Packet loss %.0f%% above threshold %d%%", ms.PacketLoss, maxLoss))
+	}
+
+	if maxRTT > 0 && ms.RoundTripMs > float32(maxRTT) {
+		return fail(fmt.Sprintf("Average round trip %.2fms above threshold %dms", ms.RoundTripMs, maxRTT))
+	}
+
+	return ms
+}
+
+func listenICMP(isIPv6 bool) (conn *icmp.PacketConn, privileged bool, err error) {
+	network, rawNetwork, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if isIPv6 {
+		network, rawNetwork, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	conn, err = icmp.ListenPacket(network, address)
+	if err == nil {
+		return conn, false, nil
+	}
+
+	conn, rawErr := icmp.ListenPacket(rawNetwork, address)
+	if rawErr != nil {
+		return nil, false, fmt.Errorf("unprivileged: %s, raw: %s", err, rawErr)
+	}
+
+	return conn, true, nil
+}
+
+func queryInt(query url.Values, key string, def int) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
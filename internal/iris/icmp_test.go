@@ -0,0 +1,26 @@
+package iris
+
+import "testing"
+
+func TestCheckICMPLoopback(t *testing.T) {
+	conn, _, err := listenICMP(false)
+	if err != nil {
+		t.Skip("ICMP sockets are not permitted here: ", err)
+	}
+	conn.Close()
+
+	status := checkICMP(monitor{URL: "icmp://127.0.0.1?count=2&max_loss=0", TimeoutSeconds: 2})
+	if !status.OK {
+		t.Fatal("Expected loopback to reply: ", status.Reason)
+	}
+
+	if status.PacketLoss != 0 || status.RoundTripMs <= 0 {
+		t.Fatalf("Unexpected results for loopback, loss: %f rtt: %f", status.PacketLoss, status.RoundTripMs)
+	}
+}
+
+func TestCheckICMPInvalidOptions(t *testing.T) {
+	if status := checkICMP(monitor{URL: "icmp://127.0.0.1?count=abc"}); status.OK {
+		t.Fatal("Invalid count should fail the check")
+	}
+}
@@ -0,0 +1,175 @@
+package iris
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// Version is sent to theia during the protocol handshake, set it at build time with
+// -ldflags "-X github.com/NHAS/StatsCollector/internal/iris.Version=1.2.3"
+var Version = "dev"
+
+// How long to wait for theia to reply to our hello
+var helloTimeout = 10 * time.Second
+
+// errNoHello is returned when a server that speaks the versioned protocol doesnt reply to our hello in time
+var errNoHello = errors.New("server did not reply to protocol hello")
+
+// session is the agent side of an open metrics channel
+type session struct {
+	sync.Mutex
+
+	conn    ssh.Conn
+	channel ssh.Channel
+	encoder *json.Encoder
+	decoder *json.Decoder
+
+	version int
+}
+
+// openSession opens the metrics channel and negotiates the protocol version with theia
+func openSession(conn ssh.Conn) (*session, error) {
+	hello, err := json.Marshal(models.NewHello(Version))
+	if err != nil {
+		return nil, err
+	}
+
+	channel, requests, err := conn.OpenChannel("metrics", hello)
+	if err != nil {
+		return nil, err
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	s := &session{
+		conn:    conn,
+		channel: channel,
+		encoder: json.NewEncoder(channel),
+		decoder: json.NewDecoder(channel),
+	}
+
+	s.version, err = s.handshake()
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	log.Println("Using protocol version: ", s.version)
+
+	return s, nil
+}
+
+func (s *session) handshake() (int, error) {
+	type result struct {
+		version int
+		err     error
+	}
+
+	reply := make(chan result, 1)
+
+	go func() {
+		var env models.Envelope
+		if err := s.decoder.Decode(&env); err != nil {
+			reply <- result{err: err}
+			return
+		}
+
+		if env.Type != models.MessageHello {
+			reply <- result{err: fmt.Errorf("expected hello from server, got %q", env.Type)}
+			return
+		}
+
+		var hello models.Hello
+		if err := env.Decode(&hello); err != nil {
+			reply <- result{err: err}
+			return
+		}
+
+		if hello.Version < models.MinProtocolVersion || hello.Version > models.ProtocolVersion {
+			reply <- result{err: fmt.Errorf("server chose unsupported protocol version %d", hello.Version)}
+			return
+		}
+
+		reply <- result{version: hello.Version}
+	}()
+
+	select {
+	case r := <-reply:
+		return r.version, r.err
+	case <-time.After(helloTimeout):
+		// A versioned server that is just slow would send its hello after we had started sending bare stats, so reconnect instead
+		if strings.HasPrefix(string(s.conn.ServerVersion()), models.SSHServerVersion) {
+			return 0, errNoHello
+		}
+
+		// Servers that predate protocol versioning never reply
+		log.Println("Server did not send a protocol hello, falling back to legacy protocol")
+		return 0, nil
+	}
+}
+
+// Send writes a message to theia, translating it to the legacy protocol if required
+func (s *session) Send(messageType string, payload interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.version == 0 {
+		switch messageType {
+		case models.MessageStats:
+			return s.encoder.Encode(payload)
+
+		case models.MessageSystemInfo:
+			b, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+
+			_, err = s.channel.SendRequest("system", false, b)
+			return err
+		}
+
+		return errors.New("message type " + messageType + " is not supported by the legacy protocol")
+	}
+
+	env, err := models.NewEnvelope(s.version, messageType, payload)
+	if err != nil {
+		return err
+	}
+
+	return s.encoder.Encode(env)
+}
+
+// Receive calls handle for every message sent by theia until the channel is closed
+func (s *session) Receive(handle func(models.Envelope)) error {
+	if s.version == 0 {
+		// Legacy servers never send anything
+		return nil
+	}
+
+	for {
+		var env models.Envelope
+		if err := s.decoder.Decode(&env); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				log.Println("Skipping message from server that could not be decoded: ", err)
+				continue
+			}
+			return err
+		}
+
+		handle(env)
+	}
+}
+
+// Close closes the metrics channel and the connection it was opened on, so the client reconnects
+func (s *session) Close() error {
+	s.channel.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,230 @@
+package iris
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+const maxFirstRoundSpread = 1 * time.Second
+
+// scheduler runs every monitor on its own interval, with at most maxConcurrent checks in flight at once.
+// The latest result of each check is cached so that stats reports never wait on a slow endpoint.
+type scheduler struct {
+	sync.RWMutex
+
+	monitors        []monitor
+	defaultInterval time.Duration
+
+	// results are keyed by monitorKey, so a monitor whose options change is not reported with the result of its old options
+	results map[string]models.MonitorStatus
+	slots   chan struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newScheduler(monitors []monitor, defaultInterval time.Duration, maxConcurrent int) *scheduler {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	return &scheduler{
+		monitors:        monitors,
+		defaultInterval: defaultInterval,
+		results:         make(map[string]models.MonitorStatus),
+		slots:           make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Start begins checking all monitors, the first round of checks is started immediately
+func (s *scheduler) Start() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+
+	s.stop = make(chan struct{})
+
+	for _, m := range s.monitors {
+		s.wg.Add(1)
+		go s.run(m, s.stop)
+	}
+}
+
+// Stop halts all checks and waits for any in flight to finish
+func (s *scheduler) Stop() {
+	s.Lock()
+	if s.stop == nil {
+		s.Unlock()
+		return
+	}
+
+	close(s.stop)
+	s.stop = nil
+	s.Unlock()
+
+	s.wg.Wait()
+}
+
+// Results returns the most recent status of every monitor, in configuration order.
+// Monitors that have not completed a check yet are left out, so the server keeps whatever state it last had for them
+func (s *scheduler) Results() []models.MonitorStatus {
+	s.RLock()
+	defer s.RUnlock()
+
+	output := make([]models.MonitorStatus, 0, len(s.monitors))
+	for _, m := range s.monitors {
+		if status, ok := s.results[monitorKey(m)]; ok {
+			output = append(output, status)
+		}
+	}
+
+	return output
+}
+
+func (s *scheduler) interval(m monitor) time.Duration {
+	if m.IntervalSeconds > 0 {
+		return time.Duration(m.IntervalSeconds) * time.Second
+	}
+	return s.defaultInterval
+}
+
+func (s *scheduler) run(m monitor, stop <-chan struct{}) {
+	defer s.wg.Done()
+
+	interval := s.interval(m)
+
+	// Spread the first round out a little so every check doesnt fire at once
+	spread := interval / 10
+	if spread > maxFirstRoundSpread {
+		spread = maxFirstRoundSpread
+	}
+
+	timer := time.NewTimer(jitter(spread))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case <-stop:
+			return
+		case s.slots <- struct{}{}:
+		}
+
+		s.check(m)
+
+		timer.Reset(interval + jitter(interval/10))
+	}
+}
+
+// check runs a monitor and caches the result, the caller must already hold one of the slots
+func (s *scheduler) check(m monitor) models.MonitorStatus {
+	status := checkMonitor(m)
+	status.Name = m.Name
+	status.CheckedAt = time.Now()
+
+	<-s.slots
+
+	s.Lock()
+	s.results[monitorKey(m)] = status
+	s.Unlock()
+
+	return status
+}
+
+// CheckNow runs the given monitors immediately rather than waiting for their next interval, and returns their results.
+// The results are cached as usual so they also go out with the next stats report
+func (s *scheduler) CheckNow(monitors []monitor) []models.MonitorStatus {
+	results := make([]models.MonitorStatus, len(monitors))
+
+	var wg sync.WaitGroup
+	for i, m := range monitors {
+		wg.Add(1)
+		go func(i int, m monitor) {
+			defer wg.Done()
+
+			s.slots <- struct{}{}
+			results[i] = s.check(m)
+		}(i, m)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Monitors returns the monitors being checked
+func (s *scheduler) Monitors() []monitor {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.monitors
+}
+
+// SetMonitors replaces the monitors being checked and the default interval, keeping the cached results of monitors that remain.
+// Checks already in flight are allowed to finish first
+func (s *scheduler) SetMonitors(monitors []monitor, defaultInterval time.Duration) {
+	s.RLock()
+	running := s.stop != nil
+	s.RUnlock()
+
+	s.Stop()
+
+	s.Lock()
+	s.monitors = monitors
+	s.defaultInterval = defaultInterval
+
+	keep := make(map[string]bool)
+	for _, m := range monitors {
+		keep[monitorKey(m)] = true
+	}
+
+	for key := range s.results {
+		if !keep[key] {
+			delete(s.results, key)
+		}
+	}
+	s.Unlock()
+
+	if running {
+		s.Start()
+	}
+}
+
+// Named returns the monitor with the given name
+func (s *scheduler) Named(name string) (monitor, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, m := range s.monitors {
+		if m.Name != "" && m.Name == name {
+			return m, true
+		}
+	}
+	return monitor{}, false
+}
+
+// monitorKey identifies a monitor by its whole configuration, so its result follows it when the monitors are replaced or reordered
+func monitorKey(m monitor) string {
+	// Cannot fail, a monitor is plain data that was decoded from JSON in the first place
+	key, _ := json.Marshal(m)
+	return string(key)
+}
+
+// jitter returns a random duration in [0, max)
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
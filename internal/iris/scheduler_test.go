@@ -0,0 +1,125 @@
+package iris
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBoundedConcurrency(t *testing.T) {
+	var current, highest int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+
+		for {
+			old := atomic.LoadInt32(&highest)
+			if now <= old || atomic.CompareAndSwapInt32(&highest, old, now) {
+				break
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	var monitors []monitor
+	for i := 0; i < 6; i++ {
+		monitors = append(monitors, monitor{URL: ts.URL + "/" + strconv.Itoa(i)})
+	}
+
+	checks := newScheduler(monitors, time.Hour, 2)
+	checks.Start()
+	defer checks.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(checks.Results()) < len(monitors) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	results := checks.Results()
+	if len(results) != len(monitors) {
+		t.Fatal("Not all monitors were checked, got: ", len(results))
+	}
+
+	for i, r := range results {
+		if r.Path != monitors[i].URL || !r.OK || r.CheckedAt.IsZero() {
+			t.Fatal("Unexpected result: ", r)
+		}
+	}
+
+	if highest > 2 {
+		t.Fatal("More checks ran at once than allowed: ", highest)
+	}
+}
+
+func TestSchedulerPerCheckInterval(t *testing.T) {
+	var fast, slow int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fast" {
+			atomic.AddInt32(&fast, 1)
+			return
+		}
+		atomic.AddInt32(&slow, 1)
+	}))
+	defer ts.Close()
+
+	checks := newScheduler([]monitor{
+		{URL: ts.URL + "/fast"},
+		{URL: ts.URL + "/slow", IntervalSeconds: 3600},
+	}, 20*time.Millisecond, 4)
+
+	checks.Start()
+
+	// The first round is spread over up to a second
+	deadline := time.Now().Add(2 * time.Second)
+	for (atomic.LoadInt32(&slow) == 0 || atomic.LoadInt32(&fast) < 3) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	checks.Stop()
+
+	if atomic.LoadInt32(&fast) < 3 {
+		t.Fatal("Fast check should have run several times, ran: ", fast)
+	}
+
+	if atomic.LoadInt32(&slow) != 1 {
+		t.Fatal("Slow check should have run exactly once, ran: ", slow)
+	}
+}
+
+func TestSchedulerSameURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer ts.Close()
+
+	monitors := []monitor{
+		{URL: ts.URL, Name: "get"},
+		{URL: ts.URL, Name: "post", Method: http.MethodPost},
+	}
+
+	checks := newScheduler(monitors, time.Hour, 2)
+	checks.CheckNow(monitors)
+
+	results := checks.Results()
+	if len(results) != 2 || results[0].Name != "get" || !results[0].OK || results[1].Name != "post" || results[1].OK {
+		t.Fatalf("Monitors sharing a URL overwrote each others results: %+v", results)
+	}
+
+	// Reordering keeps each result with its monitor
+	checks.SetMonitors([]monitor{monitors[1], monitors[0]}, time.Hour)
+
+	results = checks.Results()
+	if len(results) != 2 || results[0].Name != "post" || results[1].Name != "get" {
+		t.Fatalf("Results did not follow their monitors: %+v", results)
+	}
+}
@@ -0,0 +1,242 @@
+package iris
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	reconnectMinDelay = 2 * time.Second
+	reconnectMaxDelay = 5 * time.Minute
+
+	dialTimeout = 30 * time.Second
+)
+
+// backoff produces exponentially growing delays between reconnection attempts.
+// Each delay is randomised between half and all of its nominal value, so agents that lost theia at the same time dont all come back at once
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+// Next returns how long to wait before the next attempt
+func (b *backoff) Next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if n := b.min << uint(b.attempt); n > 0 && n < b.max {
+			d = n
+		}
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Reset starts the delays from the minimum again, once a connection has been established
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// supervisor keeps a session with theia open, reconnecting whenever it is lost
+type supervisor struct {
+	sync.Mutex
+
+	address   string
+	sshConfig *ssh.ClientConfig
+	stats     *publisher
+	commands  *commander
+	config    *configurator
+
+	// conn is the current connection to theia, nil while disconnected
+	conn ssh.Conn
+
+	backoff backoff
+}
+
+func newSupervisor(address string, sshConfig *ssh.ClientConfig, stats *publisher, commands *commander, config *configurator) *supervisor {
+	return &supervisor{
+		address:   address,
+		sshConfig: sshConfig,
+		stats:     stats,
+		commands:  commands,
+		config:    config,
+		backoff:   backoff{min: reconnectMinDelay, max: reconnectMaxDelay},
+	}
+}
+
+// SetTarget changes the server and credentials used, from the next time a connection is made
+func (s *supervisor) SetTarget(address string, sshConfig *ssh.ClientConfig) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.address = address
+	s.sshConfig = sshConfig
+}
+
+// Reconnect drops the current connection so a new one is made straight away with the current target, such as after the agents key has been rotated
+func (s *supervisor) Reconnect() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// Run connects to theia and reconnects whenever the session ends, until ctx is cancelled
+func (s *supervisor) Run(ctx context.Context) {
+	for {
+		err := s.runSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := s.backoff.Next()
+		log.Printf("Session with stats server ended: %v. Reconnecting in %s", err, delay.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runSession connects to theia and serves a single session, returning once the connection is lost or ctx is cancelled.
+// Everything started for the session is stopped before it returns
+func (s *supervisor) runSession(ctx context.Context) error {
+	s.Lock()
+	address, sshConfig := s.address, s.sshConfig
+	s.Unlock()
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	con, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(con, address, sshConfig)
+	if err != nil {
+		con.Close()
+		return err
+	}
+	defer sshConn.Close()
+
+	s.Lock()
+	s.conn = sshConn
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.conn = nil
+		s.Unlock()
+	}()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The incoming Request channel must be serviced.
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		for newChannel := range chans {
+			if newChannel.ChannelType() == models.CommandChannel && s.commands != nil {
+				go s.commands.serve(newChannel)
+				continue
+			}
+
+			newChannel.Reject(ssh.Prohibited, "Clients disallow channel requests")
+		}
+	}()
+
+	// Closing the connection unblocks everything below if we're asked to stop part way through
+	go func() {
+		<-sessionCtx.Done()
+		sshConn.Close()
+	}()
+
+	metrics, err := openSession(sshConn)
+	if err != nil {
+		return err
+	}
+
+	if err := s.stats.Attach(metrics); err != nil {
+		return err
+	}
+	defer s.stats.Detach(metrics)
+
+	log.Println("Connected to stats server ", address)
+	s.backoff.Reset()
+
+	go func() {
+		err := metrics.Receive(func(env models.Envelope) {
+			switch env.Type {
+			case models.MessageConfig:
+				s.applyConfig(metrics, env)
+			default:
+				log.Println("Ignoring message from server of unknown type: ", env.Type)
+			}
+		})
+		if err != nil && sessionCtx.Err() == nil {
+			log.Println("Reading from server failed: ", err)
+		}
+	}()
+
+	go sendSystemInfo(sessionCtx, metrics)
+
+	return sshConn.Wait()
+}
+
+// applyConfig applies monitors pushed by theia and tells it whether they were accepted
+func (s *supervisor) applyConfig(metrics *session, env models.Envelope) {
+	if s.config == nil {
+		return
+	}
+
+	var update models.ConfigUpdate
+	err := env.Decode(&update)
+	if err == nil {
+		err = s.config.Apply(update)
+	}
+
+	ack := models.ConfigAck{Revision: update.Revision, OK: err == nil}
+	if err != nil {
+		log.Println("Refusing config from server: ", err)
+		ack.Error = err.Error()
+	} else {
+		ack.Monitors = s.config.Paths()
+	}
+
+	if err := metrics.Send(models.MessageConfigAck, ack); err != nil {
+		log.Println("Unable to acknowledge config: ", err)
+	}
+}
+
+//sendSystemInfo updates the system metrics that shouldnt change very often, such as memory size/cpu, until ctx is cancelled
+func sendSystemInfo(ctx context.Context, metrics *session) {
+	log.Println("Started sending system info")
+
+	for {
+		systemInfo, err := getSystemInfo()
+		if err != nil {
+			log.Println("Unable to get system info: ", err)
+		} else if err := metrics.Send(models.MessageSystemInfo, systemInfo); err != nil {
+			log.Println("Sending system info failed: ", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Hour):
+		}
+	}
+}
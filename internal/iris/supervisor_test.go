@@ -0,0 +1,301 @@
+package iris
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// fakeTheia is just enough of a stats server to speak the metrics protocol, it passes on every stats report it receives
+type fakeTheia struct {
+	sync.Mutex
+
+	listener net.Listener
+	conns    []net.Conn
+
+	received chan models.Stats
+}
+
+func startFakeTheia(t *testing.T, address string, hostKey ssh.Signer, received chan models.Stats) *fakeTheia {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	f := &fakeTheia{listener: listener, received: received}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			f.Lock()
+			f.conns = append(f.conns, conn)
+			f.Unlock()
+
+			go f.serve(conn, config)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeTheia) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		var hello models.Hello
+		if err := json.Unmarshal(newChannel.ExtraData(), &hello); err != nil {
+			newChannel.Reject(ssh.Prohibited, err.Error())
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		go func() {
+			reply, _ := models.NewEnvelope(models.ProtocolVersion, models.MessageHello, models.Hello{Version: models.ProtocolVersion})
+			if err := json.NewEncoder(channel).Encode(reply); err != nil {
+				return
+			}
+
+			decoder := json.NewDecoder(channel)
+			for {
+				var env models.Envelope
+				if err := decoder.Decode(&env); err != nil {
+					return
+				}
+
+				if env.Type == models.MessageStats {
+					var stat models.Stats
+					if err := env.Decode(&stat); err == nil {
+						f.received <- stat
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Stop kills the listener and every open connection, as if theia had gone away
+func (f *fakeTheia) Stop() {
+	f.listener.Close()
+
+	f.Lock()
+	defer f.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func expectStat(t *testing.T, received chan models.Stats, memory float32) {
+	select {
+	case stat := <-received:
+		if stat.MemoryUsage != memory {
+			t.Fatal("Received stats out of order, expected ", memory, " got ", stat.MemoryUsage)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for stats ", memory)
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for ", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorReconnects(t *testing.T) {
+	hostKey := newTestSigner(t)
+
+	// Find a free port for theia to come and go on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	sshConfig := &ssh.ClientConfig{
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestSigner(t))},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	}
+
+	buffer, _ := openStatsBuffer("", 100)
+	stats := &publisher{buffer: buffer}
+
+	connected := func() bool {
+		stats.Lock()
+		defer stats.Unlock()
+		return stats.session != nil
+	}
+
+	s := newSupervisor(address, sshConfig, stats, nil, nil)
+	s.backoff = backoff{min: 10 * time.Millisecond, max: 100 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan bool)
+	go func() {
+		s.Run(ctx)
+		close(finished)
+	}()
+
+	// Theia isnt up yet, so this is buffered and the supervisor keeps retrying rather than giving up
+	stats.Publish(models.Stats{MemoryUsage: 1})
+	time.Sleep(100 * time.Millisecond)
+
+	received := make(chan models.Stats, 10)
+	theia := startFakeTheia(t, address, hostKey, received)
+
+	expectStat(t, received, 1)
+	waitFor(t, "connection", connected)
+
+	stats.Publish(models.Stats{MemoryUsage: 2})
+	expectStat(t, received, 2)
+
+	theia.Stop()
+	waitFor(t, "disconnection", func() bool { return !connected() })
+
+	stats.Publish(models.Stats{MemoryUsage: 3})
+	stats.Publish(models.Stats{MemoryUsage: 4})
+
+	theia = startFakeTheia(t, address, hostKey, received)
+	defer theia.Stop()
+
+	expectStat(t, received, 3)
+	expectStat(t, received, 4)
+	waitFor(t, "reconnection", connected)
+
+	cancel()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Supervisor did not stop when cancelled")
+	}
+
+	if connected() {
+		t.Fatal("Session was not detached when the supervisor stopped")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 10 * time.Second}
+
+	for i, nominal := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		nominal *= time.Second
+
+		d := b.Next()
+		if d < nominal/2 || d > nominal {
+			t.Fatalf("Attempt %d: delay %s outside of %s-%s", i, d, nominal/2, nominal)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Fatal("Reset did not return to the minimum delay: ", d)
+	}
+}
+
+// dialSilentTheia connects to a server that accepts the metrics channel but never replies to the hello
+func dialSilentTheia(t *testing.T, serverVersion string) ssh.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	config := &ssh.ServerConfig{NoClientAuth: true, ServerVersion: serverVersion}
+	config.AddHostKey(newTestSigner(t))
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		for newChannel := range chans {
+			_, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client.Conn
+}
+
+func TestHandshakeWithoutHello(t *testing.T) {
+	defer func(timeout time.Duration) { helloTimeout = timeout }(helloTimeout)
+	helloTimeout = 100 * time.Millisecond
+
+	// A server from before protocol versioning never replies
+	legacy, err := openSession(dialSilentTheia(t, "SSH-2.0-Go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if legacy.version != 0 {
+		t.Fatal("Expected to fall back to the legacy protocol, got version ", legacy.version)
+	}
+
+	// A versioned server that is slow to reply must not be spoken to with the legacy protocol
+	if _, err := openSession(dialSilentTheia(t, models.SSHServerVersion)); err != errNoHello {
+		t.Fatal("Expected the session to fail without a hello, got: ", err)
+	}
+}
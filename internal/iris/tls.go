@@ -0,0 +1,130 @@
+package iris
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+// checkTLS connects to a tls://host:port monitor, completes the handshake and records details of the leaf certificate
+func checkTLS(m monitor) models.MonitorStatus {
+	ms := models.MonitorStatus{Path: m.URL, Reason: "-", OK: true}
+
+	u, err := url.Parse(m.URL)
+	if err != nil {
+		ms.OK = false
+		ms.Reason = "Unable to parse URL: " + err.Error()
+		return ms
+	}
+
+	tlsConfig, err := newTLSConfig(m, u.Hostname())
+	if err != nil {
+		ms.OK = false
+		ms.Reason = err.Error()
+		return ms
+	}
+
+	timeout := monitorTimeout(m, checkTimeout)
+	d := &net.Dialer{Timeout: timeout}
+
+	start := time.Now()
+
+	rawConn, err := d.Dial("tcp", u.Host)
+	if err != nil {
+		ms.OK = false
+		ms.Reason = "Could not connect: " + err.Error()
+		return ms
+	}
+
+	connected := time.Now()
+	ms.ConnectMs = durationMs(connected.Sub(start))
+
+	// Without a deadline a server that accepts but never finishes the handshake would hang the check
+	rawConn.SetDeadline(start.Add(timeout))
+
+	conn := tls.Client(rawConn, tlsConfig)
+	defer conn.Close()
+
+	err = conn.Handshake()
+
+	ms.TLSMs = durationMs(time.Since(connected))
+	ms.TotalMs = durationMs(time.Since(start))
+
+	if err != nil {
+		ms.OK = false
+		ms.Reason = "TLS handshake failed: " + err.Error()
+
+		// Still try to record the certificate details, as an expired or mismatched certificate is why we are here.
+		// A server that timed out wont answer the probe either, and waiting again would double how long the check takes
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			probeCertificate(&ms, u.Host, u.Hostname(), timeout)
+		}
+		return ms
+	}
+
+	recordCertificate(&ms, conn.ConnectionState(), u.Hostname())
+
+	return ms
+}
+
+func newTLSConfig(m monitor, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: m.InsecureSkipVerify,
+	}
+
+	if len(m.CAPath) > 0 {
+		caBytes, err := ioutil.ReadFile(m.CAPath)
+		if err != nil {
+			return nil, errors.New("Unable to load CA: " + err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("Unable to load CA: no PEM certificates found in " + m.CAPath)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// recordCertificate fills out the certificate fields of a monitor status from the leaf certificate presented by the server
+func recordCertificate(ms *models.MonitorStatus, state tls.ConnectionState, serverName string) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	leaf := state.PeerCertificates[0]
+
+	ms.CertExpiry = leaf.NotAfter
+	ms.CertIssuer = leaf.Issuer.String()
+	ms.CertSANMatch = leaf.VerifyHostname(serverName) == nil
+	ms.CertDaysLeft = int(time.Until(leaf.NotAfter).Hours() / 24)
+}
+
+// probeCertificate dials without verification purely to inspect the certificate, used when the real check failed verification
+func probeCertificate(ms *models.MonitorStatus, address, serverName string, timeout time.Duration) {
+	// The timeout covers the handshake as well as connecting
+	d := &net.Dialer{Timeout: timeout, Deadline: time.Now().Add(timeout)}
+
+	if !strings.Contains(address, ":") {
+		address = net.JoinHostPort(address, "443")
+	}
+
+	conn, err := tls.DialWithDialer(d, "tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	recordCertificate(ms, conn.ConnectionState(), serverName)
+}
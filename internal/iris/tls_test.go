@@ -0,0 +1,88 @@
+package iris
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckTLSRecordsCertificate(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	target := "tls://" + strings.TrimPrefix(ts.URL, "https://")
+
+	status := checkTLS(monitor{URL: target, TimeoutSeconds: 5})
+	if status.OK {
+		t.Fatal("Self signed certificate should fail verification")
+	}
+
+	if status.CertExpiry.IsZero() || status.CertDaysLeft <= 0 {
+		t.Fatal("Certificate details should be recorded even when verification fails")
+	}
+
+	status = checkTLS(monitor{URL: target, TimeoutSeconds: 5, InsecureSkipVerify: true})
+	if !status.OK {
+		t.Fatal("Expected verification to be skipped: ", status.Reason)
+	}
+
+	if !status.CertSANMatch {
+		t.Fatal("httptest certificate should be valid for 127.0.0.1")
+	}
+
+	if len(status.CertIssuer) == 0 {
+		t.Fatal("Issuer was not recorded")
+	}
+}
+
+func TestCheckHTTPSRecordsCertificate(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	status := checkHTTP(monitor{URL: ts.URL, TimeoutSeconds: 5, InsecureSkipVerify: true})
+	if !status.OK {
+		t.Fatal(status.Reason)
+	}
+
+	if status.CertExpiry.IsZero() {
+		t.Fatal("Certificate expiry was not recorded for https monitor")
+	}
+}
+
+func TestCheckTLSDefaultTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	done := make(chan bool)
+	go func() {
+		done <- checkTLS(monitor{URL: "tls://" + listener.Addr().String()}).OK
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("Handshake that never completed should fail")
+		}
+	case <-time.After(checkTimeout + 5*time.Second):
+		t.Fatal("Check without timeout_seconds hung waiting for the handshake")
+	}
+}
@@ -0,0 +1,199 @@
+package theia
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// Permission extensions carrying the identity from an agents certificate through to handleAgentConnection
+const (
+	certPrincipalExtension   = "cert-principal"
+	certKeyIDExtension       = "cert-key-id"
+	certSerialExtension      = "cert-serial"
+	certAuthorityExtension   = "cert-authority"
+	certValidBeforeExtension = "cert-valid-before"
+)
+
+// agentCA authenticates agents by certificates signed by a trusted ssh user CA
+type agentCA struct {
+	sync.Mutex
+
+	authorities [][]byte
+	principals  []string
+
+	krlPath    string
+	krl        *revocationList
+	krlModTime time.Time
+	krlSize    int64
+}
+
+// loadAgentCA reads the CA keys and revocation list from the config, it returns nil if no CA is configured
+func loadAgentCA(config ServerConfig) (*agentCA, error) {
+	if len(config.AgentCAPath) == 0 {
+		return nil, nil
+	}
+
+	caBytes, err := ioutil.ReadFile(config.AgentCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load agent CA: %w", err)
+	}
+
+	ca := &agentCA{principals: config.AgentCAPrincipals, krlPath: config.AgentCAKRLPath}
+
+	for rest := caBytes; len(bytes.TrimSpace(rest)) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse agent CA: %w", err)
+		}
+
+		ca.authorities = append(ca.authorities, key.Marshal())
+	}
+
+	if len(ca.authorities) == 0 {
+		return nil, errors.New("agent_ca_path does not contain any keys")
+	}
+
+	if len(ca.principals) == 0 {
+		return nil, errors.New("agent_ca_principals must be set when using an agent CA")
+	}
+
+	for _, pattern := range ca.principals {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("agent_ca_principals %q: %w", pattern, err)
+		}
+	}
+
+	if len(ca.krlPath) > 0 {
+		if _, err := ca.revocations(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ca, nil
+}
+
+func (a *agentCA) isAuthority(auth ssh.PublicKey) bool {
+	for _, authority := range a.authorities {
+		if bytes.Equal(authority, auth.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *agentCA) principalAllowed(principal string) bool {
+	for _, pattern := range a.principals {
+		if ok, _ := path.Match(pattern, principal); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// revocations returns the revocation list, rereading it whenever the file changes so revoking a certificate doesnt need a reload
+func (a *agentCA) revocations() (*revocationList, error) {
+	if len(a.krlPath) == 0 {
+		return nil, nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	info, err := os.Stat(a.krlPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load agent KRL: %w", err)
+	}
+
+	if a.krl != nil && info.ModTime().Equal(a.krlModTime) && info.Size() == a.krlSize {
+		return a.krl, nil
+	}
+
+	krlBytes, err := ioutil.ReadFile(a.krlPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load agent KRL: %w", err)
+	}
+
+	krl, err := parseKRL(krlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse agent KRL: %w", err)
+	}
+
+	a.krl, a.krlModTime, a.krlSize = krl, info.ModTime(), info.Size()
+
+	return krl, nil
+}
+
+// isRevoked fails closed, if the revocation list cant be read no certificate is accepted
+func (a *agentCA) isRevoked(cert *ssh.Certificate) bool {
+	krl, err := a.revocations()
+	if err != nil {
+		log.Println("Refusing all agent certificates: ", err)
+		return true
+	}
+
+	return krl != nil && krl.IsRevoked(cert)
+}
+
+// authenticate checks the certificate was issued by the CA for the user the agent connected as, is in its validity period and hasnt been revoked.
+// The agent is identified by that principal, which must also be one theia allows
+func (a *agentCA) authenticate(c ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	checker := ssh.CertChecker{
+		IsUserAuthority: a.isAuthority,
+		IsRevoked:       a.isRevoked,
+	}
+
+	if _, err := checker.Authenticate(c, cert); err != nil {
+		return nil, err
+	}
+
+	if !a.principalAllowed(c.User()) {
+		return nil, fmt.Errorf("Principal %q is not allowed by agent_ca_principals", c.User())
+	}
+
+	validBefore := ""
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore = strconv.FormatUint(cert.ValidBefore, 10)
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			certPrincipalExtension:   c.User(),
+			certKeyIDExtension:       cert.KeyId,
+			certSerialExtension:      strconv.FormatUint(cert.Serial, 10),
+			certAuthorityExtension:   ssh.FingerprintSHA256(cert.SignatureKey),
+			certValidBeforeExtension: validBefore,
+		},
+	}, nil
+}
+
+// certificateIdentity recovers the identity recorded by authenticate, once the agent has proven it holds the certificates key
+func certificateIdentity(permissions *ssh.Permissions) (identity models.CertificateIdentity, ok bool) {
+	identity.Principal, ok = permissions.Extensions[certPrincipalExtension]
+	if !ok {
+		return identity, false
+	}
+
+	identity.KeyId = permissions.Extensions[certKeyIDExtension]
+	identity.Authority = permissions.Extensions[certAuthorityExtension]
+	identity.Serial, _ = strconv.ParseUint(permissions.Extensions[certSerialExtension], 10, 64)
+
+	if validBefore, err := strconv.ParseInt(permissions.Extensions[certValidBeforeExtension], 10, 64); err == nil {
+		identity.ValidBefore = time.Unix(validBefore, 0)
+	}
+
+	return identity, true
+}
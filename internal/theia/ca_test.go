@@ -0,0 +1,219 @@
+package theia
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+func krlString(b []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(b)))
+	return append(length, b...)
+}
+
+func krlUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// buildKRL assembles a KRL in the same format ssh-keygen -k writes
+func buildKRL(sections ...[]byte) []byte {
+	krl := []byte(krlMagic)
+	krl = append(krl, 0, 0, 0, krlFormatVersion)
+	krl = append(krl, krlUint64(1)...)                         // krl version
+	krl = append(krl, krlUint64(uint64(time.Now().Unix()))...) // generated date
+	krl = append(krl, krlUint64(0)...)                         // flags
+	krl = append(krl, krlString(nil)...)                       // reserved
+	krl = append(krl, krlString([]byte("test"))...)            // comment
+
+	for _, section := range sections {
+		krl = append(krl, section...)
+	}
+
+	return krl
+}
+
+func krlSection(sectionType byte, body ...[]byte) []byte {
+	var data []byte
+	for _, b := range body {
+		data = append(data, b...)
+	}
+
+	return append([]byte{sectionType}, krlString(data)...)
+}
+
+func revokedSerials(ca ssh.PublicKey, serials ...uint64) []byte {
+	var list []byte
+	for _, serial := range serials {
+		list = append(list, krlUint64(serial)...)
+	}
+
+	return krlSection(krlSectionCertificates, krlString(ca.Marshal()), krlString(nil), krlSection(krlCertSerialList, list))
+}
+
+func newTestCertificate(t *testing.T, ca, agentKey ssh.Signer, principal string, serial uint64, validBefore time.Time) ssh.Signer {
+	cert := &ssh.Certificate{
+		Key:             agentKey.PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           principal + " test",
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, agentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+func TestParseKRL(t *testing.T) {
+	ca := newTestSigner(t)
+	otherCA := newTestSigner(t)
+	revokedKey := newTestSigner(t)
+
+	krl, err := parseKRL(buildKRL(
+		krlSection(krlSectionCertificates, krlString(ca.PublicKey().Marshal()), krlString(nil),
+			krlSection(krlCertSerialList, krlUint64(5)),
+			krlSection(krlCertSerialRange, krlUint64(100), krlUint64(200)),
+			krlSection(krlCertKeyID, krlString([]byte("stolen laptop"))),
+		),
+		krlSection(krlSectionExplicitKey, krlString(revokedKey.PublicKey().Marshal())),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := func(signer ssh.Signer, key ssh.Signer, serial uint64, keyID string) *ssh.Certificate {
+		return &ssh.Certificate{Key: key.PublicKey(), SignatureKey: signer.PublicKey(), Serial: serial, KeyId: keyID}
+	}
+
+	agentKey := newTestSigner(t)
+	for _, c := range []struct {
+		name    string
+		cert    *ssh.Certificate
+		revoked bool
+	}{
+		{"valid", cert(ca, agentKey, 6, "fine"), false},
+		{"serial", cert(ca, agentKey, 5, "fine"), true},
+		{"range", cert(ca, agentKey, 150, "fine"), true},
+		{"key id", cert(ca, agentKey, 6, "stolen laptop"), true},
+		{"other ca", cert(otherCA, agentKey, 5, "stolen laptop"), false},
+		{"explicit key", cert(otherCA, revokedKey, 1, "fine"), true},
+	} {
+		if krl.IsRevoked(c.cert) != c.revoked {
+			t.Errorf("%s: expected revoked to be %t", c.name, c.revoked)
+		}
+	}
+
+	if _, err := parseKRL([]byte("not a krl")); err == nil {
+		t.Fatal("Parsed garbage as a KRL")
+	}
+
+	if _, err := parseKRL(buildKRL(krlSection(krlSectionExplicitKey))[:50]); err == nil {
+		t.Fatal("Parsed a truncated KRL")
+	}
+}
+
+func TestAgentCertificateAuth(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	dir := t.TempDir()
+
+	ca := newTestSigner(t)
+	caPath := filepath.Join(dir, "ca.pub")
+	if err := ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	krlPath := filepath.Join(dir, "revoked.krl")
+	if err := ioutil.WriteFile(krlPath, buildKRL(revokedSerials(ca.PublicKey(), 99)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	address, stop := startTestServer(t, db, ServerConfig{
+		PrivateKeyPath:    writeTestKey(t),
+		AgentCAPath:       caPath,
+		AgentCAPrincipals: []string{"web-*"},
+		AgentCAKRLPath:    krlPath,
+	})
+	defer stop()
+
+	connect := func(principal string, signer ssh.Signer) error {
+		conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+			User:            principal,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	agentKey := newTestSigner(t)
+	valid := newTestCertificate(t, ca, agentKey, "web-1", 3, time.Now().Add(time.Hour))
+
+	// Wait for the server to come up
+	dialTestServer(t, address, &ssh.ClientConfig{User: "web-1", Auth: []ssh.AuthMethod{ssh.PublicKeys(valid)}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}).Close()
+
+	waitFor := func(what string, condition func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for ", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var agent models.Agent
+	waitFor("agent to be registered", func() bool {
+		return db.First(&agent, "principal = ?", "web-1").Error == nil
+	})
+
+	if agent.PubKey != models.CertificatePubKeyPrefix+"web-1" || agent.CertificateSerial != "3" {
+		t.Fatal("Agent was not registered with its certificate identity: ", agent)
+	}
+
+	if err := connect("web-1", agentKey); err == nil {
+		t.Fatal("Agent registered by certificate authenticated with just its key")
+	}
+
+	if err := connect("db-1", newTestCertificate(t, ca, agentKey, "db-1", 4, time.Now().Add(time.Hour))); err == nil {
+		t.Fatal("Principal not in agent_ca_principals was accepted")
+	}
+
+	if err := connect("web-1", newTestCertificate(t, ca, agentKey, "web-1", 5, time.Now().Add(-time.Minute))); err == nil {
+		t.Fatal("Expired certificate was accepted")
+	}
+
+	if err := connect("web-1", newTestCertificate(t, newTestSigner(t), agentKey, "web-1", 6, time.Now().Add(time.Hour))); err == nil {
+		t.Fatal("Certificate from an unknown CA was accepted")
+	}
+
+	// Revoking the certificate takes effect without a reload
+	if err := ioutil.WriteFile(krlPath, buildKRL(revokedSerials(ca.PublicKey(), 3, 99)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := connect("web-1", valid); err == nil {
+		t.Fatal("Revoked certificate was accepted")
+	}
+}
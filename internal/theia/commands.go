@@ -0,0 +1,181 @@
+package theia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long to wait for an agent to finish a command, a recheck can take as long as the slowest monitor
+const commandTimeout = 2 * time.Minute
+
+// ErrAgentNotConnected is returned when a command is sent to an agent that isnt currently connected
+var ErrAgentNotConnected = errors.New("Agent is not connected")
+
+// ErrUnknownCommand is returned for any action agents dont support
+var ErrUnknownCommand = errors.New("Unknown command")
+
+// connectedAgents tracks the ssh connection and metrics channel of every connected agent, so commands and config can be sent to them
+type connectedAgents struct {
+	sync.RWMutex
+
+	store    models.AgentStore
+	conns    map[int64]ssh.Conn
+	sessions map[int64]*agentSession
+
+	// closeReasons are why theia closed a connection, so its entry in the connection log says so rather than just EOF
+	closeReasons map[ssh.Conn]string
+}
+
+func newConnectedAgents(store models.AgentStore) *connectedAgents {
+	return &connectedAgents{
+		store:        store,
+		conns:        make(map[int64]ssh.Conn),
+		sessions:     make(map[int64]*agentSession),
+		closeReasons: make(map[ssh.Conn]string),
+	}
+}
+
+// closeWith disconnects an agent and remembers why, the caller must hold the lock
+func (a *connectedAgents) closeWith(conn ssh.Conn, reason string) {
+	a.closeReasons[conn] = reason
+	conn.Close()
+}
+
+// closeReason returns, and forgets, why theia closed a connection. ok is false if theia didnt close it
+func (a *connectedAgents) closeReason(conn ssh.Conn) (reason string, ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	reason, ok = a.closeReasons[conn]
+	delete(a.closeReasons, conn)
+	return reason, ok
+}
+
+func (a *connectedAgents) add(agentID int64, conn ssh.Conn) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.conns[agentID] = conn
+}
+
+// remove forgets an agents connection, unless the agent has already reconnected on a new one
+func (a *connectedAgents) remove(agentID int64, conn ssh.Conn) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.conns[agentID] == conn {
+		delete(a.conns, agentID)
+	}
+	delete(a.closeReasons, conn)
+}
+
+// closeAll disconnects every connected agent, returning how many there were
+func (a *connectedAgents) closeAll() int {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, conn := range a.conns {
+		a.closeWith(conn, models.DisconnectShutdown)
+	}
+
+	return len(a.conns)
+}
+
+// DisconnectKey drops an agents connection if it authenticated with keyID, so retiring a key takes effect straight away.
+// It returns whether the agent was disconnected
+func (a *connectedAgents) DisconnectKey(agentID, keyID int64) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	conn, ok := a.conns[agentID].(*ssh.ServerConn)
+	if !ok || conn.Permissions == nil || conn.Permissions.Extensions[agentKeyExtension] != strconv.FormatInt(keyID, 10) {
+		return false
+	}
+
+	a.closeWith(conn, models.DisconnectKeyRetired)
+	return true
+}
+
+// DisconnectAgent drops an agents connection, so archiving it takes effect straight away. It returns whether the agent was connected
+func (a *connectedAgents) DisconnectAgent(agentID int64) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	conn, ok := a.conns[agentID]
+	if !ok {
+		return false
+	}
+
+	a.closeWith(conn, models.DisconnectArchived)
+	return true
+}
+
+// RunCommand sends a command to a connected agent and waits for its result
+func (a *connectedAgents) RunCommand(agentID int64, command models.Command) (models.CommandResult, error) {
+	var result models.CommandResult
+
+	switch command.Action {
+	case models.CommandRecheck, models.CommandSystemInfo, models.CommandRunCheck:
+	default:
+		return result, ErrUnknownCommand
+	}
+
+	a.RLock()
+	conn, ok := a.conns[agentID]
+	a.RUnlock()
+
+	if !ok {
+		return result, ErrAgentNotConnected
+	}
+
+	b, err := json.Marshal(command)
+	if err != nil {
+		return result, err
+	}
+
+	channel, requests, err := conn.OpenChannel(models.CommandChannel, b)
+	if err != nil {
+		return result, fmt.Errorf("Agent refused command: %w", err)
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	decoded := make(chan error, 1)
+	go func() {
+		decoded <- json.NewDecoder(channel).Decode(&result)
+	}()
+
+	select {
+	case err := <-decoded:
+		if err != nil {
+			return result, fmt.Errorf("Unable to read command result: %w", err)
+		}
+	case <-time.After(commandTimeout):
+		return result, errors.New("Timed out waiting for agent to finish command")
+	}
+
+	if result.Id != command.Id {
+		return result, errors.New("Agent replied to a different command")
+	}
+
+	if result.SystemInfo != nil {
+		b, err := json.Marshal(result.SystemInfo)
+		if err != nil {
+			return result, err
+		}
+
+		if err := storeSystemAttributes(a.store, agentID, b); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package theia
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// connectTestAgent connects an agent over loopback that answers every command channel with reply
+func connectTestAgent(t *testing.T, agents *connectedAgents, agentID int64, reply func(models.Command) models.CommandResult) {
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(newTestSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	registered := make(chan bool)
+	go func() {
+		nConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		conn, chans, reqs, err := ssh.NewServerConn(nConn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			for newChannel := range chans {
+				newChannel.Reject(ssh.Prohibited, "")
+			}
+		}()
+
+		agents.add(agentID, conn)
+		close(registered)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		for newChannel := range client.HandleChannelOpen(models.CommandChannel) {
+			var command models.Command
+			json.Unmarshal(newChannel.ExtraData(), &command)
+
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+
+			json.NewEncoder(channel).Encode(reply(command))
+			channel.Close()
+		}
+	}()
+
+	<-registered
+}
+
+func TestRunCommand(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	agent := models.Agent{Name: "commands", PubKey: "ssh-ed25519 AAAAcommands"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	agents := newConnectedAgents(models.NewDatabaseStore(db))
+
+	if _, err := agents.RunCommand(agent.ID, models.Command{Id: "1", Action: models.CommandRecheck}); err != ErrAgentNotConnected {
+		t.Fatal("Commands to disconnected agents should fail: ", err)
+	}
+
+	connectTestAgent(t, agents, agent.ID, func(command models.Command) models.CommandResult {
+		return models.CommandResult{Id: command.Id, OK: true, SystemInfo: &models.SystemInfo{CpuCores: 12, Platform: "command"}}
+	})
+
+	if _, err := agents.RunCommand(agent.ID, models.Command{Id: "2", Action: "shell"}); err != ErrUnknownCommand {
+		t.Fatal("Unknown commands should never be sent: ", err)
+	}
+
+	result, err := agents.RunCommand(agent.ID, models.Command{Id: "3", Action: models.CommandSystemInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.OK || result.Id != "3" {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+
+	var info models.SystemInfo
+	if err := db.First(&info, "agent_id = ?", agent.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if info.CpuCores != 12 || info.Platform != "command" {
+		t.Fatalf("Refreshed system info was not stored: %+v", info)
+	}
+}
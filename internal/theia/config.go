@@ -0,0 +1,72 @@
+package theia
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+// agentSession is theias end of an agents metrics channel, used to push messages to the agent
+type agentSession struct {
+	sync.Mutex
+
+	encoder *json.Encoder
+	version int
+}
+
+// Send writes a message to the agent
+func (s *agentSession) Send(messageType string, payload interface{}) error {
+	env, err := models.NewEnvelope(s.version, messageType, payload)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.encoder.Encode(env)
+}
+
+func (a *connectedAgents) attach(agentID int64, session *agentSession) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.sessions[agentID] = session
+}
+
+// detach forgets an agents metrics channel, unless the agent has already opened a new one
+func (a *connectedAgents) detach(agentID int64, session *agentSession) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.sessions[agentID] == session {
+		delete(a.sessions, agentID)
+	}
+}
+
+// PushConfig sends an agent the monitors currently defined for it, agents that arent connected are sent them when they next connect
+func (a *connectedAgents) PushConfig(agentID int64) error {
+	a.RLock()
+	session, ok := a.sessions[agentID]
+	a.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	definitions, err := a.store.GetMonitorDefinitions(agentID)
+	if err != nil {
+		return err
+	}
+
+	update, err := models.NewConfigUpdate(definitions)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Pushing config revision %d with %d monitors to agent %d", update.Revision, len(update.Monitors), agentID)
+
+	return session.Send(models.MessageConfig, update)
+}
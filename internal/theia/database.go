@@ -0,0 +1,254 @@
+package theia
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"    // Imports the mysql dialect for gorm to use
+	_ "github.com/jinzhu/gorm/dialects/postgres" // Imports the postgres dialect for gorm to use
+	_ "github.com/jinzhu/gorm/dialects/sqlite"   // Imports the sqlite dialect for gorm to use
+)
+
+// Supported database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+	DriverSQLite   = "sqlite3"
+)
+
+// mysqlTLSConfigName is what the TLS settings are registered with the mysql driver as
+const mysqlTLSConfigName = "theia"
+
+// DatabaseConfig says where theia keeps its data. The defaults match the postgres database theia has always used
+type DatabaseConfig struct {
+	Driver string `json:"driver"`
+
+	// DSN is passed to the driver as is, overriding all the settings below
+	DSN string `json:"dsn"`
+
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+
+	// Path is the sqlite database file
+	Path string `json:"path"`
+
+	// TLSMode is postgres' sslmode (disable, require, verify-ca or verify-full) or mysql's tls (false, true, skip-verify or preferred).
+	// With mysql, setting TLSCAPath or TLSCertPath verifies the server with that CA and presents the client certificate
+	TLSMode     string `json:"tls_mode"`
+	TLSCAPath   string `json:"tls_ca_path"`
+	TLSCertPath string `json:"tls_cert_path"`
+	TLSKeyPath  string `json:"tls_key_path"`
+}
+
+// DefaultDatabaseConfig is used for any settings missing from the config file
+func DefaultDatabaseConfig() DatabaseConfig {
+	return DatabaseConfig{
+		Driver:  DriverPostgres,
+		Host:    "localhost",
+		User:    "gorm",
+		Name:    "stats",
+		Path:    "theia.db",
+		TLSMode: "disable",
+	}
+}
+
+// ApplyEnvironment overrides the database settings with any THEIA_DB_ variables that are set, so credentials can be kept out of the config file.
+// PASSWORD is still honoured for the password, as it was the only setting theia used to take
+func (d *DatabaseConfig) ApplyEnvironment(lookup func(string) (string, bool)) {
+	if password, ok := lookup("PASSWORD"); ok {
+		d.Password = password
+	}
+
+	for name, setting := range map[string]*string{
+		"THEIA_DB_DRIVER":        &d.Driver,
+		"THEIA_DB_DSN":           &d.DSN,
+		"THEIA_DB_HOST":          &d.Host,
+		"THEIA_DB_PORT":          &d.Port,
+		"THEIA_DB_USER":          &d.User,
+		"THEIA_DB_PASSWORD":      &d.Password,
+		"THEIA_DB_NAME":          &d.Name,
+		"THEIA_DB_PATH":          &d.Path,
+		"THEIA_DB_TLS_MODE":      &d.TLSMode,
+		"THEIA_DB_TLS_CA_PATH":   &d.TLSCAPath,
+		"THEIA_DB_TLS_CERT_PATH": &d.TLSCertPath,
+		"THEIA_DB_TLS_KEY_PATH":  &d.TLSKeyPath,
+	} {
+		if value, ok := lookup(name); ok {
+			*setting = value
+		}
+	}
+}
+
+// Validate checks the settings make sense for the driver, without connecting
+func (d DatabaseConfig) Validate() error {
+	switch d.Driver {
+	case DriverPostgres, DriverMySQL:
+		if len(d.DSN) == 0 && len(d.Name) == 0 {
+			return errors.New("database name must be set")
+		}
+
+	case DriverSQLite:
+		if len(d.DSN) == 0 && len(d.Path) == 0 {
+			return errors.New("database path must be set for sqlite3")
+		}
+
+	default:
+		return fmt.Errorf("Unknown database driver %q, must be one of %s, %s or %s", d.Driver, DriverPostgres, DriverMySQL, DriverSQLite)
+	}
+
+	if (len(d.TLSCertPath) == 0) != (len(d.TLSKeyPath) == 0) {
+		return errors.New("database tls_cert_path and tls_key_path must be set together")
+	}
+
+	return nil
+}
+
+// dataSource builds the drivers DSN from the settings
+func (d DatabaseConfig) dataSource() (string, error) {
+	if len(d.DSN) > 0 {
+		return d.DSN, nil
+	}
+
+	switch d.Driver {
+	case DriverPostgres:
+		options := []string{
+			"host=" + quotePostgres(d.Host),
+			"user=" + quotePostgres(d.User),
+			"dbname=" + quotePostgres(d.Name),
+			"password=" + quotePostgres(d.Password),
+			"sslmode=" + quotePostgres(d.TLSMode),
+		}
+
+		optional := map[string]string{"port": d.Port, "sslrootcert": d.TLSCAPath, "sslcert": d.TLSCertPath, "sslkey": d.TLSKeyPath}
+		for _, name := range []string{"port", "sslrootcert", "sslcert", "sslkey"} {
+			if len(optional[name]) > 0 {
+				options = append(options, name+"="+quotePostgres(optional[name]))
+			}
+		}
+
+		return strings.Join(options, " "), nil
+
+	case DriverMySQL:
+		config := mysql.NewConfig()
+		config.User = d.User
+		config.Passwd = d.Password
+		config.DBName = d.Name
+		config.Net = "tcp"
+		config.Addr = d.Host
+		if len(d.Port) > 0 {
+			config.Addr = net.JoinHostPort(d.Host, d.Port)
+		}
+
+		// gorm needs times parsed, and utf8mb4 so agent and monitor names arent limited to 3 byte characters
+		config.ParseTime = true
+		config.Params = map[string]string{"charset": "utf8mb4"}
+
+		switch {
+		case len(d.TLSCAPath) > 0 || len(d.TLSCertPath) > 0:
+			tlsConfig, err := d.mysqlTLS()
+			if err != nil {
+				return "", err
+			}
+
+			if err := mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsConfig); err != nil {
+				return "", err
+			}
+			config.TLSConfig = mysqlTLSConfigName
+
+		case len(d.TLSMode) > 0 && d.TLSMode != "disable":
+			config.TLSConfig = d.TLSMode
+		}
+
+		return config.FormatDSN(), nil
+
+	case DriverSQLite:
+		return d.Path, nil
+	}
+
+	return "", fmt.Errorf("Unknown database driver %q", d.Driver)
+}
+
+func (d DatabaseConfig) mysqlTLS() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: d.Host, InsecureSkipVerify: d.TLSMode == "skip-verify"}
+
+	if len(d.TLSCAPath) > 0 {
+		caBytes, err := ioutil.ReadFile(d.TLSCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load database CA: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, errors.New("Database CA file does not contain any certificates")
+		}
+	}
+
+	if len(d.TLSCertPath) > 0 {
+		cert, err := tls.LoadX509KeyPair(d.TLSCertPath, d.TLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load database client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// quotePostgres quotes a value for a postgres key=value connection string
+func quotePostgres(value string) string {
+	if len(value) > 0 && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// OpenDatabase connects to the configured database
+func OpenDatabase(config DatabaseConfig) (*gorm.DB, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	dsn, err := config.dataSource()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open(config.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Driver == DriverSQLite {
+		// sqlite only allows one writer, sharing a single connection stops concurrent writes failing with "database is locked"
+		db.DB().SetMaxOpenConns(1)
+	}
+
+	return db, nil
+}
+
+// String describes where the database is for logging, without the password
+func (d DatabaseConfig) String() string {
+	switch {
+	case d.Driver == DriverSQLite && len(d.DSN) == 0:
+		return d.Path
+	case len(d.DSN) > 0:
+		if u, err := url.Parse(d.DSN); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return "(dsn)"
+	}
+
+	return fmt.Sprintf("%s@%s/%s", d.User, d.Host, d.Name)
+}
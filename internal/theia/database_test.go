@@ -0,0 +1,74 @@
+package theia
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+func TestDatabaseDataSource(t *testing.T) {
+	config := DefaultDatabaseConfig()
+
+	env := map[string]string{"PASSWORD": "legacy", "THEIA_DB_PASSWORD": "it's secret", "THEIA_DB_PORT": "5433", "THEIA_DB_TLS_MODE": "verify-full"}
+	config.ApplyEnvironment(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+
+	dsn, err := config.dataSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `host=localhost user=gorm dbname=stats password='it\'s secret' sslmode=verify-full port=5433`
+	if dsn != expected {
+		t.Fatalf("Postgres DSN was %q, expected %q", dsn, expected)
+	}
+
+	if strings.Contains(config.String(), "secret") {
+		t.Fatal("Password was included in the database description: ", config.String())
+	}
+
+	config.Driver = DriverMySQL
+	config.TLSMode = "true"
+	if dsn, err = config.dataSource(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(dsn, "gorm:it's secret@tcp(localhost:5433)/stats?") || !strings.Contains(dsn, "parseTime=true") || !strings.Contains(dsn, "tls=true") {
+		t.Fatal("Unexpected mysql DSN: ", dsn)
+	}
+
+	config.Driver = "oracle"
+	if _, err := OpenDatabase(config); err == nil {
+		t.Fatal("Unknown driver was accepted")
+	}
+}
+
+func TestOpenSQLiteDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "theia.db")
+
+	db, err := OpenDatabase(DatabaseConfig{Driver: DriverSQLite, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AutoMigrate(&models.Group{}).Create(&models.Group{Name: "sqlite"}).Error
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDatabase(DatabaseConfig{Driver: DriverSQLite, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var group models.Group
+	if err := db.First(&group, "name = ?", "sqlite").Error; err != nil {
+		t.Fatal("Data was not kept in the database file: ", err)
+	}
+}
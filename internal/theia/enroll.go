@@ -0,0 +1,57 @@
+package theia
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// enrollmentExtension marks a connection from an agent enrolling, it holds the public key the agent authenticated with
+const enrollmentExtension = "enroll-pubkey"
+
+// handleEnrollment registers the key an agent connected with if it presents a valid enrollment token.
+// The connection is only good for one attempt, a wrong token gets it closed
+func handleEnrollment(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, pubKey string, agents models.AgentStore) {
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != models.EnrollmentChannel {
+			newChannel.Reject(ssh.Prohibited, "Only enrollment is allowed before an agent is registered")
+			continue
+		}
+
+		var request models.EnrollmentRequest
+		if err := json.Unmarshal(newChannel.ExtraData(), &request); err != nil {
+			newChannel.Reject(ssh.Prohibited, "Malformed enrollment request")
+			return
+		}
+
+		agent, err := agents.RedeemEnrollmentToken(request.Token, pubKey, request.Name)
+		if err != nil {
+			log.Printf("Enrollment from [%s] with key [%s] failed: %s", conn.RemoteAddr(), pubKey, err)
+			newChannel.Reject(ssh.Prohibited, err.Error())
+			return
+		}
+
+		log.Printf("Agent %s version [%s] enrolled from [%s]", agentLabel(agent), request.ClientVersion, conn.RemoteAddr())
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Println("Could not accept enrollment channel: ", err)
+			return
+		}
+		go ssh.DiscardRequests(requests)
+
+		if err := json.NewEncoder(channel).Encode(models.EnrollmentResult{AgentName: agent.Name}); err != nil {
+			log.Println("Unable to send enrollment result: ", err)
+		}
+
+		channel.Close()
+
+		// Let the agent hang up once it has read the result
+		conn.Wait()
+		return
+	}
+}
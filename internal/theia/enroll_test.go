@@ -0,0 +1,86 @@
+package theia
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/internal/iris"
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/NHAS/StatsCollector/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEnrollment(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	store := models.NewDatabaseStore(db)
+
+	privateKeyPath := writeTestKey(t)
+	hostKey, err := ServerConfig{PrivateKeyPath: privateKeyPath}.hostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateGroup("enrolled"); err != nil {
+		t.Fatal(err)
+	}
+
+	var group models.Group
+	if err := db.First(&group, "name = ?", "enrolled").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, secret, err := store.CreateEnrollmentToken("", "admin", []int64{group.ID}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, stop := startTestServer(t, db, ServerConfig{PrivateKeyPath: privateKeyPath})
+	defer stop()
+
+	// Wait for the server to come up
+	dialTestServer(t, address, &ssh.ClientConfig{User: models.EnrollmentUser, Auth: []ssh.AuthMethod{ssh.PublicKeys(newTestSigner(t))}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}).Close()
+
+	dir := t.TempDir()
+
+	wrongServer := models.FormatEnrollmentToken(secret, strings.Repeat("0", 64))
+	if _, _, err := iris.Enroll(iris.ClientConfig{ServerAddress: address, PrivateKeyPath: filepath.Join(dir, "wrong")}, wrongServer, "host"); err == nil {
+		t.Fatal("Enrolled with a server whose host key didnt match the token")
+	}
+
+	token := models.FormatEnrollmentToken(secret, utils.HexFingerprintSHA256(hostKey.PublicKey()))
+
+	config, name, err := iris.Enroll(iris.ClientConfig{ServerAddress: address, PrivateKeyPath: filepath.Join(dir, "id_ecdsa"), UpdateIntervalSec: 60}, token, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "host" {
+		t.Fatal("Agent was not named after its host: ", name)
+	}
+
+	if config.AuthorisedKey != strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))) {
+		t.Fatal("Server host key was not pinned: ", config.AuthorisedKey)
+	}
+
+	var agent models.Agent
+	if err := db.Preload("Groups").First(&agent, "name = ?", "host").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agent.Groups) != 1 || agent.Groups[0].ID != group.ID {
+		t.Fatal("Agent was not put in the tokens groups: ", agent.Groups)
+	}
+
+	// The written config should now be good to connect as a normal agent
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := iris.Enroll(iris.ClientConfig{ServerAddress: address, PrivateKeyPath: filepath.Join(dir, "again")}, token, "again"); err == nil {
+		t.Fatal("Enrollment token was used twice")
+	}
+}
@@ -1,6 +1,7 @@
 package theia
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -11,125 +12,266 @@ import (
 	"time"
 
 	"github.com/NHAS/StatsCollector/models"
-	"github.com/jinzhu/gorm"
 )
 
 var ErrRatelimited = errors.New("Ratelimiting email send request")
 
-func sendEvent(db *gorm.DB, agentID int64, urgency int, title, message string) error {
-	t := time.Now()
+func sendEvent(events models.EventStore, agentID int64, urgency int, title, message string) error {
+	return sendEventSince(events, agentID, urgency, title, message, time.Now().Add(-2*time.Hour))
+}
 
-	cooldown := t.Add(-2 * time.Hour)
+//sendEventSince creates an event unless one with the same title has already been created for the agent after cooldown
+func sendEventSince(events models.EventStore, agentID int64, urgency int, title, message string, cooldown time.Time) error {
 
-	var num int64
-	if err := db.Model(&models.Event{}).Where("created_at > ? AND title = ? AND agent_id = ?", cooldown, title, agentID).Count(&num).Error; err != nil {
+	num, err := events.CountEventsSince(agentID, title, cooldown)
+	if err != nil {
 		return err
 	}
 
 	if num > 0 {
-		log.Println("Ratelimiting message as it has occured within 2 hours")
+		log.Println("Ratelimiting message as it has occured since ", cooldown.Format("Mon Jan 2 15:04"))
 		return ErrRatelimited
 	}
 
-	return db.Create(&models.Event{AgentId: agentID, Urgency: urgency, Title: title, Message: message}).Error
+	return events.AddEvent(models.Event{AgentId: agentID, Urgency: urgency, Title: title, Message: message})
 }
 
-func getAgentsWithIssues(db *gorm.DB) (agentsWithIssues []models.Agent, err error) {
-	timeout := time.Now().Add(-10 * time.Minute)
+//getAgentsWithIssues returns the alerting agents that have something wrong, including those that havent reported in 10 minutes
+func getAgentsWithIssues(agents models.AgentStore) ([]models.Agent, error) {
+	return agents.GetAgentsWithIssues(time.Now().Add(-10 * time.Minute))
+}
 
-	if err = db.Debug().Preload("Monitors").Preload("Disks").Preload("AlertProfile").
-		Select("DISTINCT agents.*").
-		Joins("INNER JOIN monitor_entries ON agents.id = monitor_entries.agent_id").
-		Joins("INNER JOIN disk_entries ON agents.id = disk_entries.agent_id").
-		Joins("INNER JOIN alerts ON agents.id = alerts.agent_id").
-		Find(&agentsWithIssues,
-			"alerts.active AND (agents.last_transmission < ? OR disk_entries.usage > alerts.disk_util OR NOT monitor_entries.ok)", timeout).
-		Error; err != nil {
+//getExpiringCertificates returns the monitors of alerting agents whose certificate expires within the given number of days
+func getExpiringCertificates(agents models.AgentStore, days int) ([]models.MonitorEntry, error) {
+	return agents.GetExpiringCertificates(time.Now().Add(time.Duration(days) * 24 * time.Hour))
+}
 
-		return agentsWithIssues, err
+//certificateWarningThreshold returns the smallest configured threshold that the certificate has crossed
+func certificateWarningThreshold(expiry time.Time, thresholds []int) (threshold int, crossed bool) {
+	daysLeft := time.Until(expiry).Hours() / 24
+
+	for _, t := range thresholds {
+		if daysLeft <= float64(t) && (!crossed || t < threshold) {
+			threshold = t
+			crossed = true
+		}
 	}
 
-	return agentsWithIssues, nil
+	return threshold, crossed
 }
 
-func eventGenerator(db *gorm.DB) {
-	time.Sleep(1 * time.Minute) // Wait for things to connect before just saying theyre dead
-	for {
+func certificateEvents(store models.Store, thresholds []int) {
+	largest := 0
+	for _, t := range thresholds {
+		if t > largest {
+			largest = t
+		}
+	}
 
-		agentsWithIssues, err := getAgentsWithIssues(db)
+	if largest == 0 {
+		return
+	}
+
+	expiring, err := getExpiringCertificates(store, largest)
+	if err != nil {
+		log.Println("Error getting expiring certificates: ", err)
+		return
+	}
+
+	for _, m := range expiring {
+
+		a, err := store.GetAgent(m.AgentId)
 		if err != nil {
-			log.Println("Error getting agents with issues: ", err)
+			log.Println("Unable to find agent for certificate warning: ", err)
+			continue
 		}
 
-		for _, a := range agentsWithIssues {
-			title := ""
+		name := "Agent"
+		if len(a.Name) > 0 {
+			name = a.Name
+		}
 
-			message := "Agent: " + a.PubKey + "\n"
-			if len(a.Name) > 0 {
-				message += "Friendly Name: " + a.Name + "\n"
-				title += a.Name + " "
-			} else {
-				title += "Agent "
-			}
-			if len(a.LastConnectionFrom) > 0 {
-				message += "Last Connection: " + a.LastConnectionFrom + "\n"
-			}
+		message := "Agent: " + agentLabel(a) + "\n"
+		message += "Endpoint: " + m.MonitorEntry.Path + "\n"
+		message += "Issuer: " + m.MonitorEntry.CertIssuer + "\n"
+		message += "Expires: " + m.MonitorEntry.CertExpiry.Format("Mon Jan 2 15:04 2006") + "\n"
+		if !m.MonitorEntry.CertSANMatch {
+			message += "Warning: Certificate does not match the endpoint host name\n"
+		}
 
-			message += "Last Transmission: " + a.LastTransmission.Format("Mon Jan 2 15:04") + "\n"
-			if !a.CurrentlyConnected {
-				title += " is offline"
+		var title string
+		var since time.Time
+		if time.Now().After(m.MonitorEntry.CertExpiry) {
+			title = name + " certificate for " + m.MonitorEntry.Path + " has expired"
+			since = m.MonitorEntry.CertExpiry
+		} else {
+			threshold, crossed := certificateWarningThreshold(m.MonitorEntry.CertExpiry, thresholds)
+			if !crossed {
+				continue
 			}
 
-			message += "\nEndpoint Status\n"
+			title = name + " certificate for " + m.MonitorEntry.Path + fmt.Sprintf(" expires within %d days", threshold)
+			// Only warn once per threshold for any given certificate
+			since = m.MonitorEntry.CertExpiry.Add(-time.Duration(threshold) * 24 * time.Hour)
+		}
 
-			endpointsDown := 0
-			for _, m := range a.Monitors {
+		if err := sendEventSince(store, a.ID, 1, title, message, since); err != nil && err != ErrRatelimited {
+			log.Println("Unable to send certificate event: ", err)
+		}
+	}
+}
 
-				message += "\t" + m.MonitorEntry.Path + "\n\tStatus: "
-				if !m.MonitorEntry.OK {
-					message += "Down. Reason: " + m.MonitorEntry.Reason + "\n"
-					endpointsDown++
-					continue
-				}
+//pruneHistory removes monitor and metric samples older than the retention period, a period of 0 keeps history forever
+func pruneHistory(metrics models.MetricStore, retentionDays int) error {
+	if retentionDays <= 0 {
+		return nil
+	}
 
-				message += "Up.\n"
+	return metrics.PruneHistory(time.Now().AddDate(0, 0, -retentionDays))
+}
 
-			}
+//purgeArchivedAgents deletes agents that have been archived for longer than the retention period, a period of 0 keeps them until they are deleted by hand
+func purgeArchivedAgents(agents models.AgentStore, retentionDays int) error {
+	if retentionDays <= 0 {
+		return nil
+	}
 
-			message += "\nDisks\n"
+	purged, err := agents.PurgeArchivedAgents(time.Now().AddDate(0, 0, -retentionDays))
+	for _, id := range purged {
+		log.Printf("Deleted agent %d, it was archived more than %d days ago", id, retentionDays)
+	}
 
-			disksAboveUsage := 0
-			for _, d := range a.Disks {
-				if int64(d.Usage) > a.AlertProfile.DiskUtil {
-					disksAboveUsage++
-				}
-				message += "\t" + d.Device + " Usage: " + fmt.Sprintf("%.02f", d.Usage) + "\n"
+	return err
+}
+
+//eventGeneratorDelay is how long agents get to connect after starting before the generator first runs
+var eventGeneratorDelay = 1 * time.Minute
+
+func eventGenerator(ctx context.Context, store models.Store, server *Server) {
+	// Wait for things to connect before just saying theyre dead
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(eventGeneratorDelay):
+	}
+
+	for {
+		// Read every time around so reloaded settings are picked up
+		if err := generateEvents(store, server.Config()); err != nil {
+			log.Println("Unable to send event, dying: ", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Minute):
+		}
+	}
+}
+
+//generateEvents raises events for expiring certificates and agents with issues, and prunes old history and archived agents
+func generateEvents(store models.Store, config ServerConfig) error {
+	certificateEvents(store, config.CertWarningDays)
+
+	if err := pruneHistory(store, config.HistoryRetentionDays); err != nil {
+		log.Println("Unable to prune history: ", err)
+	}
+
+	if err := purgeArchivedAgents(store, config.ArchiveRetentionDays); err != nil {
+		log.Println("Unable to purge archived agents: ", err)
+	}
+
+	agentsWithIssues, err := getAgentsWithIssues(store)
+	if err != nil {
+		log.Println("Error getting agents with issues: ", err)
+	}
+
+	for _, a := range agentsWithIssues {
+		title := ""
+
+		message := "Agent: " + agentLabel(a) + "\n"
+		if len(a.Name) > 0 {
+			title += a.Name + " "
+		} else {
+			title += "Agent "
+		}
+		if len(a.LastConnectionFrom) > 0 {
+			message += "Last Connection: " + a.LastConnectionFrom + "\n"
+		}
+
+		message += "Last Transmission: " + a.LastTransmission.Format("Mon Jan 2 15:04") + "\n"
+		if !a.CurrentlyConnected {
+			title += " is offline"
+		}
+
+		message += "\nEndpoint Status\n"
+
+		endpointsDown := 0
+		endpointsSlow := 0
+		for _, m := range a.Monitors {
+
+			message += "\t" + m.MonitorEntry.Path + "\n\tStatus: "
+			if !m.MonitorEntry.OK {
+				message += "Down. Reason: " + m.MonitorEntry.Reason + "\n"
+				endpointsDown++
+				continue
 			}
 
-			if a.CurrentlyConnected {
-				title += "has " + fmt.Sprintf("%d endpoints down, %d disks over usage", endpointsDown, disksAboveUsage)
+			if a.AlertProfile.LatencyMs > 0 && int64(m.MonitorEntry.TotalMs) > a.AlertProfile.LatencyMs {
+				message += fmt.Sprintf("Up, but slow. Took %.0fms (threshold %dms)\n", m.MonitorEntry.TotalMs, a.AlertProfile.LatencyMs)
+				endpointsSlow++
+				continue
 			}
 
-			if err := sendEvent(db, a.ID, 1, title, message); err != nil {
-				log.Println("Unable to send event, dying: ", err)
-				return
+			message += "Up.\n"
+
+		}
+
+		message += "\nDisks\n"
+
+		disksAboveUsage := 0
+		for _, d := range a.Disks {
+			if int64(d.Usage) > a.AlertProfile.DiskUtil {
+				disksAboveUsage++
 			}
+			message += "\t" + d.Device + " Usage: " + fmt.Sprintf("%.02f", d.Usage) + "\n"
+		}
 
+		if a.CurrentlyConnected {
+			title += "has " + fmt.Sprintf("%d endpoints down, %d disks over usage", endpointsDown, disksAboveUsage)
+			if endpointsSlow > 0 {
+				title += fmt.Sprintf(", %d endpoints slow", endpointsSlow)
+			}
+		}
+
+		// The issue is still going on, it has just been reported recently
+		if err := sendEvent(store, a.ID, 1, title, message); err != nil && err != ErrRatelimited {
+			return err
 		}
-		time.Sleep(5 * time.Minute)
 	}
+
+	return nil
 }
 
-func startEventProcessors(db *gorm.DB) {
+//startEventProcessors emails out events until ctx is cancelled, a batch of emails already being sent is finished first.
+//It waits for notification settings to be configured before sending anything
+func startEventProcessors(ctx context.Context, store models.Store) {
 	var notification models.NotificationDetail
 	for {
 
-		err := db.First(&notification).Error
+		var err error
+		notification, err = store.GetNotificationSettings()
 		if err == nil {
 			break
 		}
 		log.Println("Unable to find details of how to notify:", err)
-		time.Sleep(30 * time.Second)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
 	}
 
 	host, _, _ := net.SplitHostPort(notification.EmailProviderHost)
@@ -139,12 +281,9 @@ func startEventProcessors(db *gorm.DB) {
 	from := mail.Address{Name: "", Address: notification.SendAddress}
 	to := mail.Address{Name: "", Address: notification.Destination}
 
-	go eventGenerator(db)
-
 	for {
 
-		var events []models.Event
-		if err := db.Find(&events, "notified = false AND urgency < 2").Error; err == nil && len(events) > 0 {
+		if events, err := store.GetUnnotifiedEvents(1); err == nil && len(events) > 0 {
 
 			// Here is the key, you need to call tls.Dial instead of smtp.Dial
 			// for smtp servers running on 465 that require an ssl connection
@@ -205,7 +344,7 @@ func startEventProcessors(db *gorm.DB) {
 					log.Fatalln(err)
 				}
 
-				if err := db.Model(&e).Update("notified", true).Error; err != nil {
+				if err := store.SetEventNotified(e.Id); err != nil {
 					log.Fatal("Going to send too many emails if this fails. So die: ", err)
 				}
 
@@ -217,6 +356,10 @@ func startEventProcessors(db *gorm.DB) {
 			log.Println("Disconnecting")
 		}
 
-		<-time.After(5 * time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Minute):
+		}
 	}
 }
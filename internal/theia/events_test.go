@@ -1,16 +1,19 @@
 package theia
 
 import (
+	"fmt"
 	"log"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/NHAS/StatsCollector/models"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"golang.org/x/crypto/ssh"
 )
 
 func setupDatabase() *gorm.DB {
-	db, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
+	db, err := OpenDatabase(DatabaseConfig{Driver: DriverSQLite, Path: "file::memory:?cache=shared"})
 	if err != nil {
 		log.Println(err)
 	}
@@ -24,7 +27,7 @@ func TestUnratelimitedSendEvent(t *testing.T) {
 
 	title := "test 1 title"
 
-	if err := sendEvent(db, -1, 10, title, "message"); err != nil {
+	if err := sendEvent(models.NewDatabaseStore(db), -1, 10, title, "message"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -42,17 +45,19 @@ func TestUniqueEventsUnratelimitedSendEvent(t *testing.T) {
 	db := setupDatabase()
 	defer db.Close()
 
+	store := models.NewDatabaseStore(db)
+
 	title := "test 1 title"
 
-	if err := sendEvent(db, -1, 10, title, "message"); err != nil {
+	if err := sendEvent(store, -1, 10, title, "message"); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := sendEvent(db, -1, 10, title+"2", "message"); err != nil {
+	if err := sendEvent(store, -1, 10, title+"2", "message"); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := sendEvent(db, -1, 10, title+"3", "message"); err != nil {
+	if err := sendEvent(store, -1, 10, title+"3", "message"); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -61,13 +66,15 @@ func TestRatelimitedSendEvent(t *testing.T) {
 	db := setupDatabase()
 	defer db.Close()
 
+	store := models.NewDatabaseStore(db)
+
 	title := "test 1 title"
 
-	if err := sendEvent(db, -1, 10, title, "message"); err != nil {
+	if err := sendEvent(store, -1, 10, title, "message"); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := sendEvent(db, -1, 10, title, "message"); err != ErrRatelimited {
+	if err := sendEvent(store, -1, 10, title, "message"); err != ErrRatelimited {
 		t.Fatal("Request wasnt ratelimited")
 	}
 }
@@ -76,7 +83,7 @@ func TestGetAgentsWithIssuesEmpty(t *testing.T) {
 	db := setupDatabase()
 	defer db.Close()
 
-	agents, err := getAgentsWithIssues(db)
+	agents, err := getAgentsWithIssues(models.NewDatabaseStore(db))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,3 +92,217 @@ func TestGetAgentsWithIssuesEmpty(t *testing.T) {
 		t.Fatal("Cant be finding agents if there are no agents present")
 	}
 }
+
+func TestCertificateWarningThreshold(t *testing.T) {
+	thresholds := []int{30, 14, 3}
+
+	if _, crossed := certificateWarningThreshold(time.Now().Add(60*24*time.Hour), thresholds); crossed {
+		t.Fatal("Certificate with 60 days left should not have crossed any threshold")
+	}
+
+	threshold, crossed := certificateWarningThreshold(time.Now().Add(10*24*time.Hour), thresholds)
+	if !crossed || threshold != 14 {
+		t.Fatal("Certificate with 10 days left should have crossed the 14 day threshold, got: ", threshold)
+	}
+
+	threshold, crossed = certificateWarningThreshold(time.Now().Add(24*time.Hour), thresholds)
+	if !crossed || threshold != 3 {
+		t.Fatal("Certificate with 1 day left should have crossed the 3 day threshold, got: ", threshold)
+	}
+}
+
+func TestCertificateEventsOncePerThreshold(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	store := models.NewDatabaseStore(db)
+
+	agent := models.Agent{Name: "certs", PubKey: "ssh-ed25519 AAAAcerts"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&models.Alert{AgentId: agent.ID, Active: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&models.MonitorEntry{AgentId: agent.ID, MonitorEntry: models.MonitorStatus{
+		Path:       "tls://certs.example.com:443",
+		OK:         true,
+		CertExpiry: time.Now().Add(10 * 24 * time.Hour),
+	}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	certificateEvents(store, []int{30, 14, 3})
+	certificateEvents(store, []int{30, 14, 3})
+
+	var events []models.Event
+	if err := db.Find(&events, "agent_id = ?", agent.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 {
+		t.Fatal("Expected exactly one certificate warning event, got: ", len(events))
+	}
+
+	if !strings.Contains(events[0].Message, fmt.Sprintf(`Agent: "certs" (agent %d)`, agent.ID)) || strings.Contains(events[0].Message, agent.PubKey) {
+		t.Fatal("Event should identify the agent by name and ID: ", events[0].Message)
+	}
+}
+
+func TestGetAgentsWithIssuesSlowEndpoint(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	store := models.NewDatabaseStore(db)
+
+	agent := models.Agent{Name: "slow", PubKey: "ssh-ed25519 AAAAslow", LastTransmission: time.Now()}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&models.Alert{AgentId: agent.ID, Active: true, DiskUtil: 90, LatencyMs: 100}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&models.DiskEntry{AgentId: agent.ID, Device: "/dev/slow", Usage: 10}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&models.MonitorEntry{AgentId: agent.ID, MonitorEntry: models.MonitorStatus{Path: "https://slow.example.com", OK: true, TotalMs: 50}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := getAgentsWithIssues(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agents) != 0 {
+		t.Fatal("Endpoint within latency threshold should not be an issue")
+	}
+
+	if err := db.Model(&models.MonitorEntry{}).Where("agent_id = ?", agent.ID).Update("total_ms", 500).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err = getAgentsWithIssues(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agents) != 1 {
+		t.Fatal("Endpoint over latency threshold should be an issue")
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	if err := db.Create(&models.MonitorSample{AgentId: 1, Path: "old", CreatedAt: time.Now().AddDate(0, 0, -40)}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&models.MonitorSample{AgentId: 1, Path: "new"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneHistory(models.NewDatabaseStore(db), 30); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []models.MonitorSample
+	if err := db.Find(&remaining).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(remaining) != 1 || remaining[0].Path != "new" {
+		t.Fatal("Only history older than the retention period should be pruned")
+	}
+}
+
+func TestIngestBackdatedStats(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	agent := models.Agent{Name: "buffered", PubKey: "ssh-ed25519 AAAAbuffered"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	takenAt := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	ingestStats(models.NewDatabaseStore(db), agent, models.Stats{MemoryUsage: 40, DiskUsage: map[string]float32{"/dev/buffered": 70}, Timestamp: takenAt})
+
+	var samples []models.MetricSample
+	if err := db.Find(&samples, "agent_id = ?", agent.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 2 {
+		t.Fatal("Expected a memory and a disk sample: ", len(samples))
+	}
+
+	for _, sample := range samples {
+		if !sample.CreatedAt.Equal(takenAt) {
+			t.Fatal("Buffered sample was not stored at the time it was taken: ", sample.CreatedAt, takenAt)
+		}
+	}
+
+	var updated models.Agent
+	if err := db.First(&updated, agent.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(updated.LastTransmission) > time.Minute {
+		t.Fatal("Replayed stats should still count as a transmission")
+	}
+}
+
+func TestGenerateEventsOncePerIssue(t *testing.T) {
+	store := models.NewMemoryStore()
+
+	pubKey := string(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey()))
+	if _, err := store.CreateAgent("memory", pubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agentID := agents[0].ID
+
+	if err := store.SetAlertProfile(agentID, 50, 0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.IngestStats(agentID, models.Stats{
+		DiskUsage:     map[string]float32{"/dev/full": 95},
+		MonitorValues: []models.MonitorStatus{{Path: "https://example.com", OK: true, CheckedAt: time.Now()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second run is rate limited, which should not stop the generator
+	for i := 0; i < 2; i++ {
+		if err := generateEvents(store, ServerConfig{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := store.GetUnnotifiedEvents(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].AgentId != agentID {
+		t.Fatal("Expected one event for the full disk: ", events)
+	}
+
+	if !strings.Contains(events[0].Message, fmt.Sprintf(`Agent: "memory" (agent %d)`, agentID)) || strings.Contains(events[0].Message, strings.TrimSpace(pubKey)) {
+		t.Fatal("Event should identify the agent by name and ID: ", events[0].Message)
+	}
+}
@@ -0,0 +1,286 @@
+package theia
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The OpenSSH key revocation list format, as produced by ssh-keygen -k. See PROTOCOL.krl in the OpenSSH source
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+type serialRange struct {
+	min, max uint64
+}
+
+// revokedCertificates are the certificates revoked for one CA, or for any CA if ca is empty
+type revokedCertificates struct {
+	ca []byte
+
+	serials map[uint64]bool
+	ranges  []serialRange
+	keyIDs  map[string]bool
+}
+
+func (r *revokedCertificates) revoked(cert *ssh.Certificate) bool {
+	if len(r.ca) > 0 && !bytes.Equal(r.ca, cert.SignatureKey.Marshal()) {
+		return false
+	}
+
+	if r.serials[cert.Serial] || r.keyIDs[cert.KeyId] {
+		return true
+	}
+
+	for _, sr := range r.ranges {
+		if cert.Serial >= sr.min && cert.Serial <= sr.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// revocationList is a parsed KRL
+type revocationList struct {
+	certificates []*revokedCertificates
+
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+}
+
+func (krl *revocationList) keyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+
+	sha1sum := sha1.Sum(blob)
+	sha256sum := sha256.Sum256(blob)
+
+	return krl.keys[string(blob)] || krl.sha1[string(sha1sum[:])] || krl.sha256[string(sha256sum[:])]
+}
+
+// IsRevoked checks a certificate against the list. It is revoked if it is listed itself, or either its key or the CA that signed it is
+func (krl *revocationList) IsRevoked(cert *ssh.Certificate) bool {
+	if krl.keyRevoked(cert.Key) || krl.keyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	for _, r := range krl.certificates {
+		if r.revoked(cert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// krlReader reads the ssh wire encoding used throughout the KRL
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+var errKRLTruncated = errors.New("KRL is truncated")
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(r.data) < n {
+		r.err = errKRLTruncated
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *krlReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *krlReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *krlReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *krlReader) string() []byte {
+	length := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+
+	if uint64(length) > uint64(len(r.data)) {
+		r.err = errKRLTruncated
+		return nil
+	}
+
+	return r.next(int(length))
+}
+
+// more is true while there is data left and nothing has gone wrong reading it
+func (r *krlReader) more() bool {
+	return r.err == nil && len(r.data) > 0
+}
+
+// parseKRL parses a binary OpenSSH KRL. Signatures on the list arent checked, the file is trusted in the same way the CA key is
+func parseKRL(data []byte) (*revocationList, error) {
+	if !bytes.HasPrefix(data, []byte(krlMagic)) {
+		return nil, errors.New("Not an OpenSSH KRL (bad magic)")
+	}
+
+	r := &krlReader{data: data[len(krlMagic):]}
+
+	if version := r.uint32(); r.err == nil && version != krlFormatVersion {
+		return nil, fmt.Errorf("Unsupported KRL format version %d", version)
+	}
+
+	r.uint64() // krl version
+	r.uint64() // generated date
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+
+	krl := &revocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+
+	for r.more() {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			certs, err := parseKRLCertificates(section)
+			if err != nil {
+				return nil, err
+			}
+			krl.certificates = append(krl.certificates, certs)
+
+		case krlSectionExplicitKey:
+			for section.more() {
+				krl.keys[string(section.string())] = true
+			}
+
+		case krlSectionFingerprintSHA1:
+			for section.more() {
+				krl.sha1[string(section.string())] = true
+			}
+
+		case krlSectionFingerprintSHA256:
+			for section.more() {
+				krl.sha256[string(section.string())] = true
+			}
+
+		case krlSectionSignature:
+			// Signatures come last, and cover everything before them
+			return krl, nil
+
+		default:
+			return nil, fmt.Errorf("Unknown KRL section type %d", sectionType)
+		}
+
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return krl, nil
+}
+
+func parseKRLCertificates(r *krlReader) (*revokedCertificates, error) {
+	certs := &revokedCertificates{
+		ca:      r.string(),
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+	r.string() // reserved
+
+	for r.more() {
+		subsectionType := r.byte()
+		subsection := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch subsectionType {
+		case krlCertSerialList:
+			for subsection.more() {
+				certs.serials[subsection.uint64()] = true
+			}
+
+		case krlCertSerialRange:
+			for subsection.more() {
+				certs.ranges = append(certs.ranges, serialRange{min: subsection.uint64(), max: subsection.uint64()})
+			}
+
+		case krlCertSerialBitmap:
+			offset := subsection.uint64()
+			bitmap := new(big.Int).SetBytes(subsection.string())
+			for i := 0; i < bitmap.BitLen(); i++ {
+				if bitmap.Bit(i) == 1 {
+					certs.serials[offset+uint64(i)] = true
+				}
+			}
+
+		case krlCertKeyID:
+			for subsection.more() {
+				certs.keyIDs[string(subsection.string())] = true
+			}
+
+		default:
+			return nil, fmt.Errorf("Unknown KRL certificate section type %d", subsectionType)
+		}
+
+		if subsection.err != nil {
+			return nil, subsection.err
+		}
+	}
+
+	return certs, r.err
+}
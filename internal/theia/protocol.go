@@ -0,0 +1,173 @@
+package theia
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+//negotiateVersion picks the protocol version for a new metrics channel from the hello in its extra data.
+//Agents that send no hello predate protocol versioning and are spoken to with version 0
+func negotiateVersion(extraData []byte) (int, models.Hello, error) {
+	var hello models.Hello
+	if len(extraData) == 0 {
+		return 0, hello, nil
+	}
+
+	if err := json.Unmarshal(extraData, &hello); err != nil {
+		return 0, hello, err
+	}
+
+	version, err := models.NegotiateVersion(hello)
+	return version, hello, err
+}
+
+//agentLabel identifies an agent in logs and events by its name and ID.
+//Its public key isnt used, as that changes when the key is rotated and is only a placeholder for agents using certificates
+func agentLabel(a models.Agent) string {
+	if len(a.Name) == 0 {
+		return fmt.Sprintf("agent %d", a.ID)
+	}
+	return fmt.Sprintf("%q (agent %d)", a.Name, a.ID)
+}
+
+//serveChannel replies to the agents hello, sends it its config, then handles its stream of envelopes until the channel closes, returning what closed it
+func serveChannel(channel ssh.Channel, version int, clientAgent models.Agent, store models.Store, agents *connectedAgents) error {
+	defer channel.Close()
+	defer markDisconnected(store, clientAgent)
+
+	hello := models.NewHello("")
+	hello.Version = version
+
+	session := &agentSession{encoder: json.NewEncoder(channel), version: version}
+	if err := session.Send(models.MessageHello, hello); err != nil {
+		log.Printf("Client [%s] unable to send hello: %s", agentLabel(clientAgent), err)
+		return err
+	}
+
+	if agents != nil {
+		agents.attach(clientAgent.ID, session)
+		defer agents.detach(clientAgent.ID, session)
+
+		go func() {
+			if err := agents.PushConfig(clientAgent.ID); err != nil {
+				log.Printf("Client [%s] unable to send config: %s", agentLabel(clientAgent), err)
+			}
+		}()
+	}
+
+	decoder := json.NewDecoder(channel)
+	for {
+		var env models.Envelope
+		if err := decoder.Decode(&env); err != nil {
+			// The decoder has still consumed the whole message, so the stream is intact
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				log.Printf("Client [%s] sent an envelope I couldnt decode, skipping: %s", agentLabel(clientAgent), err)
+				continue
+			}
+
+			log.Printf("Client [%s] channel closed: %s", agentLabel(clientAgent), err)
+			return err
+		}
+
+		handleEnvelope(env, clientAgent, store)
+	}
+}
+
+func handleEnvelope(env models.Envelope, clientAgent models.Agent, store models.Store) {
+	switch env.Type {
+	case models.MessageStats:
+		var stat models.Stats
+		if err := env.Decode(&stat); err != nil {
+			log.Printf("Client [%s] sent stats I couldnt decode, skipping: %s", agentLabel(clientAgent), err)
+			return
+		}
+
+		ingestStats(store, clientAgent, stat)
+
+	case models.MessageSystemInfo:
+		if err := storeSystemAttributes(store, clientAgent.ID, env.Payload); err != nil {
+			log.Printf("Client [%s] sent system info I couldnt decode, skipping: %s", agentLabel(clientAgent), err)
+		}
+
+	case models.MessageEvent:
+		var event models.AgentEvent
+		if err := env.Decode(&event); err != nil {
+			log.Printf("Client [%s] sent an event I couldnt decode, skipping: %s", agentLabel(clientAgent), err)
+			return
+		}
+
+		if err := sendEvent(store, clientAgent.ID, event.Urgency, event.Title, event.Message); err != nil && err != ErrRatelimited {
+			log.Println("Unable to store agent event: ", err)
+		}
+
+	case models.MessageConfigAck:
+		var ack models.ConfigAck
+		if err := env.Decode(&ack); err != nil {
+			log.Printf("Client [%s] sent a config acknowledgement I couldnt decode, skipping: %s", agentLabel(clientAgent), err)
+			return
+		}
+
+		if !ack.OK {
+			log.Printf("Client [%s] refused config revision %d: %s", agentLabel(clientAgent), ack.Revision, ack.Error)
+		}
+
+		if err := store.SetAgentConfigStatus(clientAgent.ID, ack.Revision, ack.Error); err != nil {
+			log.Println("Unable to store config acknowledgement: ", err)
+		}
+
+		// Otherwise the last status of a removed monitor would stay on the agent page and keep being alerted on
+		if ack.OK && ack.Monitors != nil {
+			if err := store.RemoveStaleMonitors(clientAgent.ID, ack.Monitors); err != nil {
+				log.Println("Unable to remove monitors the agent no longer runs: ", err)
+			}
+		}
+
+	default:
+		log.Printf("Client [%s] sent unknown message type %q (protocol version %d), skipping", agentLabel(clientAgent), env.Type, env.Version)
+	}
+}
+
+//serveLegacyChannel handles agents that predate protocol versioning, which send a bare stream of stats
+//and their system information as "system" requests. It returns what closed the channel
+func serveLegacyChannel(channel ssh.Channel, requests <-chan *ssh.Request, clientAgent models.Agent, store models.Store) error {
+
+	go func(in <-chan *ssh.Request) {
+		for req := range in {
+			switch req.Type {
+			case "system":
+				if err := storeSystemAttributes(store, clientAgent.ID, req.Payload); err != nil {
+					log.Printf("Client [%s] sent something I couldnt decode, killing", agentLabel(clientAgent))
+					channel.Close()
+					return
+				}
+			default:
+				log.Println("Client sent something... but what...: ", req.Type)
+			}
+		}
+	}(requests)
+
+	defer channel.Close()
+	decoder := json.NewDecoder(channel)
+
+	for {
+		var stat models.Stats
+		err := decoder.Decode(&stat)
+		if err != nil {
+			log.Printf("Client [%s] sent something I couldnt decode, killing", agentLabel(clientAgent))
+			markDisconnected(store, clientAgent)
+			return err
+		}
+
+		ingestStats(store, clientAgent, stat)
+	}
+}
+
+func markDisconnected(agents models.AgentStore, clientAgent models.Agent) {
+	if err := agents.SetAgentConnected(clientAgent.ID, false); err != nil {
+		log.Println("Unsetting currently connected failed: ", err)
+	}
+}
@@ -0,0 +1,255 @@
+package theia
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// openTestChannel connects a client over loopback to a server that serves metrics channels with serveChannel
+func openTestChannel(t *testing.T, agent models.Agent, extraData []byte) (ssh.Channel, error) {
+	db := setupDatabase()
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(newTestSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, chans, reqs, err := ssh.NewServerConn(serverConn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		for newChannel := range chans {
+			version, _, err := negotiateVersion(newChannel.ExtraData())
+			if err != nil {
+				newChannel.Reject(ssh.Prohibited, err.Error())
+				continue
+			}
+
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go serveChannel(channel, version, agent, models.NewDatabaseStore(db), nil)
+		}
+	}()
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	channel, requests, err := conn.OpenChannel("metrics", extraData)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(requests)
+
+	return channel, nil
+}
+
+func TestProtocolRoundTrip(t *testing.T) {
+	agent := models.Agent{Name: "protocol", PubKey: "ssh-ed25519 AAAAprotocol"}
+
+	hello, _ := json.Marshal(models.NewHello("test"))
+
+	channel, err := openTestChannel(t, agent, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply models.Envelope
+	if err := json.NewDecoder(channel).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+
+	var serverHello models.Hello
+	if err := reply.Decode(&serverHello); err != nil || reply.Type != models.MessageHello || serverHello.Version != models.ProtocolVersion {
+		t.Fatalf("Unexpected hello from server: %+v %+v %v", reply, serverHello, err)
+	}
+
+	encoder := json.NewEncoder(channel)
+	send := func(messageType string, payload interface{}) {
+		env, err := models.NewEnvelope(serverHello.Version, messageType, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := encoder.Encode(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither of these should end the session
+	send("from_the_future", map[string]string{"hello": "there"})
+	send(models.MessageStats, "not stats")
+
+	send(models.MessageStats, models.Stats{MemoryUsage: 12, DiskUsage: map[string]float32{"/dev/protocol": 50}})
+
+	db := setupDatabase()
+	defer db.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var disk models.DiskEntry
+		if err := db.First(&disk, "device = ?", "/dev/protocol").Error; err == nil {
+			if disk.Usage != 50 {
+				t.Fatal("Disk usage not stored correctly: ", disk.Usage)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Stats sent after unknown and malformed messages were not ingested")
+}
+
+func TestProtocolRejectsUnsupportedVersion(t *testing.T) {
+	agent := models.Agent{Name: "future", PubKey: "ssh-ed25519 AAAAfuture"}
+
+	hello, _ := json.Marshal(models.Hello{MinVersion: models.ProtocolVersion + 1, MaxVersion: models.ProtocolVersion + 1})
+
+	if _, err := openTestChannel(t, agent, hello); err == nil {
+		t.Fatal("Channel with no common protocol version should be rejected")
+	}
+}
+
+func TestProtocolPushesConfig(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	store := models.NewDatabaseStore(db)
+
+	agent := models.Agent{Name: "configured", PubKey: "ssh-ed25519 AAAAconfigured"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateMonitorDefinition(agent.ID, 0, "https://example.com", "example", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// State left over from a monitor that has since been removed
+	if err := store.IngestStats(agent.ID, models.Stats{MonitorValues: []models.MonitorStatus{{Path: "https://removed.example.com", CheckedAt: time.Now()}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	agents := newConnectedAgents(store)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(newTestSigner(t))
+
+	go func() {
+		nConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, chans, reqs, err := ssh.NewServerConn(nConn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		for newChannel := range chans {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go serveChannel(channel, models.ProtocolVersion, agent, store, agents)
+		}
+	}()
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hello, _ := json.Marshal(models.NewHello("test"))
+	channel, requests, err := conn.OpenChannel("metrics", hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	decoder := json.NewDecoder(channel)
+
+	var env models.Envelope
+	if err := decoder.Decode(&env); err != nil || env.Type != models.MessageHello {
+		t.Fatal("Expected hello: ", env.Type, err)
+	}
+
+	if err := decoder.Decode(&env); err != nil || env.Type != models.MessageConfig {
+		t.Fatal("Expected config to be pushed on connect: ", env.Type, err)
+	}
+
+	var update models.ConfigUpdate
+	if err := env.Decode(&update); err != nil || len(update.Monitors) != 1 {
+		t.Fatalf("Unexpected config: %+v %v", update, err)
+	}
+
+	ack, _ := models.NewEnvelope(models.ProtocolVersion, models.MessageConfigAck, models.ConfigAck{Revision: update.Revision, OK: true, Monitors: []string{"https://example.com"}})
+	if err := json.NewEncoder(channel).Encode(ack); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var stored models.Agent
+		var stale int
+		db.Model(&models.MonitorEntry{}).Where("agent_id = ?", agent.ID).Count(&stale)
+		if err := db.First(&stored, agent.ID).Error; err == nil && stored.ConfigRevision == update.Revision && stale == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Config acknowledgement was not stored or the removed monitor was kept")
+}
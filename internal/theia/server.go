@@ -1,77 +1,264 @@
 package theia
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/NHAS/StatsCollector/internal/theia/webservice"
 	"github.com/NHAS/StatsCollector/models"
-	"github.com/NHAS/StatsCollector/utils"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres" // Imports the postgres dialect for gorm to use
-
 	"golang.org/x/crypto/ssh"
 )
 
+// agentKeyExtension records which of an agents keys it authenticated with
+const agentKeyExtension = "agent-key-id"
+
 // ServerConfig is the structure containing the various listening addresses and the private key
 type ServerConfig struct {
 	CollectionListenAddr string `json:"ssh_listen_addr"`
 	WebListenAddr        string `json:"web_interface_addr"`
 	PrivateKeyPath       string `json:"private_key_path"`
 	WebResourcesPath     string `json:"web_path"`
+
+	// CertWarningDays are the number of days before a monitored certificate expires that a warning event is raised
+	CertWarningDays []int `json:"cert_warning_days"`
+
+	// HistoryRetentionDays is how long monitor response time, memory and disk history is kept
+	HistoryRetentionDays int `json:"history_retention_days"`
+
+	// ArchiveRetentionDays is how long an archived agent and its history are kept before it is deleted, 0 keeps them until deleted by hand
+	ArchiveRetentionDays int `json:"archive_retention_days"`
+
+	// LogPath overrides the -log flag, changing it and reloading moves the log
+	LogPath string `json:"log_path"`
+
+	// AgentCAPath is an authorized_keys style file of ssh user CA keys. Agents presenting a certificate from one of them, for a principal
+	// matching one of the AgentCAPrincipals patterns, are registered automatically. AgentCAKRLPath is an optional OpenSSH key revocation list
+	AgentCAPath       string   `json:"agent_ca_path"`
+	AgentCAPrincipals []string `json:"agent_ca_principals"`
+	AgentCAKRLPath    string   `json:"agent_ca_krl_path"`
+
+	// Database is opened by OpenDatabase before the server is created, so it is only read at startup
+	Database DatabaseConfig `json:"database"`
+}
+
+// Validate checks the config is usable, including that the private key can be loaded
+func (config ServerConfig) Validate() error {
+	if len(config.CollectionListenAddr) == 0 {
+		return errors.New("ssh_listen_addr must be set")
+	}
+
+	if len(config.WebListenAddr) == 0 {
+		return errors.New("web_interface_addr must be set")
+	}
+
+	if _, err := config.hostKey(); err != nil {
+		return err
+	}
+
+	for _, days := range config.CertWarningDays {
+		if days < 1 {
+			return fmt.Errorf("cert_warning_days must all be at least 1, got %d", days)
+		}
+	}
+
+	if config.HistoryRetentionDays < 0 {
+		return errors.New("history_retention_days cannot be negative")
+	}
+
+	if config.ArchiveRetentionDays < 0 {
+		return errors.New("archive_retention_days cannot be negative")
+	}
+
+	if _, err := loadAgentCA(config); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (config ServerConfig) hostKey() (ssh.Signer, error) {
+	privateBytes, err := ioutil.ReadFile(config.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load private key: %w", err)
+	}
+
+	private, err := ssh.ParsePrivateKey(privateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key: %w", err)
+	}
+
+	return private, nil
+}
+
+// Server is a running theia instance, its config can be reloaded while it runs
+type Server struct {
+	sync.Mutex
+
+	db     *gorm.DB
+	config ServerConfig
+	ca     *agentCA
+}
+
+// NewServer checks the config, nothing is started until Run is called
+func NewServer(db *gorm.DB, config ServerConfig) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	ca, err := loadAgentCA(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{db: db, config: config, ca: ca}, nil
+}
+
+// Config returns the settings currently in use
+func (s *Server) Config() ServerConfig {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.config
+}
+
+// Reload applies a new config without dropping agent connections. An invalid config is refused and the current one kept.
+// The listening addresses, private key and web resources are only read on start, so changes to them are ignored until a restart
+func (s *Server) Reload(config ServerConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	ca, err := loadAgentCA(config)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	previous := s.config
+	if previous.CollectionListenAddr != config.CollectionListenAddr || previous.WebListenAddr != config.WebListenAddr ||
+		previous.PrivateKeyPath != config.PrivateKeyPath || previous.WebResourcesPath != config.WebResourcesPath {
+		log.Println("Changes to ssh_listen_addr, web_interface_addr, private_key_path and web_path only take effect after a restart")
+
+		config.CollectionListenAddr = previous.CollectionListenAddr
+		config.WebListenAddr = previous.WebListenAddr
+		config.PrivateKeyPath = previous.PrivateKeyPath
+		config.WebResourcesPath = previous.WebResourcesPath
+	}
+
+	if previous.Database != config.Database {
+		log.Println("Changes to database only take effect after a restart")
+		config.Database = previous.Database
+	}
+
+	s.config = config
+	s.ca = ca
+
+	return nil
 }
 
-//RunServer starts the webserver, ssh server (collector) and the event database notifier
-func RunServer(db *gorm.DB, config ServerConfig) {
+func (s *Server) agentCA() *agentCA {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.ca
+}
+
+// How long shutdown waits for web requests and notification sends in progress to finish
+const shutdownTimeout = 30 * time.Second
+
+//Run starts the webserver, ssh server (collector) and the event database notifier.
+//Once ctx is cancelled it stops accepting agents, disconnects those connected and waits for work in progress before returning
+func (s *Server) Run(ctx context.Context) error {
 
 	log.Println("Starting in server mode")
 
-	models.InitaliseModels(db)
+	db := s.db
+	config := s.Config()
+
+	if err := models.InitaliseModels(db); err != nil {
+		return fmt.Errorf("Unable to migrate database: %w", err)
+	}
 
-	db.Model(&models.Agent{}).Update("currently_connected", false)
+	store := models.NewDatabaseStore(db)
+
+	if err := store.SetAllAgentsDisconnected(); err != nil {
+		log.Println("Unable to mark agents as offline: ", err)
+	}
+
+	if err := store.EndOpenConnections(); err != nil {
+		log.Println("Unable to close connections left open in the connection log: ", err)
+	}
 
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
 	serverConfig := &ssh.ServerConfig{
+		// Tells agents this server will reply to their hello
+		ServerVersion: models.SSHServerVersion,
+
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
 
 			receivedPubKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey)))
 
-			var authorisedKeys []string
-			if err := db.Debug().Find(&models.Agent{}, "pub_key LIKE ?", receivedPubKey+"%").Pluck("pub_key", &authorisedKeys).Error; err != nil && err != gorm.ErrRecordNotFound {
-				utils.Check("Unable to load public keys from database", err)
-			}
-
-			log.Printf("Client connected with: [%s] pubkey. Number agents matching that key: %d", string(receivedPubKey), len(authorisedKeys))
-
-			if len(authorisedKeys) == 1 {
-
+			// Enrolling agents arent known yet, theyre only allowed to redeem a token for the key they authenticated with
+			if c.User() == models.EnrollmentUser {
 				return &ssh.Permissions{
-					// Record the public key used for authentication.
 					Extensions: map[string]string{
-						"pubkey-fp": authorisedKeys[0],
+						enrollmentExtension: receivedPubKey,
 					},
 				}, nil
 			}
 
-			if len(authorisedKeys) > 1 {
-				log.Printf("Warning key [%s] is used in %d place/s", receivedPubKey, len(authorisedKeys))
+			if cert, ok := pubKey.(*ssh.Certificate); ok {
+				ca := s.agentCA()
+				if ca == nil {
+					return nil, fmt.Errorf("Certificate presented for %q but no agent CA is configured", c.User())
+				}
+
+				permissions, err := ca.authenticate(c, cert)
+				if err != nil {
+					log.Printf("Certificate for %q from [%s] refused: %s", c.User(), c.RemoteAddr(), err)
+				}
+				return permissions, err
+			}
+
+			// Only keys that havent been retired are accepted, so once an agent has rotated its key the old one is useless
+			key, err := store.GetActiveAgentKey(receivedPubKey)
+			if err != nil {
+				if err != models.ErrNotFound {
+					log.Println("Unable to load agent key from database: ", err)
+				}
+				return nil, fmt.Errorf("Unknown public key for %q", c.User())
 			}
 
-			return nil, fmt.Errorf("Unknown public key for %q", c.User())
+			log.Printf("Client connected with key [%s] of agent %d", key.Fingerprint, key.AgentId)
+
+			return &ssh.Permissions{
+				// Record the key used for authentication
+				Extensions: map[string]string{
+					agentKeyExtension: strconv.FormatInt(key.Id, 10),
+				},
+			}, nil
 		},
 	}
 
-	privateBytes, err := ioutil.ReadFile(config.PrivateKeyPath)
-	utils.Check("Failed to load private key: ", err)
-
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	utils.Check("Failed to parse private key: ", err)
+	private, err := config.hostKey()
+	if err != nil {
+		return fmt.Errorf("Unable to load host key: %w", err)
+	}
 
 	serverConfig.AddHostKey(private)
 
@@ -79,28 +266,93 @@ func RunServer(db *gorm.DB, config ServerConfig) {
 	// accepted.
 
 	listener, err := net.Listen("tcp", config.CollectionListenAddr)
-	utils.Check("Failed to listen for connection: ", err)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for connection: %w", err)
+	}
+
+	agents := newConnectedAgents(store)
 
 	log.Println("Starting web interface")
-	webservice.StartWebServer(config.WebListenAddr, config.WebResourcesPath, db)
+	web := webservice.StartWebServer(config.WebListenAddr, config.WebResourcesPath, store, agents, private.PublicKey())
+
+	var events sync.WaitGroup
+	events.Add(2)
+
+	// Events are raised, and history pruned, whether or not there is anywhere to email them yet
+	log.Println("Starting event generator")
+	go func() {
+		defer events.Done()
+		eventGenerator(ctx, store, s)
+	}()
 
 	log.Println("Starting event processor")
-	go startEventProcessors(db)
+	go func() {
+		defer events.Done()
+		startEventProcessors(ctx, store)
+	}()
+
+	// Closing the listener is the only way to unblock Accept
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var connections sync.WaitGroup
 
 	log.Println("Now accepting connections on ", listener.Addr().String())
 	for {
 
 		nConn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
 			log.Println("Failed to accept incoming connection: ", err)
+			continue
 		}
 
-		go handleAgentConnection(nConn, serverConfig, db)
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			handleAgentConnection(nConn, serverConfig, store, agents)
+		}()
+	}
+
+	log.Println("Shutting down, no longer accepting agent connections")
+
+	log.Printf("Disconnecting %d agents", agents.closeAll())
+	connections.Wait()
+
+	if err := store.SetAllAgentsDisconnected(); err != nil {
+		log.Println("Unable to mark agents as offline: ", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := web.Shutdown(shutdownCtx); err != nil {
+		log.Println("Web interface did not shut down cleanly: ", err)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		events.Wait()
+		close(finished)
+	}()
 
+	select {
+	case <-finished:
+	case <-shutdownCtx.Done():
+		log.Println("Timed out waiting for notifications to be sent")
 	}
+
+	log.Println("Shutdown complete")
+
+	return nil
 }
 
-func handleAgentConnection(nConn net.Conn, config *ssh.ServerConfig, db *gorm.DB) {
+func handleAgentConnection(nConn net.Conn, config *ssh.ServerConfig, store models.Store, agents *connectedAgents) {
 	// Before use, a handshake must be performed on the incoming
 	// net.Conn.
 	conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
@@ -109,20 +361,63 @@ func handleAgentConnection(nConn net.Conn, config *ssh.ServerConfig, db *gorm.DB
 		return
 	}
 	defer conn.Close()
-	publicKey := conn.Permissions.Extensions["pubkey-fp"]
 
-	log.Printf("Client connected [%s]", publicKey)
+	if enrollingKey, ok := conn.Permissions.Extensions[enrollmentExtension]; ok {
+		handleEnrollment(conn, chans, reqs, enrollingKey, store)
+		return
+	}
 
 	var clientAgent models.Agent
-	if err := db.Where("pub_key = ?", publicKey).First(&clientAgent).Error; err != nil {
+	client := ""
 
-		log.Println("Something went wrong finding the agent associated with the pub key: ", err)
-		return
+	// Agents with certificates are only registered now the handshake has proven they hold the certificates key
+	if identity, ok := certificateIdentity(conn.Permissions); ok {
+		clientAgent, err = store.AgentForCertificate(identity)
+		if err != nil {
+			log.Printf("Unable to find or register agent for principal %q: %s", identity.Principal, err)
+			return
+		}
+
+		log.Printf("Agent %q authenticated with certificate %q (serial %d)", identity.Principal, identity.KeyId, identity.Serial)
+		client = identity.Principal
+	} else {
+		keyID, err := strconv.ParseInt(conn.Permissions.Extensions[agentKeyExtension], 10, 64)
+		if err != nil {
+			log.Println("Something went wrong finding the key the agent authenticated with: ", err)
+			return
+		}
+
+		key, err := store.GetAgentKey(keyID)
+		if err != nil {
+			log.Println("Something went wrong finding the key the agent authenticated with: ", err)
+			return
+		}
+
+		clientAgent, err = store.GetAgent(key.AgentId)
+		if err != nil {
+			log.Println("Something went wrong finding the agent associated with the key: ", err)
+			return
+		}
+
+		if err := store.TouchAgentKey(key.Id); err != nil {
+			log.Println("Unable to record key use: ", err)
+		}
+
+		client = key.Fingerprint
 	}
 
+	log.Printf("Client connected [%s] as %s", client, agentLabel(clientAgent))
+
+	agents.add(clientAgent.ID, conn)
+	defer agents.remove(clientAgent.ID, conn)
+
 	// The incoming Request channel must be serviced.
 	go ssh.DiscardRequests(reqs)
 
+	// Channels are waited for, so their connections are logged as ended before theia finishes shutting down
+	var channels sync.WaitGroup
+	defer channels.Wait()
+
 	// Service the incoming Channel channel.
 	for newChannel := range chans {
 		// Channels have a type, depending on the application level
@@ -136,140 +431,97 @@ func handleAgentConnection(nConn net.Conn, config *ssh.ServerConfig, db *gorm.DB
 
 		log.Println("Handling new channel: ", string(newChannel.ExtraData()), " ", newChannel.ChannelType())
 
+		version, hello, err := negotiateVersion(newChannel.ExtraData())
+		if err != nil {
+			log.Printf("Client [%s] could not negotiate protocol: %s", agentLabel(clientAgent), err)
+			newChannel.Reject(ssh.Prohibited, err.Error())
+			continue
+		}
+
+		log.Printf("Client [%s] version [%s] using protocol version %d", agentLabel(clientAgent), hello.ClientVersion, version)
+
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
 			log.Println("Could not accept channel: ", err)
 			continue
 		}
 
-		if err := db.Model(&clientAgent).Updates(models.Agent{LastConnectionFrom: nConn.RemoteAddr().String()}).Error; err != nil {
+		if err := store.SetLastConnectionFrom(clientAgent.ID, nConn.RemoteAddr().String()); err != nil {
 			log.Println("Updating last connected ip failed: ", err)
 			return
 		}
 
-		go func() {
-			defer channel.Close()
-			decoder := json.NewDecoder(channel)
-
-			for {
-				var stat models.Stats
-				err := decoder.Decode(&stat)
-				if err != nil {
-					log.Printf("Client [%s] sent something I couldnt decode, killing", publicKey)
-					if err := db.Model(&clientAgent).Update("currently_connected", false).Error; err != nil {
-						log.Println("Unsetting currently connected failed: ", err)
-						continue
-					}
-
-					return
-				}
-
-				update := models.Agent{
-					LastTransmission:   time.Now(),
-					CurrentlyConnected: true,
-					MemoryUsage:        stat.MemoryUsage,
-				}
+		connection, err := store.StartConnection(clientAgent.ID, nConn.RemoteAddr().String(), hello.ClientVersion, version)
+		if err != nil {
+			log.Println("Unable to record agent connection: ", err)
+		}
 
-				if err := db.Model(&clientAgent).Updates(update).Error; err != nil {
-					log.Println("Updating database failed: ", err)
-					continue
-				}
+		channels.Add(1)
+		go func() {
+			defer channels.Done()
+
+			var err error
+			if version == 0 {
+				err = serveLegacyChannel(channel, requests, clientAgent, store)
+			} else {
+				go ssh.DiscardRequests(requests)
+				err = serveChannel(channel, version, clientAgent, store, agents)
+			}
 
-				for device, usage := range stat.DiskUsage {
-					var entry models.DiskEntry
-					if err := db.Where("device = ? AND agent_id = ?", device, clientAgent.ID).First(&entry).Error; err != nil {
-						if err == gorm.ErrRecordNotFound {
-							if err := db.Create(&models.DiskEntry{
-								AgentId: clientAgent.ID,
-								Device:  device,
-								Usage:   usage,
-							}).Error; err != nil {
-								log.Println("Unable to create new disk device: ", err)
-
-							}
-							continue
-						}
-
-						log.Println("Error adding disk to database:", err)
-						continue
-					}
-
-					if entry.Usage != usage {
-						if err := db.Model(&entry).Update("usage", usage).Error; err != nil {
-							log.Println("Error doing the update for disk:", err)
-						}
-					}
-				}
+			endConnection(store, agents, conn, connection, err)
+		}()
+	}
+}
 
-				for _, monitorV := range stat.MonitorValues {
-					var me models.MonitorEntry
-
-					if err := db.Where("path = ? AND agent_id = ?", monitorV.Path, clientAgent.ID).First(&me).Error; err != nil {
-						if err == gorm.ErrRecordNotFound {
-							if err := db.Create(&models.MonitorEntry{
-								AgentId:      clientAgent.ID,
-								MonitorEntry: monitorV,
-							}).Error; err != nil {
-								log.Println("Unable to create new monitor entry: ", err)
-
-							}
-							continue
-						}
-
-						log.Println("An error occur update the monitor stat: ", err)
-						continue
-
-					}
-
-					if err := db.Model(&me).Updates(&models.MonitorEntry{
-						MonitorEntry: monitorV,
-					}).Error; err != nil {
-						log.Println("Error: ", err)
-					}
-
-					//Gorm doesnt update values if the value is "default" in a struct i.e false..., so t -> f never works.
-					//Stupid brittle fix
-					if err := db.Model(&me).Update("ok", monitorV.OK).Error; err != nil {
-						log.Println("Error: ", err)
-					}
-				}
+//endConnection records why an agent disconnected in its connection log, err is what ended its channel
+func endConnection(store models.ConnectionStore, agents *connectedAgents, conn ssh.Conn, connection models.AgentConnection, err error) {
+	// Recording the connection failed, there is nothing to end
+	if connection.Id == 0 {
+		return
+	}
 
-			}
-		}()
+	reason, closedByTheia := agents.closeReason(conn)
+	if !closedByTheia {
+		reason = disconnectReason(err)
+	}
 
-		// Sessions have out-of-band requests such as "shell",
-		// "pty-req" and "env".  Here we handle only the
-		// "shell" request.
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				switch req.Type {
-				case "system":
-					if err := storeSystemAttributes(clientAgent.ID, req.Payload, db); err != nil {
-						log.Printf("Client [%s] sent something I couldnt decode, killing", publicKey)
-						channel.Close()
-						return
-					}
-				default:
-					log.Println("Client sent something... but what...: ", req.Type)
-				}
-			}
-		}(requests)
+	if err := store.EndConnection(connection, reason); err != nil {
+		log.Println("Unable to record agent disconnecting: ", err)
 	}
 }
 
-func storeSystemAttributes(agentID int64, b []byte, db *gorm.DB) error {
-	var sysinfo models.SystemInfo
+//disconnectReason describes the error that ended an agents channel
+func disconnectReason(err error) string {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case err == nil, errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return models.DisconnectEOF
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, syscall.ETIMEDOUT):
+		return models.DisconnectTimeout
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return models.DisconnectDecodeError
+	default:
+		return models.DisconnectError
+	}
+}
 
-	if err := db.Find(&sysinfo, "agent_id = ?", agentID).Error; err != nil && err != gorm.ErrRecordNotFound {
-		return err
+//ingestStats stores a stats report from an agent, see models.IngestStats
+func ingestStats(metrics models.MetricStore, clientAgent models.Agent, stat models.Stats) {
+	if err := metrics.IngestStats(clientAgent.ID, stat); err != nil {
+		log.Printf("Storing stats from %s failed: %s", agentLabel(clientAgent), err)
 	}
+}
 
-	sysinfo.AgentId = agentID
+func storeSystemAttributes(agents models.AgentStore, agentID int64, b []byte) error {
+	var sysinfo models.SystemInfo
 
 	err := json.Unmarshal(b, &sysinfo)
 	if err != nil {
 		return err
 	}
 
-	return db.Save(&sysinfo).Error
+	return agents.SetSystemInfo(agentID, sysinfo)
 }
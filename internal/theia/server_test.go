@@ -0,0 +1,414 @@
+package theia
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/internal/iris"
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/NHAS/StatsCollector/utils"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeTestKey(t *testing.T) string {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestServerReload(t *testing.T) {
+	config := ServerConfig{
+		CollectionListenAddr: "127.0.0.1:2222",
+		WebListenAddr:        "127.0.0.1:8080",
+		PrivateKeyPath:       writeTestKey(t),
+		WebResourcesPath:     ".",
+		CertWarningDays:      []int{30},
+		HistoryRetentionDays: 30,
+	}
+
+	server, err := NewServer(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated := config
+	updated.CertWarningDays = []int{7}
+	updated.HistoryRetentionDays = 90
+	updated.WebListenAddr = "127.0.0.1:9090"
+	if err := server.Reload(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	current := server.Config()
+	if current.HistoryRetentionDays != 90 || len(current.CertWarningDays) != 1 || current.CertWarningDays[0] != 7 {
+		t.Fatal("Reloadable settings were not applied: ", current)
+	}
+
+	if current.WebListenAddr != config.WebListenAddr {
+		t.Fatal("Listen address changed without a restart: ", current.WebListenAddr)
+	}
+
+	invalid := updated
+	invalid.HistoryRetentionDays = -1
+	if err := server.Reload(invalid); err == nil {
+		t.Fatal("Negative retention was accepted")
+	}
+
+	if server.Config().HistoryRetentionDays != 90 {
+		t.Fatal("Refused config was applied")
+	}
+}
+
+// startTestServer runs theia on a free port, the returned function shuts it down and waits for it to finish
+func startTestServer(t *testing.T, db *gorm.DB, config ServerConfig) (address string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address = l.Addr().String()
+	l.Close()
+
+	config.CollectionListenAddr = address
+	config.WebListenAddr = "127.0.0.1:0"
+	config.WebResourcesPath = "../../resources"
+
+	server, err := NewServer(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan error)
+	go func() {
+		finished <- server.Run(ctx)
+	}()
+
+	return address, func() {
+		cancel()
+
+		select {
+		case err := <-finished:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Server did not stop when cancelled")
+		}
+	}
+}
+
+// dialTestServer retries until the server is up
+func dialTestServer(t *testing.T, address string, config *ssh.ClientConfig) *ssh.Client {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := ssh.Dial("tcp", address, config)
+		if err == nil {
+			return conn
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Unable to connect to server: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func createTestAgent(t *testing.T, db *gorm.DB, name string, key ssh.Signer) models.Agent {
+	pubKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey())))
+	if _, err := models.NewDatabaseStore(db).CreateAgent(name, pubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var agent models.Agent
+	if err := db.First(&agent, "pub_key = ?", pubKey).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return agent
+}
+
+// loadTestKey reads a key written by writeTestKey
+func loadTestKey(t *testing.T, path string) ssh.Signer {
+	signer, err := ServerConfig{PrivateKeyPath: path}.hostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// waitForKeyUse waits until theia has recorded an agent authenticating with key
+func waitForKeyUse(t *testing.T, db *gorm.DB, key ssh.Signer) models.AgentKey {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var used models.AgentKey
+		if err := db.First(&used, "fingerprint = ?", utils.HexFingerprintSHA256(key.PublicKey())).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if used.LastUsedAt != nil {
+			return used
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Agent never connected with key ", used.Fingerprint)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAgentKeyRotation(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	store := models.NewDatabaseStore(db)
+
+	hostKeyPath := writeTestKey(t)
+	oldKeyPath, newKeyPath := writeTestKey(t), writeTestKey(t)
+	oldKey, newKey := loadTestKey(t, oldKeyPath), loadTestKey(t, newKeyPath)
+
+	agent := createTestAgent(t, db, "rotation", oldKey)
+
+	address, stop := startTestServer(t, db, ServerConfig{PrivateKeyPath: hostKeyPath})
+	defer stop()
+
+	if _, err := ssh.Dial("tcp", address, &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.PublicKeys(newKey)}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}); err == nil {
+		t.Fatal("Key that hasnt been added was accepted")
+	}
+
+	// The agents key file is replaced in place, as it would be when rotating a key
+	keyPath := filepath.Join(t.TempDir(), "id_ecdsa")
+	copyFile := func(from string) {
+		b, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(keyPath, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyFile(oldKeyPath)
+
+	config := iris.ClientConfig{
+		ServerAddress:     address,
+		PrivateKeyPath:    keyPath,
+		AuthorisedKey:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(loadTestKey(t, hostKeyPath).PublicKey()))),
+		UpdateIntervalSec: 60,
+	}
+
+	client, err := iris.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan bool)
+	go func() {
+		client.Run(ctx)
+		close(finished)
+	}()
+	defer func() {
+		cancel()
+		<-finished
+	}()
+
+	old := waitForKeyUse(t, db, oldKey)
+
+	added, err := store.AddAgentKey(agent.ID, string(ssh.MarshalAuthorizedKey(newKey.PublicKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyFile(newKeyPath)
+	if err := client.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if waitForKeyUse(t, db, newKey).Id != added.Id {
+		t.Fatal("Agent switched to the wrong key")
+	}
+
+	if _, err := store.RetireAgentKey(agent.ID, old.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ssh.Dial("tcp", address, &ssh.ClientConfig{Auth: []ssh.AuthMethod{ssh.PublicKeys(oldKey)}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}); err == nil {
+		t.Fatal("Retired key was still accepted")
+	}
+
+	rotated, err := store.GetAgent(agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.ID != agent.ID || len(rotated.Keys) != 2 {
+		t.Fatal("Agent changed when its key was rotated: ", rotated)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	agentKey := newTestSigner(t)
+	agent := createTestAgent(t, db, "shutdown", agentKey)
+
+	address, stop := startTestServer(t, db, ServerConfig{PrivateKeyPath: writeTestKey(t)})
+
+	conn := dialTestServer(t, address, &ssh.ClientConfig{
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(agentKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	defer conn.Close()
+
+	if err := db.Model(&agent).Update("currently_connected", true).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hello, err := json.Marshal(models.NewHello("shutdown-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel, requests, err := conn.OpenChannel("metrics", hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	stop()
+
+	disconnected := make(chan error)
+	go func() {
+		disconnected <- conn.Wait()
+	}()
+
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent was not disconnected on shutdown")
+	}
+
+	if err := db.First(&agent, agent.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.CurrentlyConnected {
+		t.Fatal("Agent still marked as connected after shutdown")
+	}
+
+	if _, err := net.DialTimeout("tcp", address, time.Second); err == nil {
+		t.Fatal("Server still accepting connections after shutdown")
+	}
+
+	connections, err := models.NewDatabaseStore(db).GetConnections(agent.ID, time.Time{})
+	if err != nil || len(connections) != 1 {
+		t.Fatal("Expected the connection to be logged: ", connections, err)
+	}
+
+	if c := connections[0]; c.DisconnectedAt == nil || c.DisconnectReason != models.DisconnectShutdown || c.ClientVersion != "shutdown-test" || c.ProtocolVersion != models.ProtocolVersion {
+		t.Fatalf("Connection was not logged as ended by the shutdown: %+v", c)
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	var syntaxErr error = &json.SyntaxError{}
+	var timeoutErr error = &net.OpError{Op: "read", Err: syscall.ETIMEDOUT}
+
+	for err, expected := range map[error]string{
+		io.EOF:                       models.DisconnectEOF,
+		io.ErrUnexpectedEOF:          models.DisconnectEOF,
+		syntaxErr:                    models.DisconnectDecodeError,
+		timeoutErr:                   models.DisconnectTimeout,
+		os.ErrDeadlineExceeded:       models.DisconnectTimeout,
+		errors.New("something else"): models.DisconnectError,
+	} {
+		if got := disconnectReason(err); got != expected {
+			t.Errorf("%v: expected %q, got %q", err, expected, got)
+		}
+	}
+}
+
+func TestServerPrunesWithoutNotifications(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	defer func(delay time.Duration) { eventGeneratorDelay = delay }(eventGeneratorDelay)
+	eventGeneratorDelay = 10 * time.Millisecond
+
+	// Nowhere to email events to
+	if err := db.Delete(&models.NotificationDetail{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	old := models.MonitorSample{AgentId: 1, Path: "unnotified", CreatedAt: time.Now().AddDate(0, 0, -40)}
+	if err := db.Create(&old).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	_, stop := startTestServer(t, db, ServerConfig{PrivateKeyPath: writeTestKey(t), HistoryRetentionDays: 30})
+	defer stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var remaining int
+		db.Model(&models.MonitorSample{}).Where("id = ?", old.Id).Count(&remaining)
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("History was not pruned without notification settings")
+}
+
+func TestServerHostKeyError(t *testing.T) {
+	db := setupDatabase()
+	defer db.Close()
+
+	keyPath := writeTestKey(t)
+	server, err := NewServer(db, ServerConfig{CollectionListenAddr: "127.0.0.1:0", WebListenAddr: "127.0.0.1:0", PrivateKeyPath: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key going missing after the config was checked should fail Run, not exit the process
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "host key") {
+		t.Fatal("Expected the host key error to be returned, got: ", err)
+	}
+}
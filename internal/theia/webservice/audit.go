@@ -0,0 +1,156 @@
+package webservice
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/csrf"
+)
+
+// auditPageSize is how many entries the audit page shows, the export has all of them
+const auditPageSize = 500
+
+const auditDateFormat = "2006-01-02"
+
+func agentTarget(agentID int64) string {
+	return "agent:" + strconv.FormatInt(agentID, 10)
+}
+
+func enrollmentTokenTarget(tokenID int64) string {
+	return "enrollment_token:" + strconv.FormatInt(tokenID, 10)
+}
+
+func userTarget(username string) string {
+	return "user:" + username
+}
+
+func groupTarget(groupID int64) string {
+	return "group:" + strconv.FormatInt(groupID, 10)
+}
+
+// recordAudit adds what the logged in user just changed to the audit log. before and after are stored as JSON, nil for nothing
+func recordAudit(c *gin.Context, audit models.AuditStore, action, target string, before, after interface{}) {
+	u := c.Keys["user"].(models.User)
+	recordAuditAs(c, audit, u.Username, action, target, before, after)
+}
+
+// recordAuditAs is recordAudit for requests with no logged in user, such as logging in
+func recordAuditAs(c *gin.Context, audit models.AuditStore, actor, action, target string, before, after interface{}) {
+	entry := models.AuditEntry{
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		SourceIP: c.ClientIP(),
+	}
+
+	for _, v := range []struct {
+		value interface{}
+		field *string
+	}{{before, &entry.Before}, {after, &entry.After}} {
+		if v.value == nil {
+			continue
+		}
+
+		b, err := json.Marshal(v.value)
+		if err != nil {
+			log.Printf("Unable to encode audit entry for %s on %s: %s", action, target, err)
+			continue
+		}
+		*v.field = string(b)
+	}
+
+	// The change has already been made, so failing to audit it is logged rather than failing the request
+	if err := audit.AddAuditEntry(entry); err != nil {
+		log.Printf("Unable to audit %s of %s by [%s]: %s", action, target, actor, err)
+	}
+}
+
+// auditFilter reads the audit log filter from the query string, since and until are dates and both are included
+func auditFilter(c *gin.Context) (filter models.AuditFilter, err error) {
+	filter.Actor = strings.TrimSpace(c.Query("actor"))
+	filter.Action = strings.TrimSpace(c.Query("action"))
+	filter.Target = strings.TrimSpace(c.Query("target"))
+
+	if since := c.Query("since"); since != "" {
+		filter.Since, err = time.ParseInLocation(auditDateFormat, since, time.Local)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if until := c.Query("until"); until != "" {
+		filter.Until, err = time.ParseInLocation(auditDateFormat, until, time.Local)
+		if err != nil {
+			return filter, err
+		}
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	return filter, nil
+}
+
+func getAuditLog(audit models.AuditStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := auditFilter(c)
+		if err != nil {
+			c.String(400, "Invalid date")
+			return
+		}
+
+		entries, err := audit.GetAuditLog(filter, auditPageSize)
+		if err != nil {
+			log.Println("Error getting audit log: ", err)
+			c.String(500, "Unable to get audit log")
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.HTML(http.StatusOK, "audit.templ.html", gin.H{
+			"Entries":        entries,
+			"Truncated":      len(entries) == auditPageSize,
+			"Actions":        models.AuditActions,
+			"Filter":         filter,
+			"Since":          c.Query("since"),
+			"Until":          c.Query("until"),
+			"ExportQuery":    template.URL(url.Values{"actor": {filter.Actor}, "action": {filter.Action}, "target": {filter.Target}, "since": {c.Query("since")}, "until": {c.Query("until")}}.Encode()),
+			csrf.TemplateTag: csrf.TemplateField(c.Request),
+		})
+	}
+}
+
+func getAuditExport(audit models.AuditStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := auditFilter(c)
+		if err != nil {
+			c.String(400, "Invalid date")
+			return
+		}
+
+		entries, err := audit.GetAuditLog(filter, 0)
+		if err != nil {
+			log.Println("Error getting audit log: ", err)
+			c.String(500, "Unable to get audit log")
+			return
+		}
+
+		u := c.Keys["user"].(models.User)
+		log.Printf("User [%s] exported %d audit log entries", u.Username, len(entries))
+
+		c.Header("Cache-Control", "no-store")
+		c.Header("Content-Disposition", "attachment; filename=audit-"+time.Now().Format(auditDateFormat)+".jsonl")
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+
+		if err := models.WriteAuditLog(c.Writer, entries); err != nil {
+			log.Println("Error writing audit log export: ", err)
+		}
+	}
+}
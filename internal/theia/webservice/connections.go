@@ -0,0 +1,107 @@
+package webservice
+
+import (
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+// timelineWindow is how far back the connection timeline on the agent page goes
+const timelineWindow = 7 * 24 * time.Hour
+
+// recentConnections is how many connections are listed on the agent page
+const recentConnections = 20
+
+// availabilityWindows are the periods availability is shown for on the agent page, the longest is also how much of the connection log is read
+var availabilityWindows = []struct {
+	Name   string
+	Period time.Duration
+}{
+	{"24 hours", 24 * time.Hour},
+	{"7 days", 7 * 24 * time.Hour},
+	{"30 days", 30 * 24 * time.Hour},
+}
+
+type availability struct {
+	Name    string
+	Percent float64
+}
+
+// timelineSegment is a connection placed on the timeline, Left and Width are percentages of the timeline
+type timelineSegment struct {
+	Left, Width float64
+	Connection  models.AgentConnection
+}
+
+// connectionHistory is what the agent page shows of an agents connection log
+type connectionHistory struct {
+	// Since is when the agent first connected, availability isnt counted from before it. It is zero if it has never connected
+	Since        time.Time
+	Availability []availability
+	Timeline     []timelineSegment
+	// Recent are the latest connections in the longest availability window, newest first
+	Recent []models.AgentConnection
+}
+
+func getConnectionHistory(connections models.ConnectionStore, agentID int64, now time.Time) (history connectionHistory, err error) {
+	first, err := connections.GetFirstConnection(agentID)
+	if err == models.ErrNotFound {
+		return history, nil
+	}
+
+	if err != nil {
+		return history, err
+	}
+	history.Since = first.ConnectedAt
+
+	longest := availabilityWindows[len(availabilityWindows)-1].Period
+	logged, err := connections.GetConnections(agentID, now.Add(-longest))
+	if err != nil {
+		return history, err
+	}
+
+	for _, w := range availabilityWindows {
+		from := now.Add(-w.Period)
+		if from.Before(first.ConnectedAt) {
+			from = first.ConnectedAt
+		}
+
+		history.Availability = append(history.Availability, availability{Name: w.Name, Percent: models.Availability(logged, from, now)})
+	}
+
+	history.Timeline = connectionTimeline(logged, now.Add(-timelineWindow), now)
+
+	for i := len(logged) - 1; i >= 0 && len(history.Recent) < recentConnections; i-- {
+		history.Recent = append(history.Recent, logged[i])
+	}
+
+	return history, nil
+}
+
+// connectionTimeline places the connections that overlap from and to on a timeline between them
+func connectionTimeline(connections []models.AgentConnection, from, to time.Time) (segments []timelineSegment) {
+	span := float64(to.Sub(from))
+
+	for _, c := range connections {
+		start, end := c.ConnectedAt, to
+		if c.DisconnectedAt != nil && c.DisconnectedAt.Before(to) {
+			end = *c.DisconnectedAt
+		}
+
+		if start.Before(from) {
+			start = from
+		}
+
+		if !end.After(start) {
+			continue
+		}
+
+		segments = append(segments, timelineSegment{
+			Left:       100 * float64(start.Sub(from)) / span,
+			Width:      100 * float64(end.Sub(start)) / span,
+			Connection: c,
+		})
+	}
+
+	return segments
+}
@@ -0,0 +1,164 @@
+package webservice
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/gin-gonic/gin"
+)
+
+// eventPageSize is how many events the events page shows at a time
+const eventPageSize = 50
+
+// recentEvents is how many events are shown on the agent page, the rest are on the events page
+const recentEvents = 10
+
+var errInvalidEventFilter = errors.New("Invalid event filter")
+
+func eventsURL(agentID int64) string {
+	return "/events?agent=" + strconv.FormatInt(agentID, 10)
+}
+
+// eventFilter reads the event filter from the query string. The agent and group filters are both applied if set, since and until are dates and both are included
+func eventFilter(c *gin.Context, store models.AgentStore) (filter models.EventFilter, err error) {
+	filter.Search = strings.TrimSpace(c.Query("q"))
+
+	if agent := c.Query("agent"); agent != "" {
+		agentID, err := strconv.ParseInt(agent, 10, 64)
+		if err != nil {
+			return filter, errInvalidEventFilter
+		}
+		filter.AgentIDs = []int64{agentID}
+	}
+
+	if group := c.Query("group"); group != "" {
+		groupID, err := strconv.ParseInt(group, 10, 64)
+		if err != nil {
+			return filter, errInvalidEventFilter
+		}
+
+		members, err := store.GetGroupAgentIDs(groupID)
+		if err != nil {
+			return filter, err
+		}
+
+		inGroup := []int64{}
+		for _, id := range members {
+			if filter.AgentIDs == nil || filter.AgentIDs[0] == id {
+				inGroup = append(inGroup, id)
+			}
+		}
+		filter.AgentIDs = inGroup
+	}
+
+	if urgency := c.Query("urgency"); urgency != "" {
+		maxUrgency, err := strconv.Atoi(urgency)
+		if err != nil {
+			return filter, errInvalidEventFilter
+		}
+		filter.MaxUrgency = &maxUrgency
+	}
+
+	switch c.Query("notified") {
+	case "":
+	case "yes", "no":
+		notified := c.Query("notified") == "yes"
+		filter.Notified = &notified
+	default:
+		return filter, errInvalidEventFilter
+	}
+
+	if since := c.Query("since"); since != "" {
+		filter.Since, err = time.ParseInLocation(auditDateFormat, since, time.Local)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if until := c.Query("until"); until != "" {
+		filter.Until, err = time.ParseInLocation(auditDateFormat, until, time.Local)
+		if err != nil {
+			return filter, err
+		}
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	return filter, nil
+}
+
+// pageQuery is the current query string with the page changed, so paging keeps the filter
+func pageQuery(query url.Values, page int) template.URL {
+	values := url.Values{}
+	for k, v := range query {
+		values[k] = v
+	}
+	values.Set("page", strconv.Itoa(page))
+
+	return template.URL(values.Encode())
+}
+
+func getEvents(store models.AgentStore, events models.EventStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := eventFilter(c, store)
+		if err != nil {
+			c.String(400, "Invalid filter")
+			return
+		}
+
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			c.String(400, "Invalid page")
+			return
+		}
+
+		matched, total, err := events.GetEvents(filter, (page-1)*eventPageSize, eventPageSize)
+		if err != nil {
+			log.Println("Error getting events: ", err)
+			c.String(500, "Unable to get events")
+			return
+		}
+
+		agents, err := store.GetAgentList("", 0)
+		if err != nil {
+			log.Println("Unable to get agent list: ", err)
+		}
+
+		groups, err := store.GetGroups()
+		if err != nil {
+			log.Println("Unable to get groups: ", err)
+		}
+
+		// Archived agents arent listed, so their events are shown with their id
+		names := make(map[int64]string)
+		for _, agent := range agents {
+			names[agent.ID] = agent.Name
+		}
+
+		pages := (total + eventPageSize - 1) / eventPageSize
+		if pages == 0 {
+			pages = 1
+		}
+
+		query := c.Request.URL.Query()
+
+		c.HTML(http.StatusOK, "events.templ.html", gin.H{
+			"Events":   matched,
+			"Total":    total,
+			"Names":    names,
+			"Agents":   agents,
+			"Groups":   groups,
+			"Query":    query,
+			"Page":     page,
+			"Pages":    pages,
+			"Previous": pageQuery(query, page-1),
+			"Next":     pageQuery(query, page+1),
+		})
+	}
+}
@@ -7,18 +7,17 @@ import (
 
 	"github.com/NHAS/StatsCollector/models"
 	"github.com/gin-gonic/gin"
-	"github.com/jinzhu/gorm"
 )
 
-func authorisionMiddleware(db *gorm.DB) gin.HandlerFunc {
+func authorisionMiddleware(users models.UserStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		valid, user := checkCookie(c, db)
+		valid, user := checkCookie(c, users)
 		if !valid {
 			denyRequest(c)
 			return
 		}
 
-		if err := db.Model(&models.User{}).Where("id = ?", user.Id).Update("token_created_at", time.Now().Unix()).Error; err != nil {
+		if err := users.RefreshUserToken(user.Id); err != nil {
 			denyRequest(c)
 			log.Println("Unable to extend token lifetime: ", err)
 			return
@@ -34,7 +33,7 @@ func denyRequest(c *gin.Context) {
 	c.Abort()
 }
 
-func checkCookie(c *gin.Context, db *gorm.DB) (valid bool, u models.User) {
+func checkCookie(c *gin.Context, users models.UserStore) (valid bool, u models.User) {
 	contents, err := c.Cookie(CookieName)
 	if err != nil {
 		return false, u
@@ -45,8 +44,8 @@ func checkCookie(c *gin.Context, db *gorm.DB) (valid bool, u models.User) {
 		return false, u
 	}
 
-	var record models.User
-	if db.Debug().Where("username = ? AND token = ?", parts[0], parts[1]).First(&record).Error != nil {
+	record, err := users.GetUserByToken(parts[0], parts[1])
+	if err != nil {
 		return false, u
 	}
 
@@ -0,0 +1,230 @@
+package webservice
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Periods a report can cover, each is the calendar day, ISO week or month containing the date asked for
+const (
+	reportDaily   = "day"
+	reportWeekly  = "week"
+	reportMonthly = "month"
+)
+
+var errUnknownPeriod = errors.New("Unknown report period")
+
+// reportPeriod returns the period of kind containing date, date is in the form 2006-01-02 and defaults to today
+func reportPeriod(kind, date string, now time.Time) (from, to time.Time, err error) {
+	day := now
+	if date != "" {
+		day, err = time.ParseInLocation(auditDateFormat, date, now.Location())
+		if err != nil {
+			return from, to, err
+		}
+	}
+
+	year, month, dayOfMonth := day.Date()
+	from = time.Date(year, month, dayOfMonth, 0, 0, 0, 0, now.Location())
+
+	switch kind {
+	case reportDaily:
+		return from, from.AddDate(0, 0, 1), nil
+	case reportWeekly:
+		// Weeks start on Monday
+		from = from.AddDate(0, 0, -((int(from.Weekday()) + 6) % 7))
+		return from, from.AddDate(0, 0, 7), nil
+	case reportMonthly:
+		from = time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+		return from, from.AddDate(0, 1, 0), nil
+	}
+
+	return from, to, errUnknownPeriod
+}
+
+// reportRow is the uptime of an agent, or of one of its monitors when Path is set
+type reportRow struct {
+	AgentID int64
+	Agent   string
+	Path    string
+	models.Uptime
+}
+
+type availabilityReport struct {
+	Period   string
+	From, To time.Time
+	Agents   []reportRow
+	Monitors []reportRow
+}
+
+// buildAvailabilityReport works out the uptime of every agent from its connection log, and of every monitor from its check history.
+// Nothing is counted from after now, or from before an agent first connected
+func buildAvailabilityReport(store models.Store, period string, from, to, now time.Time) (report availabilityReport, err error) {
+	report = availabilityReport{Period: period, From: from, To: to}
+
+	end := to
+	if now.Before(end) {
+		end = now
+	}
+
+	agents, err := store.GetAgentList("", 0)
+	if err != nil {
+		return report, err
+	}
+
+	for _, agent := range agents {
+		name := agent.Name
+		if name == "" {
+			name = fmt.Sprintf("agent %d", agent.ID)
+		}
+
+		row := reportRow{AgentID: agent.ID, Agent: name}
+
+		first, err := store.GetFirstConnection(agent.ID)
+		if err != nil && err != models.ErrNotFound {
+			return report, err
+		}
+
+		var connections []models.AgentConnection
+		if err == nil {
+			start := from
+			if first.ConnectedAt.After(start) {
+				start = first.ConnectedAt
+			}
+
+			connections, err = store.GetConnections(agent.ID, start)
+			if err != nil {
+				return report, err
+			}
+
+			row.Uptime = models.ConnectionUptime(connections, start, end)
+		}
+		report.Agents = append(report.Agents, row)
+
+		samples, err := store.GetMonitorSamples(agent.ID, from)
+		if err != nil {
+			return report, err
+		}
+
+		byPath := make(map[string][]models.MonitorSample)
+		for _, s := range samples {
+			if s.CreatedAt.Before(end) {
+				byPath[s.Path] = append(byPath[s.Path], s)
+			}
+		}
+
+		var paths []string
+		for path := range byPath {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			report.Monitors = append(report.Monitors, reportRow{AgentID: agent.ID, Agent: name, Path: path, Uptime: models.MonitorUptime(byPath[path], connections, from, end)})
+		}
+	}
+
+	return report, nil
+}
+
+// reportFromQuery builds the report asked for by the period and date query parameters
+func reportFromQuery(c *gin.Context, store models.Store) (availabilityReport, error) {
+	period := c.DefaultQuery("period", reportMonthly)
+
+	from, to, err := reportPeriod(period, c.Query("date"), time.Now())
+	if err != nil {
+		c.String(400, "Invalid report period")
+		return availabilityReport{}, err
+	}
+
+	report, err := buildAvailabilityReport(store, period, from, to, time.Now())
+	if err != nil {
+		log.Println("Error building availability report: ", err)
+		c.String(500, "Unable to build report")
+	}
+
+	return report, err
+}
+
+func getReports(store models.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, err := reportFromQuery(c, store)
+		if err != nil {
+			return
+		}
+
+		c.HTML(http.StatusOK, "reports.templ.html", gin.H{
+			"Report":   report,
+			"Date":     report.From.Format(auditDateFormat),
+			"Previous": report.From.AddDate(0, 0, -1).Format(auditDateFormat),
+			"Next":     report.To.Format(auditDateFormat),
+			"Periods":  []string{reportDaily, reportWeekly, reportMonthly},
+		})
+	}
+}
+
+func getReportPrint(store models.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, err := reportFromQuery(c, store)
+		if err != nil {
+			return
+		}
+
+		c.HTML(http.StatusOK, "report_print.templ.html", gin.H{
+			"Report":    report,
+			"Generated": time.Now(),
+		})
+	}
+}
+
+func getReportCSV(store models.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, err := reportFromQuery(c, store)
+		if err != nil {
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=availability-%s-%s.csv", report.Period, report.From.Format(auditDateFormat)))
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"type", "agent_id", "agent", "monitor", "from", "to", "measured_seconds", "downtime_seconds", "availability_percent", "incidents"})
+
+		for _, rows := range [][]reportRow{report.Agents, report.Monitors} {
+			for _, row := range rows {
+				kind := "agent"
+				if row.Path != "" {
+					kind = "monitor"
+				}
+
+				w.Write([]string{
+					kind,
+					strconv.FormatInt(row.AgentID, 10),
+					row.Agent,
+					row.Path,
+					report.From.Format(time.RFC3339),
+					report.To.Format(time.RFC3339),
+					strconv.FormatInt(int64(row.Measured.Seconds()), 10),
+					strconv.FormatInt(int64(row.Downtime.Seconds()), 10),
+					strconv.FormatFloat(row.Percent(), 'f', 3, 64),
+					strconv.Itoa(row.Incidents),
+				})
+			}
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Println("Error writing availability report: ", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package webservice
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+)
+
+func TestReportPeriod(t *testing.T) {
+	// A Thursday
+	now := time.Date(2020, 10, 15, 13, 30, 0, 0, time.UTC)
+
+	for _, c := range []struct {
+		kind, date string
+		from, to   string
+	}{
+		{reportDaily, "", "2020-10-15", "2020-10-16"},
+		{reportWeekly, "", "2020-10-12", "2020-10-19"},
+		{reportWeekly, "2020-10-18", "2020-10-12", "2020-10-19"},
+		{reportMonthly, "", "2020-10-01", "2020-11-01"},
+		{reportMonthly, "2020-12-31", "2020-12-01", "2021-01-01"},
+	} {
+		from, to, err := reportPeriod(c.kind, c.date, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if from.Format(auditDateFormat) != c.from || to.Format(auditDateFormat) != c.to || from.Hour() != 0 {
+			t.Errorf("%s of %q: expected %s to %s, got %s to %s", c.kind, c.date, c.from, c.to, from, to)
+		}
+	}
+
+	if _, _, err := reportPeriod("year", "", now); err == nil {
+		t.Fatal("Unknown periods should be refused")
+	}
+
+	if _, _, err := reportPeriod(reportDaily, "yesterday", now); err == nil {
+		t.Fatal("Invalid dates should be refused")
+	}
+}
+
+func TestAvailabilityReport(t *testing.T) {
+	r, store, cookie := newTestRouter(t, &fakeCommander{})
+
+	if _, err := store.CreateAgent("reported", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.CreateAgent("never connected", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 0)
+	if err != nil || len(agents) != 2 {
+		t.Fatal("Agents were not created: ", err)
+	}
+
+	reported := agents[0]
+	if reported.Name != "reported" {
+		reported = agents[1]
+	}
+
+	if _, err := store.StartConnection(reported.ID, "192.0.2.1:4000", "9.9.9", models.ProtocolVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, status := range []models.MonitorStatus{
+		{Path: "https://example.com", OK: true, CheckedAt: now.Add(-2 * time.Minute)},
+		{Path: "https://example.com", OK: false, CheckedAt: now.Add(-time.Minute)},
+	} {
+		if err := store.IngestStats(reported.ID, models.Stats{MonitorValues: []models.MonitorStatus{status}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := buildAvailabilityReport(store, reportDaily, now.Add(-time.Hour), now.Add(time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Agents) != 2 || len(report.Monitors) != 1 {
+		t.Fatal("Expected both agents and the one monitor: ", report)
+	}
+
+	for _, row := range report.Agents {
+		if row.AgentID == reported.ID && (row.Measured == 0 || row.Downtime != 0) {
+			t.Fatal("Agent has been connected since it first connected: ", row)
+		}
+
+		if row.AgentID != reported.ID && row.Measured != 0 {
+			t.Fatal("An agent that never connected has no data: ", row)
+		}
+	}
+
+	if m := report.Monitors[0]; m.Path != "https://example.com" || m.Measured != 2*time.Minute || m.Downtime != time.Minute || m.Incidents != 1 {
+		t.Fatal("Monitor should be down for the last of its 2 minutes: ", m)
+	}
+
+	// The day of the last check, so it is in the report even just after midnight
+	req := httptest.NewRequest("GET", "/reports/export.csv?period=day&date="+now.Add(-time.Minute).Format(auditDateFormat), nil)
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if w.Code != 200 || err != nil || len(records) != 4 {
+		t.Fatal("Expected a header, 2 agents and 1 monitor: ", w.Code, records, err)
+	}
+
+	if !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment; filename=availability-day-") {
+		t.Fatal("CSV should be downloaded: ", w.Header())
+	}
+
+	if records[3][0] != "monitor" || records[3][3] != "https://example.com" {
+		t.Fatal("Unexpected monitor row: ", records[3])
+	}
+
+	req = httptest.NewRequest("GET", "/reports/print?period=week", nil)
+	req.AddCookie(cookie)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "https://example.com") || !strings.Contains(body, "No data") || strings.Contains(body, "navbar") {
+		t.Fatal("Expected a printable report without navigation, got: ", w.Code, body)
+	}
+
+	req = httptest.NewRequest("GET", "/reports", nil)
+	req.AddCookie(cookie)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "reported") {
+		t.Fatal("Expected the monthly report, got: ", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/reports?period=fortnight", nil)
+	req.AddCookie(cookie)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatal("Unknown periods should be refused: ", w.Code)
+	}
+}
@@ -1,17 +1,20 @@
 package webservice
 
 import (
-	"encoding/hex"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NHAS/StatsCollector/models"
+	"github.com/NHAS/StatsCollector/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/csrf"
-	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
@@ -19,66 +22,110 @@ const (
 	CookieName = "auth"
 )
 
-func StartWebServer(listenAddr, templates string, db *gorm.DB) {
+// AgentCommander sends commands and config to connected agents
+type AgentCommander interface {
+	RunCommand(agentID int64, command models.Command) (models.CommandResult, error)
+	PushConfig(agentID int64) error
+	DisconnectKey(agentID, keyID int64) bool
+	DisconnectAgent(agentID int64) bool
+}
+
+// StartWebServer serves the web interface in the background, the returned server should be shut down when theia stops.
+// hostKey is theias ssh host key, enrollment tokens carry its fingerprint so agents can pin it
+func StartWebServer(listenAddr, templates string, store models.Store, agents AgentCommander, hostKey ssh.PublicKey) *http.Server {
+
+	CSRF := csrf.Protect([]byte("189734oiylkasJHKUY"), csrf.Secure(false))
+
+	srv := &http.Server{
+		Addr:    listenAddr,
+		Handler: CSRF(newRouter(templates, store, agents, utils.HexFingerprintSHA256(hostKey))),
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Listen error: %s\n", err)
+		}
+	}()
+
+	return srv
+}
+
+// newRouter sets up every page of the web interface, everything but the login page requires a user to be logged in
+func newRouter(templates string, store models.Store, agents AgentCommander, hostKeyFingerprint string) *gin.Engine {
 
 	r := gin.Default()
 	r.SetFuncMap(template.FuncMap{
-		"humanDate":  humanDate,
-		"humanTime":  humanTime,
-		"limitPrint": limitPrint,
-		"Wrap":       wrap,
-		"Hex":        hexEncode,
+		"humanDate":     humanDate,
+		"humanTime":     humanTime,
+		"limitPrint":    limitPrint,
+		"humanDuration": humanDuration,
+		"Wrap":          wrap,
 	})
 
-	r.GET("/", index(db))
-	setupSessionRoutes(r, db)
-
-	db.AutoMigrate(&models.User{})
+	r.GET("/", index(store))
+	setupSessionRoutes(r, store, store)
 
 	r.LoadHTMLGlob(templates + "/*/*.templ.html")
 
-	CSRF := csrf.Protect([]byte("189734oiylkasJHKUY"), csrf.Secure(false))
+	r.Use(authorisionMiddleware(store))
 
-	r.Use(authorisionMiddleware(db))
+	r.GET("/dashboard", getDashboard(store))
 
-	r.GET("/dashboard", getDashboard(db))
+	r.GET("/list_agents", getAgentsList(store))
+	r.GET("/agent/:id", getAgent(store, store, store))
+	r.GET("/agent/:id/latency", getAgentLatency(store))
+	r.POST("/agent/:id/command", postAgentCommand(store, store, agents))
+	r.GET("/agent_key/:fingerprint", getAgentByKey(store))
 
-	r.GET("/list_agents", getAgentsList(db))
-	r.GET("/agent/:pubkey", getAgent(db))
+	r.POST("/add_agent_key", postAddAgentKey(store, store))
+	r.POST("/retire_agent_key", postRetireAgentKey(store, store, agents))
 
-	r.GET("/add_agent", getCreateAgentPage())
-	r.POST("/add_agent", postCreateAgent(db))
-	r.POST("/remove_agent", postRemoveAgent(db))
+	r.GET("/add_agent", getCreateAgentPage(store))
+	r.POST("/add_agent", postCreateAgent(store, store))
+	r.POST("/remove_agent", postRemoveAgent(store, store, agents))
+	r.POST("/archive_agent", postArchiveAgent(store, store, agents))
+	r.POST("/restore_agent", postRestoreAgent(store, store))
 
-	r.GET("/change_password", getChangePassword(db))
-	r.POST("/change_password", postChangePassword(db))
+	r.POST("/add_enrollment_token", postAddEnrollmentToken(store, store, hostKeyFingerprint))
+	r.POST("/remove_enrollment_token", postRemoveEnrollmentToken(store, store))
 
-	r.GET("/list_users", getUsersList(db))
+	r.GET("/change_password", getChangePassword())
+	r.POST("/change_password", postChangePassword(store, store))
+
+	r.GET("/list_users", getUsersList(store))
 
 	r.GET("/create_user", getCreateUsersPage())
-	r.POST("/create_user", postCreateUser(db))
-	r.POST("/remove_user", postRemoveUser(db))
+	r.POST("/create_user", postCreateUser(store, store))
+	r.POST("/remove_user", postRemoveUser(store, store))
 
-	r.GET("/notification_settings", getNotificationsConfigPage(db))
-	r.POST("/notification_settings", postNotificationConfigPage(db))
+	r.GET("/notification_settings", getNotificationsConfigPage(store))
+	r.POST("/notification_settings", postNotificationConfigPage(store, store))
 
-	r.POST("/set_alert", postSetAlert(db))
+	r.POST("/set_alert", postSetAlert(store, store))
 
-	srv := &http.Server{
-		Addr:    listenAddr,
-		Handler: CSRF(r),
-	}
+	r.GET("/groups", getGroups(store))
+	r.POST("/add_group", postAddGroup(store, store))
+	r.POST("/remove_group", postRemoveGroup(store, store, agents))
+	r.POST("/group_members", postGroupMembers(store, store, agents))
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Listen error: %s\n", err)
-		}
-	}()
+	r.POST("/add_monitor", postAddMonitor(store, store, agents))
+	r.POST("/remove_monitor", postRemoveMonitor(store, store, agents))
+
+	r.GET("/audit", getAuditLog(store))
+	r.GET("/audit/export", getAuditExport(store))
+
+	r.GET("/events", getEvents(store, store))
+
+	r.GET("/reports", getReports(store))
+	r.GET("/reports/export.csv", getReportCSV(store))
+	r.GET("/reports/print", getReportPrint(store))
+
+	return r
 }
 
-func index(db *gorm.DB) gin.HandlerFunc {
+func index(users models.UserStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if valid, _ := checkCookie(c, db); valid {
+		if valid, _ := checkCookie(c, users); valid {
 			c.Redirect(302, "/dashboard")
 			return
 		}
@@ -87,10 +134,10 @@ func index(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func getDashboard(db *gorm.DB) gin.HandlerFunc {
+func getDashboard(store models.AgentStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		totalAgents, downAgents, degradedAgents, failedEndPoints, err := models.GetDashboardInformation()
+		totalAgents, downAgents, degradedAgents, failedEndPoints, err := store.GetDashboardInformation()
 		if err != nil {
 			log.Println("Unable to load information for dashboard: ", err)
 			c.String(500, "Unable to load dashboard")
@@ -108,7 +155,7 @@ func getDashboard(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func getAgentsList(db *gorm.DB) gin.HandlerFunc {
+func getAgentsList(store models.AgentStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		query := c.Request.URL.Query()
 
@@ -117,7 +164,7 @@ func getAgentsList(db *gorm.DB) gin.HandlerFunc {
 			filter = query["status"][0]
 		}
 
-		agents, err := models.GetAgentList(filter, 100)
+		agents, err := store.GetAgentList(filter, 100)
 		if err != nil {
 			log.Println("Error getting agents list: ", err)
 			c.String(500, "Unable to get agents list")
@@ -125,36 +172,202 @@ func getAgentsList(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.HTML(http.StatusOK, "agentlist.templ.html", gin.H{"Agents": agents, csrf.TemplateTag: csrf.TemplateField(c.Request)})
+		archived, err := store.GetArchivedAgents()
+		if err != nil {
+			log.Println("Error getting archived agents: ", err)
+		}
+
+		c.HTML(http.StatusOK, "agentlist.templ.html", gin.H{"Agents": agents, "Archived": archived, csrf.TemplateTag: csrf.TemplateField(c.Request)})
+	}
+}
+
+// agentByID looks up an agent by the id used in its URLs and forms
+func agentByID(store models.AgentStore, id string) (models.Agent, error) {
+	agentID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+	if err != nil {
+		return models.Agent{}, err
 	}
+
+	return store.GetAgent(agentID)
+}
+
+func agentURL(agentID int64) string {
+	return "/agent/" + strconv.FormatInt(agentID, 10)
 }
 
-func getAgent(db *gorm.DB) gin.HandlerFunc {
+func getAgent(store models.AgentStore, connections models.ConnectionStore, events models.EventStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		key, err := hex.DecodeString(c.Param("pubkey"))
+		currentAgent, err := agentByID(store, c.Param("id"))
 		if err != nil {
-			log.Println(err)
-			c.String(404, "Not found nerd")
+			log.Println("Unable to get current agent: ", err)
+			c.String(404, "Agent not found")
+			return
+		}
+
+		commands, err := store.GetCommandLog(currentAgent.ID, 10)
+		if err != nil {
+			log.Println("Unable to get command log: ", err)
+		}
 
+		managed, err := store.GetMonitorDefinitions(currentAgent.ID)
+		if err != nil {
+			log.Println("Unable to get managed monitors: ", err)
+		}
+
+		config, err := models.NewConfigUpdate(managed)
+		if err != nil {
+			log.Println("Unable to build agent config: ", err)
+		}
+
+		history, err := getConnectionHistory(connections, currentAgent.ID, time.Now())
+		if err != nil {
+			log.Println("Unable to get connection history: ", err)
+		}
+
+		recent, totalEvents, err := events.GetEvents(models.EventFilter{AgentIDs: []int64{currentAgent.ID}}, 0, recentEvents)
+		if err != nil {
+			log.Println("Unable to get events: ", err)
+		}
+
+		c.HTML(http.StatusOK, "agent.templ.html", gin.H{
+			"Agent":           &currentAgent,
+			"Connections":     history,
+			"Events":          recent,
+			"EventsTotal":     totalEvents,
+			"EventsURL":       eventsURL(currentAgent.ID),
+			"Commands":        commands,
+			"ManagedMonitors": managed,
+			"ConfigRevision":  config.Revision,
+			csrf.TemplateTag:  csrf.TemplateField(c.Request),
+		})
+	}
+}
+
+func postAgentCommand(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.Keys["user"].(models.User)
+
+		currentAgent, err := agentByID(store, c.Param("id"))
+		if err != nil {
+			log.Println("Unable to get current agent: ", err)
+			c.JSON(404, gin.H{"error": "Agent not found"})
 			return
 		}
 
-		currentAgent, err := models.GetAgent(string(key))
+		id, err := utils.GenerateHexToken(8)
+		if err != nil {
+			log.Println("Error generating command id: ", err)
+			c.JSON(500, gin.H{"error": "Server error"})
+			return
+		}
+
+		command := models.Command{
+			Id:     id,
+			Action: c.PostForm("action"),
+			Check:  strings.TrimSpace(c.PostForm("check")),
+		}
+
+		switch command.Action {
+		case models.CommandRecheck, models.CommandSystemInfo, models.CommandRunCheck:
+		default:
+			c.JSON(400, gin.H{"error": "Unknown command"})
+			return
+		}
+
+		// No audit record, no command
+		entry, err := store.RecordCommand(currentAgent.ID, u.Username, command)
+		if err != nil {
+			log.Println("Unable to audit command: ", err)
+			c.JSON(500, gin.H{"error": "Unable to record command"})
+			return
+		}
+
+		log.Printf("User [%s] sent %q [%s] to agent %d", u.Username, command.Action, command.Id, currentAgent.ID)
+		recordAudit(c, audit, models.AuditAgentCommand, agentTarget(currentAgent.ID), nil, command)
+
+		result, err := agents.RunCommand(currentAgent.ID, command)
+		if err != nil {
+			if err := store.CompleteCommand(entry, false, err.Error()); err != nil {
+				log.Println("Unable to audit command outcome: ", err)
+			}
+
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		outcome := "Completed"
+		if !result.OK {
+			outcome = result.Error
+		} else if len(result.Monitors) > 0 {
+			failed := 0
+			for _, m := range result.Monitors {
+				if !m.OK {
+					failed++
+				}
+			}
+			outcome = fmt.Sprintf("%d checks run, %d failed", len(result.Monitors), failed)
+		}
+
+		if err := store.CompleteCommand(entry, result.OK, outcome); err != nil {
+			log.Println("Unable to audit command outcome: ", err)
+		}
+
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+type latencyPoint struct {
+	Time    int64   `json:"t"`
+	OK      bool    `json:"ok"`
+	DNS     float32 `json:"dns"`
+	Connect float32 `json:"connect"`
+	TLS     float32 `json:"tls"`
+	TTFB    float32 `json:"ttfb"`
+	Total   float32 `json:"total"`
+}
+
+func getAgentLatency(store models.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+		if err != nil || hours < 1 {
+			c.String(400, "Invalid hours")
+			return
+		}
+
+		currentAgent, err := agentByID(store, c.Param("id"))
 		if err != nil {
 			log.Println("Unable to get current agent: ", err)
 			c.String(404, "Agent not found")
 			return
 		}
 
-		c.HTML(http.StatusOK, "agent.templ.html", gin.H{
-			"Agent":          &currentAgent,
-			csrf.TemplateTag: csrf.TemplateField(c.Request),
-		})
+		samples, err := store.GetMonitorSamples(currentAgent.ID, time.Now().Add(-time.Duration(hours)*time.Hour))
+		if err != nil {
+			log.Println("Unable to get monitor history: ", err)
+			c.String(500, "Unable to get monitor history")
+			return
+		}
+
+		history := make(map[string][]latencyPoint)
+		for _, s := range samples {
+			history[s.Path] = append(history[s.Path], latencyPoint{
+				Time:    s.CreatedAt.Unix() * 1000,
+				OK:      s.OK,
+				DNS:     s.DNSMs,
+				Connect: s.ConnectMs,
+				TLS:     s.TLSMs,
+				TTFB:    s.TTFBMs,
+				Total:   s.TotalMs,
+			})
+		}
+
+		c.JSON(http.StatusOK, history)
 	}
 }
 
-func getChangePassword(db *gorm.DB) gin.HandlerFunc {
+func getChangePassword() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.HTML(http.StatusOK, "changepassword.templ.html", gin.H{
 			"Status":         "",
@@ -164,14 +377,14 @@ func getChangePassword(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func postChangePassword(db *gorm.DB) gin.HandlerFunc {
+func postChangePassword(store models.UserStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		u := c.Keys["user"].(models.User)
 		newPassword := c.PostForm("password")
 		confirm := c.PostForm("confirmPassword")
 		previousPassword := c.PostForm("currentPassword")
 
-		if err := models.ChangePassword(u.Id, newPassword, confirm, previousPassword, u.Password); err != nil {
+		if err := store.ChangePassword(u.Id, newPassword, confirm, previousPassword, u.Password); err != nil {
 			c.HTML(http.StatusOK, "changepassword.templ.html", gin.H{
 				"Status":         err.Error(),
 				"Error":          true,
@@ -180,6 +393,9 @@ func postChangePassword(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Neither password is recorded, only that it changed
+		recordAudit(c, audit, models.AuditPassword, userTarget(u.Username), nil, nil)
+
 		c.HTML(http.StatusOK, "changepassword.templ.html", gin.H{
 			"Status":         "Password changed",
 			"Error":          false,
@@ -188,10 +404,10 @@ func postChangePassword(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func getUsersList(db *gorm.DB) gin.HandlerFunc {
+func getUsersList(store models.UserStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		users, err := models.GetAllUsers()
+		users, err := store.GetAllUsers()
 		if err != nil {
 			c.String(500, err.Error())
 			return
@@ -205,14 +421,36 @@ func getUsersList(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func postRemoveUser(db *gorm.DB) gin.HandlerFunc {
+func postRemoveUser(store models.UserStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		guid := c.PostForm("userid")
 
-		err := models.DeleteUser(c.PostForm("userid"))
+		users, err := store.GetAllUsers()
 		if err != nil {
 			c.String(500, err.Error())
 			return
 		}
+
+		var removed *models.User
+		for i := range users {
+			if users[i].GUID == guid {
+				removed = &users[i]
+			}
+		}
+
+		if removed == nil {
+			c.String(404, "User not found")
+			return
+		}
+
+		err = store.DeleteUser(guid)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+
+		recordAudit(c, audit, models.AuditUserDelete, userTarget(removed.Username), gin.H{"username": removed.Username}, nil)
+
 		c.Redirect(302, "/list_users")
 	}
 }
@@ -225,73 +463,283 @@ func getCreateUsersPage() gin.HandlerFunc {
 	}
 }
 
-func postCreateUser(db *gorm.DB) gin.HandlerFunc {
+func postCreateUser(store models.UserStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		username := c.PostForm("username")
 		password := c.PostForm("password")
 
-		if err := models.AddUser(username, password); err != nil {
+		if err := store.AddUser(username, password); err != nil {
 			log.Println(err)
 			c.Redirect(301, "/create_user")
 			return
 		}
+
+		recordAudit(c, audit, models.AuditUserCreate, userTarget(username), nil, gin.H{"username": username})
+
 		c.Redirect(http.StatusFound, "/list_users")
 	}
 }
 
-func getCreateAgentPage() gin.HandlerFunc {
+// renderCreateAgent shows the add agent page, along with the outstanding enrollment tokens and the groups new agents can be put in
+func renderCreateAgent(c *gin.Context, store models.AgentStore, isError bool, status, token string) {
+	tokens, err := store.GetEnrollmentTokens()
+	if err != nil {
+		log.Println("Error getting enrollment tokens: ", err)
+	}
+
+	groups, err := store.GetGroups()
+	if err != nil {
+		log.Println("Error getting groups: ", err)
+	}
+
+	c.HTML(http.StatusOK, "createagent.templ.html", gin.H{
+		"Error":          isError,
+		"Status":         status,
+		"Token":          token,
+		"Tokens":         tokens,
+		"Groups":         groups,
+		csrf.TemplateTag: csrf.TemplateField(c.Request),
+	})
+}
+
+func getCreateAgentPage(store models.AgentStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.HTML(http.StatusOK, "createagent.templ.html", gin.H{
-			"Error":          false,
-			"Status":         "",
-			csrf.TemplateTag: csrf.TemplateField(c.Request),
-		})
+		renderCreateAgent(c, store, false, "", "")
 	}
 }
 
-func postCreateAgent(db *gorm.DB) gin.HandlerFunc {
+func postCreateAgent(store models.AgentStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		name := strings.TrimSpace(c.PostForm("name"))
 		key := strings.TrimSpace(c.PostForm("sshkey"))
 
-		err := models.CreateAgent(name, key)
+		agentID, err := store.CreateAgent(name, key)
 		if err != nil {
-			c.HTML(http.StatusOK, "createagent.templ.html", gin.H{
-				"Error":          true,
-				"Status":         err.Error(),
-				csrf.TemplateTag: csrf.TemplateField(c.Request),
-			})
+			renderCreateAgent(c, store, true, err.Error(), "")
 			return
 		}
 
-		c.HTML(http.StatusOK, "createagent.templ.html", gin.H{
-			"Error":          false,
-			"Status":         "Agent key added!",
-			csrf.TemplateTag: csrf.TemplateField(c.Request),
-		})
+		recordAudit(c, audit, models.AuditAgentCreate, agentTarget(agentID), nil, gin.H{"name": name, "pub_key": key})
 
+		renderCreateAgent(c, store, false, "Agent key added!", "")
+
+	}
+}
+
+func postAddEnrollmentToken(store models.AgentStore, audit models.AuditStore, hostKeyFingerprint string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.Keys["user"].(models.User)
+
+		hours, err := strconv.Atoi(c.PostForm("hours"))
+		if err != nil {
+			renderCreateAgent(c, store, true, "Invalid number of hours", "")
+			return
+		}
+
+		var groupIDs []int64
+		for _, id := range c.PostFormArray("groups") {
+			groupID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				c.String(400, "Invalid group")
+				return
+			}
+			groupIDs = append(groupIDs, groupID)
+		}
+
+		tokenID, secret, err := store.CreateEnrollmentToken(c.PostForm("name"), u.Username, groupIDs, time.Duration(hours)*time.Hour)
+		if err != nil {
+			renderCreateAgent(c, store, true, err.Error(), "")
+			return
+		}
+
+		// The secret is never recorded, anyone reading the audit log could enroll an agent with it
+		recordAudit(c, audit, models.AuditTokenCreate, enrollmentTokenTarget(tokenID), nil, gin.H{"agent_name": c.PostForm("name"), "groups": groupIDs, "valid_for_hours": hours})
+
+		renderCreateAgent(c, store, false, "Enrollment token created, it will only be shown once", models.FormatEnrollmentToken(secret, hostKeyFingerprint))
 	}
 }
 
-func postRemoveAgent(db *gorm.DB) gin.HandlerFunc {
+func postRemoveEnrollmentToken(store models.AgentStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		key := strings.TrimSpace(c.PostForm("pubkey"))
+		id, err := strconv.ParseInt(c.PostForm("token"), 10, 64)
+		if err != nil {
+			c.String(400, "Invalid token")
+			return
+		}
+
+		var before interface{}
+		if tokens, err := store.GetEnrollmentTokens(); err == nil {
+			for _, token := range tokens {
+				if token.Id == id {
+					before = gin.H{"agent_name": token.AgentName, "created_by": token.CreatedBy, "expires_at": token.ExpiresAt}
+				}
+			}
+		}
+
+		if err := store.DeleteEnrollmentToken(id); err != nil {
+			log.Println("Error removing enrollment token: ", err)
+			c.String(500, "Unable to remove enrollment token")
+			return
+		}
+
+		recordAudit(c, audit, models.AuditTokenDelete, enrollmentTokenTarget(id), before, nil)
+
+		c.Redirect(302, "/add_agent")
+	}
+}
 
-		err := models.DeleteAgent(key)
+func postRemoveAgent(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
 		if err != nil {
+			log.Println("Unable to get agent to remove: ", err)
+			c.String(404, "Agent not found")
+			return
+		}
+
+		if err := store.DeleteAgent(currentAgent.ID); err != nil {
 			log.Println("Error removing agent: ", err)
+			c.String(500, "Unable to remove agent")
+			return
+		}
+
+		recordAudit(c, audit, models.AuditAgentDelete, agentTarget(currentAgent.ID), gin.H{"name": currentAgent.Name, "pub_key": currentAgent.PubKey}, nil)
+
+		// Otherwise its session would keep reporting stats for an agent that no longer exists
+		if agents.DisconnectAgent(currentAgent.ID) {
+			log.Printf("Disconnected agent %d, it has been removed", currentAgent.ID)
+		}
+
+		c.Redirect(302, "/list_agents")
+	}
+}
+
+func postArchiveAgent(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.Keys["user"].(models.User)
+
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
+		if err != nil {
+			c.String(404, "Agent not found")
+			return
 		}
+
+		if err := store.ArchiveAgent(currentAgent.ID); err != nil {
+			log.Println("Error archiving agent: ", err)
+			c.String(500, "Unable to archive agent")
+			return
+		}
+
+		log.Printf("User [%s] archived agent %d", u.Username, currentAgent.ID)
+		recordAudit(c, audit, models.AuditAgentArchive, agentTarget(currentAgent.ID), gin.H{"archived": false}, gin.H{"archived": true})
+
+		if agents.DisconnectAgent(currentAgent.ID) {
+			log.Printf("Disconnected agent %d, it has been archived", currentAgent.ID)
+		}
+
 		c.Redirect(302, "/list_agents")
+	}
+}
+
+func postRestoreAgent(store models.AgentStore, audit models.AuditStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.Keys["user"].(models.User)
+
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
+		if err != nil {
+			c.String(404, "Agent not found")
+			return
+		}
+
+		if err := store.RestoreAgent(currentAgent.ID); err != nil {
+			log.Println("Error restoring agent: ", err)
+			c.String(500, "Unable to restore agent")
+			return
+		}
+
+		log.Printf("User [%s] restored agent %d", u.Username, currentAgent.ID)
+		recordAudit(c, audit, models.AuditAgentRestore, agentTarget(currentAgent.ID), gin.H{"archived": true}, gin.H{"archived": false})
+
+		c.Redirect(302, agentURL(currentAgent.ID))
+	}
+}
+
+func getAgentByKey(store models.AgentStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, err := store.GetAgentKeyByFingerprint(c.Param("fingerprint"))
+		if err != nil {
+			c.String(404, "Agent not found")
+			return
+		}
+
+		c.Redirect(302, agentURL(key.AgentId))
+	}
+}
+
+func postAddAgentKey(store models.AgentStore, audit models.AuditStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.Keys["user"].(models.User)
+
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
+		if err != nil {
+			c.String(404, "Agent not found")
+			return
+		}
+
+		key, err := store.AddAgentKey(currentAgent.ID, c.PostForm("pubkey"))
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+
+		log.Printf("User [%s] added key [%s] to agent %d", u.Username, key.Fingerprint, currentAgent.ID)
+		recordAudit(c, audit, models.AuditKeyAdd, agentTarget(currentAgent.ID), nil, gin.H{"key": key.Id, "fingerprint": key.Fingerprint})
 
+		c.Redirect(302, agentURL(currentAgent.ID))
 	}
 }
 
-func getNotificationsConfigPage(db *gorm.DB) gin.HandlerFunc {
+func postRetireAgentKey(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		u := c.Keys["user"].(models.User)
 
-		emailInformation, err := models.GetNotificationSettingsForUser(u.Id)
-		if err != nil && err != gorm.ErrRecordNotFound {
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
+		if err != nil {
+			c.String(404, "Agent not found")
+			return
+		}
+
+		keyID, err := strconv.ParseInt(c.PostForm("key"), 10, 64)
+		if err != nil {
+			c.String(400, "Invalid key")
+			return
+		}
+
+		key, err := store.RetireAgentKey(currentAgent.ID, keyID)
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+
+		log.Printf("User [%s] retired key [%s] of agent %d", u.Username, key.Fingerprint, currentAgent.ID)
+		recordAudit(c, audit, models.AuditKeyRetire, agentTarget(currentAgent.ID),
+			gin.H{"key": key.Id, "fingerprint": key.Fingerprint, "retired": false},
+			gin.H{"key": key.Id, "fingerprint": key.Fingerprint, "retired": true})
+
+		if agents.DisconnectKey(currentAgent.ID, key.Id) {
+			log.Printf("Disconnected agent %d, it was still using its retired key", currentAgent.ID)
+		}
+
+		c.Redirect(302, agentURL(currentAgent.ID))
+	}
+}
+
+func getNotificationsConfigPage(store models.UserStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.Keys["user"].(models.User)
+
+		emailInformation, err := store.GetNotificationSettingsForUser(u.Id)
+		if err != nil && err != models.ErrNotFound {
 			c.String(500, "Error fetching data")
 			return
 		}
@@ -305,7 +753,7 @@ func getNotificationsConfigPage(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func postNotificationConfigPage(db *gorm.DB) gin.HandlerFunc {
+func postNotificationConfigPage(store models.UserStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		u := c.Keys["user"].(models.User)
 
@@ -314,13 +762,13 @@ func postNotificationConfigPage(db *gorm.DB) gin.HandlerFunc {
 		sendAddress := c.PostForm("sendFrom")
 		password := c.PostForm("sendPassword")
 
-		emailInformation, err := models.GetNotificationSettingsForUser(u.Id)
-		if err != nil && err != gorm.ErrRecordNotFound {
+		emailInformation, err := store.GetNotificationSettingsForUser(u.Id)
+		if err != nil && err != models.ErrNotFound {
 			c.String(500, "Error fetching data")
 			return
 		}
 
-		err = models.CreateNotificationSetting(u.Id, dest, sendAddress, password, host)
+		err = store.CreateNotificationSetting(u.Id, dest, sendAddress, password, host)
 		if err != nil {
 			c.HTML(http.StatusOK, "notificationsettings.templ.html", gin.H{
 				"Host":             emailInformation.EmailProviderHost,
@@ -333,6 +781,11 @@ func postNotificationConfigPage(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// The sending accounts password is left out, the audit log is readable by every user
+		recordAudit(c, audit, models.AuditNotify, userTarget(u.Username),
+			gin.H{"destination": emailInformation.Destination, "send_address": emailInformation.SendAddress, "host": emailInformation.EmailProviderHost},
+			gin.H{"destination": dest, "send_address": sendAddress, "host": host})
+
 		c.HTML(http.StatusOK, "notificationsettings.templ.html", gin.H{
 			"Host":             emailInformation.EmailProviderHost,
 			"DestinationEmail": emailInformation.Destination,
@@ -344,7 +797,7 @@ func postNotificationConfigPage(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
-func postSetAlert(db *gorm.DB) gin.HandlerFunc {
+func postSetAlert(store models.AgentStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		status := strings.TrimSpace(c.PostForm("shouldAlert"))
@@ -357,19 +810,263 @@ func postSetAlert(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		pubkey, err := hex.DecodeString(c.PostForm("pubkey"))
+		latencyInt := int64(0)
+		if latency := strings.TrimSpace(c.PostForm("latencyThreshold")); len(latency) > 0 {
+			latencyInt, err = strconv.ParseInt(latency, 10, 64)
+			if err != nil || latencyInt < 0 {
+				log.Println(err)
+				c.String(400, "No convert = bad")
+				return
+			}
+		}
+
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
 		if err != nil {
 			log.Println(err)
-			c.String(400, "No decode? Bad")
+			c.String(404, "Agent not found")
 			return
 		}
 
-		err = models.CreateAlertProfileForAgent(string(pubkey), diskInt, (status == "enabled"))
+		err = store.SetAlertProfile(currentAgent.ID, diskInt, latencyInt, (status == "enabled"))
 		if err != nil {
 			c.String(500, err.Error())
 			return
 		}
 
-		c.Redirect(302, "/agent/"+c.PostForm("pubkey"))
+		before := currentAgent.AlertProfile
+		recordAudit(c, audit, models.AuditAlertProfile, agentTarget(currentAgent.ID),
+			gin.H{"active": before.Active, "disk_util": before.DiskUtil, "latency_ms": before.LatencyMs},
+			gin.H{"active": status == "enabled", "disk_util": diskInt, "latency_ms": latencyInt})
+
+		c.Redirect(302, agentURL(currentAgent.ID))
+	}
+}
+
+func pushConfig(agents AgentCommander, agentIDs ...int64) {
+	for _, id := range agentIDs {
+		if err := agents.PushConfig(id); err != nil {
+			log.Printf("Unable to push config to agent %d: %s", id, err)
+		}
+	}
+}
+
+func getGroups(store models.AgentStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		groups, err := store.GetGroups()
+		if err != nil {
+			log.Println("Error getting groups: ", err)
+			c.String(500, "Unable to get groups")
+			return
+		}
+
+		agents, err := store.GetAgentList("", 1000)
+		if err != nil {
+			log.Println("Error getting agents list: ", err)
+			c.String(500, "Unable to get agents list")
+			return
+		}
+
+		c.HTML(http.StatusOK, "groups.templ.html", gin.H{
+			"Groups":         groups,
+			"Agents":         agents,
+			"Status":         c.Query("error"),
+			csrf.TemplateTag: csrf.TemplateField(c.Request),
+		})
+	}
+}
+
+// groupByID finds a group and its members, returning models.ErrNotFound if there is no such group
+func groupByID(store models.AgentStore, groupID int64) (models.Group, error) {
+	groups, err := store.GetGroups()
+	if err != nil {
+		return models.Group{}, err
+	}
+
+	for _, group := range groups {
+		if group.ID == groupID {
+			return group, nil
+		}
+	}
+
+	return models.Group{}, models.ErrNotFound
+}
+
+func postAddGroup(store models.AgentStore, audit models.AuditStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := strings.TrimSpace(c.PostForm("name"))
+		if err := store.CreateGroup(name); err != nil {
+			log.Println("Error creating group: ", err)
+			c.Redirect(302, "/groups?error="+url.QueryEscape(err.Error()))
+			return
+		}
+
+		target := "group:"
+		if groups, err := store.GetGroups(); err == nil {
+			for _, group := range groups {
+				if group.Name == name {
+					target = groupTarget(group.ID)
+				}
+			}
+		}
+		recordAudit(c, audit, models.AuditGroupCreate, target, nil, gin.H{"name": name})
+
+		c.Redirect(302, "/groups")
+	}
+}
+
+func postRemoveGroup(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseInt(c.PostForm("group"), 10, 64)
+		if err != nil {
+			c.String(400, "Invalid group")
+			return
+		}
+
+		group, err := groupByID(store, groupID)
+		if err != nil {
+			c.String(404, "Group not found")
+			return
+		}
+
+		members, err := store.DeleteGroup(groupID)
+		if err != nil {
+			log.Println("Error removing group: ", err)
+			c.String(500, "Unable to remove group")
+			return
+		}
+
+		recordAudit(c, audit, models.AuditGroupDelete, groupTarget(groupID), gin.H{"name": group.Name, "members": members}, nil)
+
+		pushConfig(agents, members...)
+
+		c.Redirect(302, "/groups")
+	}
+}
+
+func postGroupMembers(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseInt(c.PostForm("group"), 10, 64)
+		if err != nil {
+			c.String(400, "Invalid group")
+			return
+		}
+
+		var agentIDs []int64
+		for _, id := range c.PostFormArray("agents") {
+			agentID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				c.String(400, "Invalid agent")
+				return
+			}
+			agentIDs = append(agentIDs, agentID)
+		}
+
+		before, err := store.GetGroupAgentIDs(groupID)
+		if err != nil {
+			log.Println("Error getting group members: ", err)
+			c.String(500, "Unable to set group members")
+			return
+		}
+
+		changed, err := store.SetGroupMembers(groupID, agentIDs)
+		if err != nil {
+			log.Println("Error setting group members: ", err)
+			c.String(500, "Unable to set group members")
+			return
+		}
+
+		if len(changed) > 0 {
+			recordAudit(c, audit, models.AuditGroupMembers, groupTarget(groupID), gin.H{"members": before}, gin.H{"members": agentIDs})
+		}
+
+		pushConfig(agents, changed...)
+
+		c.Redirect(302, "/groups")
+	}
+}
+
+func postAddMonitor(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		monitorURL := c.PostForm("url")
+		name := c.PostForm("name")
+		options := c.PostForm("options")
+
+		// Options are left out, they can hold credentials for the site being monitored
+		added := gin.H{"url": monitorURL, "name": name}
+
+		if groupID, err := strconv.ParseInt(c.PostForm("group"), 10, 64); err == nil {
+			if err := store.CreateMonitorDefinition(0, groupID, monitorURL, name, options); err != nil {
+				c.Redirect(302, "/groups?error="+url.QueryEscape(err.Error()))
+				return
+			}
+
+			recordAudit(c, audit, models.AuditMonitorCreate, groupTarget(groupID), nil, added)
+
+			members, err := store.GetGroupAgentIDs(groupID)
+			if err != nil {
+				log.Println("Unable to get group members: ", err)
+			}
+			pushConfig(agents, members...)
+
+			c.Redirect(302, "/groups")
+			return
+		}
+
+		currentAgent, err := agentByID(store, c.PostForm("agent"))
+		if err != nil {
+			log.Println("Unable to get current agent: ", err)
+			c.String(404, "Agent not found")
+			return
+		}
+
+		if err := store.CreateMonitorDefinition(currentAgent.ID, 0, monitorURL, name, options); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+
+		recordAudit(c, audit, models.AuditMonitorCreate, agentTarget(currentAgent.ID), nil, added)
+
+		pushConfig(agents, currentAgent.ID)
+
+		c.Redirect(302, agentURL(currentAgent.ID))
+	}
+}
+
+func postRemoveMonitor(store models.AgentStore, audit models.AuditStore, agents AgentCommander) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.PostForm("monitor"), 10, 64)
+		if err != nil {
+			c.String(400, "Invalid monitor")
+			return
+		}
+
+		definition, err := store.DeleteMonitorDefinition(id)
+		if err != nil {
+			log.Println("Error removing monitor: ", err)
+			c.String(500, "Unable to remove monitor")
+			return
+		}
+
+		target := agentTarget(definition.AgentId)
+		if definition.GroupId != 0 {
+			target = groupTarget(definition.GroupId)
+		}
+		recordAudit(c, audit, models.AuditMonitorDelete, target, gin.H{"monitor": definition.Id, "url": definition.URL, "name": definition.Name}, nil)
+
+		if definition.GroupId != 0 {
+			members, err := store.GetGroupAgentIDs(definition.GroupId)
+			if err != nil {
+				log.Println("Unable to get group members: ", err)
+			}
+			pushConfig(agents, members...)
+
+			c.Redirect(302, "/groups")
+			return
+		}
+
+		pushConfig(agents, definition.AgentId)
+
+		c.Redirect(302, agentURL(definition.AgentId))
 	}
 }
@@ -0,0 +1,475 @@
+package webservice
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/StatsCollector/models"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeCommander struct {
+	disconnected       []int64
+	disconnectedAgents []int64
+}
+
+func (f *fakeCommander) RunCommand(agentID int64, command models.Command) (models.CommandResult, error) {
+	return models.CommandResult{}, nil
+}
+
+func (f *fakeCommander) PushConfig(agentID int64) error {
+	return nil
+}
+
+func (f *fakeCommander) DisconnectKey(agentID, keyID int64) bool {
+	f.disconnected = append(f.disconnected, keyID)
+	return true
+}
+
+func (f *fakeCommander) DisconnectAgent(agentID int64) bool {
+	f.disconnectedAgents = append(f.disconnectedAgents, agentID)
+	return true
+}
+
+func newTestPubKey(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(ssh.MarshalAuthorizedKey(key))
+}
+
+// newTestRouter returns the web interface backed by a MemoryStore, and the auth cookie of a logged in user
+func newTestRouter(t *testing.T, agents AgentCommander) (*gin.Engine, *models.MemoryStore, *http.Cookie) {
+	gin.SetMode(gin.TestMode)
+
+	store := models.NewMemoryStore()
+	if err := store.AddUser("admin", "a long enough password"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetUserToken(user.Id, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	return newRouter("../../../resources", store, agents, "fingerprint"), store, &http.Cookie{Name: CookieName, Value: "admin:token"}
+}
+
+func TestPagesRequireLogin(t *testing.T) {
+	r, _, _ := newTestRouter(t, &fakeCommander{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard", nil))
+
+	if w.Code == 200 {
+		t.Fatal("Dashboard was shown without logging in")
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	r, store, cookie := newTestRouter(t, &fakeCommander{})
+
+	if _, err := store.CreateAgent("web-agent", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/dashboard", nil)
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatal("Expected the dashboard, got: ", w.Code, w.Body.String())
+	}
+}
+
+func TestRetireAgentKeyDisconnects(t *testing.T) {
+	commander := &fakeCommander{}
+	r, store, cookie := newTestRouter(t, commander)
+
+	if _, err := store.CreateAgent("rotating", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agent := agents[0]
+
+	if _, err := store.AddAgentKey(agent.ID, newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	retired := agent.Keys[0]
+
+	form := url.Values{"agent": {strconv.FormatInt(agent.ID, 10)}, "key": {strconv.FormatInt(retired.Id, 10)}}
+	req := httptest.NewRequest("POST", "/retire_agent_key", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 302 {
+		t.Fatal("Expected a redirect back to the agent, got: ", w.Code, w.Body.String())
+	}
+
+	if len(commander.disconnected) != 1 || commander.disconnected[0] != retired.Id {
+		t.Fatal("Agent using the retired key was not disconnected: ", commander.disconnected)
+	}
+
+	if _, err := store.GetActiveAgentKey(retired.PubKey); err == nil {
+		t.Fatal("Key was not retired")
+	}
+}
+
+func TestArchiveAgent(t *testing.T) {
+	commander := &fakeCommander{}
+	r, store, cookie := newTestRouter(t, commander)
+
+	if _, err := store.CreateAgent("archived", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agent := agents[0]
+
+	form := url.Values{"agent": {strconv.FormatInt(agent.ID, 10)}}
+	req := httptest.NewRequest("POST", "/archive_agent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 302 {
+		t.Fatal("Expected a redirect to the agent list, got: ", w.Code, w.Body.String())
+	}
+
+	if len(commander.disconnectedAgents) != 1 || commander.disconnectedAgents[0] != agent.ID {
+		t.Fatal("Archived agent was not disconnected: ", commander.disconnectedAgents)
+	}
+
+	if _, err := store.GetActiveAgentKey(agent.Keys[0].PubKey); err == nil {
+		t.Fatal("Archived agent can still authenticate")
+	}
+
+	req = httptest.NewRequest("GET", "/list_agents", nil)
+	req.AddCookie(cookie)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/restore_agent") {
+		t.Fatal("Archived agent was not listed to be restored: ", w.Code)
+	}
+}
+
+func TestRemoveAgentDisconnects(t *testing.T) {
+	commander := &fakeCommander{}
+	r, store, cookie := newTestRouter(t, commander)
+
+	if _, err := store.CreateAgent("removed", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agent := agents[0]
+
+	form := url.Values{"agent": {strconv.FormatInt(agent.ID, 10)}}
+	req := httptest.NewRequest("POST", "/remove_agent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 302 {
+		t.Fatal("Expected a redirect to the agent list, got: ", w.Code, w.Body.String())
+	}
+
+	if len(commander.disconnectedAgents) != 1 || commander.disconnectedAgents[0] != agent.ID {
+		t.Fatal("Removed agent was not disconnected: ", commander.disconnectedAgents)
+	}
+
+	if err := store.IngestStats(agent.ID, models.Stats{MemoryUsage: 10}); err == nil {
+		t.Fatal("Stats for the removed agent were accepted")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	r, store, cookie := newTestRouter(t, &fakeCommander{})
+
+	if _, err := store.CreateAgent("audited", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agent := agents[0]
+
+	form := url.Values{"agent": {strconv.FormatInt(agent.ID, 10)}, "shouldAlert": {"enabled"}, "diskUtilisation": {"90"}}
+	req := httptest.NewRequest("POST", "/set_alert", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 302 {
+		t.Fatal("Expected a redirect back to the agent, got: ", w.Code, w.Body.String())
+	}
+
+	form = url.Values{"username": {"admin"}, "password": {"wrong"}}
+	req = httptest.NewRequest("POST", "/authenticate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries, err := store.GetAuditLog(models.AuditFilter{Target: agentTarget(agent.ID)}, 0)
+	if err != nil || len(entries) != 1 {
+		t.Fatal("Changing the alert profile was not audited: ", entries, err)
+	}
+
+	if entries[0].Actor != "admin" || entries[0].Action != models.AuditAlertProfile || entries[0].Before == "" || !strings.Contains(entries[0].After, `"disk_util":90`) {
+		t.Fatal("Audit entry is missing what changed: ", entries[0])
+	}
+
+	failed, err := store.GetAuditLog(models.AuditFilter{Action: models.AuditLoginFailed}, 0)
+	if err != nil || len(failed) != 1 || failed[0].Actor != "admin" {
+		t.Fatal("Failed login was not audited: ", failed, err)
+	}
+
+	req = httptest.NewRequest("GET", "/audit/export?target=agent:", nil)
+	req.AddCookie(cookie)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 || strings.Count(w.Body.String(), "\n") != 1 || !strings.Contains(w.Body.String(), `"action":"`+models.AuditAlertProfile+`"`) {
+		t.Fatal("Expected the agent entry exported as a JSON line, got: ", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/audit?actor=admin", nil)
+	req.AddCookie(cookie)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 || !strings.Contains(w.Body.String(), models.AuditLoginFailed) {
+		t.Fatal("Expected the audit log page, got: ", w.Code)
+	}
+}
+
+func TestAuditCreatedTargets(t *testing.T) {
+	r, store, cookie := newTestRouter(t, &fakeCommander{})
+
+	for _, form := range []url.Values{
+		{"name": {"created"}, "sshkey": {newTestPubKey(t)}},
+		{"name": {"enrolled"}, "hours": {"1"}},
+	} {
+		path := "/add_agent"
+		if form.Get("hours") != "" {
+			path = "/add_enrollment_token"
+		}
+
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatal("Expected the add agent page, got: ", w.Code, w.Body.String())
+		}
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+
+	tokens, err := store.GetEnrollmentTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Fatal("Enrollment token was not created: ", err)
+	}
+
+	for action, target := range map[string]string{
+		models.AuditAgentCreate: agentTarget(agents[0].ID),
+		models.AuditTokenCreate: enrollmentTokenTarget(tokens[0].Id),
+	} {
+		entries, err := store.GetAuditLog(models.AuditFilter{Action: action}, 0)
+		if err != nil || len(entries) != 1 || entries[0].Target != target {
+			t.Fatalf("Expected %s to be audited against %s, got %v %v", action, target, entries, err)
+		}
+	}
+}
+
+func TestAgentConnectionHistory(t *testing.T) {
+	r, store, cookie := newTestRouter(t, &fakeCommander{})
+
+	if _, err := store.CreateAgent("connected", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agent := agents[0]
+
+	connection, err := store.StartConnection(agent.ID, "192.0.2.1:4000", "9.9.9", models.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.EndConnection(connection, models.DisconnectDecodeError); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.StartConnection(agent.ID, "192.0.2.1:4001", "9.9.9", models.ProtocolVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", agentURL(agent.ID), nil)
+	req.AddCookie(cookie)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "192.0.2.1:4000") || !strings.Contains(body, models.DisconnectDecodeError) || !strings.Contains(body, "Available over the last 30 days") {
+		t.Fatal("Expected the connection log on the agent page, got: ", w.Code, body)
+	}
+
+	history, err := getConnectionHistory(store, agent.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent has been connected since it first connected, bar the moment between its connections
+	if len(history.Availability) != len(availabilityWindows) || history.Availability[0].Percent < 99 {
+		t.Fatal("Availability should only count from the first connection: ", history.Availability)
+	}
+
+	if len(history.Recent) != 2 || history.Recent[0].DisconnectedAt != nil || len(history.Timeline) != 2 {
+		t.Fatal("Expected both connections newest first: ", history.Recent)
+	}
+}
+
+func TestEventBrowser(t *testing.T) {
+	r, store, cookie := newTestRouter(t, &fakeCommander{})
+
+	for _, name := range []string{"noisy", "quiet"} {
+		if _, err := store.CreateAgent(name, newTestPubKey(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agents, err := store.GetAgentList("", 0)
+	if err != nil || len(agents) != 2 {
+		t.Fatal("Agents were not created: ", err)
+	}
+	noisy, quiet := agents[0], agents[1]
+
+	if err := store.CreateGroup("quiet ones"); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := store.GetGroups()
+	if err != nil || len(groups) != 1 {
+		t.Fatal("Group was not created: ", err)
+	}
+
+	if _, err := store.SetGroupMembers(groups[0].ID, []int64{quiet.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < eventPageSize+10; i++ {
+		if err := store.AddEvent(models.Event{AgentId: noisy.ID, Urgency: 3, Title: fmt.Sprintf("Noise %d", i), CreatedAt: start.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.AddEvent(models.Event{AgentId: quiet.ID, Urgency: 1, Title: "Agent down", Message: "Not heard from in ages"}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get(agentURL(noisy.ID))
+	if code != 200 || !strings.Contains(body, "Noise 59") || strings.Contains(body, "Noise 49") || !strings.Contains(body, eventsURL(noisy.ID)) {
+		t.Fatal("Agent page should only show the latest events, with a link to the rest: ", code, body)
+	}
+
+	code, body = get(eventsURL(noisy.ID))
+	if code != 200 || !strings.Contains(body, "Page 1 of 2") || !strings.Contains(body, "Noise 10<") || strings.Contains(body, "Noise 9<") || strings.Contains(body, "Agent down") {
+		t.Fatal("Expected the first page of the noisy agents events: ", code, body)
+	}
+
+	code, body = get(eventsURL(noisy.ID) + "&page=2")
+	if code != 200 || !strings.Contains(body, "Page 2 of 2") || !strings.Contains(body, "Noise 0<") || strings.Contains(body, "Noise 10<") {
+		t.Fatal("Expected the second page of the noisy agents events: ", code, body)
+	}
+
+	for _, path := range []string{
+		"/events?group=" + strconv.FormatInt(groups[0].ID, 10),
+		"/events?q=AGES",
+		"/events?urgency=1&notified=no",
+	} {
+		code, body = get(path)
+		if code != 200 || !strings.Contains(body, "Agent down") || strings.Contains(body, "Noise") {
+			t.Fatal("Expected only the quiet agents event from ", path, ": ", code, body)
+		}
+	}
+
+	code, body = get("/events?group=" + strconv.FormatInt(groups[0].ID, 10) + "&agent=" + strconv.FormatInt(noisy.ID, 10))
+	if code != 200 || !strings.Contains(body, "No events") {
+		t.Fatal("The agent isnt in the group, so nothing should match: ", code, body)
+	}
+
+	for _, path := range []string{"/events?page=0", "/events?notified=maybe", "/events?agent=noisy"} {
+		if code, _ := get(path); code != 400 {
+			t.Fatal("Expected an invalid filter to be refused: ", path, code)
+		}
+	}
+}
@@ -3,16 +3,14 @@ package webservice
 import (
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/NHAS/StatsCollector/models"
 	"github.com/NHAS/StatsCollector/utils"
 	"github.com/gin-gonic/gin"
-	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func setupSessionRoutes(r *gin.Engine, db *gorm.DB) {
+func setupSessionRoutes(r *gin.Engine, users models.UserStore, audit models.AuditStore) {
 
 	b, err := utils.GenerateRandomBytes(16)
 	utils.Check("Generating random bytes failed", err)
@@ -20,12 +18,12 @@ func setupSessionRoutes(r *gin.Engine, db *gorm.DB) {
 	dummyPassword, err := bcrypt.GenerateFromPassword(b, bcrypt.DefaultCost)
 	utils.Check("Creating dummy password hash failed", err)
 
-	r.POST("/authenticate", authenticatePOST(db, dummyPassword))
-	r.GET("/logout", logoutGET(db))
+	r.POST("/authenticate", authenticatePOST(users, audit, dummyPassword))
+	r.GET("/logout", logoutGET(users, audit))
 
 }
 
-func authenticatePOST(db *gorm.DB, dummyPassword []byte) gin.HandlerFunc {
+func authenticatePOST(users models.UserStore, audit models.AuditStore, dummyPassword []byte) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		username := c.PostForm("username")
 		password := c.PostForm("password")
@@ -35,15 +33,17 @@ func authenticatePOST(db *gorm.DB, dummyPassword []byte) gin.HandlerFunc {
 			return
 		}
 
-		var record models.User
-		if err := db.Where("username = ?", username).First(&record).Error; err != nil {
+		record, err := users.GetUser(username)
+		if err != nil {
 			bcrypt.CompareHashAndPassword(dummyPassword, []byte(password)) // Dummy compair to stop timing attacks
+			recordAuditAs(c, audit, username, models.AuditLoginFailed, userTarget(username), nil, nil)
 			c.Redirect(302, "/")
 			log.Println(err)
 			return
 		}
 
 		if err := bcrypt.CompareHashAndPassword([]byte(record.Password), []byte(password)); err != nil {
+			recordAuditAs(c, audit, username, models.AuditLoginFailed, userTarget(username), nil, nil)
 			c.Redirect(302, "/")
 			log.Println(err)
 			return
@@ -58,15 +58,14 @@ func authenticatePOST(db *gorm.DB, dummyPassword []byte) gin.HandlerFunc {
 			return
 		}
 
-		if db.Model(&record).Updates(models.User{
-			Token:          token,
-			TokenCreatedAt: time.Now().Unix(),
-		}).Error != nil {
+		if err := users.SetUserToken(record.Id, token); err != nil {
 			log.Println("Error saving token in database: ", err)
 			c.String(http.StatusInternalServerError, "Server error")
 			return
 		}
 
+		recordAuditAs(c, audit, record.Username, models.AuditLogin, userTarget(record.Username), nil, nil)
+
 		c.SetSameSite(http.SameSiteStrictMode) // Stupid way of setting same site gin....
 		c.SetCookie(CookieName, record.Username+":"+token, 3600, "", "localhost:8080", false, true)
 
@@ -76,9 +75,9 @@ func authenticatePOST(db *gorm.DB, dummyPassword []byte) gin.HandlerFunc {
 
 }
 
-func logoutGET(db *gorm.DB) gin.HandlerFunc {
+func logoutGET(users models.UserStore, audit models.AuditStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		valid, u := checkCookie(c, db)
+		valid, u := checkCookie(c, users)
 		if !valid {
 			denyRequest(c)
 			return
@@ -91,16 +90,14 @@ func logoutGET(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		if err := db.Debug().Model(&models.User{}).Where("guid = ? AND token = ?", u.GUID, u.Token).
-			Updates(models.User{
-				Token:          newToken,
-				TokenCreatedAt: time.Now().Unix(),
-			}).Error; err != nil {
+		if err := users.SetUserToken(u.Id, newToken); err != nil {
 			log.Println("Error saving token in database: ", err)
 			c.String(http.StatusInternalServerError, "Server error")
 			return
 		}
 
+		recordAuditAs(c, audit, u.Username, models.AuditLogout, userTarget(u.Username), nil, nil)
+
 		c.Redirect(302, "/")
 
 	}
@@ -1,7 +1,6 @@
 package webservice
 
 import (
-	"encoding/hex"
 	"fmt"
 	"html/template"
 	"time"
@@ -35,12 +34,12 @@ func humanTime(time time.Time) string {
 	return humanDate(time.Unix())
 }
 
-func limitPrint(number float32) string {
-	return fmt.Sprintf("%.2f", number)
+func humanDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
 }
 
-func hexEncode(s string) string {
-	return hex.EncodeToString([]byte(s))
+func limitPrint(number float32) string {
+	return fmt.Sprintf("%.2f", number)
 }
 
 func wrap(agent models.Agent, csrfElement template.HTML) map[string]interface{} {
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/jinzhu/gorm"
 )
 
 //Agent is the overarching database structure tying all client metrics together
@@ -19,11 +20,30 @@ type Agent struct {
 
 	SystemInfo   SystemInfo
 	AlertProfile Alert
-	Events       []Event
 
 	MemoryUsage float32
 	Disks       []DiskEntry    `gorm:"PRELOAD:true"`
 	Monitors    []MonitorEntry `gorm:"PRELOAD:true"`
+
+	Groups []Group `gorm:"many2many:agent_groups"`
+
+	//Keys are the keys the agent can authenticate with, PubKey is only the key it was first registered with
+	Keys []AgentKey
+
+	//ConfigRevision is the revision of the centrally managed monitors the agent last acknowledged, ConfigError is set if it refused them
+	ConfigRevision int64
+	ConfigError    string
+
+	//Principal is set for agents that authenticate with a certificate from the agent CA, they are matched by it rather than by key.
+	//The rest describe the certificate last used
+	Principal              string
+	CertificateKeyId       string
+	CertificateSerial      string
+	CertificateAuthority   string
+	CertificateValidBefore time.Time
+
+	//ArchivedAt is set when an agent is archived, it can no longer authenticate and is hidden but its history is kept until it is purged
+	ArchivedAt *time.Time
 }
 
 //ErrAgentNameTooLong is returned when an agent name is too long
@@ -32,66 +52,169 @@ var ErrAgentNameTooLong = errors.New("Agent name was >1000 characters long")
 //ErrAgentPubKeyNotValid is returned when an ssh key given for an agent is not parsable as a public key
 var ErrAgentPubKeyNotValid = errors.New("The key supplied to create an agent was invalid (not an SSH public key)")
 
-//CreateAgent parses a public key and adds a new agent to the database.
-func CreateAgent(Name, PubKey string) error {
-
-	if len(Name) > 1000 {
+//validateNewAgent checks the name and key an agent is being created with
+func validateNewAgent(name, pubKey string) error {
+	if len(name) > 1000 {
 		return ErrAgentNameTooLong
 	}
 
-	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(PubKey))
-	if len(PubKey) == 0 || err != nil {
+	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if len(pubKey) == 0 || err != nil {
 		return ErrAgentPubKeyNotValid
 	}
 
+	return nil
+}
+
+//CreateAgent parses a public key and adds a new agent to the database, returning the id of the new agent.
+func (s DatabaseStore) CreateAgent(Name, PubKey string) (int64, error) {
+
+	if err := validateNewAgent(Name, PubKey); err != nil {
+		return 0, err
+	}
+
 	var newAgent models.Agent
 	newAgent.Name = Name
 	newAgent.PubKey = PubKey
 
-	return db.Create(&newAgent).Error
+	tx := s.db.Begin()
+	if err := tx.Create(&newAgent).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if _, err := newAgentKey(tx, newAgent.ID, PubKey); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return newAgent.ID, tx.Commit().Error
+}
+
+//agentTables are the models that belong to an agent through their agent_id. Deleting an agent deletes its rows in every one, so any new model with an AgentId must be added here
+var agentTables = []interface{}{
+	&MonitorEntry{},
+	&DiskEntry{},
+	&Alert{},
+	&Event{},
+	&SystemInfo{},
+	&AgentKey{},
+	&MonitorDefinition{},
+	&CommandLog{},
+	&MonitorSample{},
+	&MetricSample{},
+	&AgentConnection{},
+}
+
+//ErrAgentArchived is returned when an archived agent tries to connect
+var ErrAgentArchived = errors.New("Agent is archived")
+
+//DeleteAgent removes an agent and everything that belongs to it, including its history, in a single transaction
+func (s DatabaseStore) DeleteAgent(agentID int64) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := deleteAgent(tx, agentID); err != nil {
+		tx.Rollback()
+		return notFound(err)
+	}
+
+	return tx.Commit().Error
 }
 
-//DeleteAgent removes an agent and any of its relationed structures (such as disk information) from the database
-//Todo, this is currently a fragile way of doing this, as we have to keep adding more "delete" statements. GORM probably has a way of doing this. But am unsure
-func DeleteAgent(PubKey string) error {
+func deleteAgent(tx *gorm.DB, agentID int64) error {
+	if err := tx.First(&Agent{}, "id = ?", agentID).Error; err != nil {
+		return err
+	}
+
+	for _, table := range agentTables {
+		if err := tx.Delete(table, "agent_id = ?", agentID).Error; err != nil {
+			return err
+		}
+	}
 
-	var toRemove models.Agent
-	if err := db.Find(&toRemove, "pub_key = ?", PubKey).Error; err != nil {
+	if err := tx.Exec("DELETE FROM agent_groups WHERE agent_id = ?", agentID).Error; err != nil {
 		return err
 	}
 
-	db.Where("id = ?", toRemove.Id).Delete(&toRemove)
-	db.Delete(&models.MonitorEntry{}, "agent_id = ?", toRemove.Id)
-	db.Delete(&models.DiskEntry{}, "agent_id = ?", toRemove.Id)
-	db.Delete(&models.Alert{}, "agent_id = ?", toRemove.Id)
-	db.Delete(&models.Event{}, "agent_id = ?", toRemove.Id)
-	db.Delete(&models.SystemInfo{}, "agent_id = ?", toRemove.Id)
+	// Used enrollment tokens are kept as a record of who let the agent in
+	if err := tx.Model(&EnrollmentToken{}).Where("agent_id = ?", agentID).Update("agent_id", 0).Error; err != nil {
+		return err
+	}
 
-	return nil
+	return tx.Delete(&Agent{}, "id = ?", agentID).Error
+}
+
+//ArchiveAgent stops an agent authenticating and hides it, while keeping its history until it is purged or the agent is restored
+func (s DatabaseStore) ArchiveAgent(agentID int64) error {
+	var agent Agent
+	if err := s.db.First(&agent, "id = ?", agentID).Error; err != nil {
+		return notFound(err)
+	}
+
+	if agent.ArchivedAt != nil {
+		return nil
+	}
+
+	return s.db.Model(&agent).Updates(map[string]interface{}{"archived_at": time.Now(), "currently_connected": false}).Error
+}
+
+//RestoreAgent brings an archived agent back, it can connect again straight away
+func (s DatabaseStore) RestoreAgent(agentID int64) error {
+	if err := s.db.First(&Agent{}, "id = ?", agentID).Error; err != nil {
+		return notFound(err)
+	}
+
+	return s.db.Model(&Agent{}).Where("id = ?", agentID).Update("archived_at", gorm.Expr("NULL")).Error
+}
+
+//GetArchivedAgents returns every archived agent, most recently archived first
+func (s DatabaseStore) GetArchivedAgents() (agents []Agent, err error) {
+	return agents, s.db.Where("archived_at IS NOT NULL").Order("archived_at desc").Find(&agents).Error
+}
+
+//PurgeArchivedAgents deletes the agents archived before cutoff, returning their ids
+func (s DatabaseStore) PurgeArchivedAgents(cutoff time.Time) (purged []int64, err error) {
+	var agents []Agent
+	if err := s.db.Where("archived_at IS NOT NULL AND archived_at < ?", cutoff).Find(&agents).Error; err != nil {
+		return nil, err
+	}
+
+	for _, agent := range agents {
+		if err := s.DeleteAgent(agent.ID); err != nil {
+			return purged, err
+		}
+		purged = append(purged, agent.ID)
+	}
+
+	return purged, nil
 }
 
-//GetAgent returns an agent from the database with the matching Public Key
+//GetAgent returns an agent from the database by its ID, which stays the same when its key is rotated
 //It also loads all the associated structures, such as monitors and disk information
-func GetAgent(PubKey string) (Agent, error) {
+func (s DatabaseStore) GetAgent(id int64) (Agent, error) {
 	var currentAgent Agent
 
-	if err := db.Preload("AlertProfile").
+	if err := s.db.Preload("AlertProfile").
 		Preload("Monitors").
 		Preload("Disks").
 		Preload("SystemInfo").
-		Preload("Events").
-		Find(&currentAgent, "pub_key = ?", string(PubKey)).Error; err != nil {
+		Preload("Groups").
+		Preload("Keys", func(db *gorm.DB) *gorm.DB { return db.Order("created_at desc") }).
+		First(&currentAgent, "id = ?", id).Error; err != nil {
 
-		return Agent{}, err
+		return Agent{}, notFound(err)
 	}
 
 	return currentAgent, nil
 }
 
-//GetAgentList returns a limited number of agents with a filter whether they are connected or not.
-func GetAgentList(filter string, limit int) (agents []Agent, err error) {
+//GetAgentList returns a limited number of agents with a filter whether they are connected or not. Archived agents are left out
+func (s DatabaseStore) GetAgentList(filter string, limit int) (agents []Agent, err error) {
 
-	tx := db
+	tx := s.db.Where("archived_at IS NULL")
 	if len(filter) > 0 {
 		tx = tx.Where("currently_connected = ?", filter == "online")
 	}
@@ -103,26 +226,28 @@ func GetAgentList(filter string, limit int) (agents []Agent, err error) {
 
 //GetDashboardInformation gets the agents that are up or down and those that have failed endpoints.
 // This is used in the dashboard
-func GetDashboardInformation() (totalAgents int, downAgents []Agent, degradedAgents []Agent, failedEndPoints []MonitorEntry, err error) {
+func (s DatabaseStore) GetDashboardInformation() (totalAgents int, downAgents []Agent, degradedAgents []Agent, failedEndPoints []MonitorEntry, err error) {
 
-	err = db.Model(&models.Agent{}).Count(&totalAgents).Error
+	err = s.db.Model(&models.Agent{}).Where("archived_at IS NULL").Count(&totalAgents).Error
 	if err != nil {
 		goto failed
 	}
 
-	err = db.Find(&downAgents, "currently_connected = ?", false).Error
+	err = s.db.Find(&downAgents, "currently_connected = ? AND archived_at IS NULL", false).Error
 	if err != nil {
 		goto failed
 	}
 
-	err = db.Select("DISTINCT agents.*").
+	err = s.db.Select("DISTINCT agents.*").
 		Joins("INNER JOIN monitor_entries ON agents.id = monitor_entries.agent_id").
-		Find(&degradedAgents, "(NOT monitor_entries.ok) AND agents.currently_connected").Error
+		Find(&degradedAgents, "(NOT monitor_entries.ok) AND agents.currently_connected AND agents.archived_at IS NULL").Error
 	if err != nil {
 		goto failed
 	}
 
-	err = db.Find(&failedEndPoints, "ok = ?", false).Error
+	err = s.db.Select("monitor_entries.*").
+		Joins("INNER JOIN agents ON agents.id = monitor_entries.agent_id").
+		Find(&failedEndPoints, "monitor_entries.ok = ? AND agents.archived_at IS NULL", false).Error
 	if err != nil {
 		goto failed
 	}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/NHAS/StatsCollector/utils"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/ssh"
+)
+
+//AgentKey is a public key an agent can authenticate with. An agent can have several, so its key can be rotated without losing its history
+type AgentKey struct {
+	Id      int64
+	AgentId int64 `gorm:"index"`
+
+	//PubKey is the key in authorized_keys format without the comment, Fingerprint is its SHA256 in hex
+	PubKey      string `gorm:"unique;not null"`
+	Fingerprint string `gorm:"unique;not null"`
+	Comment     string
+
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RetiredAt  *time.Time
+}
+
+//ErrAgentKeyInUse is returned when adding a key that already belongs to an agent, retired or not
+var ErrAgentKeyInUse = errors.New("That key is already in use by an agent")
+
+//ErrLastAgentKey is returned when retiring the only active key of an agent, which would lock it out
+var ErrLastAgentKey = errors.New("Cannot retire the last active key of an agent, add its new key first")
+
+//parseAgentKey splits a key in authorized_keys format into the key itself, its fingerprint and its comment
+func parseAgentKey(authorizedKey string) (pubKey, fingerprint, comment string, err error) {
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if len(strings.TrimSpace(authorizedKey)) == 0 || err != nil {
+		return "", "", "", ErrAgentPubKeyNotValid
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), utils.HexFingerprintSHA256(key), comment, nil
+}
+
+func newAgentKey(tx *gorm.DB, agentID int64, authorizedKey string) (AgentKey, error) {
+	pubKey, fingerprint, comment, err := parseAgentKey(authorizedKey)
+	if err != nil {
+		return AgentKey{}, err
+	}
+
+	var existing int
+	if err := tx.Model(&AgentKey{}).Where("pub_key = ?", pubKey).Count(&existing).Error; err != nil {
+		return AgentKey{}, err
+	}
+
+	if existing > 0 {
+		return AgentKey{}, ErrAgentKeyInUse
+	}
+
+	key := AgentKey{AgentId: agentID, PubKey: pubKey, Fingerprint: fingerprint, Comment: comment}
+	return key, tx.Create(&key).Error
+}
+
+//AddAgentKey authorises another key for an agent, the first step in rotating its key
+func (s DatabaseStore) AddAgentKey(agentID int64, authorizedKey string) (AgentKey, error) {
+	if err := s.db.First(&Agent{}, agentID).Error; err != nil {
+		return AgentKey{}, notFound(err)
+	}
+
+	return newAgentKey(s.db, agentID, authorizedKey)
+}
+
+//RetireAgentKey stops a key being used to authenticate as the agent, the last step in rotating its key. The key is kept so it cant be reused
+func (s DatabaseStore) RetireAgentKey(agentID, keyID int64) (AgentKey, error) {
+	var key AgentKey
+	if err := s.db.First(&key, "id = ? AND agent_id = ?", keyID, agentID).Error; err != nil {
+		return AgentKey{}, notFound(err)
+	}
+
+	if key.RetiredAt != nil {
+		return key, nil
+	}
+
+	var active int
+	if err := s.db.Model(&AgentKey{}).Where("agent_id = ? AND retired_at IS NULL", agentID).Count(&active).Error; err != nil {
+		return AgentKey{}, err
+	}
+
+	if active < 2 {
+		return AgentKey{}, ErrLastAgentKey
+	}
+
+	now := time.Now()
+	key.RetiredAt = &now
+
+	return key, s.db.Model(&key).Update("retired_at", now).Error
+}
+
+//GetAgentKeys returns every key an agent has had, newest first
+func (s DatabaseStore) GetAgentKeys(agentID int64) (keys []AgentKey, err error) {
+	return keys, s.db.Where("agent_id = ?", agentID).Order("created_at desc").Find(&keys).Error
+}
+
+//GetActiveAgentKey finds the key an agent is authenticating with, retired keys and the keys of archived agents are never returned
+func (s DatabaseStore) GetActiveAgentKey(authorizedKey string) (AgentKey, error) {
+	pubKey, _, _, err := parseAgentKey(authorizedKey)
+	if err != nil {
+		return AgentKey{}, err
+	}
+
+	var key AgentKey
+	err = s.db.Select("agent_keys.*").
+		Joins("INNER JOIN agents ON agents.id = agent_keys.agent_id").
+		First(&key, "agent_keys.pub_key = ? AND agent_keys.retired_at IS NULL AND agents.archived_at IS NULL", pubKey).Error
+	return key, notFound(err)
+}
+
+//GetAgentKeyByFingerprint finds a key, retired or not, by its SHA256 fingerprint
+func (s DatabaseStore) GetAgentKeyByFingerprint(fingerprint string) (AgentKey, error) {
+	var key AgentKey
+	return key, notFound(s.db.First(&key, "fingerprint = ?", strings.ToLower(fingerprint)).Error)
+}
+
+//TouchAgentKey records that a key was just used, so it is clear when an agent has switched to its new key
+func (s DatabaseStore) TouchAgentKey(keyID int64) error {
+	return s.db.Model(&AgentKey{}).Where("id = ?", keyID).Update("last_used_at", time.Now()).Error
+}
+
+//migrateAgentKeys gives agents that predate AgentKey their original key, agents registered by certificate dont have one.
+//It is migration 3, so it only uses the tables as the initial schema created them
+func migrateAgentKeys(tx *gorm.DB) error {
+	var agents []v1Agent
+	if err := tx.Select("id, pub_key").Where("pub_key NOT LIKE ? AND id NOT IN (?)", CertificatePubKeyPrefix+"%", tx.Table("agent_keys").Select("agent_id").QueryExpr()).Find(&agents).Error; err != nil {
+		return err
+	}
+
+	for _, agent := range agents {
+		pubKey, fingerprint, comment, err := parseAgentKey(agent.PubKey)
+		if err == nil {
+			var existing int
+			if err = tx.Model(&v1AgentKey{}).Where("pub_key = ?", pubKey).Count(&existing).Error; err != nil {
+				return err
+			}
+
+			if existing > 0 {
+				err = ErrAgentKeyInUse
+			}
+		}
+
+		// Keys that were never valid cant be used to connect anyway, so they shouldnt stop the migration
+		if err != nil {
+			log.Printf("Unable to migrate key of agent %d: %s", agent.ID, err)
+			continue
+		}
+
+		if err := tx.Create(&v1AgentKey{AgentId: agent.ID, PubKey: pubKey, Fingerprint: fingerprint, Comment: comment}).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestRotateAgentKey(t *testing.T) {
+	setupDatabase()
+
+	oldKey := newTestPubKey(t)
+	if _, err := store.CreateAgent("rotating", oldKey+" old@host"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := store.GetActiveAgentKey(oldKey)
+	if err != nil {
+		t.Fatal("Registered key was not active: ", err)
+	}
+
+	if current.Comment != "old@host" {
+		t.Fatal("Key comment was not kept: ", current.Comment)
+	}
+
+	if _, err := store.RetireAgentKey(current.AgentId, current.Id); err != ErrLastAgentKey {
+		t.Fatal("Retired the only key of an agent: ", err)
+	}
+
+	newKey := newTestPubKey(t)
+	added, err := store.AddAgentKey(current.AgentId, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.AddAgentKey(current.AgentId, newKey); err != ErrAgentKeyInUse {
+		t.Fatal("Added the same key twice: ", err)
+	}
+
+	if _, err := store.RetireAgentKey(current.AgentId, current.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetActiveAgentKey(oldKey); err == nil {
+		t.Fatal("Retired key can still authenticate")
+	}
+
+	if _, err := store.AddAgentKey(current.AgentId, oldKey); err != ErrAgentKeyInUse {
+		t.Fatal("Retired key was reused: ", err)
+	}
+
+	byFingerprint, err := store.GetAgentKeyByFingerprint(added.Fingerprint)
+	if err != nil || byFingerprint.AgentId != current.AgentId {
+		t.Fatal("Could not find the agent by its new key: ", err)
+	}
+
+	if err := store.TouchAgentKey(added.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := store.GetAgent(current.AgentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.PubKey != oldKey+" old@host" || len(agent.Keys) != 2 {
+		t.Fatal("Agent lost its history when its key was rotated: ", agent)
+	}
+
+	for _, key := range agent.Keys {
+		if key.Id == added.Id && key.LastUsedAt == nil {
+			t.Fatal("Use of the new key was not recorded")
+		}
+	}
+
+	for _, disk := range []int64{80, 90} {
+		if err := store.SetAlertProfile(agent.ID, disk, 0, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var alerts []Alert
+	if err := db.Find(&alerts, "agent_id = ?", agent.ID).Error; err != nil || len(alerts) != 1 || alerts[0].DiskUtil != 90 || !alerts[0].Active {
+		t.Fatal("Alert profile of a rotated agent was not replaced: ", alerts, err)
+	}
+}
+
+func TestMigrateAgentKeys(t *testing.T) {
+	setupDatabase()
+
+	legacy := Agent{Name: "legacy", PubKey: newTestPubKey(t)}
+	if err := db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	certificate := Agent{Name: "certificate", PubKey: CertificatePubKeyPrefix + "migrate-1", Principal: "migrate-1"}
+	if err := db.Create(&certificate).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := migrateAgentKeys(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := store.GetAgentKeys(legacy.ID)
+	if err != nil || len(keys) != 1 {
+		t.Fatal("Legacy agent was not given exactly one key: ", keys, err)
+	}
+
+	if keys, err := store.GetAgentKeys(certificate.ID); err != nil || len(keys) != 0 {
+		t.Fatal("Certificate agent was given a key: ", keys, err)
+	}
+}
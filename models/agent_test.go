@@ -0,0 +1,206 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteAgentCascades(t *testing.T) {
+	restore := useEmptyDatabase(t, "delete-agent")
+	defer restore()
+
+	if _, err := store.CreateAgent("deleted", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.CreateAgent("kept", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var agents []Agent
+	if err := db.Order("id").Find(&agents).Error; err != nil || len(agents) != 2 {
+		t.Fatal("Agents were not created: ", err)
+	}
+
+	if err := store.CreateGroup("members"); err != nil {
+		t.Fatal(err)
+	}
+
+	var group Group
+	if err := db.First(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.SetGroupMembers(group.ID, []int64{agents[0].ID, agents[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, agent := range agents {
+		if err := store.IngestStats(agent.ID, Stats{
+			DiskUsage:     map[string]float32{"/dev/sda1": 10},
+			MonitorValues: []MonitorStatus{{Path: "https://example.com", OK: true, CheckedAt: time.Now()}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		rows := []interface{}{
+			&Alert{AgentId: agent.ID},
+			&Event{AgentId: agent.ID, Title: "event"},
+			&SystemInfo{AgentId: agent.ID},
+			&MonitorDefinition{AgentId: agent.ID, URL: "https://example.com"},
+			&CommandLog{AgentId: agent.ID},
+			&AgentConnection{AgentId: agent.ID, ConnectedAt: time.Now()},
+		}
+		for _, row := range rows {
+			if err := db.Create(row).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := db.Create(&EnrollmentToken{SecretHash: "used", AgentId: agents[0].ID}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteAgent(agents[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"agent_groups"}
+	for _, table := range agentTables {
+		tables = append(tables, db.NewScope(table).TableName())
+	}
+
+	for _, table := range tables {
+		var remaining, kept int
+		if err := db.Table(table).Where("agent_id = ?", agents[0].ID).Count(&remaining).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Table(table).Where("agent_id = ?", agents[1].ID).Count(&kept).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if remaining != 0 || kept == 0 {
+			t.Fatalf("%s: %d rows of the deleted agent left, %d rows of the other agent kept", table, remaining, kept)
+		}
+	}
+
+	var token EnrollmentToken
+	if err := db.First(&token, "secret_hash = ?", "used").Error; err != nil || token.AgentId != 0 {
+		t.Fatal("Used enrollment token was not kept, or still refers to the agent: ", token, err)
+	}
+
+	if err := store.DeleteAgent(agents[0].ID); err == nil {
+		t.Fatal("Deleted an agent that doesnt exist")
+	}
+}
+
+//TestAgentTablesComplete catches a new table that refers to agents but isnt cleaned up when one is deleted
+func TestAgentTablesComplete(t *testing.T) {
+	restore := useEmptyDatabase(t, "agent-tables")
+	defer restore()
+
+	covered := map[string]bool{"agent_groups": true, "enrollment_tokens": true}
+	for _, table := range agentTables {
+		covered[db.NewScope(table).TableName()] = true
+	}
+
+	var tables []string
+	if err := db.Raw("SELECT name FROM sqlite_master WHERE type = 'table'").Pluck("name", &tables).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range tables {
+		if db.Dialect().HasColumn(table, "agent_id") && !covered[table] {
+			t.Errorf("Table %s has an agent_id but is not in agentTables", table)
+		}
+	}
+}
+
+func TestArchiveAgent(t *testing.T) {
+	restore := useEmptyDatabase(t, "archive-agent")
+	defer restore()
+
+	pubKey := newTestPubKey(t)
+	if _, err := store.CreateAgent("archived", pubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := store.GetActiveAgentKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.IngestStats(key.AgentId, Stats{MemoryUsage: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.ArchiveAgent(key.AgentId); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetActiveAgentKey(pubKey); err == nil {
+		t.Fatal("Archived agent can still authenticate")
+	}
+
+	if agents, err := store.GetAgentList("", 10); err != nil || len(agents) != 0 {
+		t.Fatal("Archived agent is still listed: ", agents, err)
+	}
+
+	if total, _, _, _, err := store.GetDashboardInformation(); err != nil || total != 0 {
+		t.Fatal("Archived agent is still on the dashboard: ", total, err)
+	}
+
+	archived, err := store.GetArchivedAgents()
+	if err != nil || len(archived) != 1 {
+		t.Fatal("Archived agent is not listed as archived: ", archived, err)
+	}
+
+	if samples, err := store.GetMetricSamples(key.AgentId, time.Time{}); err != nil || len(samples) == 0 {
+		t.Fatal("Archived agent lost its history: ", err)
+	}
+
+	if err := store.RestoreAgent(key.AgentId); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetActiveAgentKey(pubKey); err != nil {
+		t.Fatal("Restored agent cannot authenticate: ", err)
+	}
+
+	if err := store.ArchiveAgent(key.AgentId); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged, err := store.PurgeArchivedAgents(time.Now().Add(-time.Hour)); err != nil || len(purged) != 0 {
+		t.Fatal("Purged an agent before its retention period was up: ", purged, err)
+	}
+
+	if purged, err := store.PurgeArchivedAgents(time.Now().Add(time.Minute)); err != nil || len(purged) != 1 {
+		t.Fatal("Archived agent was not purged: ", purged, err)
+	}
+
+	if samples, err := store.GetMetricSamples(key.AgentId, time.Time{}); err != nil || len(samples) != 0 {
+		t.Fatal("Purged agent's history was kept: ", err)
+	}
+}
+
+func TestMissingAgentNotFound(t *testing.T) {
+	restore := useEmptyDatabase(t, "missing-agent")
+	defer restore()
+
+	for name, s := range map[string]Store{"database": store, "memory": NewMemoryStore()} {
+		if _, err := s.GetAgent(404); err != ErrNotFound {
+			t.Fatalf("%s store returned %v for a missing agent, expected ErrNotFound", name, err)
+		}
+
+		if err := s.ArchiveAgent(404); err != ErrNotFound {
+			t.Fatalf("%s store returned %v archiving a missing agent, expected ErrNotFound", name, err)
+		}
+
+		if _, err := s.GetFirstConnection(404); err != ErrNotFound {
+			t.Fatalf("%s store returned %v for an agent that never connected, expected ErrNotFound", name, err)
+		}
+	}
+}
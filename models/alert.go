@@ -13,32 +13,32 @@ type Alert struct {
 
 	Active   bool
 	DiskUtil int64
+
+	//LatencyMs is the total response time above which a monitor is alerted on, 0 disables latency alerts
+	LatencyMs int64
 }
 
 //ErrPubKeyEmpty is the error returned if a public key was not specified when creating an alert (as alerts are associated with an agent)
 var ErrPubKeyEmpty = errors.New("Public Key not set")
 
-//CreateAlertProfileForAgent adds an associated alert profile. I.e one that may contain disk utilisation limits/notification triggers
-func CreateAlertProfileForAgent(agentPubkey string, diskUtilisation int64, active bool) error {
-	if len(agentPubkey) == 0 {
-		return ErrPubKeyEmpty
+//CreateAlertProfileForAgent adds or replaces the alert profile of an agent. I.e one that may contain disk utilisation limits/notification triggers
+//It is keyed on the agent id, as an agent that has rotated its key no longer has the public key it was created with
+func (s DatabaseStore) CreateAlertProfileForAgent(agentID, diskUtilisation, latencyMs int64, active bool) error {
+	newAlert := models.Alert{
+		AgentId:   agentID,
+		DiskUtil:  diskUtilisation,
+		LatencyMs: latencyMs,
+		Active:    active,
 	}
 
-	var agent models.Agent
-	if err := db.Find(&agent, "pub_key = ?", string(agentPubkey)).Error; err != nil {
+	var alertID []int64
+	if err := s.db.Model(&models.Alert{}).Where("agent_id = ?", agentID).Pluck("id", &alertID).Error; err != nil {
 		return err
 	}
 
-	newAlert := models.Alert{
-		AgentId:  agent.Id,
-		DiskUtil: diskUtilisation,
-		Active:   active,
-	}
-
-	var alertID []int64
-	if err := db.Find(&models.Alert{}, "agent_id = ?", agent.Id).Pluck("id", &alertID).Error; err == nil {
+	if len(alertID) > 0 {
 		newAlert.Id = alertID[0]
 	}
 
-	return db.Debug().Save(&newAlert).Error
+	return s.db.Save(&newAlert).Error
 }
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditLogin       = "user.login"
+	AuditLoginFailed = "user.login_failed"
+	AuditLogout      = "user.logout"
+	AuditUserCreate  = "user.create"
+	AuditUserDelete  = "user.delete"
+	AuditPassword    = "user.change_password"
+	AuditNotify      = "user.notification_settings"
+
+	AuditAgentCreate  = "agent.create"
+	AuditAgentDelete  = "agent.delete"
+	AuditAgentArchive = "agent.archive"
+	AuditAgentRestore = "agent.restore"
+	AuditAgentCommand = "agent.command"
+	AuditAlertProfile = "agent.alert_profile"
+	AuditKeyAdd       = "agent.key_add"
+	AuditKeyRetire    = "agent.key_retire"
+
+	AuditTokenCreate = "enrollment_token.create"
+	AuditTokenDelete = "enrollment_token.delete"
+
+	AuditGroupCreate  = "group.create"
+	AuditGroupDelete  = "group.delete"
+	AuditGroupMembers = "group.members"
+
+	AuditMonitorCreate = "monitor.create"
+	AuditMonitorDelete = "monitor.delete"
+)
+
+//AuditActions is every action the audit log records, for filtering by
+var AuditActions = []string{
+	AuditLogin, AuditLoginFailed, AuditLogout, AuditUserCreate, AuditUserDelete, AuditPassword, AuditNotify,
+	AuditAgentCreate, AuditAgentDelete, AuditAgentArchive, AuditAgentRestore, AuditAgentCommand, AuditAlertProfile, AuditKeyAdd, AuditKeyRetire,
+	AuditTokenCreate, AuditTokenDelete,
+	AuditGroupCreate, AuditGroupDelete, AuditGroupMembers,
+	AuditMonitorCreate, AuditMonitorDelete,
+}
+
+//AuditEntry records who changed what through the web interface. Entries are only ever added, never changed or removed
+type AuditEntry struct {
+	Id        int64
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string    `gorm:"index"`
+	Action    string    `gorm:"index"`
+	// Target is what was changed, written as kind:id e.g agent:4 or user:alice
+	Target   string `gorm:"index"`
+	SourceIP string
+	// Before and After are JSON, and empty when there was nothing before or after the change
+	Before string `gorm:"type:text"`
+	After  string `gorm:"type:text"`
+}
+
+//AuditFilter picks entries out of the audit log, empty fields match everything
+type AuditFilter struct {
+	Actor  string
+	Action string
+	// Target matches exactly, or ending in ':' matches every target of that kind e.g agent:
+	Target string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	if f.Actor != "" && entry.Actor != f.Actor {
+		return false
+	}
+
+	if f.Action != "" && entry.Action != f.Action {
+		return false
+	}
+
+	if strings.HasSuffix(f.Target, ":") {
+		if !strings.HasPrefix(entry.Target, f.Target) {
+			return false
+		}
+	} else if f.Target != "" && entry.Target != f.Target {
+		return false
+	}
+
+	if !f.Since.IsZero() && entry.CreatedAt.Before(f.Since) {
+		return false
+	}
+
+	return f.Until.IsZero() || entry.CreatedAt.Before(f.Until)
+}
+
+func (f AuditFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.Actor != "" {
+		query = query.Where("actor = ?", f.Actor)
+	}
+
+	if f.Action != "" {
+		query = query.Where("action = ?", f.Action)
+	}
+
+	if strings.HasSuffix(f.Target, ":") {
+		// Escape the wildcards so only the prefix is matched, mysql treats backslashes in strings specially so ! is used
+		prefix := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(f.Target)
+		query = query.Where("target LIKE ? ESCAPE '!'", prefix+"%")
+	} else if f.Target != "" {
+		query = query.Where("target = ?", f.Target)
+	}
+
+	if !f.Since.IsZero() {
+		query = query.Where("created_at >= ?", f.Since)
+	}
+
+	if !f.Until.IsZero() {
+		query = query.Where("created_at < ?", f.Until)
+	}
+
+	return query
+}
+
+//AddAuditEntry appends to the audit log
+func (s DatabaseStore) AddAuditEntry(entry AuditEntry) error {
+	entry.Id = 0
+	return s.db.Create(&entry).Error
+}
+
+//GetAuditLog returns the entries matching filter newest first, a limit of 0 or less returns all of them
+func (s DatabaseStore) GetAuditLog(filter AuditFilter, limit int) (entries []AuditEntry, err error) {
+	query := filter.apply(s.db).Order("created_at desc, id desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	return entries, query.Find(&entries).Error
+}
+
+//auditLine is how an AuditEntry is exported, with its before and after values left as JSON rather than strings
+type auditLine struct {
+	Time     time.Time       `json:"time"`
+	Actor    string          `json:"actor"`
+	Action   string          `json:"action"`
+	Target   string          `json:"target"`
+	SourceIP string          `json:"source_ip"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+}
+
+//WriteAuditLog writes entries to w as JSON lines, one object per entry
+func WriteAuditLog(w io.Writer, entries []AuditEntry) error {
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		line := auditLine{
+			Time:     entry.CreatedAt.UTC(),
+			Actor:    entry.Actor,
+			Action:   entry.Action,
+			Target:   entry.Target,
+			SourceIP: entry.SourceIP,
+		}
+
+		if entry.Before != "" {
+			line.Before = json.RawMessage(entry.Before)
+		}
+
+		if entry.After != "" {
+			line.After = json.RawMessage(entry.After)
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	restore := useEmptyDatabase(t, "audit")
+	defer restore()
+
+	entries := []AuditEntry{
+		{Actor: "admin", Action: AuditAgentDelete, Target: "agent:1", SourceIP: "10.0.0.1", Before: `{"name":"web"}`},
+		{Actor: "admin", Action: AuditAlertProfile, Target: "agent:12", Before: `{"active":false}`, After: `{"active":true}`},
+		{Actor: "other", Action: AuditUserCreate, Target: "user:agent:1", After: `{"username":"agent:1"}`},
+		{Actor: "other", Action: AuditGroupCreate, Target: "group_a:1"},
+	}
+
+	for _, entry := range entries {
+		if err := store.AddAuditEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := store.GetAuditLog(AuditFilter{}, 0)
+	if err != nil || len(all) != len(entries) {
+		t.Fatal("Expected every entry: ", all, err)
+	}
+
+	if all[0].Action != AuditGroupCreate {
+		t.Fatal("Audit log is not newest first: ", all[0])
+	}
+
+	for _, f := range []struct {
+		filter AuditFilter
+		count  int
+	}{
+		{AuditFilter{Actor: "admin"}, 2},
+		{AuditFilter{Action: AuditUserCreate}, 1},
+		{AuditFilter{Target: "agent:1"}, 1},
+		{AuditFilter{Target: "agent:"}, 2},
+		{AuditFilter{Target: "group_:"}, 0},
+		{AuditFilter{Actor: "admin", Target: "agent:"}, 2},
+		{AuditFilter{Since: time.Now().Add(time.Hour)}, 0},
+		{AuditFilter{Until: time.Now().Add(time.Hour)}, 4},
+	} {
+		found, err := store.GetAuditLog(f.filter, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(found) != f.count {
+			t.Fatalf("Filter %+v found %d entries rather than %d", f.filter, len(found), f.count)
+		}
+
+		for _, entry := range found {
+			if !f.filter.matches(entry) {
+				t.Fatalf("Database and memory filters disagree on %+v for %+v", entry, f.filter)
+			}
+		}
+	}
+
+	limited, err := store.GetAuditLog(AuditFilter{}, 1)
+	if err != nil || len(limited) != 1 {
+		t.Fatal("Limit was not applied: ", limited, err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteAuditLog(&buf, all); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal("Export line is not JSON: ", scanner.Text())
+		}
+
+		if line["action"] == AuditAlertProfile {
+			after, ok := line["after"].(map[string]interface{})
+			if !ok || after["active"] != true {
+				t.Fatal("After value was not exported as JSON: ", scanner.Text())
+			}
+		}
+		lines++
+	}
+
+	if lines != len(all) {
+		t.Fatal("Expected one line per entry, got ", lines)
+	}
+}
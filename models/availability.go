@@ -0,0 +1,140 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+//IncidentThreshold is how long an outage must last to count as an incident. Shorter outages, like an agent reconnecting after being reloaded, still count as downtime
+const IncidentThreshold = time.Minute
+
+//Uptime is how much of a period an agent or monitor was up, Measured is how much of the period there is data for
+type Uptime struct {
+	Measured  time.Duration
+	Downtime  time.Duration
+	Incidents int
+}
+
+//Percent is the percentage of the measured time that was up, 0 if nothing was measured
+func (u Uptime) Percent() float64 {
+	if u.Measured <= 0 {
+		return 0
+	}
+
+	return 100 * float64(u.Measured-u.Downtime) / float64(u.Measured)
+}
+
+//outage adds a period of downtime, counting it as an incident if it was long enough
+func (u *Uptime) outage(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	u.Downtime += d
+	if d >= IncidentThreshold {
+		u.Incidents++
+	}
+}
+
+//ConnectionUptime measures how much of the time between from and to an agent was connected, open connections count as connected up to to.
+//Any time it wasnt connected is downtime, so from should not be before the agent first connected
+func ConnectionUptime(connections []AgentConnection, from, to time.Time) (uptime Uptime) {
+	if !to.After(from) {
+		return uptime
+	}
+	uptime.Measured = to.Sub(from)
+
+	sorted := append([]AgentConnection(nil), connections...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ConnectedAt.Before(sorted[j].ConnectedAt) })
+
+	covered := from // Connections can overlap when an agent reconnects before its old connection is noticed closing
+	for _, c := range sorted {
+		start, end := c.ConnectedAt, to
+		if c.DisconnectedAt != nil && c.DisconnectedAt.Before(to) {
+			end = *c.DisconnectedAt
+		}
+
+		if start.After(to) {
+			start = to
+		}
+
+		if start.After(covered) {
+			uptime.outage(start.Sub(covered))
+		}
+
+		if end.After(covered) {
+			covered = end
+		}
+	}
+
+	uptime.outage(to.Sub(covered))
+
+	return uptime
+}
+
+//disconnections returns when an agent went offline, the ends of its connections that no other connection overlaps, in order
+func disconnections(connections []AgentConnection) (offline []time.Time) {
+	sorted := append([]AgentConnection(nil), connections...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ConnectedAt.Before(sorted[j].ConnectedAt) })
+
+	var covered *time.Time
+	for i, c := range sorted {
+		if c.DisconnectedAt == nil {
+			// Still connected, so nothing after this ends the agents time online
+			return offline
+		}
+
+		if covered == nil || c.DisconnectedAt.After(*covered) {
+			covered = c.DisconnectedAt
+		}
+
+		if i+1 == len(sorted) || sorted[i+1].ConnectedAt.After(*covered) {
+			offline = append(offline, *covered)
+		}
+	}
+
+	return offline
+}
+
+//MonitorUptime measures how much of the time between from and to a monitor was up from its check history, which must be for a single path.
+//Each check is taken to hold until the next one, or until the agent disconnected if that was sooner, as nothing is known about the monitor while its agent is offline.
+//So only the time from the first check on while its agent was connected is measured
+func MonitorUptime(samples []MonitorSample, connections []AgentConnection, from, to time.Time) (uptime Uptime) {
+	sorted := append([]MonitorSample(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CreatedAt.Before(sorted[j].CreatedAt) })
+
+	offline := disconnections(connections)
+
+	var failing time.Duration
+	for i, s := range sorted {
+		start, end := s.CreatedAt, to
+		if i+1 < len(sorted) && sorted[i+1].CreatedAt.Before(end) {
+			end = sorted[i+1].CreatedAt
+		}
+
+		if next := sort.Search(len(offline), func(j int) bool { return !offline[j].Before(start) }); next < len(offline) && offline[next].Before(end) {
+			end = offline[next]
+		}
+
+		if start.Before(from) {
+			start = from
+		}
+
+		if !end.After(start) {
+			continue
+		}
+
+		uptime.Measured += end.Sub(start)
+
+		if s.OK {
+			uptime.outage(failing)
+			failing = 0
+			continue
+		}
+		failing += end.Sub(start)
+	}
+
+	uptime.outage(failing)
+
+	return uptime
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConnectionUptime(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+
+	at := func(d time.Duration) *time.Time {
+		t := from.Add(d)
+		return &t
+	}
+
+	uptime := ConnectionUptime([]AgentConnection{
+		{ConnectedAt: from, DisconnectedAt: at(2 * time.Hour)},
+		// Reconnecting after a few seconds is downtime, but not an incident
+		{ConnectedAt: *at(2*time.Hour + 10*time.Second), DisconnectedAt: at(5 * time.Hour)},
+		{ConnectedAt: *at(6 * time.Hour)},
+	}, from, to)
+
+	if uptime.Measured != 10*time.Hour || uptime.Downtime != time.Hour+10*time.Second || uptime.Incidents != 1 {
+		t.Fatalf("Expected an hour and 10 seconds of downtime in 1 incident, got %+v", uptime)
+	}
+
+	if math.Abs(uptime.Percent()-(100*(36000-3610)/36000.0)) > 0.001 {
+		t.Fatal("Wrong percentage: ", uptime.Percent())
+	}
+
+	if uptime := ConnectionUptime([]AgentConnection{{ConnectedAt: *at(time.Hour), DisconnectedAt: at(2 * time.Hour)}}, from, to); uptime.Incidents != 2 || uptime.Downtime != 9*time.Hour {
+		t.Fatalf("Outages before and after the connection should both be incidents, got %+v", uptime)
+	}
+
+	if uptime := ConnectionUptime(nil, to, from); uptime.Measured != 0 || uptime.Percent() != 0 {
+		t.Fatalf("An empty period has nothing to measure, got %+v", uptime)
+	}
+}
+
+func TestMonitorUptime(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+
+	check := func(d time.Duration, ok bool) MonitorSample {
+		return MonitorSample{Path: "https://example.com", CreatedAt: from.Add(d), OK: ok}
+	}
+
+	if uptime := MonitorUptime(nil, nil, from, to); uptime.Measured != 0 {
+		t.Fatalf("No checks should measure nothing, got %+v", uptime)
+	}
+
+	// Out of order, as nothing says samples must be sorted
+	uptime := MonitorUptime([]MonitorSample{
+		check(4*time.Hour, true),
+		check(time.Hour, true),
+		check(2*time.Hour, false),
+		check(3*time.Hour, false),
+		check(6*time.Hour, false),
+		check(6*time.Hour+30*time.Second, true),
+	}, nil, from, to)
+
+	// Measured from the first check, the two failing checks in a row are one incident and the 30 second blip is not one
+	if uptime.Measured != 9*time.Hour || uptime.Downtime != 2*time.Hour+30*time.Second || uptime.Incidents != 1 {
+		t.Fatalf("Expected 2 hours 30 seconds downtime over 9 hours in 1 incident, got %+v", uptime)
+	}
+
+	if uptime := MonitorUptime([]MonitorSample{check(8*time.Hour, false)}, nil, from, to); uptime.Downtime != 2*time.Hour || uptime.Incidents != 1 || uptime.Percent() != 0 {
+		t.Fatalf("A monitor still failing at the end of the period is an incident, got %+v", uptime)
+	}
+
+	at := func(d time.Duration) *time.Time {
+		t := from.Add(d)
+		return &t
+	}
+
+	// The agent went offline for 6 hours after its last check, which says nothing about the monitor
+	uptime = MonitorUptime([]MonitorSample{check(time.Hour, true), check(2*time.Hour, false), check(9*time.Hour, true)}, []AgentConnection{
+		{ConnectedAt: from, DisconnectedAt: at(2*time.Hour + 30*time.Minute)},
+		// Reconnecting before the old connection was noticed closing isnt going offline
+		{ConnectedAt: *at(2*time.Hour + 20*time.Minute), DisconnectedAt: at(3 * time.Hour)},
+		{ConnectedAt: *at(9 * time.Hour)},
+	}, from, to)
+
+	if uptime.Measured != 3*time.Hour || uptime.Downtime != time.Hour || uptime.Incidents != 1 {
+		t.Fatalf("Expected an hour of downtime over the 3 hours the agent was connected and checking, got %+v", uptime)
+	}
+}
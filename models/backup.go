@@ -0,0 +1,661 @@
+package models
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//BackupFormatVersion is the version of the archive ExportBackup writes, ImportBackup reads archives up to this version
+const BackupFormatVersion = 1
+
+//Backup is everything needed to move theia to a new host. Records refer to each other by what identifies them (an agents key, a groups name) rather than database ids, so a backup can be merged into a database that already has data
+type Backup struct {
+	FormatVersion int
+	SchemaVersion int64
+	CreatedAt     time.Time
+
+	Groups []BackupGroup
+	Agents []BackupAgent
+	Users  []BackupUser
+
+	//History is only included when asked for, it is by far the largest part of a backup
+	History *BackupHistory `json:",omitempty"`
+}
+
+//BackupGroup is a group and its centrally managed monitors, its members are listed on each agent
+type BackupGroup struct {
+	Name     string
+	Monitors []BackupMonitor
+}
+
+//BackupMonitor is a centrally managed monitor
+type BackupMonitor struct {
+	URL     string
+	Name    string
+	Options string
+}
+
+//BackupAgent is an agent with its keys, alert profile, group memberships and monitors.
+//ID is only used to match its history, it is not kept on import
+type BackupAgent struct {
+	ID        int64
+	Name      string
+	PubKey    string
+	Principal string
+
+	//ArchivedAt is set for archived agents, which are imported still archived
+	ArchivedAt *time.Time `json:",omitempty"`
+
+	Keys         []BackupAgentKey
+	AlertProfile *BackupAlert `json:",omitempty"`
+	Groups       []string
+	Monitors     []BackupMonitor
+}
+
+//BackupAgentKey is a key an agent can, or once could, authenticate with
+type BackupAgentKey struct {
+	PubKey     string
+	Comment    string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RetiredAt  *time.Time
+}
+
+//BackupAlert is an agents alert profile
+type BackupAlert struct {
+	Active    bool
+	DiskUtil  int64
+	LatencyMs int64
+}
+
+//BackupUser is a web interface user, with their password hash so they can log in with the same password after an import
+type BackupUser struct {
+	GUID         string
+	Username     string
+	PasswordHash string
+
+	Notifications *BackupNotifications `json:",omitempty"`
+}
+
+//BackupNotifications are the settings a user has events emailed with
+type BackupNotifications struct {
+	Destination       string
+	SendAddress       string
+	AccountPassword   string
+	EmailProviderHost string
+}
+
+//BackupHistory is the monitor, metric and connection history of every agent, AgentId is the ID of the agent in the backup
+type BackupHistory struct {
+	MonitorSamples []MonitorSample
+	MetricSamples  []MetricSample
+	Connections    []AgentConnection `json:",omitempty"`
+}
+
+//ImportResult counts what an import added, and what was already in the database and left as it was
+type ImportResult struct {
+	AgentsAdded, AgentsExisting int
+	GroupsAdded, GroupsExisting int
+	UsersAdded, UsersExisting   int
+
+	KeysAdded     int
+	MonitorsAdded int
+	SamplesAdded  int
+}
+
+func (r ImportResult) String() string {
+	return fmt.Sprintf("%d agents added (%d already present), %d groups added (%d already present), %d users added (%d already present), %d keys, %d monitors and %d history samples added",
+		r.AgentsAdded, r.AgentsExisting, r.GroupsAdded, r.GroupsExisting, r.UsersAdded, r.UsersExisting, r.KeysAdded, r.MonitorsAdded, r.SamplesAdded)
+}
+
+//ErrBackupVersion is returned when reading a backup written by a newer version of theia, or one that isnt a backup at all
+var ErrBackupVersion = errors.New("Backup format version is not supported")
+
+//ErrBackupConflict is returned when a backup cannot be merged into the database because they disagree, e.g a key belongs to a different agent in each
+var ErrBackupConflict = errors.New("Backup conflicts with the database")
+
+//ExportBackup writes every agent, group, user and their settings to w as a gzipped JSON archive, with the monitor, metric and connection history if includeHistory is set
+func (s DatabaseStore) ExportBackup(w io.Writer, includeHistory bool) error {
+	backup, err := s.newBackup(includeHistory)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(backup); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func (s DatabaseStore) newBackup(includeHistory bool) (backup Backup, err error) {
+	backup.FormatVersion = BackupFormatVersion
+	backup.CreatedAt = time.Now()
+
+	backup.SchemaVersion, err = SchemaVersion(s.db)
+	if err != nil {
+		return backup, err
+	}
+
+	// Everything is read in one transaction so the backup is consistent
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return backup, tx.Error
+	}
+	defer tx.Rollback()
+
+	var definitions []MonitorDefinition
+	if err := tx.Order("id").Find(&definitions).Error; err != nil {
+		return backup, err
+	}
+
+	agentMonitors := make(map[int64][]BackupMonitor)
+	groupMonitors := make(map[int64][]BackupMonitor)
+	for _, d := range definitions {
+		monitor := BackupMonitor{URL: d.URL, Name: d.Name, Options: d.Options}
+		if d.GroupId != 0 {
+			groupMonitors[d.GroupId] = append(groupMonitors[d.GroupId], monitor)
+		} else {
+			agentMonitors[d.AgentId] = append(agentMonitors[d.AgentId], monitor)
+		}
+	}
+
+	var groups []Group
+	if err := tx.Order("id").Find(&groups).Error; err != nil {
+		return backup, err
+	}
+
+	groupNames := make(map[int64]string)
+	for _, g := range groups {
+		groupNames[g.ID] = g.Name
+		backup.Groups = append(backup.Groups, BackupGroup{Name: g.Name, Monitors: groupMonitors[g.ID]})
+	}
+
+	var memberships []struct {
+		AgentId int64
+		GroupId int64
+	}
+	if err := tx.Table("agent_groups").Select("agent_id, group_id").Order("group_id").Scan(&memberships).Error; err != nil {
+		return backup, err
+	}
+
+	agentGroups := make(map[int64][]string)
+	for _, m := range memberships {
+		agentGroups[m.AgentId] = append(agentGroups[m.AgentId], groupNames[m.GroupId])
+	}
+
+	var keys []AgentKey
+	if err := tx.Order("id").Find(&keys).Error; err != nil {
+		return backup, err
+	}
+
+	agentKeys := make(map[int64][]BackupAgentKey)
+	for _, k := range keys {
+		agentKeys[k.AgentId] = append(agentKeys[k.AgentId], BackupAgentKey{
+			PubKey:     k.PubKey,
+			Comment:    k.Comment,
+			CreatedAt:  k.CreatedAt,
+			LastUsedAt: k.LastUsedAt,
+			RetiredAt:  k.RetiredAt,
+		})
+	}
+
+	var alerts []Alert
+	if err := tx.Find(&alerts).Error; err != nil {
+		return backup, err
+	}
+
+	agentAlerts := make(map[int64]*BackupAlert)
+	for _, a := range alerts {
+		agentAlerts[a.AgentId] = &BackupAlert{Active: a.Active, DiskUtil: a.DiskUtil, LatencyMs: a.LatencyMs}
+	}
+
+	var agents []Agent
+	if err := tx.Order("id").Find(&agents).Error; err != nil {
+		return backup, err
+	}
+
+	for _, a := range agents {
+		backup.Agents = append(backup.Agents, BackupAgent{
+			ID:           a.ID,
+			Name:         a.Name,
+			PubKey:       a.PubKey,
+			Principal:    a.Principal,
+			ArchivedAt:   a.ArchivedAt,
+			Keys:         agentKeys[a.ID],
+			AlertProfile: agentAlerts[a.ID],
+			Groups:       agentGroups[a.ID],
+			Monitors:     agentMonitors[a.ID],
+		})
+	}
+
+	var notifications []NotificationDetail
+	if err := tx.Find(&notifications).Error; err != nil {
+		return backup, err
+	}
+
+	userNotifications := make(map[int64]*BackupNotifications)
+	for _, n := range notifications {
+		userNotifications[n.UserId] = &BackupNotifications{
+			Destination:       n.Destination,
+			SendAddress:       n.SendAddress,
+			AccountPassword:   n.AccountPassword,
+			EmailProviderHost: n.EmailProviderHost,
+		}
+	}
+
+	var users []User
+	if err := tx.Order("id").Find(&users).Error; err != nil {
+		return backup, err
+	}
+
+	// Sessions are not kept, users log in again on the new host
+	for _, u := range users {
+		backup.Users = append(backup.Users, BackupUser{
+			GUID:          u.GUID,
+			Username:      u.Username,
+			PasswordHash:  u.Password,
+			Notifications: userNotifications[u.Id],
+		})
+	}
+
+	if includeHistory {
+		backup.History = &BackupHistory{}
+		if err := tx.Order("id").Find(&backup.History.MonitorSamples).Error; err != nil {
+			return backup, err
+		}
+
+		if err := tx.Order("id").Find(&backup.History.MetricSamples).Error; err != nil {
+			return backup, err
+		}
+
+		if err := tx.Order("id").Find(&backup.History.Connections).Error; err != nil {
+			return backup, err
+		}
+	}
+
+	return backup, nil
+}
+
+//ReadBackup reads and validates a backup written by ExportBackup
+func ReadBackup(r io.Reader) (backup Backup, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return backup, fmt.Errorf("Not a theia backup: %w", err)
+	}
+	defer zr.Close()
+
+	if err := json.NewDecoder(zr).Decode(&backup); err != nil {
+		return backup, fmt.Errorf("Not a theia backup: %w", err)
+	}
+
+	return backup, backup.Validate()
+}
+
+//Validate checks a backup is complete and consistent before anything is imported from it
+func (backup Backup) Validate() error {
+	if backup.FormatVersion < 1 || backup.FormatVersion > BackupFormatVersion {
+		return fmt.Errorf("%w: %d, expected at most %d", ErrBackupVersion, backup.FormatVersion, BackupFormatVersion)
+	}
+
+	groups := make(map[string]bool)
+	for _, g := range backup.Groups {
+		name, err := groupName(g.Name)
+		if err != nil || name != g.Name {
+			return fmt.Errorf("Group %q: %w", g.Name, ErrGroupNameInvalid)
+		}
+
+		if groups[g.Name] {
+			return fmt.Errorf("Group %q is in the backup twice", g.Name)
+		}
+		groups[g.Name] = true
+
+		for _, m := range g.Monitors {
+			if _, err := newMonitorDefinition(0, 1, m.URL, m.Name, m.Options); err != nil {
+				return fmt.Errorf("Group %q monitor %q: %w", g.Name, m.URL, err)
+			}
+		}
+	}
+
+	agentIDs := make(map[int64]bool)
+	pubKeys := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, a := range backup.Agents {
+		if err := a.validate(); err != nil {
+			return fmt.Errorf("Agent %q: %w", a.Name, err)
+		}
+
+		if agentIDs[a.ID] || pubKeys[a.PubKey] {
+			return fmt.Errorf("Agent %q is in the backup twice", a.Name)
+		}
+		agentIDs[a.ID] = true
+		pubKeys[a.PubKey] = true
+
+		for _, k := range a.Keys {
+			if keys[k.PubKey] {
+				return fmt.Errorf("Agent %q: key %q belongs to more than one agent", a.Name, k.PubKey)
+			}
+			keys[k.PubKey] = true
+		}
+
+		for _, g := range a.Groups {
+			if !groups[g] {
+				return fmt.Errorf("Agent %q is in group %q, which is not in the backup", a.Name, g)
+			}
+		}
+	}
+
+	usernames := make(map[string]bool)
+	guids := make(map[string]bool)
+	for _, u := range backup.Users {
+		if len(u.Username) == 0 || len(u.GUID) == 0 || len(u.PasswordHash) == 0 {
+			return fmt.Errorf("User %q: %w", u.Username, ErrManditoryFieldsNotFilled)
+		}
+
+		if usernames[u.Username] || guids[u.GUID] {
+			return fmt.Errorf("User %q is in the backup twice", u.Username)
+		}
+		usernames[u.Username] = true
+		guids[u.GUID] = true
+
+		if n := u.Notifications; n != nil {
+			if _, err := newNotificationDetail(1, n.Destination, n.SendAddress, n.AccountPassword, n.EmailProviderHost); err != nil {
+				return fmt.Errorf("User %q notification settings: %w", u.Username, err)
+			}
+		}
+	}
+
+	if backup.History != nil {
+		for _, s := range backup.History.MonitorSamples {
+			if !agentIDs[s.AgentId] {
+				return fmt.Errorf("Monitor history refers to agent %d, which is not in the backup", s.AgentId)
+			}
+		}
+
+		for _, s := range backup.History.MetricSamples {
+			if !agentIDs[s.AgentId] {
+				return fmt.Errorf("Metric history refers to agent %d, which is not in the backup", s.AgentId)
+			}
+		}
+
+		for _, c := range backup.History.Connections {
+			if !agentIDs[c.AgentId] {
+				return fmt.Errorf("Connection history refers to agent %d, which is not in the backup", c.AgentId)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a BackupAgent) validate() error {
+	// Agents registered by certificate have a placeholder rather than a key
+	if len(a.Principal) > 0 {
+		if len(a.Name) > 1000 {
+			return ErrAgentNameTooLong
+		}
+
+		if a.PubKey != CertificatePubKeyPrefix+a.Principal {
+			return ErrAgentPubKeyNotValid
+		}
+	} else if err := validateNewAgent(a.Name, a.PubKey); err != nil {
+		return err
+	}
+
+	for _, k := range a.Keys {
+		if pubKey, _, _, err := parseAgentKey(k.PubKey); err != nil || pubKey != k.PubKey {
+			return ErrAgentPubKeyNotValid
+		}
+	}
+
+	for _, m := range a.Monitors {
+		if _, err := newMonitorDefinition(1, 0, m.URL, m.Name, m.Options); err != nil {
+			return fmt.Errorf("Monitor %q: %w", m.URL, err)
+		}
+	}
+
+	return nil
+}
+
+//ImportBackup validates a backup then merges it into the database in a single transaction.
+//Agents, keys, groups and users already in the database are left as they are, only what is missing is added. History is only imported for agents the import adds, so importing the same backup twice doesnt duplicate it
+func (s DatabaseStore) ImportBackup(r io.Reader) (result ImportResult, err error) {
+	backup, err := ReadBackup(r)
+	if err != nil {
+		return result, err
+	}
+
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return result, tx.Error
+	}
+
+	if err := importBackup(tx, backup, &result); err != nil {
+		tx.Rollback()
+		return ImportResult{}, err
+	}
+
+	return result, tx.Commit().Error
+}
+
+func importBackup(tx *gorm.DB, backup Backup, result *ImportResult) error {
+	groupIDs := make(map[string]int64)
+	for _, g := range backup.Groups {
+		var group Group
+		err := tx.First(&group, "name = ?", g.Name).Error
+		switch {
+		case err == nil:
+			result.GroupsExisting++
+		case gorm.IsRecordNotFoundError(err):
+			group = Group{Name: g.Name}
+			if err := tx.Create(&group).Error; err != nil {
+				return err
+			}
+			result.GroupsAdded++
+		default:
+			return err
+		}
+		groupIDs[g.Name] = group.ID
+
+		for _, m := range g.Monitors {
+			added, err := importMonitor(tx, 0, group.ID, m)
+			if err != nil {
+				return err
+			}
+			if added {
+				result.MonitorsAdded++
+			}
+		}
+	}
+
+	// Agents added by this import, from their id in the backup to their id in the database
+	added := make(map[int64]int64)
+	for _, a := range backup.Agents {
+		var agent Agent
+		err := tx.First(&agent, "pub_key = ?", a.PubKey).Error
+		switch {
+		case err == nil:
+			result.AgentsExisting++
+		case gorm.IsRecordNotFoundError(err):
+			agent = Agent{Name: a.Name, PubKey: a.PubKey, Principal: a.Principal, ArchivedAt: a.ArchivedAt}
+			if err := tx.Create(&agent).Error; err != nil {
+				return err
+			}
+			added[a.ID] = agent.ID
+			result.AgentsAdded++
+
+			if p := a.AlertProfile; p != nil {
+				if err := tx.Create(&Alert{AgentId: agent.ID, Active: p.Active, DiskUtil: p.DiskUtil, LatencyMs: p.LatencyMs}).Error; err != nil {
+					return err
+				}
+			}
+		default:
+			return err
+		}
+
+		for _, k := range a.Keys {
+			keyAdded, err := importAgentKey(tx, agent, k)
+			if err != nil {
+				return err
+			}
+			if keyAdded {
+				result.KeysAdded++
+			}
+		}
+
+		for _, g := range a.Groups {
+			var member int
+			if err := tx.Table("agent_groups").Where("agent_id = ? AND group_id = ?", agent.ID, groupIDs[g]).Count(&member).Error; err != nil {
+				return err
+			}
+
+			if member == 0 {
+				if err := tx.Exec("INSERT INTO agent_groups (agent_id, group_id) VALUES (?, ?)", agent.ID, groupIDs[g]).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, m := range a.Monitors {
+			monitorAdded, err := importMonitor(tx, agent.ID, 0, m)
+			if err != nil {
+				return err
+			}
+			if monitorAdded {
+				result.MonitorsAdded++
+			}
+		}
+	}
+
+	for _, u := range backup.Users {
+		var user User
+		err := tx.First(&user, "username = ?", u.Username).Error
+		if err == nil {
+			result.UsersExisting++
+			continue
+		}
+
+		if !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+
+		var guidInUse int
+		if err := tx.Model(&User{}).Where("guid = ?", u.GUID).Count(&guidInUse).Error; err != nil {
+			return err
+		}
+
+		if guidInUse > 0 {
+			return fmt.Errorf("%w: user %q has the same GUID as another user", ErrBackupConflict, u.Username)
+		}
+
+		user = User{GUID: u.GUID, Username: u.Username, Password: u.PasswordHash}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		result.UsersAdded++
+
+		if n := u.Notifications; n != nil {
+			notification, err := newNotificationDetail(user.Id, n.Destination, n.SendAddress, n.AccountPassword, n.EmailProviderHost)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Create(&notification).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	if backup.History == nil {
+		return nil
+	}
+
+	var history []interface{}
+	for _, s := range backup.History.MonitorSamples {
+		if agentID, ok := added[s.AgentId]; ok {
+			s.AgentId = agentID
+			history = append(history, s)
+		}
+	}
+
+	for _, s := range backup.History.MetricSamples {
+		if agentID, ok := added[s.AgentId]; ok {
+			s.AgentId = agentID
+			history = append(history, s)
+		}
+	}
+
+	for _, c := range backup.History.Connections {
+		if agentID, ok := added[c.AgentId]; ok {
+			c.AgentId = agentID
+			history = append(history, c)
+		}
+	}
+
+	if err := upsert(tx, history); err != nil {
+		return fmt.Errorf("Unable to import history: %w", err)
+	}
+	result.SamplesAdded = len(history)
+
+	return nil
+}
+
+//importAgentKey adds a key to an agent unless it already has it, a key belonging to another agent is a conflict
+func importAgentKey(tx *gorm.DB, agent Agent, k BackupAgentKey) (added bool, err error) {
+	var existing AgentKey
+	err = tx.First(&existing, "pub_key = ?", k.PubKey).Error
+	if err == nil {
+		if existing.AgentId != agent.ID {
+			return false, fmt.Errorf("%w: a key of agent %q belongs to another agent", ErrBackupConflict, agent.Name)
+		}
+		return false, nil
+	}
+
+	if !gorm.IsRecordNotFoundError(err) {
+		return false, err
+	}
+
+	_, fingerprint, _, err := parseAgentKey(k.PubKey)
+	if err != nil {
+		return false, err
+	}
+
+	key := AgentKey{
+		AgentId:     agent.ID,
+		PubKey:      k.PubKey,
+		Fingerprint: fingerprint,
+		Comment:     k.Comment,
+		CreatedAt:   k.CreatedAt,
+		LastUsedAt:  k.LastUsedAt,
+		RetiredAt:   k.RetiredAt,
+	}
+
+	return true, tx.Create(&key).Error
+}
+
+//importMonitor adds a monitor to an agent or group unless it already has one for the same URL
+func importMonitor(tx *gorm.DB, agentID, groupID int64, m BackupMonitor) (added bool, err error) {
+	definition, err := newMonitorDefinition(agentID, groupID, m.URL, m.Name, m.Options)
+	if err != nil {
+		return false, err
+	}
+
+	var existing int
+	if err := tx.Model(&MonitorDefinition{}).Where("agent_id = ? AND group_id = ? AND url = ?", agentID, groupID, strings.TrimSpace(m.URL)).Count(&existing).Error; err != nil {
+		return false, err
+	}
+
+	if existing > 0 {
+		return false, nil
+	}
+
+	return true, tx.Create(&definition).Error
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//useEmptyDatabase points the models at a new database, returning a function to close it and switch back
+func useEmptyDatabase(t *testing.T, name string) func() {
+	previous := db
+
+	empty, err := gorm.Open("sqlite3", "file:"+name+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitaliseModels(empty); err != nil {
+		t.Fatal(err)
+	}
+
+	db, store = empty, NewDatabaseStore(empty)
+
+	return func() {
+		empty.Close()
+		db, store = previous, NewDatabaseStore(previous)
+	}
+}
+
+func writeTestBackup(t *testing.T, backup Backup) *bytes.Buffer {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestExportImportBackup(t *testing.T) {
+	restore := useEmptyDatabase(t, "backup-source")
+	defer restore()
+
+	pubKey := newTestPubKey(t)
+	if _, err := store.CreateAgent("backed-up", pubKey+" first@host"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := store.GetActiveAgentKey(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentID := key.AgentId
+
+	if _, err := store.AddAgentKey(agentID, newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.RetireAgentKey(agentID, key.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&Alert{AgentId: agentID, Active: true, DiskUtil: 80, LatencyMs: 500}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateGroup("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	var group Group
+	if err := db.First(&group, "name = ?", "web").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.SetGroupMembers(group.ID, []int64{agentID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateMonitorDefinition(0, group.ID, "https://example.com", "example", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddUser("admin", "a long enough password"); err != nil {
+		t.Fatal(err)
+	}
+
+	var user User
+	if err := db.First(&user, "username = ?", "admin").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateNotificationSetting(user.Id, "to@example.com", "from@example.com", "secret", "smtp.example.com:587"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.IngestStats(agentID, Stats{MemoryUsage: 20, DiskUsage: map[string]float32{"/dev/sda1": 50}}); err != nil {
+		t.Fatal(err)
+	}
+
+	connection, err := store.StartConnection(agentID, "10.0.0.1:5000", "1.0.0", ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.EndConnection(connection, DisconnectTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := store.ExportBackup(&archive, true); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreTarget := useEmptyDatabase(t, "backup-target")
+	defer restoreTarget()
+
+	result, err := store.ImportBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.AgentsAdded != 1 || result.KeysAdded != 2 || result.GroupsAdded != 1 || result.UsersAdded != 1 || result.MonitorsAdded != 1 || result.SamplesAdded != 3 {
+		t.Fatal("Not everything was imported: ", result)
+	}
+
+	var imported Agent
+	if err := db.First(&imported, "name = ?", "backed-up").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetActiveAgentKey(pubKey); err == nil {
+		t.Fatal("Retired key was imported as active")
+	}
+
+	var alert Alert
+	if err := db.First(&alert, "agent_id = ?", imported.ID).Error; err != nil || alert.DiskUtil != 80 || alert.LatencyMs != 500 {
+		t.Fatal("Alert profile was not imported: ", alert, err)
+	}
+
+	definitions, err := store.GetMonitorDefinitions(imported.ID)
+	if err != nil || len(definitions) != 1 {
+		t.Fatal("Agent did not get its groups monitor: ", definitions, err)
+	}
+
+	connections, err := store.GetConnections(imported.ID, time.Time{})
+	if err != nil || len(connections) != 1 || connections[0].DisconnectReason != DisconnectTimeout {
+		t.Fatal("Connection history was not imported: ", connections, err)
+	}
+
+	var importedUser User
+	if err := db.First(&importedUser, "username = ?", "admin").Error; err != nil || importedUser.Password != user.Password {
+		t.Fatal("User was not imported with their password: ", err)
+	}
+
+	notifications, err := store.GetNotificationSettingsForUser(importedUser.Id)
+	if err != nil || notifications.Destination != "to@example.com" {
+		t.Fatal("Notification settings were not imported: ", notifications, err)
+	}
+
+	// Importing again merges nothing new, and doesnt duplicate history
+	result, err = store.ImportBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.AgentsExisting != 1 || result.UsersExisting != 1 || result.GroupsExisting != 1 || result.AgentsAdded+result.KeysAdded+result.MonitorsAdded+result.SamplesAdded != 0 {
+		t.Fatal("Importing twice changed the database: ", result)
+	}
+}
+
+func TestImportBackupConflict(t *testing.T) {
+	restore := useEmptyDatabase(t, "backup-conflict")
+	defer restore()
+
+	sharedKey := newTestPubKey(t)
+	if _, err := store.CreateAgent("existing", sharedKey); err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey := newTestPubKey(t)
+	backup := Backup{
+		FormatVersion: BackupFormatVersion,
+		Groups:        []BackupGroup{{Name: "new-group"}},
+		Agents: []BackupAgent{{
+			ID:     1,
+			Name:   "incoming",
+			PubKey: otherKey,
+			Keys:   []BackupAgentKey{{PubKey: otherKey}, {PubKey: sharedKey}},
+			Groups: []string{"new-group"},
+		}},
+	}
+
+	if _, err := store.ImportBackup(writeTestBackup(t, backup)); !errors.Is(err, ErrBackupConflict) {
+		t.Fatal("Expected a key belonging to another agent to conflict: ", err)
+	}
+
+	var groups int
+	db.Model(&Group{}).Count(&groups)
+	if groups != 0 {
+		t.Fatal("Part of a failed import was stored")
+	}
+
+	backup.FormatVersion = BackupFormatVersion + 1
+	if _, err := store.ImportBackup(writeTestBackup(t, backup)); !errors.Is(err, ErrBackupVersion) {
+		t.Fatal("Imported a backup from a newer version: ", err)
+	}
+
+	backup.FormatVersion = BackupFormatVersion
+	backup.Agents[0].Groups = []string{"missing"}
+	if _, err := store.ImportBackup(writeTestBackup(t, backup)); err == nil {
+		t.Fatal("Imported an agent in a group that is not in the backup")
+	}
+
+	backup.Agents[0].Groups = nil
+	backup.History = &BackupHistory{MetricSamples: []MetricSample{{AgentId: 2, Name: MemoryMetric, CreatedAt: time.Now()}}}
+	if _, err := store.ImportBackup(writeTestBackup(t, backup)); err == nil {
+		t.Fatal("Imported history for an agent that is not in the backup")
+	}
+}
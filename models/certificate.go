@@ -0,0 +1,79 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//CertificatePubKeyPrefix marks the pub_key of agents registered by certificate, it can never match a raw key so they cant authenticate without one
+const CertificatePubKeyPrefix = "principal:"
+
+//CertificateIdentity is what theia learns about an agent from a valid certificate
+type CertificateIdentity struct {
+	Principal   string
+	KeyId       string
+	Serial      uint64
+	Authority   string
+	ValidBefore time.Time
+}
+
+//ErrPrincipalEmpty is returned when a certificate identity doesnt have a principal to match on
+var ErrPrincipalEmpty = errors.New("Certificate principal cannot be empty")
+
+func (identity CertificateIdentity) validate() error {
+	if len(identity.Principal) == 0 {
+		return ErrPrincipalEmpty
+	}
+
+	if len(identity.Principal) > 1000 {
+		return ErrAgentNameTooLong
+	}
+
+	return nil
+}
+
+//newAgent is the agent registered the first time the identity's principal is seen
+func (identity CertificateIdentity) newAgent() Agent {
+	return Agent{
+		Name:      identity.Principal,
+		PubKey:    CertificatePubKeyPrefix + identity.Principal,
+		Principal: identity.Principal,
+	}
+}
+
+//AgentForCertificate finds the agent with the identity's principal, registering a new one if there isnt one yet, and records the certificate it used
+func (s DatabaseStore) AgentForCertificate(identity CertificateIdentity) (Agent, error) {
+	if err := identity.validate(); err != nil {
+		return Agent{}, err
+	}
+
+	var agent Agent
+	err := s.db.First(&agent, "principal = ?", identity.Principal).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return Agent{}, err
+	}
+
+	if agent.ArchivedAt != nil {
+		return Agent{}, ErrAgentArchived
+	}
+
+	if err == gorm.ErrRecordNotFound {
+		agent = identity.newAgent()
+
+		if err := s.db.Create(&agent).Error; err != nil {
+			return Agent{}, err
+		}
+	}
+
+	update := map[string]interface{}{
+		"certificate_key_id":       identity.KeyId,
+		"certificate_serial":       strconv.FormatUint(identity.Serial, 10),
+		"certificate_authority":    identity.Authority,
+		"certificate_valid_before": identity.ValidBefore,
+	}
+
+	return agent, s.db.Model(&agent).Updates(update).Error
+}
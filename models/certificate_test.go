@@ -0,0 +1,40 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestAgentForCertificate(t *testing.T) {
+	setupDatabase()
+	defer db.Close()
+
+	identity := CertificateIdentity{Principal: "web-1", KeyId: "web-1 2026", Serial: 7, Authority: "ca"}
+
+	agent, err := store.AgentForCertificate(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.PubKey != CertificatePubKeyPrefix+"web-1" || agent.Name != "web-1" {
+		t.Fatal("Agent was not registered by principal: ", agent)
+	}
+
+	identity.Serial = 8
+	again, err := store.AgentForCertificate(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != agent.ID {
+		t.Fatal("Agent was registered twice for the same principal")
+	}
+
+	registered, err := store.GetAgent(agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if registered.CertificateSerial != "8" || registered.CertificateKeyId != "web-1 2026" {
+		t.Fatal("Certificate details were not recorded: ", registered)
+	}
+}
@@ -0,0 +1,77 @@
+package models
+
+import "time"
+
+// CommandChannel is the ssh channel type theia opens on an agent to run a command, the Command is sent as the channel extra data
+// and the agent replies with a single CommandResult before closing the channel.
+// Agents only run the actions below, there is deliberately no way to run anything else
+const CommandChannel = "command"
+
+// Actions an agent can be asked to perform
+const (
+	// CommandRecheck runs every check immediately
+	CommandRecheck = "recheck"
+	// CommandSystemInfo refreshes the agents system information
+	CommandSystemInfo = "sysinfo"
+	// CommandRunCheck runs a single check, chosen by the name it was given in the agents config
+	CommandRunCheck = "run_check"
+)
+
+// Command is a request from theia for an agent to do something now
+type Command struct {
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	Check  string `json:"check,omitempty"`
+}
+
+// CommandResult is the agents reply to a Command
+type CommandResult struct {
+	Id    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	Monitors   []MonitorStatus `json:"monitors,omitempty"`
+	SystemInfo *SystemInfo     `json:"system_info,omitempty"`
+}
+
+//CommandLog is the audit record of a command a user sent to an agent
+type CommandLog struct {
+	Id        int64
+	AgentId   int64 `gorm:"index"`
+	CommandId string
+	Username  string
+	Action    string
+	Check     string
+	OK        bool
+	Outcome   string
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+}
+
+func newCommandLog(agentID int64, username string, command Command) CommandLog {
+	return CommandLog{
+		AgentId:   agentID,
+		CommandId: command.Id,
+		Username:  username,
+		Action:    command.Action,
+		Check:     command.Check,
+		Outcome:   "Sent",
+	}
+}
+
+//RecordCommand audits a command before it is sent to an agent, so there is a record even if it never completes
+func (s DatabaseStore) RecordCommand(agentID int64, username string, command Command) (CommandLog, error) {
+	entry := newCommandLog(agentID, username, command)
+
+	return entry, s.db.Create(&entry).Error
+}
+
+//CompleteCommand records what came of a previously audited command
+func (s DatabaseStore) CompleteCommand(entry CommandLog, ok bool, outcome string) error {
+	return s.db.Model(&entry).Updates(map[string]interface{}{"ok": ok, "outcome": outcome}).Error
+}
+
+//GetCommandLog returns the most recent commands sent to an agent, newest first
+func (s DatabaseStore) GetCommandLog(agentID int64, limit int) (entries []CommandLog, err error) {
+	return entries, s.db.Order("created_at desc").Limit(limit).Find(&entries, "agent_id = ?", agentID).Error
+}
@@ -0,0 +1,103 @@
+package models
+
+import "time"
+
+// Reasons an agent connection ended
+const (
+	DisconnectEOF         = "eof"
+	DisconnectDecodeError = "decode error"
+	DisconnectTimeout     = "timeout"
+	DisconnectError       = "connection error"
+	DisconnectKeyRetired  = "key retired"
+	DisconnectArchived    = "archived"
+	DisconnectShutdown    = "theia stopped"
+	// DisconnectUnknown is for connections that were still open when theia last stopped without closing them
+	DisconnectUnknown = "unknown"
+)
+
+//AgentConnection is one session of an agent being connected to theia
+type AgentConnection struct {
+	Id          int64
+	AgentId     int64     `gorm:"index"`
+	ConnectedAt time.Time `gorm:"index"`
+	// DisconnectedAt is nil while the agent is still connected
+	DisconnectedAt   *time.Time `gorm:"index"`
+	DisconnectReason string
+
+	RemoteAddress   string
+	ClientVersion   string
+	ProtocolVersion int
+}
+
+//Duration is how long the agent was connected for, or has been so far
+func (c AgentConnection) Duration() time.Duration {
+	if c.DisconnectedAt == nil {
+		return time.Since(c.ConnectedAt)
+	}
+
+	return c.DisconnectedAt.Sub(c.ConnectedAt)
+}
+
+//StartConnection records an agent connecting, the connection returned should be passed to EndConnection once it disconnects
+func (s DatabaseStore) StartConnection(agentID int64, remoteAddress, clientVersion string, protocolVersion int) (AgentConnection, error) {
+	connection := AgentConnection{
+		AgentId:         agentID,
+		ConnectedAt:     time.Now(),
+		RemoteAddress:   remoteAddress,
+		ClientVersion:   clientVersion,
+		ProtocolVersion: protocolVersion,
+	}
+
+	return connection, s.db.Create(&connection).Error
+}
+
+//EndConnection records an agent disconnecting, and why
+func (s DatabaseStore) EndConnection(connection AgentConnection, reason string) error {
+	return s.db.Model(&connection).Updates(map[string]interface{}{"disconnected_at": time.Now(), "disconnect_reason": reason}).Error
+}
+
+//EndOpenConnections closes connections left open when theia stopped without closing them, they are taken to have ended when the agent was last heard from
+func (s DatabaseStore) EndOpenConnections() error {
+	tx := s.db.Begin()
+
+	var open []AgentConnection
+	if err := tx.Find(&open, "disconnected_at IS NULL").Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, connection := range open {
+		var agent Agent
+		if err := tx.Select("last_transmission").First(&agent, "id = ?", connection.AgentId).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		endedAt := connection.ConnectedAt
+		if agent.LastTransmission.After(endedAt) {
+			endedAt = agent.LastTransmission
+		}
+
+		if err := tx.Model(&connection).Updates(map[string]interface{}{"disconnected_at": endedAt, "disconnect_reason": DisconnectUnknown}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+//GetConnections returns the connections of an agent that were open at any point since a point in time, oldest first
+func (s DatabaseStore) GetConnections(agentID int64, since time.Time) (connections []AgentConnection, err error) {
+	return connections, s.db.Order("connected_at asc").Find(&connections, "agent_id = ? AND (disconnected_at IS NULL OR disconnected_at > ?)", agentID, since).Error
+}
+
+//GetFirstConnection returns the first connection recorded for an agent, ErrNotFound if it has never connected
+func (s DatabaseStore) GetFirstConnection(agentID int64) (connection AgentConnection, err error) {
+	return connection, notFound(s.db.Order("connected_at asc").First(&connection, "agent_id = ?", agentID).Error)
+}
+
+//Availability is the percentage of the time between from and to that an agent was connected, open connections count as connected up to to
+func Availability(connections []AgentConnection, from, to time.Time) float64 {
+	return ConnectionUptime(connections, from, to).Percent()
+}
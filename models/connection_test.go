@@ -0,0 +1,102 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAvailability(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+
+	at := func(hours float64) *time.Time {
+		t := from.Add(time.Duration(hours * float64(time.Hour)))
+		return &t
+	}
+
+	for _, c := range []struct {
+		name        string
+		connections []AgentConnection
+		expected    float64
+	}{
+		{"never connected", nil, 0},
+		{"connected throughout", []AgentConnection{{ConnectedAt: *at(-1)}}, 100},
+		{"clipped to the window", []AgentConnection{{ConnectedAt: *at(-5), DisconnectedAt: at(2)}, {ConnectedAt: *at(9), DisconnectedAt: at(12)}}, 30},
+		{"overlapping reconnect", []AgentConnection{{ConnectedAt: *at(1), DisconnectedAt: at(4)}, {ConnectedAt: *at(3), DisconnectedAt: at(6)}}, 50},
+		{"contained", []AgentConnection{{ConnectedAt: *at(1), DisconnectedAt: at(6)}, {ConnectedAt: *at(2), DisconnectedAt: at(3)}}, 50},
+		{"still connected", []AgentConnection{{ConnectedAt: *at(5)}}, 50},
+		{"ended before the window", []AgentConnection{{ConnectedAt: *at(-3), DisconnectedAt: at(-1)}}, 0},
+	} {
+		if got := Availability(c.connections, from, to); math.Abs(got-c.expected) > 0.001 {
+			t.Errorf("%s: expected %.2f%% availability, got %.2f%%", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestConnectionLog(t *testing.T) {
+	restore := useEmptyDatabase(t, "connections")
+	defer restore()
+
+	if _, err := store.CreateAgent("connecting", newTestPubKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	agents, err := store.GetAgentList("", 1)
+	if err != nil || len(agents) != 1 {
+		t.Fatal("Agent was not created: ", err)
+	}
+	agentID := agents[0].ID
+
+	first, err := store.StartConnection(agentID, "10.0.0.1:5000", "1.2.0", ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.EndConnection(first, DisconnectEOF); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.StartConnection(agentID, "10.0.0.1:5001", "1.2.0", ProtocolVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	connections, err := store.GetConnections(agentID, time.Now().Add(-time.Hour))
+	if err != nil || len(connections) != 2 {
+		t.Fatal("Expected both connections: ", connections, err)
+	}
+
+	if connections[0].DisconnectedAt == nil || connections[0].DisconnectReason != DisconnectEOF || connections[0].RemoteAddress != "10.0.0.1:5000" {
+		t.Fatal("First connection was not ended: ", connections[0])
+	}
+
+	if connections[1].DisconnectedAt != nil {
+		t.Fatal("Second connection should still be open: ", connections[1])
+	}
+
+	if recent, err := store.GetConnections(agentID, time.Now().Add(time.Hour)); err != nil || len(recent) != 1 {
+		t.Fatal("Only the open connection is still going in the future: ", recent, err)
+	}
+
+	// theia was killed, so the open connection is closed when it starts again
+	if err := store.EndOpenConnections(); err != nil {
+		t.Fatal(err)
+	}
+
+	connections, err = store.GetConnections(agentID, time.Time{})
+	if err != nil || connections[1].DisconnectedAt == nil || connections[1].DisconnectReason != DisconnectUnknown {
+		t.Fatal("Open connection was not closed: ", connections, err)
+	}
+
+	if oldest, err := store.GetFirstConnection(agentID); err != nil || oldest.Id != first.Id {
+		t.Fatal("Expected the first connection: ", oldest, err)
+	}
+
+	if err := store.PruneHistory(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if connections, err := store.GetConnections(agentID, time.Time{}); err != nil || len(connections) != 0 {
+		t.Fatal("Ended connections were not pruned: ", connections, err)
+	}
+}
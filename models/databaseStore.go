@@ -0,0 +1,122 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//DatabaseStore is the Store backed by a database, the schema must already have been brought up to date with InitaliseModels
+type DatabaseStore struct {
+	db *gorm.DB
+}
+
+var _ Store = DatabaseStore{}
+
+//NewDatabaseStore returns a Store that reads and writes db
+func NewDatabaseStore(db *gorm.DB) DatabaseStore {
+	return DatabaseStore{db: db}
+}
+
+func (s DatabaseStore) GetAgentsWithIssues(lastSeen time.Time) (agentsWithIssues []Agent, err error) {
+	return agentsWithIssues, s.db.Debug().Preload("Monitors").Preload("Disks").Preload("AlertProfile").
+		Select("DISTINCT agents.*").
+		Joins("INNER JOIN monitor_entries ON agents.id = monitor_entries.agent_id").
+		Joins("INNER JOIN disk_entries ON agents.id = disk_entries.agent_id").
+		Joins("INNER JOIN alerts ON agents.id = alerts.agent_id").
+		Find(&agentsWithIssues,
+			"alerts.active AND agents.archived_at IS NULL AND (agents.last_transmission < ? OR disk_entries.usage > alerts.disk_util OR NOT monitor_entries.ok OR (alerts.latency_ms > 0 AND monitor_entries.total_ms > alerts.latency_ms))", lastSeen).
+		Error
+}
+
+func (s DatabaseStore) GetExpiringCertificates(deadline time.Time) (expiring []MonitorEntry, err error) {
+	return expiring, s.db.Select("monitor_entries.*").
+		Joins("INNER JOIN alerts ON monitor_entries.agent_id = alerts.agent_id").
+		Joins("INNER JOIN agents ON monitor_entries.agent_id = agents.id").
+		Find(&expiring, "alerts.active AND agents.archived_at IS NULL AND monitor_entries.cert_expiry > ? AND monitor_entries.cert_expiry < ?", time.Time{}, deadline).
+		Error
+}
+
+func (s DatabaseStore) SetAgentConnected(agentID int64, connected bool) error {
+	return s.db.Model(&Agent{}).Where("id = ?", agentID).Update("currently_connected", connected).Error
+}
+
+func (s DatabaseStore) SetAllAgentsDisconnected() error {
+	return s.db.Model(&Agent{}).Update("currently_connected", false).Error
+}
+
+func (s DatabaseStore) SetLastConnectionFrom(agentID int64, address string) error {
+	return s.db.Model(&Agent{}).Where("id = ?", agentID).Update("last_connection_from", address).Error
+}
+
+func (s DatabaseStore) SetSystemInfo(agentID int64, info SystemInfo) error {
+	var existing SystemInfo
+	if err := s.db.Where("agent_id = ?", agentID).Find(&existing).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	info.Id = existing.Id
+	info.AgentId = agentID
+
+	return s.db.Save(&info).Error
+}
+
+func (s DatabaseStore) SetAlertProfile(agentID, diskUtilisation, latencyMs int64, active bool) error {
+	if err := s.db.First(&Agent{}, "id = ?", agentID).Error; err != nil {
+		return notFound(err)
+	}
+
+	return s.CreateAlertProfileForAgent(agentID, diskUtilisation, latencyMs, active)
+}
+
+func (s DatabaseStore) GetAgentKey(keyID int64) (key AgentKey, err error) {
+	return key, notFound(s.db.First(&key, "id = ?", keyID).Error)
+}
+
+func (s DatabaseStore) AddEvent(event Event) error {
+	return s.db.Create(&event).Error
+}
+
+func (s DatabaseStore) CountEventsSince(agentID int64, title string, since time.Time) (count int, err error) {
+	return count, s.db.Model(&Event{}).Where("created_at > ? AND title = ? AND agent_id = ?", since, title, agentID).Count(&count).Error
+}
+
+func (s DatabaseStore) GetUnnotifiedEvents(maxUrgency int) (events []Event, err error) {
+	return events, s.db.Find(&events, "notified = ? AND urgency <= ?", false, maxUrgency).Error
+}
+
+func (s DatabaseStore) SetEventNotified(eventID int64) error {
+	return s.db.Model(&Event{}).Where("id = ?", eventID).Update("notified", true).Error
+}
+
+func (s DatabaseStore) GetUser(username string) (user User, err error) {
+	return user, notFound(s.db.Where("username = ?", username).First(&user).Error)
+}
+
+func (s DatabaseStore) GetUserByToken(username, token string) (user User, err error) {
+	return user, notFound(s.db.Where("username = ? AND token = ?", username, token).First(&user).Error)
+}
+
+func (s DatabaseStore) SetUserToken(uid int64, token string) error {
+	return s.db.Model(&User{}).Where("id = ?", uid).Updates(map[string]interface{}{"token": token, "token_created_at": time.Now().Unix()}).Error
+}
+
+func (s DatabaseStore) RefreshUserToken(uid int64) error {
+	return s.db.Model(&User{}).Where("id = ?", uid).Update("token_created_at", time.Now().Unix()).Error
+}
+
+func (s DatabaseStore) GetNotificationSettings() (notification NotificationDetail, err error) {
+	return notification, notFound(s.db.First(&notification).Error)
+}
+
+func (s DatabaseStore) PruneHistory(cutoff time.Time) error {
+	if err := s.db.Delete(&MonitorSample{}, "created_at < ?", cutoff).Error; err != nil {
+		return err
+	}
+
+	if err := s.db.Delete(&MetricSample{}, "created_at < ?", cutoff).Error; err != nil {
+		return err
+	}
+
+	return s.db.Delete(&AgentConnection{}, "disconnected_at < ?", cutoff).Error
+}
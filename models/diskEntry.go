@@ -1,10 +1,11 @@
 package models
 
 //DiskEntry is the used percentage of the disk for the database
+//Devices are unique per agent, the index is created by migration 2
 type DiskEntry struct {
 	ID      int64
 	AgentId int64
 
-	Device string `gorm:"unique;not null"`
+	Device string `gorm:"not null"`
 	Usage  float32
 }
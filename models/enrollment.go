@@ -0,0 +1,216 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/NHAS/StatsCollector/utils"
+	"github.com/gliderlabs/ssh"
+)
+
+//EnrollmentUser is the ssh user an agent connects as to enroll, it authenticates with the new key it wants registered
+const EnrollmentUser = "enroll"
+
+//EnrollmentChannel is opened by an enrolling agent, the EnrollmentRequest is sent as the channels extra data
+const EnrollmentChannel = "enroll"
+
+//MaxEnrollmentTokenValidity limits how long a token can be issued for, they are meant to be used straight away
+const MaxEnrollmentTokenValidity = 7 * 24 * time.Hour
+
+//EnrollmentRequest is sent by an agent enrolling with a token
+type EnrollmentRequest struct {
+	Token         string `json:"token"`
+	Name          string `json:"name"`
+	ClientVersion string `json:"client_version"`
+}
+
+//EnrollmentResult is sent back once the agent has been registered
+type EnrollmentResult struct {
+	AgentName string `json:"agent_name"`
+}
+
+//EnrollmentToken lets a new agent register its own key, it can only be used once and only until it expires.
+//Only a hash of the secret is stored
+type EnrollmentToken struct {
+	Id         int64
+	SecretHash string `gorm:"unique;not null"`
+
+	//AgentName and Groups are given to the agent that uses the token, if AgentName is empty the agent's hostname is used
+	AgentName string
+	Groups    []Group `gorm:"many2many:enrollment_token_groups"`
+
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	UsedAt  *time.Time
+	AgentId int64
+}
+
+//ErrEnrollmentTokenInvalid is returned for a token that doesnt exist, has expired or was already used. Which one isnt given away
+var ErrEnrollmentTokenInvalid = errors.New("Enrollment token is invalid, expired or has already been used")
+
+//ErrEnrollmentValidity is returned when asked for a token that would be valid for too long, or not at all
+var ErrEnrollmentValidity = errors.New("Enrollment tokens must be valid for between 1 hour and 7 days")
+
+//FormatEnrollmentToken joins the secret with the fingerprint of theias host key, so the agent can check it is talking to the right server before sending the secret
+func FormatEnrollmentToken(secret, hostKeyFingerprint string) string {
+	return secret + "." + hostKeyFingerprint
+}
+
+//ParseEnrollmentToken splits a token given to iris into the secret and theias host key fingerprint
+func ParseEnrollmentToken(token string) (secret, hostKeyFingerprint string, err error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", errors.New("Enrollment token is malformed")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func hashEnrollmentSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//newEnrollmentToken checks a token can be issued and generates its secret, the token only holds the secrets hash
+func newEnrollmentToken(agentName, createdBy string, validFor time.Duration) (token EnrollmentToken, secret string, err error) {
+	if len(agentName) > 1000 {
+		return token, "", ErrAgentNameTooLong
+	}
+
+	if validFor < time.Hour || validFor > MaxEnrollmentTokenValidity {
+		return token, "", ErrEnrollmentValidity
+	}
+
+	secret, err = utils.GenerateHexToken(16)
+	if err != nil {
+		return token, "", err
+	}
+
+	return EnrollmentToken{
+		SecretHash: hashEnrollmentSecret(secret),
+		AgentName:  strings.TrimSpace(agentName),
+		CreatedBy:  createdBy,
+		ExpiresAt:  time.Now().Add(validFor),
+	}, secret, nil
+}
+
+//CreateEnrollmentToken issues a new token, returning its id and the secret. The secret cannot be retrieved again later
+func (s DatabaseStore) CreateEnrollmentToken(agentName, createdBy string, groupIDs []int64, validFor time.Duration) (tokenID int64, secret string, err error) {
+	token, secret, err := newEnrollmentToken(agentName, createdBy, validFor)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(groupIDs) > 0 {
+		if err := s.db.Find(&token.Groups, "id IN (?)", groupIDs).Error; err != nil {
+			return 0, "", err
+		}
+	}
+
+	if err := s.db.Create(&token).Error; err != nil {
+		return 0, "", err
+	}
+
+	return token.Id, secret, nil
+}
+
+//GetEnrollmentTokens returns the tokens that can still be used
+func (s DatabaseStore) GetEnrollmentTokens() (tokens []EnrollmentToken, err error) {
+	return tokens, s.db.Preload("Groups").Where("used_at IS NULL AND expires_at > ?", time.Now()).Order("expires_at asc").Find(&tokens).Error
+}
+
+//DeleteEnrollmentToken revokes a token
+func (s DatabaseStore) DeleteEnrollmentToken(id int64) error {
+	tx := s.db.Begin()
+	if err := tx.Exec("DELETE FROM enrollment_token_groups WHERE enrollment_token_id = ?", id).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Delete(&EnrollmentToken{}, "id = ?", id).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+//agent checks the token can still be used, and returns the agent it would create
+func (token EnrollmentToken) agent(pubKey, name string, now time.Time) (Agent, error) {
+	if token.UsedAt != nil || now.After(token.ExpiresAt) {
+		return Agent{}, ErrEnrollmentTokenInvalid
+	}
+
+	agent := Agent{Name: token.AgentName, PubKey: pubKey}
+	if len(agent.Name) == 0 {
+		agent.Name = strings.TrimSpace(name)
+	}
+
+	if len(agent.Name) > 1000 {
+		return Agent{}, ErrAgentNameTooLong
+	}
+
+	return agent, nil
+}
+
+//RedeemEnrollmentToken uses up a token to register a new agent with pubKey, putting it in the tokens groups.
+//name is only used if the token doesnt set one
+func (s DatabaseStore) RedeemEnrollmentToken(secret, pubKey, name string) (Agent, error) {
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey)); len(pubKey) == 0 || err != nil {
+		return Agent{}, ErrAgentPubKeyNotValid
+	}
+
+	var token EnrollmentToken
+	if err := s.db.Preload("Groups").First(&token, "secret_hash = ?", hashEnrollmentSecret(secret)).Error; err != nil {
+		return Agent{}, ErrEnrollmentTokenInvalid
+	}
+
+	now := time.Now()
+	agent, err := token.agent(pubKey, name, now)
+	if err != nil {
+		return Agent{}, err
+	}
+
+	tx := s.db.Begin()
+
+	// Claiming the token first means two agents racing with the same token cant both succeed
+	claim := tx.Model(&EnrollmentToken{}).Where("id = ? AND used_at IS NULL", token.Id).Update("used_at", now)
+	if claim.Error != nil {
+		tx.Rollback()
+		return Agent{}, claim.Error
+	}
+
+	if claim.RowsAffected != 1 {
+		tx.Rollback()
+		return Agent{}, ErrEnrollmentTokenInvalid
+	}
+
+	if err := tx.Create(&agent).Error; err != nil {
+		tx.Rollback()
+		return Agent{}, err
+	}
+
+	if _, err := newAgentKey(tx, agent.ID, pubKey); err != nil {
+		tx.Rollback()
+		return Agent{}, err
+	}
+
+	if len(token.Groups) > 0 {
+		if err := tx.Model(&agent).Association("Groups").Append(token.Groups).Error; err != nil {
+			tx.Rollback()
+			return Agent{}, err
+		}
+	}
+
+	if err := tx.Model(&EnrollmentToken{}).Where("id = ?", token.Id).Update("agent_id", agent.ID).Error; err != nil {
+		tx.Rollback()
+		return Agent{}, err
+	}
+
+	return agent, tx.Commit().Error
+}
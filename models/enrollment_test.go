@@ -0,0 +1,103 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestPubKey(t *testing.T) string {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := gossh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+}
+
+func TestRedeemEnrollmentToken(t *testing.T) {
+	setupDatabase()
+	defer db.Close()
+
+	if err := store.CreateGroup("enrolled"); err != nil {
+		t.Fatal(err)
+	}
+
+	var group Group
+	if err := db.First(&group, "name = ?", "enrolled").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.CreateEnrollmentToken("", "admin", nil, 30*24*time.Hour); err != ErrEnrollmentValidity {
+		t.Fatal("Token valid for too long was issued: ", err)
+	}
+
+	_, secret, err := store.CreateEnrollmentToken("", "admin", []int64{group.ID}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := store.GetEnrollmentTokens()
+	if err != nil || len(pending) != 1 || len(pending[0].Groups) != 1 {
+		t.Fatal("Expected the token to be pending with its group: ", pending, err)
+	}
+
+	if _, err := store.RedeemEnrollmentToken("wrong", newTestPubKey(t), "host"); err != ErrEnrollmentTokenInvalid {
+		t.Fatal("Wrong secret was accepted: ", err)
+	}
+
+	key := newTestPubKey(t)
+	agent, err := store.RedeemEnrollmentToken(secret, key, "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered, err := store.GetAgent(agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if registered.ID != agent.ID || registered.Name != "host" || len(registered.Groups) != 1 || registered.Groups[0].ID != group.ID {
+		t.Fatal("Agent was not registered with its name and groups: ", registered)
+	}
+
+	if len(registered.Keys) != 1 || registered.Keys[0].PubKey != key {
+		t.Fatal("Agent was not registered with its key: ", registered.Keys)
+	}
+
+	if _, err := store.RedeemEnrollmentToken(secret, newTestPubKey(t), "again"); err != ErrEnrollmentTokenInvalid {
+		t.Fatal("Token was used twice: ", err)
+	}
+
+	pending, err = store.GetEnrollmentTokens()
+	if err != nil || len(pending) != 0 {
+		t.Fatal("Used token is still pending: ", pending, err)
+	}
+}
+
+func TestRedeemExpiredEnrollmentToken(t *testing.T) {
+	setupDatabase()
+	defer db.Close()
+
+	_, secret, err := store.CreateEnrollmentToken("named", "admin", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Model(&EnrollmentToken{}).Where("secret_hash = ?", hashEnrollmentSecret(secret)).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.RedeemEnrollmentToken(secret, newTestPubKey(t), "host"); err != ErrEnrollmentTokenInvalid {
+		t.Fatal("Expired token was accepted: ", err)
+	}
+}
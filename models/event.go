@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 //Event is a log/event that has occured from one of the clients
 //This is tied into email notifications
@@ -13,3 +18,95 @@ type Event struct {
 	Notified  bool
 	CreatedAt time.Time
 }
+
+//EventFilter picks events out, empty fields match everything
+type EventFilter struct {
+	// AgentIDs limits events to those raised about these agents, a non nil empty list matches nothing
+	AgentIDs []int64
+	// MaxUrgency matches events at least this urgent, lower is more urgent
+	MaxUrgency *int
+	Notified   *bool
+	// Search matches events with it anywhere in their title or message, ignoring case
+	Search string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f EventFilter) matches(event Event) bool {
+	if f.AgentIDs != nil {
+		found := false
+		for _, id := range f.AgentIDs {
+			found = found || id == event.AgentId
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.MaxUrgency != nil && event.Urgency > *f.MaxUrgency {
+		return false
+	}
+
+	if f.Notified != nil && event.Notified != *f.Notified {
+		return false
+	}
+
+	if search := strings.ToLower(f.Search); search != "" && !strings.Contains(strings.ToLower(event.Title), search) && !strings.Contains(strings.ToLower(event.Message), search) {
+		return false
+	}
+
+	if !f.Since.IsZero() && event.CreatedAt.Before(f.Since) {
+		return false
+	}
+
+	return f.Until.IsZero() || event.CreatedAt.Before(f.Until)
+}
+
+func (f EventFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.AgentIDs != nil {
+		if len(f.AgentIDs) == 0 {
+			return query.Where("1 = 0")
+		}
+		query = query.Where("agent_id IN (?)", f.AgentIDs)
+	}
+
+	if f.MaxUrgency != nil {
+		query = query.Where("urgency <= ?", *f.MaxUrgency)
+	}
+
+	if f.Notified != nil {
+		query = query.Where("notified = ?", *f.Notified)
+	}
+
+	if f.Search != "" {
+		// LIKE is case sensitive in postgres, so both sides are lowered. As in the audit log ! escapes the wildcards
+		pattern := "%" + strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(f.Search)) + "%"
+		query = query.Where("LOWER(title) LIKE ? ESCAPE '!' OR LOWER(message) LIKE ? ESCAPE '!'", pattern, pattern)
+	}
+
+	if !f.Since.IsZero() {
+		query = query.Where("created_at >= ?", f.Since)
+	}
+
+	if !f.Until.IsZero() {
+		query = query.Where("created_at < ?", f.Until)
+	}
+
+	return query
+}
+
+//GetEvents returns a page of the events matching filter newest first, along with how many match in total. A limit of 0 or less returns all of them, ignoring offset
+func (s DatabaseStore) GetEvents(filter EventFilter, offset, limit int) (events []Event, total int, err error) {
+	if err := filter.apply(s.db.Model(&Event{})).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	query := filter.apply(s.db).Order("created_at desc, id desc")
+	if limit > 0 {
+		// sqlite only allows an offset along with a limit
+		query = query.Offset(offset).Limit(limit)
+	}
+
+	return events, total, query.Find(&events).Error
+}
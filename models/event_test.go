@@ -0,0 +1,73 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetEvents(t *testing.T) {
+	restore := useEmptyDatabase(t, "events")
+	defer restore()
+
+	start := time.Now().Add(-time.Hour)
+	events := []Event{
+		{AgentId: 1, Urgency: 1, Title: "Disk usage", Message: "/dev/sda1 is 95% full", Notified: true, CreatedAt: start},
+		{AgentId: 1, Urgency: 3, Title: "Certificate expiring", Message: "example.com expires in 14 days", CreatedAt: start.Add(time.Minute)},
+		{AgentId: 2, Urgency: 2, Title: "Agent down", Message: "Not heard from in 10 minutes", CreatedAt: start.Add(2 * time.Minute)},
+		{AgentId: 3, Urgency: 1, Title: "disk_usage", Message: "100% full", CreatedAt: start.Add(3 * time.Minute)},
+	}
+
+	for _, event := range events {
+		if err := store.AddEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, total, err := store.GetEvents(EventFilter{}, 0, 0)
+	if err != nil || len(all) != len(events) || total != len(events) {
+		t.Fatal("Expected every event: ", all, total, err)
+	}
+
+	if all[0].AgentId != 3 || all[3].Title != "Disk usage" {
+		t.Fatal("Events are not newest first: ", all)
+	}
+
+	urgent, notified, unnotified := 1, true, false
+	for _, f := range []struct {
+		filter EventFilter
+		count  int
+	}{
+		{EventFilter{AgentIDs: []int64{1}}, 2},
+		{EventFilter{AgentIDs: []int64{1, 2}}, 3},
+		{EventFilter{AgentIDs: []int64{}}, 0},
+		{EventFilter{MaxUrgency: &urgent}, 2},
+		{EventFilter{Notified: &notified}, 1},
+		{EventFilter{Notified: &unnotified, MaxUrgency: &urgent}, 1},
+		{EventFilter{Search: "DISK"}, 2},
+		{EventFilter{Search: "14 days"}, 1},
+		{EventFilter{Search: "disk_"}, 1},
+		{EventFilter{Search: "100%"}, 1},
+		{EventFilter{Since: start.Add(90 * time.Second)}, 2},
+		{EventFilter{Until: start.Add(90 * time.Second)}, 2},
+	} {
+		found, total, err := store.GetEvents(f.filter, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(found) != f.count || total != f.count {
+			t.Fatalf("Filter %+v found %d (total %d) events rather than %d", f.filter, len(found), total, f.count)
+		}
+
+		for _, event := range found {
+			if !f.filter.matches(event) {
+				t.Fatalf("Filter %+v doesnt match %+v in memory", f.filter, event)
+			}
+		}
+	}
+
+	page, total, err := store.GetEvents(EventFilter{}, 1, 2)
+	if err != nil || total != len(events) || len(page) != 2 || page[0].AgentId != 2 || page[1].Title != "Certificate expiring" {
+		t.Fatal("Expected the second and third newest events: ", page, total, err)
+	}
+}
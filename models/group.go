@@ -0,0 +1,122 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+//Group is a named set of agents that share centrally managed monitors
+type Group struct {
+	ID   int64
+	Name string `gorm:"unique;not null"`
+
+	Agents   []Agent `gorm:"many2many:agent_groups"`
+	Monitors []MonitorDefinition
+}
+
+//ErrGroupNameInvalid is returned when a group name is empty or too long
+var ErrGroupNameInvalid = errors.New("Group name must be between 1 and 100 characters")
+
+//groupName trims a new group's name and checks it is valid
+func groupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(name) > 100 {
+		return "", ErrGroupNameInvalid
+	}
+
+	return name, nil
+}
+
+//CreateGroup adds a new, empty, group
+func (s DatabaseStore) CreateGroup(name string) error {
+	name, err := groupName(name)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Create(&Group{Name: name}).Error
+}
+
+//DeleteGroup removes a group along with its monitors, returning the agents that were in it so their config can be updated
+func (s DatabaseStore) DeleteGroup(groupID int64) (agentIDs []int64, err error) {
+	agentIDs, err = s.GetGroupAgentIDs(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Delete(&MonitorDefinition{}, "group_id = ?", groupID).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Exec("DELETE FROM agent_groups WHERE group_id = ?", groupID).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Delete(&Group{}, "id = ?", groupID).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return agentIDs, tx.Commit().Error
+}
+
+//GetGroups returns every group with its members and monitors
+func (s DatabaseStore) GetGroups() (groups []Group, err error) {
+	return groups, s.db.Preload("Agents").Preload("Monitors").Order("name asc").Find(&groups).Error
+}
+
+//GetGroupAgentIDs returns the ids of the agents in a group
+func (s DatabaseStore) GetGroupAgentIDs(groupID int64) (agentIDs []int64, err error) {
+	return agentIDs, s.db.Table("agent_groups").Where("group_id = ?", groupID).Pluck("agent_id", &agentIDs).Error
+}
+
+//SetGroupMembers replaces the agents in a group, returning every agent that was added or removed
+func (s DatabaseStore) SetGroupMembers(groupID int64, agentIDs []int64) (changed []int64, err error) {
+	var group Group
+	if err := s.db.First(&group, groupID).Error; err != nil {
+		return nil, notFound(err)
+	}
+
+	previous, err := s.GetGroupAgentIDs(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []Agent
+	if len(agentIDs) > 0 {
+		if err := s.db.Find(&agents, "id IN (?)", agentIDs).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.db.Model(&group).Association("Agents").Replace(agents).Error; err != nil {
+		return nil, err
+	}
+
+	current := make([]int64, 0, len(agents))
+	for _, a := range agents {
+		current = append(current, a.ID)
+	}
+
+	return memberChanges(previous, current), nil
+}
+
+//memberChanges returns every agent either side of a change in group membership, they all need their config recalculated
+func memberChanges(previous, current []int64) (changed []int64) {
+	seen := make(map[int64]bool)
+	for _, id := range previous {
+		seen[id] = true
+	}
+	for _, id := range current {
+		seen[id] = true
+	}
+
+	for id := range seen {
+		changed = append(changed, id)
+	}
+
+	return changed
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//maxBindVars keeps each batched statement under the smallest limit on query parameters, sqlite's default of 999
+const maxBindVars = 999
+
+//IngestStats stores a stats report from an agent in a single transaction, updating its current memory, disk and monitor state and adding to their history.
+//Reports replayed from the agents buffer after an outage are stored in the history at the time they were taken
+func (s DatabaseStore) IngestStats(agentID int64, stat Stats) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := ingestStats(tx, agentID, stat, time.Now()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+//report is what a stats report changes: an agents current disks and monitors, and the history to add
+type report struct {
+	disks    []DiskEntry
+	monitors []MonitorEntry
+
+	metricSamples  []MetricSample
+	monitorSamples []MonitorSample
+}
+
+//newReport works out what a stats report changes, lastChecked is when each of the agents monitors was last checked as of the previous report
+func newReport(agentID int64, stat Stats, lastChecked map[string]time.Time, now time.Time) (r report) {
+	// Agents that predate buffering dont timestamp their stats, and a clock running ahead shouldnt put history in the future
+	sampledAt := stat.Timestamp
+	if sampledAt.IsZero() || sampledAt.After(now) {
+		sampledAt = now
+	}
+
+	r.metricSamples = NewMetricSamples(agentID, stat, sampledAt)
+
+	for device, usage := range stat.DiskUsage {
+		r.disks = append(r.disks, DiskEntry{AgentId: agentID, Device: device, Usage: usage})
+	}
+
+	// A path reported twice would make the upsert touch the same row twice, which postgres refuses
+	latest := make(map[string]int)
+	for i, status := range stat.MonitorValues {
+		latest[status.Path] = i
+	}
+
+	for i, status := range stat.MonitorValues {
+		if latest[status.Path] != i {
+			continue
+		}
+
+		// Agents report the cached result of each check, so only keep history for results we havent seen
+		checkedAt, seen := lastChecked[status.Path]
+		if !seen || status.CheckedAt.IsZero() || status.CheckedAt.After(checkedAt) {
+			// Like the metrics, a check from a clock running ahead is put at now rather than in the future
+			sample := NewMonitorSample(agentID, status)
+			if sample.CreatedAt.IsZero() || sample.CreatedAt.After(now) {
+				sample.CreatedAt = now
+			}
+			r.monitorSamples = append(r.monitorSamples, sample)
+		}
+
+		r.monitors = append(r.monitors, MonitorEntry{AgentId: agentID, MonitorEntry: status})
+	}
+
+	return r
+}
+
+func ingestStats(tx *gorm.DB, agentID int64, stat Stats, now time.Time) error {
+	// A map is used so zero values, like memory usage dropping to 0, are written too
+	update := tx.Model(&Agent{}).Where("id = ?", agentID).UpdateColumns(map[string]interface{}{
+		"last_transmission":   now,
+		"currently_connected": true,
+		"memory_usage":        stat.MemoryUsage,
+	})
+	if update.Error != nil {
+		return update.Error
+	}
+
+	// The agent may have been deleted while still connected, storing the report would leave orphaned rows behind
+	if update.RowsAffected == 0 {
+		// mysql counts rows that didnt change as unaffected, so check the agent is really gone
+		var count int
+		if err := tx.Model(&Agent{}).Where("id = ?", agentID).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return ErrNotFound
+		}
+	}
+
+	lastChecked := make(map[string]time.Time)
+	if len(stat.MonitorValues) > 0 {
+		var previous []MonitorEntry
+		if err := tx.Where("agent_id = ?", agentID).Find(&previous).Error; err != nil {
+			return err
+		}
+
+		for _, entry := range previous {
+			lastChecked[entry.MonitorEntry.Path] = entry.MonitorEntry.CheckedAt
+		}
+	}
+
+	r := newReport(agentID, stat, lastChecked, now)
+
+	var disks []interface{}
+	for _, disk := range r.disks {
+		disks = append(disks, disk)
+	}
+
+	if err := upsert(tx, disks, "agent_id", "device"); err != nil {
+		return fmt.Errorf("Unable to store disks: %w", err)
+	}
+
+	var monitors []interface{}
+	for _, monitor := range r.monitors {
+		monitors = append(monitors, monitor)
+	}
+
+	if err := upsert(tx, monitors, "agent_id", "path"); err != nil {
+		return fmt.Errorf("Unable to store monitors: %w", err)
+	}
+
+	var history []interface{}
+	for _, sample := range r.metricSamples {
+		history = append(history, sample)
+	}
+	for _, sample := range r.monitorSamples {
+		history = append(history, sample)
+	}
+
+	if err := upsert(tx, history); err != nil {
+		return fmt.Errorf("Unable to record history: %w", err)
+	}
+
+	return nil
+}
+
+//upsert inserts rows of the same model in as few statements as possible. If conflict columns are given, rows that clash on them replace the existing row's values instead.
+//Primary keys are left to the database
+func upsert(tx *gorm.DB, rows []interface{}, conflict ...string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// Group rows by table, history mixes metric and monitor samples
+	tables := make(map[string][]interface{})
+	var order []string
+	for _, row := range rows {
+		table := tx.NewScope(row).TableName()
+		if _, ok := tables[table]; !ok {
+			order = append(order, table)
+		}
+		tables[table] = append(tables[table], row)
+	}
+
+	for _, table := range order {
+		if err := upsertTable(tx, table, tables[table], conflict); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func upsertTable(tx *gorm.DB, table string, rows []interface{}, conflict []string) error {
+	scope := tx.NewScope(rows[0])
+
+	var columns []string
+	for _, field := range scope.Fields() {
+		if field.IsNormal && !field.IsIgnored && !field.IsPrimaryKey {
+			columns = append(columns, field.DBName)
+		}
+	}
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = scope.Quote(column)
+	}
+
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+
+	var onConflict string
+	if len(conflict) > 0 {
+		var set []string
+		for _, column := range columns {
+			if tx.Dialect().GetName() == "mysql" {
+				set = append(set, fmt.Sprintf("%s = VALUES(%s)", scope.Quote(column), scope.Quote(column)))
+			} else {
+				set = append(set, fmt.Sprintf("%s = excluded.%s", scope.Quote(column), scope.Quote(column)))
+			}
+		}
+
+		if tx.Dialect().GetName() == "mysql" {
+			onConflict = " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+		} else {
+			quotedConflict := make([]string, len(conflict))
+			for i, column := range conflict {
+				quotedConflict[i] = scope.Quote(column)
+			}
+			onConflict = fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(quotedConflict, ", "), strings.Join(set, ", "))
+		}
+	}
+
+	batchSize := maxBindVars / len(columns)
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var values []interface{}
+		for _, row := range rows[start:end] {
+			// Every row is the same model, so its fields come in the same order as columns
+			for _, field := range tx.NewScope(row).Fields() {
+				if field.IsNormal && !field.IsIgnored && !field.IsPrimaryKey {
+					values = append(values, field.Field.Interface())
+				}
+			}
+		}
+
+		statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s%s",
+			scope.Quote(table), strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat(placeholders+", ", end-start), ", "), onConflict)
+
+		if err := tx.Exec(statement, values...).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIngestStats(t *testing.T) {
+	setupDatabase()
+
+	agents := []Agent{{Name: "ingest-1", PubKey: "ingest-1"}, {Name: "ingest-2", PubKey: "ingest-2"}}
+	for i := range agents {
+		if err := db.Create(&agents[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	report := Stats{
+		MemoryUsage: 60,
+		DiskUsage:   map[string]float32{"/dev/sda1": 80},
+		MonitorValues: []MonitorStatus{
+			{Path: "https://example.com", OK: true, StatusCode: 200, CheckedAt: checkedAt, TotalMs: 120},
+		},
+	}
+
+	// Both agents share a device name and monitor path
+	for _, agent := range agents {
+		if err := store.IngestStats(agent.ID, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same cached result again, then a new result that has gone down to zero values
+	if err := store.IngestStats(agents[0].ID, report); err != nil {
+		t.Fatal(err)
+	}
+
+	report.MemoryUsage = 0
+	report.DiskUsage = map[string]float32{"/dev/sda1": 0}
+	report.MonitorValues = []MonitorStatus{{Path: "https://example.com", OK: false, StatusCode: 0, Reason: "refused", CheckedAt: checkedAt.Add(time.Minute)}}
+	if err := store.IngestStats(agents[0].ID, report); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := store.GetAgent(agents[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agent.MemoryUsage != 0 || !agent.CurrentlyConnected || agent.LastTransmission.IsZero() {
+		t.Fatal("Agent state was not updated: ", agent)
+	}
+
+	if len(agent.Disks) != 1 || agent.Disks[0].Usage != 0 {
+		t.Fatal("Disk usage dropping to 0 was not stored: ", agent.Disks)
+	}
+
+	if len(agent.Monitors) != 1 {
+		t.Fatal("Expected one monitor, got: ", agent.Monitors)
+	}
+
+	if m := agent.Monitors[0].MonitorEntry; m.OK || m.StatusCode != 0 || m.TotalMs != 0 || m.Reason != "refused" {
+		t.Fatal("Monitor going down was not stored: ", m)
+	}
+
+	samples, err := store.GetMonitorSamples(agents[0].ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 2 || !samples[0].OK || samples[1].OK {
+		t.Fatal("Expected a history sample for each new result only: ", samples)
+	}
+
+	other, err := store.GetAgent(agents[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(other.Disks) != 1 || other.Disks[0].Usage != 80 || len(other.Monitors) != 1 || !other.Monitors[0].MonitorEntry.OK {
+		t.Fatal("Another agent's report changed this agent: ", other)
+	}
+}
+
+func TestIngestStatsIsAtomic(t *testing.T) {
+	setupDatabase()
+
+	agent := Agent{Name: "atomic", PubKey: "atomic"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Exec("DROP TABLE monitor_samples").Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.AutoMigrate(&MonitorSample{})
+
+	err := store.IngestStats(agent.ID, Stats{
+		MemoryUsage:   50,
+		DiskUsage:     map[string]float32{"/dev/atomic": 10},
+		MonitorValues: []MonitorStatus{{Path: "https://atomic.example.com", OK: true}},
+	})
+	if err == nil {
+		t.Fatal("Expected storing history to fail")
+	}
+
+	var disks int
+	db.Model(&DiskEntry{}).Where("agent_id = ?", agent.ID).Count(&disks)
+	if disks != 0 {
+		t.Fatal("Part of a failed report was stored")
+	}
+}
+
+func TestIngestStatsDeletedAgent(t *testing.T) {
+	setupDatabase()
+
+	agent := Agent{Name: "deleted", PubKey: "deleted"}
+	if err := db.Create(&agent).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteAgent(agent.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A report from a session that was still connected when the agent was deleted
+	err := store.IngestStats(agent.ID, Stats{
+		MemoryUsage:   50,
+		DiskUsage:     map[string]float32{"/dev/deleted": 10},
+		MonitorValues: []MonitorStatus{{Path: "https://deleted.example.com", OK: true}},
+	})
+	if err == nil {
+		t.Fatal("Expected stats for a deleted agent to be refused")
+	}
+
+	for _, table := range []interface{}{&DiskEntry{}, &MonitorEntry{}, &MonitorSample{}, &MetricSample{}} {
+		var count int
+		db.Model(table).Where("agent_id = ?", agent.ID).Count(&count)
+		if count != 0 {
+			t.Fatalf("Stats for a deleted agent were stored in %T", table)
+		}
+	}
+}
+
+//BenchmarkIngestStats measures how many reports theia can store, each from one of 2000 agents with 4 disks and 10 monitors
+func BenchmarkIngestStats(b *testing.B) {
+	setupDatabase()
+	defer db.Close()
+
+	const agentCount = 2000
+
+	agentIDs := make([]int64, agentCount)
+	for i := range agentIDs {
+		agent := Agent{Name: fmt.Sprintf("bench-%d", i), PubKey: fmt.Sprintf("bench-%d", i)}
+		if err := db.Create(&agent).Error; err != nil {
+			b.Fatal(err)
+		}
+		agentIDs[i] = agent.ID
+	}
+
+	report := func(n int) Stats {
+		stat := Stats{MemoryUsage: float32(n % 100), DiskUsage: make(map[string]float32)}
+		for d := 0; d < 4; d++ {
+			stat.DiskUsage[fmt.Sprintf("/dev/sda%d", d)] = float32((n + d) % 100)
+		}
+
+		for m := 0; m < 10; m++ {
+			stat.MonitorValues = append(stat.MonitorValues, MonitorStatus{
+				Path:       fmt.Sprintf("https://service-%d.example.com", m),
+				OK:         (n+m)%7 != 0,
+				StatusCode: 200,
+				CheckedAt:  time.Unix(int64(n), 0),
+				TotalMs:    float32(n % 500),
+			})
+		}
+
+		return stat
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+
+	for n := 0; n < b.N; n++ {
+		if err := store.IngestStats(agentIDs[n%agentCount], report(n)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Minutes(), "reports/min")
+}
+
+func TestRemoveStaleMonitors(t *testing.T) {
+	setupDatabase()
+
+	agents := []Agent{{Name: "stale-1", PubKey: "stale-1"}, {Name: "stale-2", PubKey: "stale-2"}}
+	for i := range agents {
+		if err := db.Create(&agents[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := Stats{MonitorValues: []MonitorStatus{
+		{Path: "https://kept.example.com", OK: true, CheckedAt: time.Now()},
+		{Path: "https://removed.example.com", OK: false, CheckedAt: time.Now()},
+	}}
+	for _, agent := range agents {
+		if err := store.IngestStats(agent.ID, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.RemoveStaleMonitors(agents[0].ID, []string{"https://kept.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, err := store.GetAgent(agents[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agent.Monitors) != 1 || agent.Monitors[0].MonitorEntry.Path != "https://kept.example.com" {
+		t.Fatal("Removed monitor was not deleted: ", agent.Monitors)
+	}
+
+	var samples int
+	db.Model(&MonitorSample{}).Where("agent_id = ? AND path = ?", agents[0].ID, "https://removed.example.com").Count(&samples)
+	if samples != 1 {
+		t.Fatal("History of a removed monitor should be kept, got samples: ", samples)
+	}
+
+	other, err := store.GetAgent(agents[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(other.Monitors) != 2 {
+		t.Fatal("Another agent's monitors were deleted: ", other.Monitors)
+	}
+
+	// An agent running no monitors at all
+	if err := store.RemoveStaleMonitors(agents[1].ID, []string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err = store.GetAgent(agents[1].ID)
+	if err != nil || len(other.Monitors) != 0 {
+		t.Fatal("Monitors were not all removed: ", other.Monitors, err)
+	}
+}
+
+func TestReportClampsFutureTimes(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ahead := now.Add(time.Hour)
+
+	r := newReport(1, Stats{
+		Timestamp:     ahead,
+		MonitorValues: []MonitorStatus{{Path: "https://example.com", OK: true, CheckedAt: ahead}},
+	}, nil, now)
+
+	if len(r.monitorSamples) != 1 || !r.monitorSamples[0].CreatedAt.Equal(now) {
+		t.Fatal("Check from a clock running ahead was not put at now: ", r.monitorSamples)
+	}
+
+	for _, sample := range r.metricSamples {
+		if !sample.CreatedAt.Equal(now) {
+			t.Fatal("Metric from a clock running ahead was not put at now: ", sample)
+		}
+	}
+}
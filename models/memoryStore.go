@@ -0,0 +1,1426 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MemoryStore is a Store that keeps everything in memory, so code using a Store can be tested without a database.
+//It enforces the same rules as DatabaseStore, and returns ErrNotFound for anything missing just as it does
+type MemoryStore struct {
+	sync.Mutex
+
+	lastID int64
+
+	// agents only hold the agents own fields, the rest are filled in when they are read
+	agents      map[int64]Agent
+	keys        []AgentKey
+	alerts      map[int64]Alert
+	systemInfo  map[int64]SystemInfo
+	disks       []DiskEntry
+	monitors    []MonitorEntry
+	groups      map[int64]Group
+	members     map[int64]map[int64]bool
+	definitions []MonitorDefinition
+	commands    []CommandLog
+	tokens      []EnrollmentToken
+
+	events        []Event
+	users         []User
+	notifications []NotificationDetail
+
+	monitorSamples []MonitorSample
+	metricSamples  []MetricSample
+	connections    []AgentConnection
+
+	audit []AuditEntry
+}
+
+var _ Store = &MemoryStore{}
+
+//NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		agents:     make(map[int64]Agent),
+		alerts:     make(map[int64]Alert),
+		systemInfo: make(map[int64]SystemInfo),
+		groups:     make(map[int64]Group),
+		members:    make(map[int64]map[int64]bool),
+	}
+}
+
+func (s *MemoryStore) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+func (s *MemoryStore) addAgent(agent Agent) (Agent, error) {
+	for _, existing := range s.agents {
+		if existing.PubKey == agent.PubKey {
+			return Agent{}, fmt.Errorf("An agent with public key %q already exists", agent.PubKey)
+		}
+	}
+
+	agent.ID = s.nextID()
+	s.agents[agent.ID] = agent
+
+	return agent, nil
+}
+
+func (s *MemoryStore) addAgentKey(agentID int64, authorizedKey string) (AgentKey, error) {
+	pubKey, fingerprint, comment, err := parseAgentKey(authorizedKey)
+	if err != nil {
+		return AgentKey{}, err
+	}
+
+	for _, existing := range s.keys {
+		if existing.PubKey == pubKey {
+			return AgentKey{}, ErrAgentKeyInUse
+		}
+	}
+
+	key := AgentKey{Id: s.nextID(), AgentId: agentID, PubKey: pubKey, Fingerprint: fingerprint, Comment: comment, CreatedAt: time.Now()}
+	s.keys = append(s.keys, key)
+
+	return key, nil
+}
+
+//details fills in everything that belongs to an agent, as GetAgent preloads it
+func (s *MemoryStore) details(agent Agent) Agent {
+	agent.AlertProfile = s.alerts[agent.ID]
+	agent.SystemInfo = s.systemInfo[agent.ID]
+
+	agent.Monitors, agent.Disks, agent.Groups, agent.Keys = nil, nil, nil, nil
+
+	for _, m := range s.monitors {
+		if m.AgentId == agent.ID {
+			agent.Monitors = append(agent.Monitors, m)
+		}
+	}
+
+	for _, d := range s.disks {
+		if d.AgentId == agent.ID {
+			agent.Disks = append(agent.Disks, d)
+		}
+	}
+
+	for _, id := range s.sortedGroupIDs() {
+		if s.members[id][agent.ID] {
+			agent.Groups = append(agent.Groups, Group{ID: id, Name: s.groups[id].Name})
+		}
+	}
+
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if s.keys[i].AgentId == agent.ID {
+			agent.Keys = append(agent.Keys, s.keys[i])
+		}
+	}
+
+	return agent
+}
+
+func (s *MemoryStore) sortedAgents() (agents []Agent) {
+	for _, agent := range s.agents {
+		agents = append(agents, s.details(agent))
+	}
+
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+func (s *MemoryStore) sortedGroupIDs() (ids []int64) {
+	for id := range s.groups {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *MemoryStore) updateAgent(agentID int64, update func(*Agent)) {
+	if agent, ok := s.agents[agentID]; ok {
+		update(&agent)
+		s.agents[agentID] = agent
+	}
+}
+
+func (s *MemoryStore) CreateAgent(name, pubKey string) (int64, error) {
+	if err := validateNewAgent(name, pubKey); err != nil {
+		return 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	agent, err := s.addAgent(Agent{Name: name, PubKey: pubKey})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.addAgentKey(agent.ID, pubKey); err != nil {
+		delete(s.agents, agent.ID)
+		return 0, err
+	}
+
+	return agent.ID, nil
+}
+
+func (s *MemoryStore) DeleteAgent(agentID int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.deleteAgent(agentID)
+}
+
+func (s *MemoryStore) deleteAgent(agentID int64) error {
+	if _, ok := s.agents[agentID]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.agents, agentID)
+	delete(s.alerts, agentID)
+	delete(s.systemInfo, agentID)
+	for _, members := range s.members {
+		delete(members, agentID)
+	}
+
+	monitors := s.monitors[:0]
+	for _, m := range s.monitors {
+		if m.AgentId != agentID {
+			monitors = append(monitors, m)
+		}
+	}
+	s.monitors = monitors
+
+	disks := s.disks[:0]
+	for _, d := range s.disks {
+		if d.AgentId != agentID {
+			disks = append(disks, d)
+		}
+	}
+	s.disks = disks
+
+	events := s.events[:0]
+	for _, e := range s.events {
+		if e.AgentId != agentID {
+			events = append(events, e)
+		}
+	}
+	s.events = events
+
+	keys := s.keys[:0]
+	for _, k := range s.keys {
+		if k.AgentId != agentID {
+			keys = append(keys, k)
+		}
+	}
+	s.keys = keys
+
+	definitions := s.definitions[:0]
+	for _, d := range s.definitions {
+		if d.AgentId != agentID {
+			definitions = append(definitions, d)
+		}
+	}
+	s.definitions = definitions
+
+	commands := s.commands[:0]
+	for _, c := range s.commands {
+		if c.AgentId != agentID {
+			commands = append(commands, c)
+		}
+	}
+	s.commands = commands
+
+	monitorSamples := s.monitorSamples[:0]
+	for _, m := range s.monitorSamples {
+		if m.AgentId != agentID {
+			monitorSamples = append(monitorSamples, m)
+		}
+	}
+	s.monitorSamples = monitorSamples
+
+	metricSamples := s.metricSamples[:0]
+	for _, m := range s.metricSamples {
+		if m.AgentId != agentID {
+			metricSamples = append(metricSamples, m)
+		}
+	}
+	s.metricSamples = metricSamples
+
+	connections := s.connections[:0]
+	for _, c := range s.connections {
+		if c.AgentId != agentID {
+			connections = append(connections, c)
+		}
+	}
+	s.connections = connections
+
+	for i := range s.tokens {
+		if s.tokens[i].AgentId == agentID {
+			s.tokens[i].AgentId = 0
+		}
+	}
+
+	return nil
+}
+
+//archived is whether an agent exists and has been archived
+func (s *MemoryStore) archived(agentID int64) bool {
+	agent, ok := s.agents[agentID]
+	return ok && agent.ArchivedAt != nil
+}
+
+func (s *MemoryStore) ArchiveAgent(agentID int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.agents[agentID]; !ok {
+		return ErrNotFound
+	}
+
+	s.updateAgent(agentID, func(a *Agent) {
+		if a.ArchivedAt == nil {
+			now := time.Now()
+			a.ArchivedAt = &now
+			a.CurrentlyConnected = false
+		}
+	})
+
+	return nil
+}
+
+func (s *MemoryStore) RestoreAgent(agentID int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.agents[agentID]; !ok {
+		return ErrNotFound
+	}
+
+	s.updateAgent(agentID, func(a *Agent) { a.ArchivedAt = nil })
+	return nil
+}
+
+func (s *MemoryStore) GetArchivedAgents() (agents []Agent, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, agent := range s.agents {
+		if agent.ArchivedAt != nil {
+			agents = append(agents, agent)
+		}
+	}
+
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ArchivedAt.After(*agents[j].ArchivedAt) })
+	return agents, nil
+}
+
+func (s *MemoryStore) PurgeArchivedAgents(cutoff time.Time) (purged []int64, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, agent := range s.sortedAgents() {
+		if agent.ArchivedAt != nil && agent.ArchivedAt.Before(cutoff) {
+			if err := s.deleteAgent(agent.ID); err != nil {
+				return purged, err
+			}
+			purged = append(purged, agent.ID)
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *MemoryStore) GetAgent(agentID int64) (Agent, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	agent, ok := s.agents[agentID]
+	if !ok {
+		return Agent{}, ErrNotFound
+	}
+
+	return s.details(agent), nil
+}
+
+func (s *MemoryStore) GetAgentList(filter string, limit int) (agents []Agent, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, agent := range s.sortedAgents() {
+		if agent.ArchivedAt != nil || (len(filter) > 0 && agent.CurrentlyConnected != (filter == "online")) {
+			continue
+		}
+
+		if limit > 0 && len(agents) == limit {
+			break
+		}
+
+		agents = append(agents, agent)
+	}
+
+	return agents, nil
+}
+
+func (s *MemoryStore) GetDashboardInformation() (totalAgents int, downAgents []Agent, degradedAgents []Agent, failedEndPoints []MonitorEntry, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, agent := range s.sortedAgents() {
+		if agent.ArchivedAt != nil {
+			continue
+		}
+
+		totalAgents++
+
+		if !agent.CurrentlyConnected {
+			downAgents = append(downAgents, agent)
+			continue
+		}
+
+		for _, m := range agent.Monitors {
+			if !m.MonitorEntry.OK {
+				degradedAgents = append(degradedAgents, agent)
+				break
+			}
+		}
+	}
+
+	for _, m := range s.monitors {
+		if !m.MonitorEntry.OK && !s.archived(m.AgentId) {
+			failedEndPoints = append(failedEndPoints, m)
+		}
+	}
+
+	return totalAgents, downAgents, degradedAgents, failedEndPoints, nil
+}
+
+func (s *MemoryStore) AgentForCertificate(identity CertificateIdentity) (Agent, error) {
+	if err := identity.validate(); err != nil {
+		return Agent{}, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var agent Agent
+	found := false
+	for _, existing := range s.sortedAgents() {
+		if existing.Principal == identity.Principal {
+			agent, found = existing, true
+			break
+		}
+	}
+
+	if agent.ArchivedAt != nil {
+		return Agent{}, ErrAgentArchived
+	}
+
+	if !found {
+		var err error
+		if agent, err = s.addAgent(identity.newAgent()); err != nil {
+			return Agent{}, err
+		}
+	}
+
+	s.updateAgent(agent.ID, func(a *Agent) {
+		a.CertificateKeyId = identity.KeyId
+		a.CertificateSerial = strconv.FormatUint(identity.Serial, 10)
+		a.CertificateAuthority = identity.Authority
+		a.CertificateValidBefore = identity.ValidBefore
+	})
+
+	return s.agents[agent.ID], nil
+}
+
+func (s *MemoryStore) GetAgentsWithIssues(lastSeen time.Time) (agentsWithIssues []Agent, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, agent := range s.sortedAgents() {
+		alert, ok := s.alerts[agent.ID]
+
+		// Like the database query, agents are only considered once they have reported a monitor and a disk
+		if !ok || !alert.Active || agent.ArchivedAt != nil || len(agent.Monitors) == 0 || len(agent.Disks) == 0 {
+			continue
+		}
+
+		issue := agent.LastTransmission.Before(lastSeen)
+		for _, d := range agent.Disks {
+			issue = issue || int64(d.Usage) > alert.DiskUtil
+		}
+
+		for _, m := range agent.Monitors {
+			issue = issue || !m.MonitorEntry.OK || (alert.LatencyMs > 0 && int64(m.MonitorEntry.TotalMs) > alert.LatencyMs)
+		}
+
+		if issue {
+			agentsWithIssues = append(agentsWithIssues, agent)
+		}
+	}
+
+	return agentsWithIssues, nil
+}
+
+func (s *MemoryStore) GetExpiringCertificates(deadline time.Time) (expiring []MonitorEntry, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, m := range s.monitors {
+		expiry := m.MonitorEntry.CertExpiry
+		if s.alerts[m.AgentId].Active && !s.archived(m.AgentId) && expiry.After(time.Time{}) && expiry.Before(deadline) {
+			expiring = append(expiring, m)
+		}
+	}
+
+	return expiring, nil
+}
+
+func (s *MemoryStore) SetAgentConnected(agentID int64, connected bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.updateAgent(agentID, func(a *Agent) { a.CurrentlyConnected = connected })
+	return nil
+}
+
+func (s *MemoryStore) SetAllAgentsDisconnected() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for id := range s.agents {
+		s.updateAgent(id, func(a *Agent) { a.CurrentlyConnected = false })
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) SetLastConnectionFrom(agentID int64, address string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.updateAgent(agentID, func(a *Agent) { a.LastConnectionFrom = address })
+	return nil
+}
+
+func (s *MemoryStore) SetSystemInfo(agentID int64, info SystemInfo) error {
+	s.Lock()
+	defer s.Unlock()
+
+	info.AgentId = agentID
+	info.Id = s.systemInfo[agentID].Id
+	if info.Id == 0 {
+		info.Id = s.nextID()
+	}
+
+	s.systemInfo[agentID] = info
+	return nil
+}
+
+func (s *MemoryStore) SetAlertProfile(agentID, diskUtilisation, latencyMs int64, active bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.agents[agentID]; !ok {
+		return ErrNotFound
+	}
+
+	alert := Alert{Id: s.alerts[agentID].Id, AgentId: agentID, DiskUtil: diskUtilisation, LatencyMs: latencyMs, Active: active}
+	if alert.Id == 0 {
+		alert.Id = s.nextID()
+	}
+
+	s.alerts[agentID] = alert
+	return nil
+}
+
+func (s *MemoryStore) SetAgentConfigStatus(agentID, revision int64, configError string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.updateAgent(agentID, func(a *Agent) {
+		a.ConfigRevision = revision
+		a.ConfigError = configError
+	})
+	return nil
+}
+
+func (s *MemoryStore) AddAgentKey(agentID int64, authorizedKey string) (AgentKey, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.agents[agentID]; !ok {
+		return AgentKey{}, ErrNotFound
+	}
+
+	return s.addAgentKey(agentID, authorizedKey)
+}
+
+func (s *MemoryStore) RetireAgentKey(agentID, keyID int64) (AgentKey, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	index, active := -1, 0
+	for i, k := range s.keys {
+		if k.AgentId != agentID {
+			continue
+		}
+
+		if k.Id == keyID {
+			index = i
+		}
+
+		if k.RetiredAt == nil {
+			active++
+		}
+	}
+
+	if index == -1 {
+		return AgentKey{}, ErrNotFound
+	}
+
+	if s.keys[index].RetiredAt != nil {
+		return s.keys[index], nil
+	}
+
+	if active < 2 {
+		return AgentKey{}, ErrLastAgentKey
+	}
+
+	now := time.Now()
+	s.keys[index].RetiredAt = &now
+
+	return s.keys[index], nil
+}
+
+func (s *MemoryStore) findKey(match func(AgentKey) bool) (AgentKey, error) {
+	for _, k := range s.keys {
+		if match(k) {
+			return k, nil
+		}
+	}
+
+	return AgentKey{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetAgentKey(keyID int64) (AgentKey, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.findKey(func(k AgentKey) bool { return k.Id == keyID })
+}
+
+func (s *MemoryStore) GetActiveAgentKey(authorizedKey string) (AgentKey, error) {
+	pubKey, _, _, err := parseAgentKey(authorizedKey)
+	if err != nil {
+		return AgentKey{}, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.findKey(func(k AgentKey) bool { return k.PubKey == pubKey && k.RetiredAt == nil && !s.archived(k.AgentId) })
+}
+
+func (s *MemoryStore) GetAgentKeyByFingerprint(fingerprint string) (AgentKey, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.findKey(func(k AgentKey) bool { return k.Fingerprint == strings.ToLower(fingerprint) })
+}
+
+func (s *MemoryStore) TouchAgentKey(keyID int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for i := range s.keys {
+		if s.keys[i].Id == keyID {
+			s.keys[i].LastUsedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) CreateGroup(name string) error {
+	name, err := groupName(name)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, g := range s.groups {
+		if g.Name == name {
+			return fmt.Errorf("A group named %q already exists", name)
+		}
+	}
+
+	id := s.nextID()
+	s.groups[id] = Group{ID: id, Name: name}
+	s.members[id] = make(map[int64]bool)
+
+	return nil
+}
+
+func (s *MemoryStore) groupAgentIDs(groupID int64) (agentIDs []int64) {
+	for id := range s.members[groupID] {
+		agentIDs = append(agentIDs, id)
+	}
+
+	sort.Slice(agentIDs, func(i, j int) bool { return agentIDs[i] < agentIDs[j] })
+	return agentIDs
+}
+
+func (s *MemoryStore) DeleteGroup(groupID int64) (agentIDs []int64, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	agentIDs = s.groupAgentIDs(groupID)
+
+	definitions := s.definitions[:0]
+	for _, d := range s.definitions {
+		if d.GroupId != groupID {
+			definitions = append(definitions, d)
+		}
+	}
+	s.definitions = definitions
+
+	delete(s.members, groupID)
+	delete(s.groups, groupID)
+
+	return agentIDs, nil
+}
+
+func (s *MemoryStore) GetGroups() (groups []Group, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, id := range s.sortedGroupIDs() {
+		group := s.groups[id]
+
+		for _, agentID := range s.groupAgentIDs(id) {
+			group.Agents = append(group.Agents, s.agents[agentID])
+		}
+
+		for _, d := range s.definitions {
+			if d.GroupId == id {
+				group.Monitors = append(group.Monitors, d)
+			}
+		}
+
+		groups = append(groups, group)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (s *MemoryStore) GetGroupAgentIDs(groupID int64) ([]int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.groupAgentIDs(groupID), nil
+}
+
+func (s *MemoryStore) SetGroupMembers(groupID int64, agentIDs []int64) (changed []int64, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.groups[groupID]; !ok {
+		return nil, ErrNotFound
+	}
+
+	previous := s.groupAgentIDs(groupID)
+
+	members := make(map[int64]bool)
+	var current []int64
+	for _, id := range agentIDs {
+		if _, ok := s.agents[id]; ok && !members[id] {
+			members[id] = true
+			current = append(current, id)
+		}
+	}
+	s.members[groupID] = members
+
+	return memberChanges(previous, current), nil
+}
+
+func (s *MemoryStore) CreateMonitorDefinition(agentID, groupID int64, monitorURL, name, options string) error {
+	definition, err := newMonitorDefinition(agentID, groupID, monitorURL, name, options)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	definition.Id = s.nextID()
+	definition.CreatedAt = time.Now()
+	definition.UpdatedAt = definition.CreatedAt
+
+	s.definitions = append(s.definitions, definition)
+	return nil
+}
+
+func (s *MemoryStore) DeleteMonitorDefinition(id int64) (MonitorDefinition, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, d := range s.definitions {
+		if d.Id == id {
+			s.definitions = append(s.definitions[:i], s.definitions[i+1:]...)
+			return d, nil
+		}
+	}
+
+	return MonitorDefinition{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetMonitorDefinitions(agentID int64) (definitions []MonitorDefinition, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, d := range s.definitions {
+		if d.AgentId == agentID || (d.GroupId != 0 && s.members[d.GroupId][agentID]) {
+			definitions = append(definitions, d)
+		}
+	}
+
+	return definitions, nil
+}
+
+func (s *MemoryStore) RecordCommand(agentID int64, username string, command Command) (CommandLog, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry := newCommandLog(agentID, username, command)
+	entry.Id = s.nextID()
+	entry.CreatedAt = time.Now()
+	entry.UpdatedAt = entry.CreatedAt
+
+	s.commands = append(s.commands, entry)
+	return entry, nil
+}
+
+func (s *MemoryStore) CompleteCommand(entry CommandLog, ok bool, outcome string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range s.commands {
+		if s.commands[i].Id == entry.Id {
+			s.commands[i].OK = ok
+			s.commands[i].Outcome = outcome
+			s.commands[i].UpdatedAt = time.Now()
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetCommandLog(agentID int64, limit int) (entries []CommandLog, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := len(s.commands) - 1; i >= 0 && (limit <= 0 || len(entries) < limit); i-- {
+		if s.commands[i].AgentId == agentID {
+			entries = append(entries, s.commands[i])
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *MemoryStore) CreateEnrollmentToken(agentName, createdBy string, groupIDs []int64, validFor time.Duration) (int64, string, error) {
+	token, secret, err := newEnrollmentToken(agentName, createdBy, validFor)
+	if err != nil {
+		return 0, "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, id := range groupIDs {
+		if group, ok := s.groups[id]; ok {
+			token.Groups = append(token.Groups, group)
+		}
+	}
+
+	token.Id = s.nextID()
+	token.CreatedAt = time.Now()
+
+	s.tokens = append(s.tokens, token)
+	return token.Id, secret, nil
+}
+
+func (s *MemoryStore) GetEnrollmentTokens() (tokens []EnrollmentToken, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for _, t := range s.tokens {
+		if t.UsedAt == nil && t.ExpiresAt.After(now) {
+			tokens = append(tokens, t)
+		}
+	}
+
+	sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].ExpiresAt.Before(tokens[j].ExpiresAt) })
+	return tokens, nil
+}
+
+func (s *MemoryStore) DeleteEnrollmentToken(id int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, t := range s.tokens {
+		if t.Id == id {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RedeemEnrollmentToken(secret, pubKey, name string) (Agent, error) {
+	if _, _, _, err := parseAgentKey(pubKey); err != nil {
+		return Agent{}, ErrAgentPubKeyNotValid
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	index := -1
+	for i, t := range s.tokens {
+		if t.SecretHash == hashEnrollmentSecret(secret) {
+			index = i
+		}
+	}
+
+	if index == -1 {
+		return Agent{}, ErrEnrollmentTokenInvalid
+	}
+
+	now := time.Now()
+	token := s.tokens[index]
+
+	agent, err := token.agent(pubKey, name, now)
+	if err != nil {
+		return Agent{}, err
+	}
+
+	if agent, err = s.addAgent(agent); err != nil {
+		return Agent{}, err
+	}
+
+	if _, err := s.addAgentKey(agent.ID, pubKey); err != nil {
+		delete(s.agents, agent.ID)
+		return Agent{}, err
+	}
+
+	for _, g := range token.Groups {
+		if members, ok := s.members[g.ID]; ok {
+			members[agent.ID] = true
+		}
+	}
+
+	s.tokens[index].UsedAt = &now
+	s.tokens[index].AgentId = agent.ID
+
+	return agent, nil
+}
+
+func (s *MemoryStore) AddEvent(event Event) error {
+	s.Lock()
+	defer s.Unlock()
+
+	event.Id = s.nextID()
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *MemoryStore) CountEventsSince(agentID int64, title string, since time.Time) (count int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, e := range s.events {
+		if e.AgentId == agentID && e.Title == title && e.CreatedAt.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *MemoryStore) GetUnnotifiedEvents(maxUrgency int) (events []Event, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, e := range s.events {
+		if !e.Notified && e.Urgency <= maxUrgency {
+			events = append(events, e)
+		}
+	}
+
+	return events, nil
+}
+
+func (s *MemoryStore) GetEvents(filter EventFilter, offset, limit int) (events []Event, total int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var matched []Event
+	for _, e := range s.events {
+		if filter.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].Id > matched[j].Id
+		}
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	if limit <= 0 {
+		return matched, len(matched), nil
+	}
+
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+
+	events = matched[offset:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, len(matched), nil
+}
+
+func (s *MemoryStore) SetEventNotified(eventID int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range s.events {
+		if s.events[i].Id == eventID {
+			s.events[i].Notified = true
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) AddUser(name, password string) error {
+	user, err := newUser(name, password)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, u := range s.users {
+		if u.Username == name {
+			return fmt.Errorf("A user named %q already exists", name)
+		}
+	}
+
+	user.Id = s.nextID()
+	s.users = append(s.users, user)
+
+	return nil
+}
+
+func (s *MemoryStore) findUser(match func(User) bool) (User, error) {
+	for _, u := range s.users {
+		if match(u) {
+			return u, nil
+		}
+	}
+
+	return User{}, ErrNotFound
+}
+
+func (s *MemoryStore) updateUser(uid int64, update func(*User)) {
+	for i := range s.users {
+		if s.users[i].Id == uid {
+			update(&s.users[i])
+		}
+	}
+}
+
+func (s *MemoryStore) GetUser(username string) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.findUser(func(u User) bool { return u.Username == username })
+}
+
+func (s *MemoryStore) GetAllUsers() ([]User, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]User(nil), s.users...), nil
+}
+
+func (s *MemoryStore) DeleteUser(guid string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, u := range s.users {
+		if u.GUID == guid {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ChangePassword(uid int64, newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash string) error {
+	hash, err := newPasswordHash(newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.updateUser(uid, func(u *User) { u.Password = hash })
+	return nil
+}
+
+func (s *MemoryStore) GetUserByToken(username, token string) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.findUser(func(u User) bool { return u.Username == username && len(token) > 0 && u.Token == token })
+}
+
+func (s *MemoryStore) SetUserToken(uid int64, token string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.updateUser(uid, func(u *User) {
+		u.Token = token
+		u.TokenCreatedAt = time.Now().Unix()
+	})
+	return nil
+}
+
+func (s *MemoryStore) RefreshUserToken(uid int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.updateUser(uid, func(u *User) { u.TokenCreatedAt = time.Now().Unix() })
+	return nil
+}
+
+func (s *MemoryStore) GetNotificationSettingsForUser(uid int64) (NotificationDetail, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, n := range s.notifications {
+		if n.UserId == uid {
+			return n, nil
+		}
+	}
+
+	return NotificationDetail{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetNotificationSettings() (NotificationDetail, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.notifications) == 0 {
+		return NotificationDetail{}, ErrNotFound
+	}
+
+	return s.notifications[0], nil
+}
+
+func (s *MemoryStore) CreateNotificationSetting(uid int64, destinationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider string) error {
+	detail, err := newNotificationDetail(uid, destinationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	detail.UpdatedAt = time.Now()
+	for i, n := range s.notifications {
+		if n.UserId == uid {
+			detail.Id = n.Id
+			s.notifications[i] = detail
+			return nil
+		}
+	}
+
+	detail.Id = s.nextID()
+	s.notifications = append(s.notifications, detail)
+
+	return nil
+}
+
+func (s *MemoryStore) IngestStats(agentID int64, stat Stats) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.agents[agentID]; !ok {
+		return ErrNotFound
+	}
+
+	now := time.Now()
+	s.updateAgent(agentID, func(a *Agent) {
+		a.LastTransmission = now
+		a.CurrentlyConnected = true
+		a.MemoryUsage = stat.MemoryUsage
+	})
+
+	lastChecked := make(map[string]time.Time)
+	for _, m := range s.monitors {
+		if m.AgentId == agentID {
+			lastChecked[m.MonitorEntry.Path] = m.MonitorEntry.CheckedAt
+		}
+	}
+
+	r := newReport(agentID, stat, lastChecked, now)
+
+	for _, disk := range r.disks {
+		found := false
+		for i := range s.disks {
+			if s.disks[i].AgentId == agentID && s.disks[i].Device == disk.Device {
+				s.disks[i].Usage, found = disk.Usage, true
+			}
+		}
+
+		if !found {
+			disk.ID = s.nextID()
+			s.disks = append(s.disks, disk)
+		}
+	}
+
+	for _, monitor := range r.monitors {
+		found := false
+		for i := range s.monitors {
+			if s.monitors[i].AgentId == agentID && s.monitors[i].MonitorEntry.Path == monitor.MonitorEntry.Path {
+				s.monitors[i].MonitorEntry, found = monitor.MonitorEntry, true
+			}
+		}
+
+		if !found {
+			monitor.Id = s.nextID()
+			s.monitors = append(s.monitors, monitor)
+		}
+	}
+
+	for _, sample := range r.metricSamples {
+		sample.Id = s.nextID()
+		s.metricSamples = append(s.metricSamples, sample)
+	}
+
+	for _, sample := range r.monitorSamples {
+		sample.Id = s.nextID()
+		s.monitorSamples = append(s.monitorSamples, sample)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RemoveStaleMonitors(agentID int64, paths []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	keep := make(map[string]bool)
+	for _, path := range paths {
+		keep[path] = true
+	}
+
+	monitors := s.monitors[:0]
+	for _, m := range s.monitors {
+		if m.AgentId != agentID || keep[m.MonitorEntry.Path] {
+			monitors = append(monitors, m)
+		}
+	}
+	s.monitors = monitors
+
+	return nil
+}
+
+func (s *MemoryStore) GetMonitorSamples(agentID int64, since time.Time) (samples []MonitorSample, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sample := range s.monitorSamples {
+		if sample.AgentId == agentID && sample.CreatedAt.After(since) {
+			samples = append(samples, sample)
+		}
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].CreatedAt.Before(samples[j].CreatedAt) })
+	return samples, nil
+}
+
+func (s *MemoryStore) GetMetricSamples(agentID int64, since time.Time) (samples []MetricSample, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sample := range s.metricSamples {
+		if sample.AgentId == agentID && sample.CreatedAt.After(since) {
+			samples = append(samples, sample)
+		}
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].CreatedAt.Before(samples[j].CreatedAt) })
+	return samples, nil
+}
+
+func (s *MemoryStore) PruneHistory(cutoff time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	monitorSamples := s.monitorSamples[:0]
+	for _, sample := range s.monitorSamples {
+		if !sample.CreatedAt.Before(cutoff) {
+			monitorSamples = append(monitorSamples, sample)
+		}
+	}
+	s.monitorSamples = monitorSamples
+
+	metricSamples := s.metricSamples[:0]
+	for _, sample := range s.metricSamples {
+		if !sample.CreatedAt.Before(cutoff) {
+			metricSamples = append(metricSamples, sample)
+		}
+	}
+	s.metricSamples = metricSamples
+
+	connections := s.connections[:0]
+	for _, c := range s.connections {
+		if c.DisconnectedAt == nil || !c.DisconnectedAt.Before(cutoff) {
+			connections = append(connections, c)
+		}
+	}
+	s.connections = connections
+
+	return nil
+}
+
+func (s *MemoryStore) AddAuditEntry(entry AuditEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	entry.Id = s.nextID()
+	entry.CreatedAt = time.Now()
+
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+func (s *MemoryStore) GetAuditLog(filter AuditFilter, limit int) (entries []AuditEntry, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := len(s.audit) - 1; i >= 0 && (limit <= 0 || len(entries) < limit); i-- {
+		if filter.matches(s.audit[i]) {
+			entries = append(entries, s.audit[i])
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *MemoryStore) StartConnection(agentID int64, remoteAddress, clientVersion string, protocolVersion int) (AgentConnection, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	connection := AgentConnection{
+		Id:              s.nextID(),
+		AgentId:         agentID,
+		ConnectedAt:     time.Now(),
+		RemoteAddress:   remoteAddress,
+		ClientVersion:   clientVersion,
+		ProtocolVersion: protocolVersion,
+	}
+
+	s.connections = append(s.connections, connection)
+	return connection, nil
+}
+
+func (s *MemoryStore) EndConnection(connection AgentConnection, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for i := range s.connections {
+		if s.connections[i].Id == connection.Id {
+			s.connections[i].DisconnectedAt = &now
+			s.connections[i].DisconnectReason = reason
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) EndOpenConnections() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, c := range s.connections {
+		if c.DisconnectedAt != nil {
+			continue
+		}
+
+		endedAt := c.ConnectedAt
+		if agent, ok := s.agents[c.AgentId]; ok && agent.LastTransmission.After(endedAt) {
+			endedAt = agent.LastTransmission
+		}
+
+		s.connections[i].DisconnectedAt = &endedAt
+		s.connections[i].DisconnectReason = DisconnectUnknown
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetConnections(agentID int64, since time.Time) (connections []AgentConnection, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.connections {
+		if c.AgentId == agentID && (c.DisconnectedAt == nil || c.DisconnectedAt.After(since)) {
+			connections = append(connections, c)
+		}
+	}
+
+	sort.SliceStable(connections, func(i, j int) bool { return connections[i].ConnectedAt.Before(connections[j].ConnectedAt) })
+	return connections, nil
+}
+
+func (s *MemoryStore) GetFirstConnection(agentID int64) (AgentConnection, error) {
+	connections, err := s.GetConnections(agentID, time.Time{})
+	if err != nil {
+		return AgentConnection{}, err
+	}
+
+	if len(connections) == 0 {
+		return AgentConnection{}, ErrNotFound
+	}
+
+	return connections[0], nil
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+//MetricSample is a single memory or disk usage reading kept as history
+type MetricSample struct {
+	Id        int64
+	AgentId   int64     `gorm:"index"`
+	Name      string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Value float32
+}
+
+//MemoryMetric is the name memory usage is stored under, disk usage is stored under "disk:" followed by the device
+const MemoryMetric = "memory"
+
+//NewMetricSamples creates history samples for the memory and disk usage in a stats report, timestamped with when the agent took them
+func NewMetricSamples(agentID int64, stat Stats, createdAt time.Time) []MetricSample {
+	samples := []MetricSample{{AgentId: agentID, Name: MemoryMetric, CreatedAt: createdAt, Value: stat.MemoryUsage}}
+
+	for device, usage := range stat.DiskUsage {
+		samples = append(samples, MetricSample{AgentId: agentID, Name: "disk:" + device, CreatedAt: createdAt, Value: usage})
+	}
+
+	return samples
+}
+
+//GetMetricSamples returns the memory and disk history of an agent since a point in time, oldest first
+func (s DatabaseStore) GetMetricSamples(agentID int64, since time.Time) (samples []MetricSample, err error) {
+	return samples, s.db.Order("created_at asc").Find(&samples, "agent_id = ? AND created_at > ?", agentID, since).Error
+}
@@ -0,0 +1,317 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//Migration is one versioned change to the database schema. Down undoes Up, and is nil for migrations that cant be undone
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+//SchemaMigration records a migration that has been applied to the database
+type SchemaMigration struct {
+	Version   int64 `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+//MigrationStatus is a known migration and when it was applied, AppliedAt is nil if it hasnt been
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+//ErrSchemaTooNew is returned when the database has migrations applied that this version doesnt know about, i.e it was used by a newer theia
+var ErrSchemaTooNew = errors.New("Database schema is newer than this version of theia supports, migrate it down with the newer version first")
+
+//migrations must stay in order, and once released a migration must never be changed. Fix mistakes with a new one
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			// Databases from before migrations were created by AutoMigrate, so this is the schema they already have
+			return tx.AutoMigrate(v1Tables...).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(v1Tables...).Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "disk devices and monitor paths unique per agent",
+		Up: func(tx *gorm.DB) error {
+			if err := rebuildTable(tx, &v1DiskEntry{}); err != nil {
+				return err
+			}
+
+			if err := tx.Model(&v1DiskEntry{}).AddUniqueIndex("idx_disk_entries_agent_device", "agent_id", "device").Error; err != nil {
+				return err
+			}
+
+			if err := rebuildTable(tx, &v1MonitorEntry{}); err != nil {
+				return err
+			}
+
+			return tx.Model(&v1MonitorEntry{}).AddUniqueIndex("idx_monitor_entries_agent_path", "agent_id", "path").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			// Fails if agents now share a device or path, as the old schema cant hold them
+			if err := rebuildTable(tx, &v1DiskEntry{}); err != nil {
+				return err
+			}
+
+			if err := tx.Model(&v1DiskEntry{}).AddUniqueIndex("idx_disk_entries_device", "device").Error; err != nil {
+				return err
+			}
+
+			if err := rebuildTable(tx, &v1MonitorEntry{}); err != nil {
+				return err
+			}
+
+			return tx.Model(&v1MonitorEntry{}).AddUniqueIndex("idx_monitor_entries_path", "path").Error
+		},
+	},
+	{
+		Version: 3,
+		Name:    "agent keys from agent public keys",
+		Up:      migrateAgentKeys,
+		Down: func(tx *gorm.DB) error {
+			// The keys are still valid, and agent_keys is dropped along with everything else by the initial schema
+			return nil
+		},
+	},
+	{
+		Version: 4,
+		Name:    "agent archiving",
+		Up: func(tx *gorm.DB) error {
+			return addColumn(tx, &v4AgentArchiving{}, "ArchivedAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			// Older versions dont know agents can be archived, so they are restored rather than left half hidden
+			if err := tx.Exec("UPDATE agents SET archived_at = NULL").Error; err != nil {
+				return err
+			}
+
+			// sqlite cant drop columns, so the table is rebuilt as version 3 had it
+			if tx.Dialect().GetName() == "sqlite3" {
+				return rebuildTableKeepingIDs(tx, &v1Agent{})
+			}
+
+			return tx.Model(&v4AgentArchiving{}).DropColumn("archived_at").Error
+		},
+	},
+	{
+		Version: 5,
+		Name:    "audit log",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&v5AuditEntry{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&v5AuditEntry{}).Error
+		},
+	},
+	{
+		Version: 6,
+		Name:    "agent connection log",
+		Up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&v6AgentConnection{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.DropTableIfExists(&v6AgentConnection{}).Error
+		},
+	},
+	{
+		Version: 7,
+		Name:    "event browsing index",
+		Up: func(tx *gorm.DB) error {
+			return tx.Model(&v1Event{}).AddIndex("idx_events_agent_created", "agent_id", "created_at").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Model(&v1Event{}).RemoveIndex("idx_events_agent_created").Error
+		},
+	},
+}
+
+//LatestSchemaVersion is the version Migrate brings the database up to
+func LatestSchemaVersion() int64 {
+	return migrations[len(migrations)-1].Version
+}
+
+//rebuildTable recreates a models table from its struct, copying its rows across. It is the only portable way to drop constraints that were declared inline with a column.
+//Primary keys arent copied, so it must only be used on tables nothing refers to by id
+func rebuildTable(tx *gorm.DB, model interface{}) error {
+	return copyTable(tx, model, false)
+}
+
+//rebuildTableKeepingIDs is rebuildTable for tables other tables refer to by id, their rows keep their primary keys.
+//Columns missing from model are dropped, which is how columns are removed in sqlite
+func rebuildTableKeepingIDs(tx *gorm.DB, model interface{}) error {
+	return copyTable(tx, model, true)
+}
+
+func copyTable(tx *gorm.DB, model interface{}, keepIDs bool) error {
+	scope := tx.NewScope(model)
+	table := scope.TableName()
+	rebuilt := table + "_rebuild"
+
+	var columns []string
+	for _, field := range scope.GetModelStruct().StructFields {
+		if field.IsNormal && !field.IsIgnored && (keepIDs || !field.IsPrimaryKey) {
+			columns = append(columns, scope.Quote(field.DBName))
+		}
+	}
+
+	if err := tx.Table(rebuilt).CreateTable(model).Error; err != nil {
+		return err
+	}
+
+	columnList := strings.Join(columns, ", ")
+	if err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", scope.Quote(rebuilt), columnList, columnList, scope.Quote(table))).Error; err != nil {
+		return err
+	}
+
+	if err := tx.DropTable(table).Error; err != nil {
+		return err
+	}
+
+	return tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", scope.Quote(rebuilt), scope.Quote(table))).Error
+}
+
+//addColumn adds the column for a field of a model to its table
+func addColumn(tx *gorm.DB, model interface{}, fieldName string) error {
+	scope := tx.NewScope(model)
+
+	field, ok := scope.FieldByName(fieldName)
+	if !ok {
+		return fmt.Errorf("%s has no field %s", scope.TableName(), fieldName)
+	}
+
+	return tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD %s %s", scope.QuotedTableName(), scope.Quote(field.DBName), tx.Dialect().DataTypeOf(field.StructField))).Error
+}
+
+func appliedMigrations(db *gorm.DB) (applied []SchemaMigration, err error) {
+	if err := db.AutoMigrate(&SchemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+
+	return applied, db.Order("version asc").Find(&applied).Error
+}
+
+//SchemaVersion returns the version of the latest migration applied to the database, 0 if there are none
+func SchemaVersion(db *gorm.DB) (int64, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil || len(applied) == 0 {
+		return 0, err
+	}
+
+	return applied[len(applied)-1].Version, nil
+}
+
+//GetMigrationStatus lists every known migration and whether it has been applied
+func GetMigrationStatus(db *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[int64]time.Time)
+	for _, m := range applied {
+		appliedAt[m.Version] = m.AppliedAt
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+
+	return status, nil
+}
+
+//Migrate brings the database schema up to date
+func Migrate(db *gorm.DB) error {
+	return MigrateTo(db, LatestSchemaVersion())
+}
+
+//MigrateTo applies or reverts migrations, one transaction each, until the schema is at version. Version 0 reverts everything
+func MigrateTo(db *gorm.DB, version int64) error {
+	if version < 0 || version > LatestSchemaVersion() {
+		return fmt.Errorf("Unknown schema version %d, the latest is %d", version, LatestSchemaVersion())
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if current > LatestSchemaVersion() {
+		return ErrSchemaTooNew
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > version {
+			continue
+		}
+
+		log.Printf("Applying migration %d: %s", m.Version, m.Name)
+		if err := runMigration(db, m, m.Up, func(tx *gorm.DB) error {
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		}); err != nil {
+			return fmt.Errorf("Migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= version {
+			continue
+		}
+
+		if m.Down == nil {
+			return fmt.Errorf("Migration %d (%s) cannot be reverted", m.Version, m.Name)
+		}
+
+		log.Printf("Reverting migration %d: %s", m.Version, m.Name)
+		if err := runMigration(db, m, m.Down, func(tx *gorm.DB) error {
+			return tx.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+		}); err != nil {
+			return fmt.Errorf("Reverting migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func runMigration(db *gorm.DB, m Migration, step, record func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := step(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
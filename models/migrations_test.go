@@ -0,0 +1,190 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	legacy, err := gorm.Open("sqlite3", "file:legacy?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+
+	// As AutoMigrate used to create it, with devices unique across every agent
+	if err := legacy.Exec(`CREATE TABLE "disk_entries" ("id" integer primary key autoincrement, "agent_id" bigint, "device" varchar(255) NOT NULL UNIQUE, "usage" real)`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := legacy.Exec(`INSERT INTO "disk_entries" ("agent_id", "device", "usage") VALUES (1, '/dev/sda1', 50)`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := legacy.Create(&DiskEntry{AgentId: 2, Device: "/dev/sda1"}).Error; err == nil {
+		t.Fatal("Legacy schema should not allow agents to share a device name")
+	}
+
+	if err := Migrate(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := SchemaVersion(legacy)
+	if err != nil || version != LatestSchemaVersion() {
+		t.Fatal("Schema was not brought up to date: ", version, err)
+	}
+
+	var disks []DiskEntry
+	if err := legacy.Find(&disks).Error; err != nil || len(disks) != 1 || disks[0].Usage != 50 {
+		t.Fatal("Existing disk entries were not kept: ", disks, err)
+	}
+
+	if err := legacy.Create(&DiskEntry{AgentId: 2, Device: "/dev/sda1"}).Error; err != nil {
+		t.Fatal("Agents still cannot share a device name: ", err)
+	}
+
+	if err := legacy.Create(&DiskEntry{AgentId: 2, Device: "/dev/sda1"}).Error; err == nil {
+		t.Fatal("An agent can have the same device twice")
+	}
+
+	if err := legacy.Create(&MonitorEntry{AgentId: 1, MonitorEntry: MonitorStatus{Path: "https://example.com"}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := legacy.Create(&MonitorEntry{AgentId: 2, MonitorEntry: MonitorStatus{Path: "https://example.com"}}).Error; err != nil {
+		t.Fatal("Agents still cannot share a monitor path: ", err)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	schema, err := gorm.Open("sqlite3", "file:down?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer schema.Close()
+
+	if err := Migrate(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := schema.Create(&DiskEntry{AgentId: 1, Device: "/dev/sda1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateTo(schema, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := schema.Create(&DiskEntry{AgentId: 2, Device: "/dev/sda1"}).Error; err == nil {
+		t.Fatal("Reverting did not restore the old constraint")
+	}
+
+	status, err := GetMigrationStatus(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range status {
+		if (m.AppliedAt != nil) != (m.Version <= 1) {
+			t.Fatal("Migration status is wrong after reverting: ", m)
+		}
+	}
+
+	if err := MigrateTo(schema, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.HasTable(&Agent{}) {
+		t.Fatal("Reverting everything left tables behind")
+	}
+
+	if err := Migrate(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := schema.Create(&SchemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(schema); err != ErrSchemaTooNew {
+		t.Fatal("Migrated a database used by a newer version: ", err)
+	}
+}
+
+func TestMigrateAgentArchiving(t *testing.T) {
+	schema, err := gorm.Open("sqlite3", "file:archiving?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer schema.Close()
+
+	if err := MigrateTo(schema, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.Dialect().HasColumn("agents", "archived_at") {
+		t.Fatal("Version 3 should not know agents can be archived")
+	}
+
+	if err := Migrate(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	if !schema.Dialect().HasColumn("agents", "archived_at") {
+		t.Fatal("archived_at was not added")
+	}
+
+	if err := schema.Exec(`INSERT INTO "agents" ("name", "pub_key", "archived_at") VALUES (?, ?, ?)`, "archived", "archived", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateTo(schema, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if schema.Dialect().HasColumn("agents", "archived_at") {
+		t.Fatal("archived_at was not removed")
+	}
+
+	var agents []v1Agent
+	if err := schema.Find(&agents).Error; err != nil || len(agents) != 1 || agents[0].Name != "archived" {
+		t.Fatal("Reverting did not keep the archived agent: ", agents, err)
+	}
+
+	// Adding the column again must work after it has been removed
+	if err := Migrate(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	var archived int
+	if err := schema.Table("agents").Where("id = ? AND archived_at IS NULL", agents[0].ID).Count(&archived).Error; err != nil || archived != 1 {
+		t.Fatal("Reverting did not restore the archived agent: ", archived, err)
+	}
+}
+
+func TestMigrationsCoverModels(t *testing.T) {
+	schema, err := gorm.Open("sqlite3", "file:coverage?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer schema.Close()
+
+	if err := Migrate(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrations no longer follow the models, so a field added to a model without a migration would only fail at runtime
+	for _, model := range []interface{}{
+		&Agent{}, &AgentKey{}, &Alert{}, &AgentConnection{}, &AuditEntry{}, &CommandLog{}, &DiskEntry{}, &EnrollmentToken{}, &Event{},
+		&Group{}, &MetricSample{}, &MonitorDefinition{}, &MonitorEntry{}, &MonitorSample{}, &NotificationDetail{}, &SystemInfo{}, &User{},
+	} {
+		scope := schema.NewScope(model)
+		for _, field := range scope.GetModelStruct().StructFields {
+			if field.IsNormal && !field.IsIgnored && !schema.Dialect().HasColumn(scope.TableName(), field.DBName) {
+				t.Errorf("%s.%s has no column, it needs a migration", scope.TableName(), field.DBName)
+			}
+		}
+	}
+}
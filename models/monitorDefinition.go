@@ -0,0 +1,144 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//MonitorDefinition is a monitor managed from theia and pushed to agents, it belongs to either a single agent or a group
+type MonitorDefinition struct {
+	Id      int64
+	AgentId int64 `gorm:"index"`
+	GroupId int64 `gorm:"index"`
+
+	URL  string `gorm:"not null"`
+	Name string
+
+	//Options is a JSON object of any other monitor options, in the same form as the agent config e.g {"okay_code": 200, "interval_seconds": 60}
+	Options string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+//ErrMonitorDefinitionInvalid is returned when a monitor definition cannot be pushed to agents
+var ErrMonitorDefinitionInvalid = errors.New("Monitor must have a URL with a scheme, belong to exactly one agent or group, and have options that are a JSON object")
+
+//newMonitorDefinition checks a monitor can be pushed to agents, and belongs to either an agent or a group
+func newMonitorDefinition(agentID, groupID int64, monitorURL, name, options string) (MonitorDefinition, error) {
+	definition := MonitorDefinition{
+		AgentId: agentID,
+		GroupId: groupID,
+		URL:     strings.TrimSpace(monitorURL),
+		Name:    strings.TrimSpace(name),
+		Options: strings.TrimSpace(options),
+	}
+
+	if (agentID == 0) == (groupID == 0) {
+		return definition, ErrMonitorDefinitionInvalid
+	}
+
+	if _, err := definition.Monitor(); err != nil {
+		return definition, err
+	}
+
+	return definition, nil
+}
+
+//CreateMonitorDefinition adds a monitor to an agent, or to a group when agentID is 0
+func (s DatabaseStore) CreateMonitorDefinition(agentID, groupID int64, monitorURL, name, options string) error {
+	definition, err := newMonitorDefinition(agentID, groupID, monitorURL, name, options)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Create(&definition).Error
+}
+
+//DeleteMonitorDefinition removes a monitor definition, returning it so the agents it applied to can be updated
+func (s DatabaseStore) DeleteMonitorDefinition(id int64) (definition MonitorDefinition, err error) {
+	if err := s.db.First(&definition, id).Error; err != nil {
+		return definition, notFound(err)
+	}
+
+	return definition, s.db.Delete(&definition).Error
+}
+
+//GetMonitorDefinitions returns every monitor definition that applies to an agent, both its own and those of its groups
+func (s DatabaseStore) GetMonitorDefinitions(agentID int64) (definitions []MonitorDefinition, err error) {
+	return definitions, s.db.Order("id asc").Find(&definitions, "agent_id = ? OR group_id IN (SELECT group_id FROM agent_groups WHERE agent_id = ?)", agentID, agentID).Error
+}
+
+//Monitor renders the definition as a monitor in the agent config format
+func (d MonitorDefinition) Monitor() (json.RawMessage, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil || u.Scheme == "" {
+		return nil, ErrMonitorDefinitionInvalid
+	}
+
+	options := make(map[string]interface{})
+	if len(d.Options) > 0 {
+		if err := json.Unmarshal([]byte(d.Options), &options); err != nil {
+			return nil, ErrMonitorDefinitionInvalid
+		}
+	}
+
+	options["url"] = d.URL
+	if len(d.Name) > 0 {
+		options["name"] = d.Name
+	}
+
+	return json.Marshal(options)
+}
+
+//BuildConfigUpdate collects the monitors an agent should be running
+func (s DatabaseStore) BuildConfigUpdate(agentID int64) (ConfigUpdate, error) {
+	definitions, err := s.GetMonitorDefinitions(agentID)
+	if err != nil {
+		return ConfigUpdate{Monitors: []json.RawMessage{}}, err
+	}
+
+	return NewConfigUpdate(definitions)
+}
+
+//NewConfigUpdate renders an agents monitor definitions as a config update. The revision is derived from the monitors themselves,
+//so it only changes when the agents config actually does.
+//Monitors are stored by URL, so when an agent and its groups define the same URL only the oldest definition is sent
+func NewConfigUpdate(definitions []MonitorDefinition) (ConfigUpdate, error) {
+	update := ConfigUpdate{Monitors: []json.RawMessage{}}
+
+	urls := make(map[string]bool)
+	for _, d := range definitions {
+		if urls[d.URL] {
+			continue
+		}
+
+		m, err := d.Monitor()
+		if err != nil {
+			// Definitions are validated when created, so this is only a broken row in the database
+			continue
+		}
+		update.Monitors = append(update.Monitors, m)
+		urls[d.URL] = true
+	}
+
+	b, err := json.Marshal(update.Monitors)
+	if err != nil {
+		return update, err
+	}
+
+	h := fnv.New64a()
+	h.Write(b)
+	update.Revision = int64(h.Sum64() >> 1)
+
+	return update, nil
+}
+
+//SetAgentConfigStatus records the config revision an agent has acknowledged, and why it rejected it if it did
+func (s DatabaseStore) SetAgentConfigStatus(agentID, revision int64, configError string) error {
+	return s.db.Model(&Agent{}).Where("id = ?", agentID).Updates(map[string]interface{}{"config_revision": revision, "config_error": configError}).Error
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMonitorDefinitionsForAgent(t *testing.T) {
+	setupDatabase()
+	defer db.Close()
+
+	agent := Agent{Name: "managed", PubKey: "ssh-ed25519 AAAAmanaged"}
+	other := Agent{Name: "unmanaged", PubKey: "ssh-ed25519 AAAAunmanaged"}
+	db.Create(&agent)
+	db.Create(&other)
+
+	if err := store.CreateGroup("web servers"); err != nil {
+		t.Fatal(err)
+	}
+
+	var group Group
+	if err := db.First(&group, "name = ?", "web servers").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := store.BuildConfigUpdate(agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateMonitorDefinition(agent.ID, 0, "tcp://127.0.0.1:22", "ssh", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateMonitorDefinition(0, group.ID, "https://example.com", "", `{"okay_code": 204}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateMonitorDefinition(0, group.ID, "not a url", "", ""); err == nil {
+		t.Fatal("Monitor without a scheme should be refused")
+	}
+
+	if err := store.CreateMonitorDefinition(0, group.ID, "https://example.com", "", `[1, 2]`); err == nil {
+		t.Fatal("Options that arent a JSON object should be refused")
+	}
+
+	own, err := store.BuildConfigUpdate(agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(own.Monitors) != 1 || own.Revision == empty.Revision {
+		t.Fatalf("Agent should only have its own monitor until it joins the group: %+v", own)
+	}
+
+	changed, err := store.SetGroupMembers(group.ID, []int64{agent.ID})
+	if err != nil || len(changed) != 1 || changed[0] != agent.ID {
+		t.Fatal("Changed agents not reported: ", changed, err)
+	}
+
+	update, err := store.BuildConfigUpdate(agent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(update.Monitors) != 2 || update.Revision == own.Revision {
+		t.Fatalf("Group monitor was not added to the agents config: %+v", update)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(update.Monitors[1], &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m["url"] != "https://example.com" || m["okay_code"] != float64(204) {
+		t.Fatal("Monitor options were not merged: ", m)
+	}
+
+	if again, _ := store.BuildConfigUpdate(agent.ID); again.Revision != update.Revision {
+		t.Fatal("Revision should be stable while nothing changes")
+	}
+
+	// The agents own copy of a group monitor would be stored over the group one, so only the first is sent
+	if err := store.CreateMonitorDefinition(agent.ID, 0, "https://example.com", "duplicate", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if duplicated, _ := store.BuildConfigUpdate(agent.ID); len(duplicated.Monitors) != 2 || duplicated.Revision != update.Revision {
+		t.Fatalf("Monitor with a URL already in the config should not be sent: %+v", duplicated)
+	}
+
+	var duplicate MonitorDefinition
+	if err := db.First(&duplicate, "name = ?", "duplicate").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.DeleteMonitorDefinition(duplicate.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if unmanaged, _ := store.BuildConfigUpdate(other.ID); len(unmanaged.Monitors) != 0 {
+		t.Fatal("Agents outside the group should not get its monitors")
+	}
+
+	members, err := store.DeleteGroup(group.ID)
+	if err != nil || len(members) != 1 {
+		t.Fatal("Deleting group failed: ", members, err)
+	}
+
+	if final, _ := store.BuildConfigUpdate(agent.ID); final.Revision != own.Revision {
+		t.Fatal("Deleting the group should leave only the agents own monitor")
+	}
+}
@@ -7,3 +7,14 @@ type MonitorEntry struct {
 
 	MonitorEntry MonitorStatus `gorm:"embedded"`
 }
+
+//RemoveStaleMonitors deletes the current state of an agent's monitors that arent in paths, so monitors removed from the agent stop being shown and alerted on.
+//Their history is kept
+func (s DatabaseStore) RemoveStaleMonitors(agentID int64, paths []string) error {
+	query := s.db.Where("agent_id = ?", agentID)
+	if len(paths) > 0 {
+		query = query.Where("path NOT IN (?)", paths)
+	}
+
+	return query.Delete(&MonitorEntry{}).Error
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+//MonitorSample is a single check result kept as history, so response times can be charted over time
+type MonitorSample struct {
+	Id        int64
+	AgentId   int64     `gorm:"index"`
+	Path      string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+
+	OK         bool
+	StatusCode int
+
+	DNSMs     float32
+	ConnectMs float32
+	TLSMs     float32
+	TTFBMs    float32
+	TotalMs   float32
+}
+
+//NewMonitorSample creates a history sample from a monitor status sent by an agent, timestamped with when the check ran
+func NewMonitorSample(agentID int64, status MonitorStatus) MonitorSample {
+	return MonitorSample{
+		AgentId:    agentID,
+		Path:       status.Path,
+		CreatedAt:  status.CheckedAt,
+		OK:         status.OK,
+		StatusCode: status.StatusCode,
+		DNSMs:      status.DNSMs,
+		ConnectMs:  status.ConnectMs,
+		TLSMs:      status.TLSMs,
+		TTFBMs:     status.TTFBMs,
+		TotalMs:    status.TotalMs,
+	}
+}
+
+//GetMonitorSamples returns the monitor history of an agent since a point in time, oldest first
+func (s DatabaseStore) GetMonitorSamples(agentID int64, since time.Time) (samples []MonitorSample, err error) {
+	return samples, s.db.Order("created_at asc").Find(&samples, "agent_id = ? AND created_at > ?", agentID, since).Error
+}
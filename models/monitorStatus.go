@@ -1,11 +1,35 @@
 package models
 
+import "time"
+
 //MonitorStatus is the object representing a endpoints status.
 //Whether it is up, or down. And if down provides a reason
+//When stored as a MonitorEntry the path is unique per agent, the index is created by migration 2
 type MonitorStatus struct {
-	Path   string `gorm:"unique;not null"`
+	Path   string `gorm:"not null"`
 	OK     bool
 	Reason string
 
+	//Name is the name the monitor was given in the agent config, if any. Named monitors can be run on demand from theia
+	Name string
+
 	StatusCode int
+	CheckedAt  time.Time
+
+	//Leaf certificate details for https:// and tls:// monitors, CertExpiry is zero for everything else
+	CertExpiry   time.Time
+	CertIssuer   string
+	CertSANMatch bool
+	CertDaysLeft int
+
+	//Results of icmp:// monitors, packet loss is a percentage
+	PacketLoss  float32
+	RoundTripMs float32
+
+	//How long each phase of the check took in milliseconds, phases that dont apply to a monitor type are left as 0
+	DNSMs     float32
+	ConnectMs float32
+	TLSMs     float32
+	TTFBMs    float32
+	TotalMs   float32
 }
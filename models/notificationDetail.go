@@ -29,41 +29,49 @@ var ErrNotValidEmailAddress = errors.New("Not a valid email address")
 
 //GetNotificationSettingsForUser returns the users current preference for notification.
 //This is the host with which to send from, and the destiniation to send to
-func GetNotificationSettingsForUser(uid int64) (emailInformation NotificationDetail, err error) {
-	return emailInformation, db.Find(&emailInformation, "user_id = ?", uid).Error
+func (s DatabaseStore) GetNotificationSettingsForUser(uid int64) (emailInformation NotificationDetail, err error) {
+	return emailInformation, notFound(s.db.Find(&emailInformation, "user_id = ?", uid).Error)
 }
 
-//CreateNotificationSetting sets a users notification prefers in the database
-func CreateNotificationSetting(uid int64, destiniationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider string) error {
+//newNotificationDetail checks a users notification preferences are complete and the email addresses are valid
+func newNotificationDetail(uid int64, destiniationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider string) (NotificationDetail, error) {
 	if len(destiniationEmail) == 0 || len(sendingAccountEmail) == 0 || len(sendingAccountPassword) == 0 || len(emailProvider) == 0 {
-		return ErrManditoryFieldsNotFilled
+		return NotificationDetail{}, ErrManditoryFieldsNotFilled
 	}
 
 	_, err := mail.ParseAddress(destiniationEmail)
 	if err != nil {
-		return ErrNotValidEmailAddress
+		return NotificationDetail{}, ErrNotValidEmailAddress
 	}
 
 	_, err = mail.ParseAddress(sendingAccountEmail)
 	if err != nil {
-		return ErrNotValidEmailAddress
+		return NotificationDetail{}, ErrNotValidEmailAddress
 	}
 
-	newProfile := NotificationDetail{
+	return NotificationDetail{
 		UserId:            uid,
 		Destination:       destiniationEmail,
 		EmailProviderHost: emailProvider,
 		SendAddress:       sendingAccountEmail,
 		AccountPassword:   sendingAccountPassword,
+	}, nil
+}
+
+//CreateNotificationSetting sets a users notification prefers in the database
+func (s DatabaseStore) CreateNotificationSetting(uid int64, destiniationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider string) error {
+	newProfile, err := newNotificationDetail(uid, destiniationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider)
+	if err != nil {
+		return err
 	}
 
 	var previousAlertDetails models.NotificationDetail
-	if err := db.Debug().Find(&previousAlertDetails, "user_id = ?", uid).Error; err != nil && err != gorm.ErrRecordNotFound {
+	if err := s.db.Debug().Find(&previousAlertDetails, "user_id = ?", uid).Error; err != nil && err != gorm.ErrRecordNotFound {
 
 		return err
 	}
 
 	newProfile.Id = previousAlertDetails.Id
 
-	return db.Debug().Save(&newProfile).Error
+	return s.db.Debug().Save(&newProfile).Error
 }
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The protocol spoken between iris and theia over the "metrics" channel.
+//
+// When iris opens the channel it puts a Hello in the channel extra data, theia picks the highest version both support
+// and replies with a Hello envelope containing that version (or rejects the channel if there is none). From then on
+// both sides write a stream of JSON envelopes. Agents that send no Hello are spoken to with the legacy (version 0) protocol,
+// which is a bare stream of Stats and "system" channel requests.
+//
+// Compatibility rules:
+//   - Fields may be added to any payload without changing the version, receivers must ignore fields they dont know
+//   - Message types may be added without changing the version, receivers must log and skip types they dont know
+//   - A payload that fails to decode is skipped, it does not end the session
+//   - Removing a field, changing its type or meaning, or removing a message type requires ProtocolVersion to be bumped
+//   - MinProtocolVersion is only raised when support for an old version is dropped entirely
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// SSHServerVersion is the ssh version string of servers that speak the versioned protocol. Legacy servers use the Go default
+// and never reply to a Hello, so iris only falls back to the legacy protocol for servers without it
+const SSHServerVersion = "SSH-2.0-theia"
+
+// Message types carried in an Envelope
+const (
+	MessageHello      = "hello"
+	MessageStats      = "stats"
+	MessageSystemInfo = "system_info"
+	MessageConfig     = "config"
+	MessageEvent      = "event"
+	MessageConfigAck  = "config_ack"
+)
+
+// ErrUnsupportedVersion is returned when two sides of a connection share no protocol version
+var ErrUnsupportedVersion = errors.New("No common protocol version")
+
+// Hello is sent by iris when opening the metrics channel, and returned by theia with the negotiated Version set
+type Hello struct {
+	MinVersion    int    `json:"min_version"`
+	MaxVersion    int    `json:"max_version"`
+	ClientVersion string `json:"client_version,omitempty"`
+
+	Version int `json:"version,omitempty"`
+}
+
+// Envelope wraps every message sent after the handshake
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Sent    time.Time       `json:"sent"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ConfigUpdate is sent from theia to iris to change the agents configuration.
+// Monitors are in the same form as the agent config file, and replace any monitors from a previous update
+type ConfigUpdate struct {
+	Revision int64             `json:"revision"`
+	Monitors []json.RawMessage `json:"monitors"`
+}
+
+// ConfigAck is sent by iris once it has applied, or refused, a ConfigUpdate
+type ConfigAck struct {
+	Revision int64  `json:"revision"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+
+	// Monitors are the paths of every monitor the agent runs once the config is applied, local ones included.
+	// It is nil from agents that predate it, theia only removes the state of monitors the agent no longer runs when it is set
+	Monitors []string `json:"monitors"`
+}
+
+// AgentEvent is an event raised by the agent itself, rather than derived by theia from the agents stats
+type AgentEvent struct {
+	Urgency int    `json:"urgency"`
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// NewHello describes the protocol versions this build supports
+func NewHello(clientVersion string) Hello {
+	return Hello{
+		MinVersion:    MinProtocolVersion,
+		MaxVersion:    ProtocolVersion,
+		ClientVersion: clientVersion,
+	}
+}
+
+// NegotiateVersion returns the highest protocol version supported by both this build and the remote side
+func NegotiateVersion(remote Hello) (int, error) {
+	version := ProtocolVersion
+	if remote.MaxVersion < version {
+		version = remote.MaxVersion
+	}
+
+	if version < MinProtocolVersion || version < remote.MinVersion {
+		return 0, fmt.Errorf("%w (local %d-%d, remote %d-%d)", ErrUnsupportedVersion, MinProtocolVersion, ProtocolVersion, remote.MinVersion, remote.MaxVersion)
+	}
+
+	return version, nil
+}
+
+// NewEnvelope marshals a payload into an envelope of the given type
+func NewEnvelope(version int, messageType string, payload interface{}) (Envelope, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		Version: version,
+		Type:    messageType,
+		Sent:    time.Now(),
+		Payload: b,
+	}, nil
+}
+
+// Decode unmarshals the envelope payload into v
+func (e Envelope) Decode(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return errors.New("Envelope has no payload")
+	}
+	return json.Unmarshal(e.Payload, v)
+}
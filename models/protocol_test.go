@@ -0,0 +1,112 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func roundTrip(t *testing.T, messageType string, payload interface{}, out interface{}) Envelope {
+	env, err := NewEnvelope(ProtocolVersion, messageType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Envelope
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Version != ProtocolVersion || decoded.Type != messageType {
+		t.Fatalf("Envelope header did not survive round trip: %+v", decoded)
+	}
+
+	if err := decoded.Decode(out); err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	stats := Stats{
+		MonitorValues: []MonitorStatus{{Path: "https://example.com", OK: true, StatusCode: 200, TotalMs: 12.5, CheckedAt: time.Now().UTC().Truncate(time.Second)}},
+		DiskUsage:     map[string]float32{"/dev/sda1": 42.5},
+		MemoryUsage:   63.2,
+	}
+
+	var decodedStats Stats
+	roundTrip(t, MessageStats, stats, &decodedStats)
+	if !reflect.DeepEqual(stats, decodedStats) {
+		t.Fatalf("Stats did not survive round trip:\n%+v\n%+v", stats, decodedStats)
+	}
+
+	info := SystemInfo{CpuCores: 4, TotalMemory: 1 << 30, Platform: "debian", Family: "debian", Version: "10"}
+
+	var decodedInfo SystemInfo
+	roundTrip(t, MessageSystemInfo, info, &decodedInfo)
+	if !reflect.DeepEqual(info, decodedInfo) {
+		t.Fatalf("System info did not survive round trip:\n%+v\n%+v", info, decodedInfo)
+	}
+
+	event := AgentEvent{Urgency: 1, Title: "Disk failing", Message: "SMART errors on /dev/sda"}
+
+	var decodedEvent AgentEvent
+	roundTrip(t, MessageEvent, event, &decodedEvent)
+	if event != decodedEvent {
+		t.Fatalf("Event did not survive round trip:\n%+v\n%+v", event, decodedEvent)
+	}
+
+	config := ConfigUpdate{Revision: 7, Monitors: []json.RawMessage{json.RawMessage(`{"url":"tcp://127.0.0.1:22","name":"ssh"}`)}}
+
+	var decodedConfig ConfigUpdate
+	roundTrip(t, MessageConfig, config, &decodedConfig)
+	if !reflect.DeepEqual(config, decodedConfig) {
+		t.Fatalf("Config did not survive round trip:\n%+v\n%+v", config, decodedConfig)
+	}
+}
+
+func TestEnvelopeIgnoresUnknownFields(t *testing.T) {
+	// A message from a newer peer, with fields this build doesnt know about
+	raw := `{"v":1,"type":"stats","sent":"2020-01-01T00:00:00Z","future":"field","payload":{"MemoryUsage":10,"SwapUsage":99}}`
+
+	var env Envelope
+	if err := json.Unmarshal([]byte(raw), &env); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats Stats
+	if err := env.Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.MemoryUsage != 10 {
+		t.Fatal("Known fields were not decoded")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	version, err := NegotiateVersion(NewHello("test"))
+	if err != nil || version != ProtocolVersion {
+		t.Fatal("Same build should negotiate the current version: ", version, err)
+	}
+
+	version, err = NegotiateVersion(Hello{MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion + 5})
+	if err != nil || version != ProtocolVersion {
+		t.Fatal("Newer peer should negotiate down to our version: ", version, err)
+	}
+
+	if _, err := NegotiateVersion(Hello{MinVersion: ProtocolVersion + 1, MaxVersion: ProtocolVersion + 2}); err == nil {
+		t.Fatal("Peer that has dropped our version should fail negotiation")
+	}
+
+	if _, err := NegotiateVersion(Hello{MinVersion: 0, MaxVersion: MinProtocolVersion - 1}); err == nil {
+		t.Fatal("Peer too old for us should fail negotiation")
+	}
+}
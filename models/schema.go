@@ -0,0 +1,308 @@
+package models
+
+import "time"
+
+//The structs here are snapshots of the tables as each migration created them. Migrations must use these rather than the models,
+//so changing a model later doesnt change what an already released migration does. Add a new snapshot along with a new migration, never edit one
+
+//Version 1, the schema AutoMigrate created before there were migrations
+
+type v1Agent struct {
+	ID                 int64
+	Name               string
+	PubKey             string `gorm:"unique;not null"`
+	LastTransmission   time.Time
+	LastConnectionFrom string
+	CurrentlyConnected bool
+
+	MemoryUsage float32
+
+	ConfigRevision int64
+	ConfigError    string
+
+	Principal              string
+	CertificateKeyId       string
+	CertificateSerial      string
+	CertificateAuthority   string
+	CertificateValidBefore time.Time
+}
+
+func (v1Agent) TableName() string { return "agents" }
+
+type v1AgentKey struct {
+	Id      int64
+	AgentId int64 `gorm:"index"`
+
+	PubKey      string `gorm:"unique;not null"`
+	Fingerprint string `gorm:"unique;not null"`
+	Comment     string
+
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RetiredAt  *time.Time
+}
+
+func (v1AgentKey) TableName() string { return "agent_keys" }
+
+type v1Alert struct {
+	Id      int64
+	AgentId int64
+
+	Active   bool
+	DiskUtil int64
+
+	LatencyMs int64
+}
+
+func (v1Alert) TableName() string { return "alerts" }
+
+type v1CommandLog struct {
+	Id        int64
+	AgentId   int64 `gorm:"index"`
+	CommandId string
+	Username  string
+	Action    string
+	Check     string
+	OK        bool
+	Outcome   string
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+}
+
+func (v1CommandLog) TableName() string { return "command_logs" }
+
+//v1DiskEntry leaves out the unique index on device that databases from before migrations have, so migration 2 can rebuild the table from it.
+//New databases never get that index, and migration 2 replaces it with one unique per agent either way
+type v1DiskEntry struct {
+	ID      int64
+	AgentId int64
+
+	Device string `gorm:"not null"`
+	Usage  float32
+}
+
+func (v1DiskEntry) TableName() string { return "disk_entries" }
+
+type v1EnrollmentToken struct {
+	Id         int64
+	SecretHash string `gorm:"unique;not null"`
+
+	AgentName string
+
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+
+	UsedAt  *time.Time
+	AgentId int64
+}
+
+func (v1EnrollmentToken) TableName() string { return "enrollment_tokens" }
+
+type v1Event struct {
+	Id        int64
+	AgentId   int64
+	Urgency   int
+	Title     string
+	Message   string
+	Notified  bool
+	CreatedAt time.Time
+}
+
+func (v1Event) TableName() string { return "events" }
+
+type v1Group struct {
+	ID   int64
+	Name string `gorm:"unique;not null"`
+}
+
+func (v1Group) TableName() string { return "groups" }
+
+//v1AgentGroup and v1EnrollmentTokenGroup are the join tables gorm created for the many2many relations
+type v1AgentGroup struct {
+	AgentId int64 `gorm:"primary_key;auto_increment:false"`
+	GroupId int64 `gorm:"primary_key;auto_increment:false"`
+}
+
+func (v1AgentGroup) TableName() string { return "agent_groups" }
+
+type v1EnrollmentTokenGroup struct {
+	EnrollmentTokenId int64 `gorm:"primary_key;auto_increment:false"`
+	GroupId           int64 `gorm:"primary_key;auto_increment:false"`
+}
+
+func (v1EnrollmentTokenGroup) TableName() string { return "enrollment_token_groups" }
+
+type v1MetricSample struct {
+	Id        int64
+	AgentId   int64     `gorm:"index"`
+	Name      string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+
+	Value float32
+}
+
+func (v1MetricSample) TableName() string { return "metric_samples" }
+
+type v1MonitorDefinition struct {
+	Id      int64
+	AgentId int64 `gorm:"index"`
+	GroupId int64 `gorm:"index"`
+
+	URL  string `gorm:"not null"`
+	Name string
+
+	Options string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (v1MonitorDefinition) TableName() string { return "monitor_definitions" }
+
+//v1MonitorEntry leaves out the unique index on path that databases from before migrations have, so migration 2 can rebuild the table from it.
+//New databases never get that index, and migration 2 replaces it with one unique per agent either way
+type v1MonitorEntry struct {
+	Id      int64
+	AgentId int64
+
+	Path   string `gorm:"not null"`
+	OK     bool
+	Reason string
+	Name   string
+
+	StatusCode int
+	CheckedAt  time.Time
+
+	CertExpiry   time.Time
+	CertIssuer   string
+	CertSANMatch bool
+	CertDaysLeft int
+
+	PacketLoss  float32
+	RoundTripMs float32
+
+	DNSMs     float32
+	ConnectMs float32
+	TLSMs     float32
+	TTFBMs    float32
+	TotalMs   float32
+}
+
+func (v1MonitorEntry) TableName() string { return "monitor_entries" }
+
+type v1MonitorSample struct {
+	Id        int64
+	AgentId   int64     `gorm:"index"`
+	Path      string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+
+	OK         bool
+	StatusCode int
+
+	DNSMs     float32
+	ConnectMs float32
+	TLSMs     float32
+	TTFBMs    float32
+	TotalMs   float32
+}
+
+func (v1MonitorSample) TableName() string { return "monitor_samples" }
+
+type v1NotificationDetail struct {
+	Id        int64
+	UserId    int64
+	UpdatedAt time.Time
+
+	Destination       string
+	SendAddress       string
+	AccountPassword   string
+	EmailProviderHost string
+}
+
+func (v1NotificationDetail) TableName() string { return "notification_details" }
+
+type v1SystemInfo struct {
+	Id            int64
+	AgentId       int64
+	CpuCores      int
+	TotalMemory   uint64
+	KernelVersion string
+
+	Platform string
+	Family   string
+	Version  string
+}
+
+func (v1SystemInfo) TableName() string { return "system_infos" }
+
+type v1User struct {
+	Id             int64
+	GUID           string `gorm:"unique;not null"`
+	Username       string `gorm:"unique;not null"`
+	Password       string `gorm:"unique;not null"`
+	Token          string `gorm:"unique;"`
+	TokenCreatedAt int64
+}
+
+func (v1User) TableName() string { return "users" }
+
+//v1Tables is every table of the initial schema
+var v1Tables = []interface{}{
+	&v1Event{},
+	&v1Agent{},
+	&v1MonitorEntry{},
+	&v1DiskEntry{},
+	&v1NotificationDetail{},
+	&v1SystemInfo{},
+	&v1Alert{},
+	&v1User{},
+	&v1MonitorSample{},
+	&v1MetricSample{},
+	&v1CommandLog{},
+	&v1Group{},
+	&v1MonitorDefinition{},
+	&v1EnrollmentToken{},
+	&v1AgentKey{},
+	&v1AgentGroup{},
+	&v1EnrollmentTokenGroup{},
+}
+
+//Version 4, agent archiving
+
+type v4AgentArchiving struct {
+	ArchivedAt *time.Time
+}
+
+func (v4AgentArchiving) TableName() string { return "agents" }
+
+//Version 5, audit log
+
+type v5AuditEntry struct {
+	Id        int64
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string    `gorm:"index"`
+	Action    string    `gorm:"index"`
+	Target    string    `gorm:"index"`
+	SourceIP  string
+	Before    string `gorm:"type:text"`
+	After     string `gorm:"type:text"`
+}
+
+func (v5AuditEntry) TableName() string { return "audit_entries" }
+
+//Version 6, agent connection log
+
+type v6AgentConnection struct {
+	Id               int64
+	AgentId          int64      `gorm:"index"`
+	ConnectedAt      time.Time  `gorm:"index"`
+	DisconnectedAt   *time.Time `gorm:"index"`
+	DisconnectReason string
+
+	RemoteAddress   string
+	ClientVersion   string
+	ProtocolVersion int
+}
+
+func (v6AgentConnection) TableName() string { return "agent_connections" }
@@ -1,9 +1,14 @@
 package models
 
+import "time"
+
 // Stats is the big object that is passed around through ssh to give system metrics
 type Stats struct {
 	MonitorValues []MonitorStatus
 
 	DiskUsage   map[string]float32
 	MemoryUsage float32
+
+	// Timestamp is when the agent took these stats, which may be well in the past if they were buffered during an outage
+	Timestamp time.Time `json:",omitempty"`
 }
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+//ErrNotFound is returned by every Store when the record asked for doesnt exist
+var ErrNotFound = errors.New("Not found")
+
+//notFound turns gorms missing record error into ErrNotFound, so callers dont depend on the store being backed by gorm
+func notFound(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+//AgentStore holds agents and everything configured for them: their keys, alert profiles, groups, managed monitors, command log and the enrollment tokens that create them
+type AgentStore interface {
+	CreateAgent(name, pubKey string) (agentID int64, err error)
+	DeleteAgent(agentID int64) error
+	ArchiveAgent(agentID int64) error
+	RestoreAgent(agentID int64) error
+	GetArchivedAgents() ([]Agent, error)
+	//PurgeArchivedAgents deletes the agents archived before cutoff, returning their ids
+	PurgeArchivedAgents(cutoff time.Time) (purged []int64, err error)
+	GetAgent(agentID int64) (Agent, error)
+	GetAgentList(filter string, limit int) ([]Agent, error)
+	GetDashboardInformation() (totalAgents int, downAgents []Agent, degradedAgents []Agent, failedEndPoints []MonitorEntry, err error)
+	AgentForCertificate(identity CertificateIdentity) (Agent, error)
+
+	//GetAgentsWithIssues returns the unarchived agents with alerting enabled that havent reported since lastSeen, or that have a disk, monitor or latency over their alert thresholds
+	GetAgentsWithIssues(lastSeen time.Time) ([]Agent, error)
+	//GetExpiringCertificates returns the monitors of alerting agents whose certificate expires before the deadline
+	GetExpiringCertificates(deadline time.Time) ([]MonitorEntry, error)
+
+	SetAgentConnected(agentID int64, connected bool) error
+	SetAllAgentsDisconnected() error
+	SetLastConnectionFrom(agentID int64, address string) error
+	SetSystemInfo(agentID int64, info SystemInfo) error
+	SetAlertProfile(agentID, diskUtilisation, latencyMs int64, active bool) error
+	SetAgentConfigStatus(agentID, revision int64, configError string) error
+
+	AddAgentKey(agentID int64, authorizedKey string) (AgentKey, error)
+	RetireAgentKey(agentID, keyID int64) (AgentKey, error)
+	GetAgentKey(keyID int64) (AgentKey, error)
+	GetActiveAgentKey(authorizedKey string) (AgentKey, error)
+	GetAgentKeyByFingerprint(fingerprint string) (AgentKey, error)
+	TouchAgentKey(keyID int64) error
+
+	CreateGroup(name string) error
+	DeleteGroup(groupID int64) (agentIDs []int64, err error)
+	GetGroups() ([]Group, error)
+	GetGroupAgentIDs(groupID int64) ([]int64, error)
+	SetGroupMembers(groupID int64, agentIDs []int64) (changed []int64, err error)
+
+	CreateMonitorDefinition(agentID, groupID int64, monitorURL, name, options string) error
+	DeleteMonitorDefinition(id int64) (MonitorDefinition, error)
+	GetMonitorDefinitions(agentID int64) ([]MonitorDefinition, error)
+
+	RecordCommand(agentID int64, username string, command Command) (CommandLog, error)
+	CompleteCommand(entry CommandLog, ok bool, outcome string) error
+	GetCommandLog(agentID int64, limit int) ([]CommandLog, error)
+
+	CreateEnrollmentToken(agentName, createdBy string, groupIDs []int64, validFor time.Duration) (tokenID int64, secret string, err error)
+	GetEnrollmentTokens() ([]EnrollmentToken, error)
+	DeleteEnrollmentToken(id int64) error
+	RedeemEnrollmentToken(secret, pubKey, name string) (Agent, error)
+}
+
+//EventStore holds the events raised about agents, which are emailed out to users
+type EventStore interface {
+	AddEvent(event Event) error
+	//CountEventsSince counts the events an agent has had with the given title since a point in time, so the same event isnt raised over and over
+	CountEventsSince(agentID int64, title string, since time.Time) (int, error)
+	//GetUnnotifiedEvents returns the events no one has been emailed about yet that are at least as urgent as maxUrgency, lower is more urgent
+	GetUnnotifiedEvents(maxUrgency int) ([]Event, error)
+	//GetEvents returns a page of the events matching filter newest first, and how many match in total
+	GetEvents(filter EventFilter, offset, limit int) ([]Event, int, error)
+	SetEventNotified(eventID int64) error
+}
+
+//UserStore holds the users of the web interface, their sessions and notification settings
+type UserStore interface {
+	AddUser(name, password string) error
+	GetUser(username string) (User, error)
+	GetAllUsers() ([]User, error)
+	DeleteUser(guid string) error
+	ChangePassword(uid int64, newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash string) error
+
+	//GetUserByToken finds the user a session token belongs to, the token may have expired
+	GetUserByToken(username, token string) (User, error)
+	//SetUserToken starts a new session for the user, replacing any other
+	SetUserToken(uid int64, token string) error
+	//RefreshUserToken restarts the expiry of the users current session
+	RefreshUserToken(uid int64) error
+
+	GetNotificationSettingsForUser(uid int64) (NotificationDetail, error)
+	//GetNotificationSettings returns the settings events are emailed out with, the first user to set them up has theirs used
+	GetNotificationSettings() (NotificationDetail, error)
+	CreateNotificationSetting(uid int64, destinationEmail, sendingAccountEmail, sendingAccountPassword, emailProvider string) error
+}
+
+//MetricStore holds what agents report, both their current state and its history
+type MetricStore interface {
+	IngestStats(agentID int64, stat Stats) error
+	//RemoveStaleMonitors deletes the current state of an agent's monitors that arent in paths
+	RemoveStaleMonitors(agentID int64, paths []string) error
+	GetMonitorSamples(agentID int64, since time.Time) ([]MonitorSample, error)
+	GetMetricSamples(agentID int64, since time.Time) ([]MetricSample, error)
+	//PruneHistory removes monitor and metric samples taken before cutoff, and agent connections that ended before it
+	PruneHistory(cutoff time.Time) error
+}
+
+//ConnectionStore holds the log of when agents were connected, and how each connection ended
+type ConnectionStore interface {
+	StartConnection(agentID int64, remoteAddress, clientVersion string, protocolVersion int) (AgentConnection, error)
+	EndConnection(connection AgentConnection, reason string) error
+	//EndOpenConnections closes the connections left open when theia stopped without closing them
+	EndOpenConnections() error
+	GetConnections(agentID int64, since time.Time) ([]AgentConnection, error)
+	GetFirstConnection(agentID int64) (AgentConnection, error)
+}
+
+//AuditStore holds the audit log of changes made through the web interface, it can only be added to
+type AuditStore interface {
+	AddAuditEntry(entry AuditEntry) error
+	GetAuditLog(filter AuditFilter, limit int) ([]AuditEntry, error)
+}
+
+//Store is everything theia keeps. DatabaseStore is used when running, MemoryStore lets code using it be tested without a database
+type Store interface {
+	AgentStore
+	EventStore
+	UserStore
+	MetricStore
+	ConnectionStore
+	AuditStore
+}
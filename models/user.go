@@ -35,54 +35,72 @@ type User struct {
 	NotificationInformation NotificationDetail
 }
 
-//AddUser adds a user to the database if the information supplied is valid
-func AddUser(name, password string) error {
+//newUser checks the information supplied for a user is valid, and hashes their password
+func newUser(name, password string) (User, error) {
 	if len(name) == 0 {
-		return ErrUsernameEmpty
+		return User{}, ErrUsernameEmpty
 	}
 
 	if len(password) == 0 {
-		return ErrPasswordEmpty
+		return User{}, ErrPasswordEmpty
 	}
 
 	if len(password) < 10 {
-		return ErrPasswordTooShort
+		return User{}, ErrPasswordTooShort
 	}
 
 	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
 	guid, err := utils.GenerateHexToken(16)
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
-	newUser := &User{Username: name, Password: string(hashBytes), GUID: guid}
-
-	return db.Debug().Create(newUser).Error
+	return User{Username: name, Password: string(hashBytes), GUID: guid}, nil
 }
 
-//ChangePassword change password for user, which checks if the user knows the currrent password.
-func ChangePassword(uid int64, newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash string) error {
+//AddUser adds a user to the database if the information supplied is valid
+func (s DatabaseStore) AddUser(name, password string) error {
+	newUser, err := newUser(name, password)
+	if err != nil {
+		return err
+	}
 
+	return s.db.Debug().Create(&newUser).Error
+}
+
+//newPasswordHash hashes a new password for a user, if they know their current one
+func newPasswordHash(newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash string) (string, error) {
 	if newPassword != confirmNewPassword {
-		return ErrConfirmPasswordNotEqual
+		return "", ErrConfirmPasswordNotEqual
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(currentPasswordHash), []byte(currentPasswordInput)); err != nil {
-		return ErrPasswordNotEqual
+		return "", ErrPasswordNotEqual
 	}
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		log.Println(err)
 
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+//ChangePassword change password for user, which checks if the user knows the currrent password.
+func (s DatabaseStore) ChangePassword(uid int64, newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash string) error {
+
+	hash, err := newPasswordHash(newPassword, confirmNewPassword, currentPasswordInput, currentPasswordHash)
+	if err != nil {
 		return err
 	}
 
-	if err := db.Model(&User{}).Where("id = ?", uid).Update("password", string(hash)).Error; err != nil {
+	if err := s.db.Model(&User{}).Where("id = ?", uid).Update("password", hash).Error; err != nil {
 		log.Println(err)
 		return err
 	}
@@ -91,12 +109,12 @@ func ChangePassword(uid int64, newPassword, confirmNewPassword, currentPasswordI
 }
 
 //GetAllUsers is a function that returns a list of all users registered
-func GetAllUsers() (users []User, err error) {
-	return users, db.Find(&users).Error
+func (s DatabaseStore) GetAllUsers() (users []User, err error) {
+	return users, s.db.Find(&users).Error
 }
 
 //DeleteUser is the function which deletes users
-func DeleteUser(guid string) error {
+func (s DatabaseStore) DeleteUser(guid string) error {
 	log.Println("User: '", guid, "'")
-	return db.Delete(&User{}, "guid = ?", guid).Error
+	return s.db.Delete(&User{}, "guid = ?", guid).Error
 }
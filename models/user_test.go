@@ -9,6 +9,12 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+//db is the database the tests run against, store reads and writes it
+var (
+	db    *gorm.DB
+	store DatabaseStore
+)
+
 func setupDatabase() {
 	dbSqlite, err := gorm.Open("sqlite3", "file::memory:?cache=shared")
 	if err != nil {
@@ -17,6 +23,8 @@ func setupDatabase() {
 
 	InitaliseModels(dbSqlite)
 
+	db = dbSqlite
+	store = NewDatabaseStore(db)
 }
 
 func TestAddUserValid(t *testing.T) {
@@ -25,7 +33,7 @@ func TestAddUserValid(t *testing.T) {
 
 	pwd := "test"
 
-	err := AddUser("test", pwd)
+	err := store.AddUser("test", pwd)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogFile is a log destination that can be reopened, so a config reload can move the log or pick up a rotated file
+type LogFile struct {
+	sync.Mutex
+
+	path string
+	file *os.File
+}
+
+// OpenLogFile opens a log file for appending, creating it if it doesnt exist
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{}
+	return l, l.Reopen(path)
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.file.Write(p)
+}
+
+// Reopen switches to the log file at path, if it cant be opened the current file is kept
+func (l *LogFile) Reopen(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.path = path
+	l.file = f
+
+	return nil
+}
+
+// Path returns the path of the current log file
+func (l *LogFile) Path() string {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.path
+}
+
+// WatchConfig calls reload whenever the process receives SIGHUP and, if pollInterval is above zero, whenever the file at path changes.
+// The returned function stops watching
+func WatchConfig(path string, pollInterval time.Duration, reload func()) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	done := make(chan struct{})
+
+	var ticker *time.Ticker
+	var poll <-chan time.Time
+	if pollInterval > 0 {
+		ticker = time.NewTicker(pollInterval)
+		poll = ticker.C
+	}
+
+	last, _ := os.Stat(path)
+
+	go func() {
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				last, _ = os.Stat(path)
+				reload()
+			case <-poll:
+				current, err := os.Stat(path)
+				if err != nil {
+					// Most likely part way through being replaced, try again next time
+					continue
+				}
+
+				if last == nil || !current.ModTime().Equal(last.ModTime()) || current.Size() != last.Size() {
+					last = current
+					reload()
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(hup)
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ShutdownContext returns a context that is cancelled when the process is asked to stop with SIGINT or SIGTERM.
+// A second signal kills the process straight away, in case shutting down gets stuck
+func ShutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-stop
+		signal.Stop(stop)
+
+		log.Println("Received ", sig, ", shutting down")
+		cancel()
+	}()
+
+	return ctx
+}